@@ -29,7 +29,10 @@ import (
 	"strings"
 
 	"github.com/asig/cbmasm/pkg/asm"
+	"github.com/asig/cbmasm/pkg/debuginfo"
+	"github.com/asig/cbmasm/pkg/diagnostics"
 	"github.com/asig/cbmasm/pkg/errors"
+	"github.com/asig/cbmasm/pkg/obj"
 	"github.com/asig/cbmasm/pkg/text"
 )
 
@@ -75,15 +78,92 @@ var (
 	flagListing     = flag.Bool("listing", false, "If true, a listing is generated.")
 	flagCPU         = flag.String("cpu", "6502", fmt.Sprintf("CPU to assemble code for. Supported values are: %s", strings.Join(asm.SupportedCPUs, ", ")))
 	flagPlatform    = flag.String("platform", "c128", fmt.Sprintf("Target platform. Supported values are: %s", strings.Join(asm.SupportedPlatforms, ", ")))
+	flagMemoryMap   = flag.String("memory_map", "", "If set, the segments for '.segment' are read from this file.")
+	flagDebugInfo   = flag.String("debug_info", "", "If set, debug information in JSON format is written to this file.")
+	flagDiagnostics = flag.String("diagnostics-format", "", fmt.Sprintf("If set, errors and warnings are written to stderr in this format. Supported values are: %s", strings.Join(diagnostics.Formats, ", ")))
+
+	// flagWarnings contains the values of all -W flags, without the "-W" prefix. The flag package can't parse
+	// flags like -Wno-unused-label, so they are extracted from the command line before parsing.
+	flagWarnings []string
 )
 
+func init() {
+	flag.Var(&flagIncludeDirs, "I", "include paths; can be repeated")
+	flag.Var(&flagDefines, "D", "defined symbols; can be repeated")
+}
+
 func usage() {
 	errorOutput.Printf("Usage: %s [flags] [inputfile] [outputfile]\n", filepath.Base(os.Args[0]))
+	errorOutput.Printf("       %s dap\n", filepath.Base(os.Args[0]))
+	errorOutput.Printf("       %s lsp [flags]\n", filepath.Base(os.Args[0]))
+	errorOutput.Printf("       %s test [flags] inputfile\n", filepath.Base(os.Args[0]))
 	errorOutput.Println("Flags:")
 	flag.PrintDefaults()
+	errorOutput.Println("  -W<name>, -Wno-<name>")
+	errorOutput.Printf("    \tenables or disables a warning; can be repeated. Supported values are: all, %s\n", strings.Join(asm.WarningCategoryNames(), ", "))
+	errorOutput.Println("  -Werror")
+	errorOutput.Println("    \ttreats warnings as errors")
 	os.Exit(1)
 }
 
+// extractWarningFlags removes all -W flags from args, and stores them in flagWarnings. The values of the other
+// flags in fs are skipped, so that -W flags can appear anywhere before the file names.
+func extractWarningFlags(fs *flag.FlagSet, args []string) []string {
+	var res []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || arg == "-" || !strings.HasPrefix(arg, "-") {
+			// End of flags
+			return append(res, args[i:]...)
+		}
+		if strings.HasPrefix(arg, "-W") && len(arg) > 2 {
+			flagWarnings = append(flagWarnings, arg[2:])
+			continue
+		}
+		res = append(res, arg)
+		if takesValue(fs, arg) && i+1 < len(args) {
+			i++
+			res = append(res, args[i])
+		}
+	}
+	return res
+}
+
+// takesValue returns whether arg is a flag of fs whose value is the next argument.
+func takesValue(fs *flag.FlagSet, arg string) bool {
+	name := strings.TrimLeft(arg, "-")
+	if strings.Contains(name, "=") {
+		return false
+	}
+	f := fs.Lookup(name)
+	if f == nil {
+		return false
+	}
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		return false
+	}
+	return true
+}
+
+// applyWarningFlags configures the assembler's warnings according to the -W flags.
+func applyWarningFlags(a *asm.Assembler) error {
+	for _, w := range flagWarnings {
+		switch {
+		case w == "error":
+			a.SetWarningsAsErrors(true)
+		case strings.HasPrefix(w, "no-"):
+			if err := a.SetWarning(w[3:], false); err != nil {
+				return err
+			}
+		default:
+			if err := a.SetWarning(w, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func printLabels(a *asm.Assembler) {
 	labels := a.Labels()
 	names := make([]string, 0, len(labels))
@@ -128,7 +208,24 @@ func saveViceLabels(a *asm.Assembler, filename string) {
 	out.Close()
 }
 
+func saveDebugInfo(a *asm.Assembler, filename string) {
+	out, err := os.Create(filename)
+	if err != nil {
+		log.Printf("Can't open output file %q.", filename)
+		return
+	}
+	defer out.Close()
+	if err := debuginfo.Write(out, a.DebugInfo()); err != nil {
+		log.Printf("Can't write debug information to %q: %s", filename, err)
+	}
+}
+
 func printListing(a *asm.Assembler) {
+	// Only show cycles if the CPU's timing is known
+	showCycles := false
+	for _, l := range a.ListingLines {
+		showCycles = showCycles || l.Cycles != nil
+	}
 	for _, l := range a.ListingLines {
 		bytes := []byte{}
 		if l.Bytes > 0 {
@@ -142,15 +239,52 @@ func printListing(a *asm.Assembler) {
 		for len(byteStrs) < 5 {
 			byteStrs = append(byteStrs, "  ")
 		}
-		statusOutput.Printf("%04x | %s | %s\n", l.Addr, strings.Join(byteStrs, " "), strings.TrimSuffix(string(l.Line.Runes), "\n"))
+		cycles := ""
+		if showCycles {
+			var cur, total string
+			if l.Cycles != nil {
+				cur = l.Cycles.String()
+				total = l.Total.RangeString()
+			}
+			cycles = fmt.Sprintf("%5s | %9s | ", cur, total)
+		}
+		statusOutput.Printf("%04x | %s | %s%s\n", l.Addr, strings.Join(byteStrs, " "), cycles, strings.TrimSuffix(string(l.Line.Runes), "\n"))
 	}
 }
 
-func init() {
+// printDiagnostics prints errors and warnings in the format selected with -diagnostics-format.
+func printDiagnostics(errs, warnings []errors.Error) {
+	if *flagDiagnostics != "" {
+		diags := append(append([]errors.Error{}, errs...), warnings...)
+		if err := diagnostics.Write(os.Stderr, *flagDiagnostics, diags); err != nil {
+			log.Fatalf("Can't write diagnostics: %s", err)
+		}
+		return
+	}
+	if len(errs) > 0 {
+		errorOutput.Printf("%d errors occurred:\n", len(errs))
+		for _, e := range errs {
+			errorOutput.Printf("%s\n", e)
+		}
+	}
+	if len(warnings) > 0 {
+		errorOutput.Printf("%d warnings occurred:\n", len(warnings))
+		for _, e := range warnings {
+			errorOutput.Printf("%s\n", e)
+		}
+	}
+}
+
+// subcommands are run instead of the assembler if their name is the first argument.
+var subcommands = map[string]func(args []string){
+	"dap":  runDap,
+	"lsp":  runLsp,
+	"test": runTest,
+}
+
+func parseFlags() {
 	flag.Usage = usage
-	flag.Var(&flagIncludeDirs, "I", "include paths; can be repeated")
-	flag.Var(&flagDefines, "D", "defined symbols; can be repeated")
-	flag.Parse()
+	flag.CommandLine.Parse(extractWarningFlags(flag.CommandLine, os.Args[1:]))
 
 	if !asm.IsSupportedPlatform(*flagPlatform) {
 		errorOutput.Printf("Unsupported platform %q. Valid platforms are: %s.", *flagPlatform, strings.Join(asm.SupportedPlatforms, ", "))
@@ -182,6 +316,21 @@ func init() {
 		os.Exit(1)
 	}
 
+	if *flagDiagnostics != "" && !diagnostics.IsSupportedFormat(*flagDiagnostics) {
+		errorOutput.Printf("Unsupported diagnostics format %q. Valid formats are: %s.", *flagDiagnostics, strings.Join(diagnostics.Formats, ", "))
+		usage()
+		os.Exit(1)
+	}
+
+	for _, w := range flagWarnings {
+		name := strings.TrimPrefix(w, "no-")
+		if _, found := asm.WarningCategories[name]; !found && name != "all" && w != "error" {
+			errorOutput.Printf("Unsupported warning %q. Valid warnings are: all, %s.", name, strings.Join(asm.WarningCategoryNames(), ", "))
+			usage()
+			os.Exit(1)
+		}
+	}
+
 	if len(flagIncludeDirs) == 0 {
 		// default to "." if no include dirs are set.
 		flagIncludeDirs = pathListFlag{"."}
@@ -189,6 +338,14 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, found := subcommands[os.Args[1]]; found {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
+	parseFlags()
 	args := flag.Args()
 
 	inputFilename := "<stdin>"
@@ -234,26 +391,42 @@ func main() {
 	t := text.Process(inputFilename, string(raw))
 
 	assembler := asm.New(flagIncludeDirs, *flagCPU, *flagPlatform, *flagOutput, *flagEncoding, flagDefines)
-	assembler.Assemble(t)
-	errs = assembler.Errors()
-	if len(errs) > 0 {
-		errorOutput.Printf("%d errors occurred:\n", len(errs))
-		for _, e := range errs {
-			errorOutput.Printf("%s\n", e)
+	if *flagMemoryMap != "" {
+		raw, err := ioutil.ReadFile(*flagMemoryMap)
+		if err != nil {
+			log.Fatalf("Can't read memory map %q.", *flagMemoryMap)
 		}
-	}
-	warnings := assembler.Warnings()
-	if len(warnings) > 0 {
-		fmt.Printf("%d warnings occurred:\n", len(warnings))
-		for _, e := range warnings {
-			fmt.Printf("%s\n", e)
+		memoryMap, errs := asm.ParseMemoryMap(text.Process(*flagMemoryMap, string(raw)))
+		if len(errs) > 0 {
+			printDiagnostics(errs, nil)
+			os.Exit(1)
 		}
+		assembler.SetMemoryMap(memoryMap)
+	}
+	if err := applyWarningFlags(assembler); err != nil {
+		log.Fatal(err)
 	}
+	assembler.Assemble(t)
+	for _, m := range assembler.Messages() {
+		statusOutput.Printf("%s\n", m)
+	}
+	errs = assembler.Errors()
+	printDiagnostics(errs, assembler.Warnings())
 	if len(errs) != 0 {
 		os.Exit(1)
 	}
+	for _, r := range assembler.CycleReports() {
+		statusOutput.Printf("%s\n", r)
+	}
 
 	output := assembler.CurrentOutput()
+	if output == "obj" {
+		if err := obj.Write(outputFile, assembler.Object(inputFilename)); err != nil {
+			log.Fatalf("Can't write object file %q: %s", outputFilename, err)
+		}
+		statusOutput.Printf("Object file written to %q.", outputFilename)
+		return
+	}
 	if output == "prg" {
 		o := assembler.Origin()
 		outputFile.Write([]byte{byte(o & 0xff), byte((o >> 8) & 0xff)})
@@ -271,6 +444,10 @@ func main() {
 		saveViceLabels(assembler, *flagLabels)
 		statusOutput.Printf("Symbols written to %q.", *flagLabels)
 	}
+	if *flagDebugInfo != "" {
+		saveDebugInfo(assembler, *flagDebugInfo)
+		statusOutput.Printf("Debug information written to %q.", *flagDebugInfo)
+	}
 
 	statusOutput.Printf("%d bytes written to %q.", len(bytes), outputFilename)
 }
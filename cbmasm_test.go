@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the assembler instead of the tests if the test binary is started by runCbmasm.
+func TestMain(m *testing.M) {
+	if os.Getenv("CBMASM_RUN_MAIN") != "" {
+		os.Args = append([]string{"cbmasm"}, strings.Fields(os.Getenv("CBMASM_RUN_MAIN"))...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCbmasm runs the assembler with args and stdin, and returns what it writes to stdout and stderr.
+func runCbmasm(t *testing.T, args, stdin string) (stdout, stderr []byte) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "CBMASM_RUN_MAIN="+args)
+	cmd.Stdin = strings.NewReader(stdin)
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("cbmasm %s failed: %s\n%s", args, err, errOut.String())
+	}
+	return out.Bytes(), errOut.Bytes()
+}
+
+func TestExtractWarningFlags(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		want         []string
+		wantWarnings []string
+	}{
+		{
+			name:         "warnings first",
+			args:         []string{"-Wall", "-Wno-zp-fallback", "-output", "plain", "in.asm"},
+			want:         []string{"-output", "plain", "in.asm"},
+			wantWarnings: []string{"all", "no-zp-fallback"},
+		},
+		{
+			name:         "warnings after flags with values",
+			args:         []string{"-output", "prg", "-Wno-zp-fallback", "-I", "inc", "-Werror", "in.asm", "out.bin"},
+			want:         []string{"-output", "prg", "-I", "inc", "in.asm", "out.bin"},
+			wantWarnings: []string{"no-zp-fallback", "error"},
+		},
+		{
+			name:         "boolean flags and values after =",
+			args:         []string{"-listing", "-Wunused-label", "--cpu=z80", "-Wtruncation", "in.asm"},
+			want:         []string{"-listing", "--cpu=z80", "in.asm"},
+			wantWarnings: []string{"unused-label", "truncation"},
+		},
+		{
+			name: "file names end the flags",
+			args: []string{"-output", "plain", "in.asm", "-Wall"},
+			want: []string{"-output", "plain", "in.asm", "-Wall"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flagWarnings = nil
+			got := extractWarningFlags(flag.CommandLine, tt.args)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Got args %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(flagWarnings, tt.wantWarnings) {
+				t.Errorf("Got warnings %q, want %q", flagWarnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestMain_stdout(t *testing.T) {
+	// The indirect jump at a page boundary is warned about by default
+	stdout, stderr := runCbmasm(t, "-output prg", "\t.org $1000\n\tjmp ($10ff)\n")
+	if want := []byte{0x00, 0x10, 0x6c, 0xff, 0x10}; !bytes.Equal(stdout, want) {
+		t.Errorf("Got stdout %q, want %q", stdout, want)
+	}
+	if !strings.Contains(string(stderr), "1 warnings occurred:") {
+		t.Errorf("Got stderr %q, want the warning", stderr)
+	}
+}
@@ -0,0 +1,35 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/asig/cbmasm/pkg/dap"
+)
+
+// runDap serves the Debug Adapter Protocol on stdin and stdout.
+func runDap(args []string) {
+	fs := flag.NewFlagSet("dap", flag.ExitOnError)
+	fs.Parse(args)
+	if err := dap.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+		errorOutput.Fatalf("Debug session failed: %s", err)
+	}
+}
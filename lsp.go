@@ -0,0 +1,46 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/asm"
+	"github.com/asig/cbmasm/pkg/lsp"
+)
+
+// runLsp serves the Language Server Protocol on stdin and stdout.
+func runLsp(args []string) {
+	var includeDirs pathListFlag
+	var defines stringArrayFlag
+	fs := flag.NewFlagSet("lsp", flag.ExitOnError)
+	fs.Var(&includeDirs, "I", "include paths; can be repeated")
+	fs.Var(&defines, "D", "defined symbols; can be repeated")
+	cpu := fs.String("cpu", "6502", fmt.Sprintf("CPU to assemble code for. Supported values are: %s", strings.Join(asm.SupportedCPUs, ", ")))
+	platform := fs.String("platform", "c128", fmt.Sprintf("Target platform. Supported values are: %s", strings.Join(asm.SupportedPlatforms, ", ")))
+	fs.Parse(args)
+
+	opts := lsp.Options{IncludeDirs: includeDirs, Defines: defines, CPU: *cpu, Platform: *platform}
+	if err := lsp.NewServer(os.Stdin, os.Stdout, opts).Serve(); err != nil {
+		errorOutput.Fatalf("Language server failed: %s", err)
+	}
+}
@@ -20,10 +20,10 @@ package asm
 
 import (
 	"fmt"
-	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/asig/cbmasm/pkg/asm/mos6502"
@@ -35,9 +35,9 @@ import (
 )
 
 var (
-	SupportedPlatforms = []string{"c128", "c64", "pet"}
-	SupportedCPUs      = []string{"6502", "z80"}
-	SupportedOutputs   = []string{"plain", "prg"}
+	SupportedPlatforms = []string{"c128", "c64", "pet", "c65", "mega65", "generic"}
+	SupportedCPUs      = []string{"6502", "6510ill", "65c02", "65ce02", "4510", "z80", "z80ill"}
+	SupportedOutputs   = []string{"plain", "prg", "obj"}
 	SupportedEncodings = []string{"petscii", "ascii"}
 )
 
@@ -68,16 +68,28 @@ func IsSupportedEncoding(s string) bool {
 }
 
 func IsValidPlatformCPUCombo(platform, cpu string) bool {
-	if cpu == "z80" {
+	platform = strings.ToLower(platform)
+	if platform == "generic" {
+		return true
+	}
+	switch strings.ToLower(cpu) {
+	case "z80", "z80ill":
 		return platform == "c128"
+	case "6510ill":
+		return platform != "c65" && platform != "mega65"
+	case "65c02":
+		return false
+	case "65ce02", "4510":
+		return platform == "c65" || platform == "mega65"
 	}
 	return true
 }
 
 // patch records nodes that can't be evaluated because of undefined nodes
 type patch struct {
-	pc   int       // Place to patch
-	node expr.Node // Node that needs to be patched in
+	section *Section  // Section that contains pc
+	pc      int       // Place to patch
+	node    expr.Node // Node that needs to be patched in
 }
 
 type mos6502Param struct {
@@ -89,7 +101,7 @@ type state int
 
 const (
 	stateAssemble state = iota
-	stateRecordMacro
+	stateRecordBlock
 )
 
 var conditionalTokens = map[scanner.TokenType]bool{
@@ -100,35 +112,50 @@ var conditionalTokens = map[scanner.TokenType]bool{
 	scanner.Endif:  true,
 }
 
-var relOpToBinOp = map[scanner.TokenType]expr.BinaryOp{
-	scanner.Eq: expr.Eq,
-	scanner.Ne: expr.Ne,
-	scanner.Lt: expr.Lt,
-	scanner.Le: expr.Le,
-	scanner.Gt: expr.Gt,
-	scanner.Ge: expr.Ge,
+// blockStarts and blockEnds are the directives that start and end macros and loops.
+var blockStarts = map[scanner.TokenType]bool{
+	scanner.Macro: true,
+	scanner.Rept:  true,
+	scanner.For:   true,
+	scanner.While: true,
+}
+
+var blockEnds = map[scanner.TokenType]bool{
+	scanner.Endm:     true,
+	scanner.Endr:     true,
+	scanner.Endfor:   true,
+	scanner.Endwhile: true,
 }
 
 type mnemonicHandler func(a *Assembler, t scanner.Token)
 
 type ListingLine struct {
-	Addr  int
-	Bytes int
-	Line  text.Line
+	Addr       int
+	Bytes      int
+	Line       text.Line
+	MacroCalls []text.Pos // Call sites of the macros the line was expanded from, outermost first
+	Cycles     *Cycles    // Cycles of the line's instruction; nil if there is none, or its timing is unknown
+	Total      Cycles     // Cycles since the last label, including this line
 }
 
 type Assembler struct {
 	// "Constant" values; not reset before Assemble()
-	includePaths    []string
-	defines         symbolTable
-	defaultPlatform string
-	defaultCPU      string
-	defaultOutput   string
-	defaultEncoding string
+	includePaths     []string
+	overlay          map[string][]byte // File contents that are used instead of the files on disk
+	defines          symbolTable
+	defaultPlatform  string
+	defaultCPU       string
+	defaultOutput    string
+	defaultEncoding  string
+	memoryMap        MemoryMap
+	warningsEnabled  map[string]bool
+	warningsAsErrors bool
 
 	// All following fields are reset in Assemble()
 	errorModifier   errors.Modifier
 	mnemonicHandler mnemonicHandler
+	mnemonics6502   map[string]mos6502.OpCodes     // Mnemonics for the current 6502 variant
+	mnemonicsZ80    map[string]z80.OpCodeEntryList // Mnemonics for the current Z80 variant
 	errors          []errors.Error
 	warnings        []errors.Error
 	scanner         *scanner.Scanner
@@ -147,23 +174,75 @@ type Assembler struct {
 
 	ListingLines []ListingLine
 
-	// current macro, only set when recording macros
-	macro *macro
+	// macro or loop body that is currently recorded, and the directive that ends it
+	macro     *macro
+	recordEnd scanner.TokenType
+	// loop that is currently recorded, or nil if a macro is recorded
+	loop *loop
+	// number of nested blocks in the block being recorded
+	blockNesting int
 
 	// Code generation buffer
 	sections []*Section
 	section  *Section
 
+	// Named segments, and the current segment (nil if code is placed with .org)
+	segments map[string]*segment
+	segment  *segment
+
 	// outstanding patches
 	patchesPerLabel map[string][]patch
 
-	// Symbol table
-	symbols symbolTable
+	// resolved patches that depend on the module's base address; only used for object files
+	relocations []patch
+
+	// Forward references of the current pass, and their values in the previous pass
+	forwardRefs []forwardRef
+	sizeHints   []sizeHint
+
+	// Data for the debug information and tools: call sites of the macros that are currently expanded, all
+	// symbols that were defined or referenced, and the scopes of local labels.
+	macroCalls  []text.Pos
+	definitions []definition
+	references  []reference
+	scopes      []scope
+
+	// Tests defined with ".test"
+	tests         []*pendingTest
+	resolvedTests []Test
+
+	// Cycles since the last label, blocks started with ".cycles_begin" that are not closed yet, and the
+	// cycles of the closed ones
+	labelCycles  Cycles
+	cycleBlocks  []*cycleBlock
+	cycleReports []CycleReport
+
+	// Output of ".print"
+	messages []Message
+
+	// Checks of code that depends on page boundaries
+	pageChecks []pageCheck
+
+	// Warnings suppressed with "; cbmasm:ignore", per line
+	ignoredWarnings map[lineKey]map[string]bool
+
+	// Names of the local labels that were hidden by the macros that are currently expanded, innermost last
+	hiddenLocals []map[string]bool
+
+	// Symbol table, and the blocks started with ".scope" or ".proc" that are currently open
+	symbols      symbolTable
+	symbolScopes []*symbolScope
+
+	// ".struct" or ".enum" block that is currently defined
+	layout *layout
 
 	// All following fields are reset for every line
 
 	// Number of emitted bytes since it was last reset
 	emitted int
+
+	// Cycles of the line's instruction
+	lineCycles *Cycles
 }
 
 func New(includePaths []string, defaultCPU string, defaultPlatform string, defaultOutput string, defaultEncoding string, defines []string) *Assembler {
@@ -174,6 +253,10 @@ func New(includePaths []string, defaultCPU string, defaultPlatform string, defau
 		defaultPlatform: defaultPlatform,
 		defaultOutput:   defaultOutput,
 		defaultEncoding: defaultEncoding,
+		warningsEnabled: make(map[string]bool),
+	}
+	for category, enabled := range WarningCategories {
+		a.warningsEnabled[category] = enabled
 	}
 	for _, d := range defines {
 		a.defines.add(symbol{name: d, val: expr.NewConst(text.Pos{}, 1, 1), kind: symbolConst})
@@ -181,22 +264,132 @@ func New(includePaths []string, defaultCPU string, defaultPlatform string, defau
 	return a
 }
 
-func (a *Assembler) beginSection(org int) {
+func (a *Assembler) beginSection(org int, relocatable bool) {
 	a.section = NewSection(org, a)
+	a.section.relocatable = relocatable
 	a.sections = append(a.sections, a.section)
 }
 
+// SetMemoryMap sets the segments that can be used with ".segment".
+func (a *Assembler) SetMemoryMap(m MemoryMap) {
+	a.memoryMap = m
+}
+
+// objectMode returns whether an object file is generated. In that case, code that is not placed with ".org" is
+// relocatable, and references to undefined global symbols are left to the linker.
+func (a *Assembler) objectMode() bool {
+	return a.defaultOutput == "obj"
+}
+
+// maxPasses is the number of passes after which the assembler gives up to find a stable layout.
+const maxPasses = 10
+
+// forwardRef records a reference to a symbol that was not defined yet when it was used.
+type forwardRef struct {
+	symbol string
+	size   int // Size that was chosen for the reference
+	node   expr.Node
+}
+
+// sizeHint is the value that a forward reference had at the end of the previous pass.
+type sizeHint struct {
+	symbol string
+	val    int
+	known  bool // false if the value is unknown or relocatable
+}
+
+// Assemble assembles the text. Forward references are assumed to be 2 bytes wide in the first pass. If it
+// turns out that some of them fit into a byte, the text is assembled again, using the values from the
+// previous pass to size the forward references. This is repeated until the sizes don't change anymore.
 func (a *Assembler) Assemble(t text.Text) {
+	a.sizeHints = nil
+	for pass := 1; ; pass++ {
+		a.assemblePass(t)
+		hints, unstable := a.checkForwardRefs()
+		if unstable == nil {
+			return
+		}
+		if pass == maxPasses {
+			a.AddError(unstable.node.Pos(), "Layout is not stable after %d passes: the size of %q keeps changing", maxPasses, unstable.symbol)
+			return
+		}
+		a.sizeHints = hints
+	}
+}
+
+// checkForwardRefs checks whether all forward references of the last pass were sized correctly. It returns the
+// hints for the next pass, and the first forward reference with the wrong size (or nil if there is none).
+func (a *Assembler) checkForwardRefs() ([]sizeHint, *forwardRef) {
+	var unstable *forwardRef
+	hints := make([]sizeHint, len(a.forwardRefs))
+	for i := range a.forwardRefs {
+		ref := &a.forwardRefs[i]
+		hints[i] = sizeHint{symbol: ref.symbol}
+		if ref.node.IsResolved() {
+			if r, ok := ref.node.Relocations(); ok && r == 0 {
+				hints[i].val = ref.node.Eval()
+				hints[i].known = true
+			}
+		}
+		size := 2
+		if hints[i].known && checkSize(1, hints[i].val) {
+			size = 1
+		}
+		if size != ref.size && unstable == nil {
+			unstable = ref
+		}
+	}
+	return hints, unstable
+}
+
+// forwardRef returns a reference to a symbol that is not defined yet. If the reference can be 1 or 2 bytes wide,
+// the size is chosen based on the symbol's value in the previous pass.
+func (a *Assembler) forwardRef(pos text.Pos, sym string, size int) expr.Node {
+	if size < 2 {
+		return expr.NewUnresolvedSymbol(pos, sym, size)
+	}
+	i := len(a.forwardRefs)
+	if i < len(a.sizeHints) {
+		hint := a.sizeHints[i]
+		if hint.symbol == sym && hint.known && checkSize(1, hint.val) {
+			size = 1
+		}
+	}
+	node := expr.NewUnresolvedSymbol(pos, sym, size)
+	a.forwardRefs = append(a.forwardRefs, forwardRef{symbol: sym, size: size, node: node})
+	return node
+}
+
+func (a *Assembler) assemblePass(t text.Text) {
 	a.errors = nil
 	a.warnings = nil
 	a.patchesPerLabel = make(map[string][]patch)
+	a.relocations = nil
+	a.forwardRefs = nil
+	a.macroCalls = nil
+	a.definitions = nil
+	a.references = nil
+	a.tests = nil
+	a.labelCycles = Cycles{}
+	a.cycleBlocks = nil
+	a.cycleReports = nil
+	a.messages = nil
+	a.pageChecks = nil
+	a.ignoredWarnings = make(map[lineKey]map[string]bool)
+	a.hiddenLocals = nil
+	a.scopes = nil
+	a.sections = nil
+	a.segments = make(map[string]*segment)
+	a.segment = nil
 	a.assemblyEnabled = stack{}
 	a.assemblyEnabled.push(true)
 	a.ListingLines = nil
 	a.canSetPlatform = true
 	a.symbols = newSymbolTable()
+	a.symbolScopes = nil
+	a.layout = nil
 
-	a.beginSection(0)
+	a.beginSection(0, a.objectMode())
 	a.section.ignore = true
 
 	a.setCPU(a.defaultCPU)
@@ -214,14 +407,30 @@ func (a *Assembler) Assemble(t text.Text) {
 
 	ll := t.LastLine()
 	p := text.Pos{Filename: ll.Filename, Line: ll.LineNumber, Col: 1}
-	if a.state == stateRecordMacro {
-		a.AddError(p, ".endm expected")
+	if a.state == stateRecordBlock {
+		a.AddError(p, "%s expected", a.recordEnd)
+	}
+	if a.layout != nil {
+		a.AddError(p, "%s expected", a.layout.end())
+	}
+	a.closeSymbolScopes(p)
+	if a.objectMode() {
+		// Undefined global symbols are imported from other modules
+		a.reportUnresolvedSymbols(p, isLocalLabel)
+		a.reportUnresolvedPatches(p, isLocalLabel)
+	} else {
+		a.reportUnresolvedSymbols(p, func(string) bool { return true })
+		a.reportUnresolvedPatches(p, func(string) bool { return true })
 	}
-	a.reportUnresolvedSymbols(p, func(string) bool { return true })
-	a.reportUnresolvedPatches(p, func(string) bool { return true })
 	if a.assemblyEnabled.len() > 1 {
 		a.AddError(p, ".endif expected")
 	}
+	a.closeScope()
+	a.finishTests()
+	a.finishCycleBlocks()
+	a.checkPages()
+	a.reportUnused()
+	a.checkOverlaps()
 }
 
 func (a *Assembler) resolveIncludes(t text.Text) text.Text {
@@ -241,7 +450,7 @@ func (a *Assembler) resolveIncludes(t text.Text) text.Text {
 				res.AppendLine(line)
 				continue
 			}
-			content, err := ioutil.ReadFile(*f)
+			content, err := a.readFile(*f)
 			if err != nil {
 				a.AddError(p, "Can't read file %q: %s", *f, err)
 			}
@@ -264,11 +473,14 @@ func (a *Assembler) assembleText(t text.Text) {
 	for _, line := range t.Lines {
 		startPc := a.section.PC()
 		a.emitted = 0
+		a.lineCycles = nil
+		a.recordIgnoredWarnings(line)
 		a.beginLine(line)
 		addToLine := a.processLine()
 		if addToLine {
-			a.ListingLines = append(a.ListingLines, ListingLine{startPc, a.emitted, line})
+			a.ListingLines = append(a.ListingLines, ListingLine{Addr: startPc, Bytes: a.emitted, Line: line, MacroCalls: a.macroCalls, Cycles: a.lineCycles, Total: a.labelCycles})
 		}
+		a.checkSegmentOverflow(line)
 	}
 }
 
@@ -278,16 +490,40 @@ func (a *Assembler) beginLine(line text.Line) {
 	a.lookahead = a.scanner.Scan()
 }
 
+// outputSections returns the sections that are written to the output, ordered by address.
+func (a *Assembler) outputSections() []*Section {
+	var res []*Section
+	for _, s := range a.sections {
+		if s.ignore || s.segment != nil && s.segment.def.BSS {
+			continue
+		}
+		res = append(res, s)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].org < res[j].org })
+	return res
+}
+
+// Origin returns the lowest address of the generated code.
 func (a *Assembler) Origin() int {
-	return a.section.Org()
+	sections := a.outputSections()
+	if len(sections) == 0 {
+		return a.section.Org()
+	}
+	return sections[0].org
 }
 
+// GetBytes returns the generated code. Gaps between sections are filled with zeroes, unless they were created
+// with ".skip".
 func (a *Assembler) GetBytes() []byte {
 	var bytes []byte
-	for _, s := range a.sections {
-		if !s.ignore {
-			bytes = append(bytes, s.bytes...)
+	sections := a.outputSections()
+	for i, s := range sections {
+		if i > 0 && !s.skipped {
+			for gap := s.org - sections[i-1].PC(); gap > 0; gap-- {
+				bytes = append(bytes, 0)
+			}
 		}
+		bytes = append(bytes, s.bytes...)
 	}
 
 	return bytes
@@ -315,6 +551,11 @@ func (a *Assembler) maybeLabel() (scanner.Token, text.Pos, string) {
 				label = t.StrVal
 				a.nextToken() // read over colon
 				t = a.lookahead
+			} else if a.lookahead.Type == scanner.Assign {
+				// "name := expr", the name is treated like a label
+				labelPos = t.Pos
+				label = t.StrVal
+				t = a.lookahead
 			} else {
 				a.pushToken()
 				a.lookahead = oldLookahead
@@ -330,15 +571,24 @@ func (a *Assembler) processLine() (addToListing bool) {
 
 	t, labelPos, label := a.maybeLabel()
 	errs := len(a.Errors())
-	if _, found := conditionalTokens[t.Type]; found {
+	if a.state == stateRecordBlock {
+		// Conditionals in macros and loops are evaluated when they are instantiated
+		addToListing = a.recordBlock(t, labelPos, label)
+	} else if _, found := conditionalTokens[t.Type]; found {
 		a.maybeAddLabel(labelPos, label)
 		switch t.Type {
 		case scanner.Ifdef, scanner.Ifndef:
 			negate := t.Type == scanner.Ifndef
 			a.nextToken()
+			p := a.lookahead.Pos
 			s := a.lookahead.StrVal
 			a.match(scanner.Ident)
-			_, found := a.symbols.get(s)
+			s = a.qualifiedName(s)
+			_, qualified, found := a.lookupSymbol(s)
+			if !found {
+				qualified = a.qualify(s)
+			}
+			a.addReference(p, qualified)
 			if negate {
 				found = !found
 			}
@@ -346,24 +596,7 @@ func (a *Assembler) processLine() (addToListing bool) {
 
 		case scanner.If:
 			a.nextToken()
-			p := a.lookahead.Pos
-			e := a.expr(2, true)
-			if containsKey(relOpToBinOp, a.lookahead.Type) {
-				binOp := relOpToBinOp[a.lookahead.Type]
-				a.nextToken()
-				e2 := a.expr(2, true)
-				if e.Type() != e2.Type() {
-					a.AddError(e2.Pos(), "types don't match")
-				} else {
-					e = expr.NewBinaryOp(e, e2, binOp)
-				}
-			}
-			if !e.IsResolved() {
-				a.AddError(p, "expression is not resolved")
-				e = expr.NewConst(p, 1, 1)
-			}
-			e = a.checkType(e, expr.NodeType_Int)
-			a.assemblyEnabled.push(a.assemblyEnabled.top() && (e.Eval() != 0))
+			a.assemblyEnabled.push(a.assemblyEnabled.top() && a.condition())
 
 		case scanner.Else:
 			a.nextToken()
@@ -387,11 +620,10 @@ func (a *Assembler) processLine() (addToListing bool) {
 			// conditionally assembly is turned off, ignore this liune
 			return
 		}
-		switch a.state {
-		case stateAssemble:
+		if a.layout != nil {
+			a.layoutLine(t, labelPos, label)
+		} else {
 			addToListing = a.assembleLine(t, labelPos, label)
-		case stateRecordMacro:
-			a.recordMacro(t, labelPos, label)
 		}
 	}
 	if len(a.Errors()) <= errs {
@@ -401,6 +633,18 @@ func (a *Assembler) processLine() (addToListing bool) {
 	return addToListing
 }
 
+// condition parses the condition of ".if" and ".while", and returns whether it is true.
+func (a *Assembler) condition() bool {
+	p := a.lookahead.Pos
+	e := a.expr(2, true)
+	if !e.IsResolved() {
+		a.AddError(p, "expression is not resolved")
+		e = expr.NewConst(p, 1, 1)
+	}
+	e = a.checkType(e, expr.NodeType_Int)
+	return e.Eval() != 0
+}
+
 func (a *Assembler) matchEol() {
 	if a.lookahead.Type != scanner.Semicolon && a.lookahead.Type != scanner.Eol {
 		a.AddError(a.lookahead.Pos, "';' or EOL expected")
@@ -425,12 +669,12 @@ func (a *Assembler) assembleLine(t scanner.Token, labelPos text.Pos, label strin
 
 	// Label checks
 	switch t.Type {
-	case scanner.Equ, scanner.Macro:
+	case scanner.Equ, scanner.Macro, scanner.Assign:
 		// Label will be treated as name
 		if label == "" {
 			a.AddError(labelPos, "Label is necessary")
 		}
-	case scanner.Org:
+	case scanner.Org, scanner.Segment, scanner.Endsegment, scanner.Scope, scanner.Proc, scanner.Struct, scanner.Enum:
 		// Can't have a label
 		if label != "" {
 			a.AddError(labelPos, "Label is not allowed")
@@ -501,6 +745,8 @@ func (a *Assembler) assembleLine(t scanner.Token, labelPos text.Pos, label strin
 		for i := 0; i < sizeNode.Eval(); i++ {
 			a.emit(valNode)
 		}
+	case scanner.Fill, scanner.Fillword:
+		a.handleFill(t)
 	case scanner.Word:
 		a.nextToken()
 		// handle wird const
@@ -524,6 +770,10 @@ func (a *Assembler) assembleLine(t scanner.Token, labelPos text.Pos, label strin
 			return
 		}
 		node = a.checkType(node, expr.NodeType_Int)
+		if a.segment != nil {
+			a.AddError(t.Pos, "Can't use .org in segment %q", a.segment.def.Name)
+			return
+		}
 		org = node.Eval()
 		max := a.section.PC()
 		if org < max {
@@ -531,9 +781,9 @@ func (a *Assembler) assembleLine(t scanner.Token, labelPos text.Pos, label strin
 			org = max
 		}
 
-		if a.section.ignore {
+		if a.section.ignore || a.section.relocatable {
 			// Just create a new section
-			a.beginSection(org)
+			a.beginSection(org, false)
 		} else {
 			// Add padding bytes to the current section
 			toAdd := org - max
@@ -553,7 +803,12 @@ func (a *Assembler) assembleLine(t scanner.Token, labelPos text.Pos, label strin
 		node = a.checkType(node, expr.NodeType_Int)
 		skip = node.Eval()
 		newOrg := a.section.PC() + skip
-		a.beginSection(newOrg)
+		a.beginSection(newOrg, a.section.relocatable)
+		a.section.skipped = true
+		if a.segment != nil {
+			a.section.segment = a.segment
+			a.segment.section = a.section
+		}
 	case scanner.Align:
 		a.nextToken()
 		node := a.expr(2, false)
@@ -562,6 +817,10 @@ func (a *Assembler) assembleLine(t scanner.Token, labelPos text.Pos, label strin
 			return
 		}
 		node = a.checkType(node, expr.NodeType_Int)
+		if a.section.relocatable {
+			a.AddError(t.Pos, "Can't use .align in relocatable code")
+			return
+		}
 		n := node.Eval()
 		toAdd := n - (a.section.PC() % n)
 		for toAdd > 0 {
@@ -573,10 +832,49 @@ func (a *Assembler) assembleLine(t scanner.Token, labelPos text.Pos, label strin
 		// label is equ name!
 		pos := t.Pos
 		val := a.expr(2, false)
-		err := a.addSymbol(label, symbolConst, val)
+		name := a.qualify(label)
+		err := a.addSymbol(name, symbolConst, val)
 		if err != nil {
 			a.AddError(pos, err.Error())
+		} else {
+			a.addDefinition(labelPos, name, symbolConst, val)
+		}
+	case scanner.Set:
+		a.nextToken()
+		namePos := a.lookahead.Pos
+		name := a.lookahead.StrVal
+		a.match(scanner.Ident)
+		a.match(scanner.Comma)
+		a.setVariable(namePos, name, a.expr(2, true))
+	case scanner.Assign:
+		a.nextToken()
+		// label is the variable's name!
+		a.setVariable(labelPos, label, a.expr(2, true))
+	case scanner.Test:
+		a.handleTest(t)
+	case scanner.Given, scanner.Expect:
+		a.handleTestAssignment(t)
+	case scanner.EndTest:
+		a.handleEndTest(t)
+	case scanner.CyclesBegin:
+		a.handleCyclesBegin(t)
+	case scanner.CyclesEnd:
+		a.handleCyclesEnd(t)
+	case scanner.AssertSamePage:
+		a.handleAssertSamePage(t)
+	case scanner.Segment:
+		a.nextToken()
+		name := a.lookahead.StrVal
+		pos := a.lookahead.Pos
+		a.match(scanner.String)
+		a.selectSegment(name, pos)
+	case scanner.Endsegment:
+		a.nextToken()
+		if a.segment == nil {
+			a.AddError(t.Pos, ".endsegment without .segment")
+			return
 		}
+		a.leaveSegment()
 	case scanner.Cpu:
 		a.nextToken()
 		cpu := a.lookahead.StrVal
@@ -614,6 +912,8 @@ func (a *Assembler) assembleLine(t scanner.Token, labelPos text.Pos, label strin
 		a.match(scanner.String)
 		if !IsSupportedOutput(output) {
 			a.AddError(pos, "Unknown output %q", output)
+		} else if (output == "obj") != a.objectMode() {
+			a.AddError(pos, "Object files can only be selected on the command line")
 		} else {
 			a.setOutput(output)
 		}
@@ -627,42 +927,65 @@ func (a *Assembler) assembleLine(t scanner.Token, labelPos text.Pos, label strin
 		} else {
 			a.setEncoding(encoding)
 		}
-	case scanner.Fail:
-		a.nextToken()
-		s := a.lookahead.StrVal
-		a.match(scanner.String)
-		a.AddError(t.Pos, s)
+	case scanner.Fail, scanner.Print, scanner.Warning, scanner.Error:
+		a.handleMessage(t)
 	case scanner.Macro:
 		a.nextToken()
 		// label is macroname!
 		macroName := label
 		a.macro = &macro{
+			name: macroName,
 			pos:  t.Pos,
 			text: &text.Text{},
 		}
 		mn := strings.ToLower(macroName)
-		_, found6502 := mos6502.Mnemonics[mn]
+		_, found6502 := a.mnemonics6502[mn]
 		_, foundZ80 := z80.Mnemonics[mn]
 		if found6502 || foundZ80 {
 			a.AddError(labelPos, "Can't use mnemonic %q as macro name", macroName)
 		}
-		if err := a.symbols.add(symbol{name: macroName, kind: symbolMacro, m: a.macro}); err != nil {
+		if err := a.symbols.add(symbol{name: a.qualify(macroName), kind: symbolMacro, m: a.macro}); err != nil {
 			a.AddError(labelPos, "%q is already defined", macroName)
+		} else {
+			a.addDefinition(labelPos, a.qualify(macroName), symbolMacro, nil)
 		}
-		if a.lookahead.Type != scanner.Eol {
+		if a.lookahead.Type != scanner.Eol && a.lookahead.Type != scanner.Semicolon {
 			a.macroParam()
 			for a.lookahead.Type == scanner.Comma {
 				a.nextToken()
 				a.macroParam()
 			}
 		}
-		a.state = stateRecordMacro
+		a.startRecording(a.macro, scanner.Endm, nil)
 	case scanner.Endm:
 		a.AddError(t.Pos, ".endm without .macro")
+	case scanner.Rept, scanner.For, scanner.While:
+		a.handleLoop(t)
+	case scanner.Endr:
+		a.AddError(t.Pos, ".endr without .rept")
+	case scanner.Endfor:
+		a.AddError(t.Pos, ".endfor without .for")
+	case scanner.Endwhile:
+		a.AddError(t.Pos, ".endwhile without .while")
+	case scanner.Scope, scanner.Proc:
+		a.handleScope(t)
+	case scanner.Endscope, scanner.Endproc:
+		a.handleEndScope(t)
+	case scanner.Struct, scanner.Enum:
+		a.handleLayout(t)
+	case scanner.Endstruct:
+		a.AddError(t.Pos, ".endstruct without .struct")
+	case scanner.Endenum:
+		a.AddError(t.Pos, ".endenum without .enum")
 	case scanner.Ident:
-		op := t.StrVal
 		a.nextToken()
-		if sym, found := a.symbols.get(op); found {
+		op := t.StrVal
+		if a.lookahead.Type == scanner.DoubleColon && a.lookahead.Pos.Col == t.Pos.Col+len([]rune(op)) {
+			// Qualified macro name, not a mnemonic with an operand like "::x"
+			op = a.qualifiedName(op)
+		}
+		if sym, qualified, found := a.lookupSymbol(op); found {
+			a.addReference(t.Pos, qualified)
 			if sym.kind != symbolMacro {
 				a.AddError(t.Pos, "%q is not a macro", op)
 				return
@@ -683,6 +1006,82 @@ func (a *Assembler) assembleLine(t scanner.Token, labelPos text.Pos, label strin
 	return addToListing
 }
 
+func (a *Assembler) selectSegment(name string, pos text.Pos) {
+	key := strings.ToUpper(name)
+	seg, found := a.segments[key]
+	if !found {
+		def, found := a.memoryMap.find(name)
+		if !found {
+			a.AddError(pos, "Segment %q is not defined in the memory map", name)
+			return
+		}
+		seg = &segment{def: def, pos: pos}
+		a.segments[key] = seg
+	}
+	if seg.section == nil {
+		a.beginSection(seg.def.Start, false)
+		a.section.segment = seg
+		seg.section = a.section
+	}
+	a.segment = seg
+	a.section = seg.section
+}
+
+// leaveSegment continues assembling outside of segments. Like at the beginning of the text, the code needs a ".org"
+// before anything can be emitted.
+func (a *Assembler) leaveSegment() {
+	a.segment = nil
+	a.beginSection(0, a.objectMode())
+	a.section.ignore = true
+}
+
+func (a *Assembler) checkSegmentOverflow(line text.Line) {
+	seg := a.segment
+	if seg == nil || seg.overflowReported {
+		return
+	}
+	end := seg.def.Start + seg.def.Size
+	if a.section.PC() > end {
+		a.AddError(text.Pos{Filename: line.Filename, Line: line.LineNumber, Col: 1}, "Segment %q overflows by %d bytes", seg.def.Name, a.section.PC()-end)
+		seg.overflowReported = true
+	}
+}
+
+func sectionDescription(s *Section) string {
+	if s.segment != nil {
+		return fmt.Sprintf("segment %q ($%04x-$%04x)", s.segment.def.Name, s.org, s.PC()-1)
+	}
+	return fmt.Sprintf("code at $%04x-$%04x", s.org, s.PC()-1)
+}
+
+// checkOverlaps reports segments that overlap with other segments or with code placed with ".org".
+func (a *Assembler) checkOverlaps() {
+	var sections []*Section
+	for _, s := range a.sections {
+		if s.Size() > 0 && !s.relocatable {
+			sections = append(sections, s)
+		}
+	}
+	sort.SliceStable(sections, func(i, j int) bool { return sections[i].org < sections[j].org })
+	for i := range sections {
+		for j := i + 1; j < len(sections) && sections[j].org < sections[i].PC(); j++ {
+			s1, s2 := sections[i], sections[j]
+			if s1.segment == s2.segment && s1.segment != nil {
+				continue
+			}
+			seg := s2.segment
+			if seg == nil {
+				seg = s1.segment
+			}
+			var pos text.Pos
+			if seg != nil {
+				pos = seg.pos
+			}
+			a.AddError(pos, "Overlap between %s and %s", sectionDescription(s1), sectionDescription(s2))
+		}
+	}
+}
+
 func (a *Assembler) handleIncbin(filename string, filenamePos text.Pos, skip, length expr.Node) {
 	skipVal := 0
 	lengthVal := 0
@@ -723,7 +1122,7 @@ func (a *Assembler) handleIncbin(filename string, filenamePos text.Pos, skip, le
 		a.AddError(filenamePos, "Can't find file %q in include paths.", filename)
 		return
 	}
-	data, err := os.ReadFile(*f)
+	data, err := a.readFile(*f)
 	if err != nil {
 		a.AddError(filenamePos, "Can't read file %q: %s", *f, err)
 		return
@@ -762,8 +1161,27 @@ func (a *Assembler) setCPU(cpu string) {
 	switch cpu {
 	case "6502":
 		a.mnemonicHandler = handle6502Mnemonic
+		a.mnemonics6502 = mos6502.Mnemonics
+	case "6510ill":
+		a.mnemonicHandler = handle6502Mnemonic
+		a.mnemonics6502 = mos6502.Mnemonics6510Ill
+	case "65c02":
+		a.mnemonicHandler = handle6502Mnemonic
+		a.mnemonics6502 = mos6502.Mnemonics65C02
+	case "65ce02":
+		a.mnemonicHandler = handle6502Mnemonic
+		a.mnemonics6502 = mos6502.Mnemonics65CE02
+	case "4510":
+		a.mnemonicHandler = handle6502Mnemonic
+		a.mnemonics6502 = mos6502.Mnemonics4510
 	case "z80":
 		a.mnemonicHandler = handleZ80Mnemonic
+		a.mnemonics6502 = mos6502.Mnemonics
+		a.mnemonicsZ80 = z80.Mnemonics
+	case "z80ill":
+		a.mnemonicHandler = handleZ80Mnemonic
+		a.mnemonics6502 = mos6502.Mnemonics
+		a.mnemonicsZ80 = z80.MnemonicsUndocumented
 	default:
 		panic(fmt.Sprintf("Unsupported CPU %s", cpu))
 	}
@@ -798,21 +1216,51 @@ func (a *Assembler) CurrentOutput() string {
 }
 
 func (a *Assembler) macroParam() {
-	paramName := a.lookahead.StrVal
+	// macroParam := ident ["=" actmacroparam] | "..." .
 	paramPos := a.lookahead.Pos
+	if a.macro.variadic {
+		a.AddError(paramPos, "'...' must be the last parameter")
+	}
+	if a.lookahead.Type == scanner.Ellipsis {
+		a.nextToken()
+		a.macro.variadic = true
+		return
+	}
+	paramName := a.lookahead.StrVal
 	a.match(scanner.Ident)
 	if err := a.macro.addParam(paramName); err != nil {
 		a.AddError(paramPos, "Parameter %s is already used", paramName)
 	}
+	if a.lookahead.Type == scanner.Eq {
+		a.nextToken()
+		if a.macro.defaults == nil {
+			a.macro.defaults = make(map[string]string)
+		}
+		a.macro.defaults[paramName] = a.rawMacroParam()
+	} else if len(a.macro.defaults) > 0 {
+		a.AddError(paramPos, "Parameter %s needs a default value, because the parameters before it have one", paramName)
+	}
 }
 
 type macroInvocation struct {
+	m       *macro
 	callPos text.Pos
+	loop    bool             // Whether m is the body of a loop
+	caller  *macroInvocation // Invocation of the enclosing macro, or nil
 }
 
 func (i *macroInvocation) Modify(err errors.Error) errors.Error {
-	msg := err.Msg + fmt.Sprintf(" (called from %s, line %d)", i.callPos.Filename, i.callPos.Line)
-	return errors.Error{err.Pos, msg}
+	err.Expansion = i.frame(err.Pos).Compact()
+	return err
+}
+
+// frame returns the expansion frames for pos, which is in the macro's body.
+func (i *macroInvocation) frame(pos text.Pos) *errors.Frame {
+	f := &errors.Frame{Macro: i.m.name, Call: i.callPos, Line: i.m.bodyLine(pos), Loop: i.loop}
+	if i.caller != nil {
+		f.Caller = i.caller.frame(i.callPos)
+	}
+	return f
 }
 
 func (a *Assembler) handleMacroInstantiation(m *macro, callPos text.Pos) {
@@ -827,8 +1275,25 @@ func (a *Assembler) handleMacroInstantiation(m *macro, callPos text.Pos) {
 		}
 	}
 
-	if len(actParams) != len(m.params) {
-		a.AddError(paramStart, "Wrong number of arguments: %d expected, %d found", len(m.params), len(actParams))
+	if !m.acceptsArgs(len(actParams)) {
+		switch {
+		case m.variadic:
+			a.AddError(paramStart, "Wrong number of arguments: at least %d expected, %d found", m.minArgs(), len(actParams))
+		case m.minArgs() < len(m.params):
+			a.AddError(paramStart, "Wrong number of arguments: %d to %d expected, %d found", m.minArgs(), len(m.params), len(actParams))
+		default:
+			a.AddError(paramStart, "Wrong number of arguments: %d expected, %d found", len(m.params), len(actParams))
+		}
+		return
+	}
+	a.instantiate(m, actParams, callPos, false)
+}
+
+// instantiate assembles the macro's body with the parameters replaced by actParams. Local labels that exist before
+// are hidden while the body is assembled. loop is set if m is the body of a loop.
+func (a *Assembler) instantiate(m *macro, actParams []string, callPos text.Pos, loop bool) {
+	if len(a.macroCalls) >= maxMacroDepth {
+		a.AddError(callPos, "Macro calls are nested more than %d levels deep", maxMacroDepth)
 		return
 	}
 
@@ -839,11 +1304,25 @@ func (a *Assembler) handleMacroInstantiation(m *macro, callPos text.Pos) {
 	savedLocalLabels := a.symbols.removeMatching(func(s *symbol) bool {
 		return s.kind == symbolLabel && isLocalLabel(s.name)
 	})
+	hidden := make(map[string]bool)
+	for _, sym := range savedLocalLabels {
+		hidden[strings.ToLower(sym.name)] = true
+	}
+	a.hiddenLocals = append(a.hiddenLocals, hidden)
 
 	// Instantiate the macro
 	savedErrorModifier := a.errorModifier
-	a.errorModifier = &macroInvocation{callPos: callPos}
+	caller, _ := a.errorModifier.(*macroInvocation)
+	a.errorModifier = &macroInvocation{m: m, callPos: callPos, loop: loop, caller: caller}
+	savedMacroCalls := a.macroCalls
+	a.macroCalls = append(append([]text.Pos{}, a.macroCalls...), callPos)
 	a.assembleText(t)
+	if a.state == stateRecordBlock {
+		a.AddError(a.lookahead.Pos, "%s expected", a.recordEnd)
+		a.state = stateAssemble
+	}
+	a.hiddenLocals = a.hiddenLocals[:len(a.hiddenLocals)-1]
+	a.macroCalls = savedMacroCalls
 	a.errorModifier = savedErrorModifier
 
 	// Remove the local labels that were defined by the macro, and complain about missing ones.
@@ -858,7 +1337,7 @@ func (a *Assembler) handleMacroInstantiation(m *macro, callPos text.Pos) {
 		if !isLocalLabel(l) {
 			return false
 		}
-		if _, found := passedInLocalLabels[l]; found {
+		if _, found := passedInLocalLabels[localPart(l)]; found {
 			return false
 		}
 		return true
@@ -912,7 +1391,7 @@ func handleZ80Mnemonic(a *Assembler, t scanner.Token) {
 	pos := t.Pos
 	op := strings.ToLower(t.StrVal)
 	// must be a mnemonic
-	opEntries, found := z80.Mnemonics[op]
+	opEntries, found := a.mnemonicsZ80[op]
 	if !found {
 		a.AddError(pos, fmt.Sprintf("%s is not a valid mnemonic", t.StrVal))
 		return
@@ -923,7 +1402,7 @@ func handleZ80Mnemonic(a *Assembler, t scanner.Token) {
 	// Read parames
 	if a.lookahead.Type != scanner.Semicolon && a.lookahead.Type != scanner.Eol {
 		params = append(params, a.z80Param())
-		if a.lookahead.Type == scanner.Comma {
+		for a.lookahead.Type == scanner.Comma {
 			a.nextToken()
 			params = append(params, a.z80Param())
 		}
@@ -940,18 +1419,24 @@ func handleZ80Mnemonic(a *Assembler, t scanner.Token) {
 		n.ForceSize(1)
 		a.emitNode(n)
 	}
+	a.addZ80Cycles(bytes)
 }
 
 func handle6502Mnemonic(a *Assembler, t scanner.Token) {
 	op := strings.ToLower(t.StrVal)
 
 	// must be a mnemonic
-	opCodes, found := mos6502.Mnemonics[op]
+	opCodes, found := a.mnemonics6502[op]
 	if !found {
 		a.AddError(t.Pos, fmt.Sprintf("%s is not a valid mnemonic", t.StrVal))
 		return
 	}
-	param := a.mos6502Param()
+	if _, found := opCodes[mos6502.AM_ZeroPageRelative]; found {
+		a.handleBitBranch(t, opCodes[mos6502.AM_ZeroPageRelative])
+		return
+	}
+	_, wordImmediate := opCodes[mos6502.AM_ImmediateWord]
+	param := a.mos6502Param(wordImmediate)
 	opCode, found := opCodes[param.mode]
 
 	if !found && param.mode == mos6502.AM_ZeroPage {
@@ -971,6 +1456,36 @@ func handle6502Mnemonic(a *Assembler, t scanner.Token) {
 			// Yes, it is! Switch to relative addressing
 			param.mode = mos6502.AM_Relative
 			param.val.MarkRelative()
+		} else if opCode, found = opCodes[mos6502.AM_RelativeLong]; found {
+			// No, but it's a 16-bit branch
+			param.mode = mos6502.AM_RelativeLong
+			param.val = a.longBranchOffset(param.val)
+		}
+	} else if !found && param.mode == mos6502.AM_AbsoluteIndirect {
+		// Maybe it's AM_ZeroPageIndirect?
+		opCode, found = opCodes[mos6502.AM_ZeroPageIndirect]
+		if found {
+			// Yes, it is!
+			param.mode = mos6502.AM_ZeroPageIndirect
+			if !param.val.ForceSize(1) {
+				a.AddError(t.Pos, "parameter too big for 1 byte")
+			}
+		}
+	} else if !found && param.mode == mos6502.AM_IndexedIndirect {
+		// Maybe it's AM_AbsoluteIndexedIndirect?
+		opCode, found = opCodes[mos6502.AM_AbsoluteIndexedIndirect]
+		if found {
+			// Yes, it is!
+			param.mode = mos6502.AM_AbsoluteIndexedIndirect
+			param.val.ForceSize(2)
+		}
+	} else if !found && param.mode == mos6502.AM_AbsoluteIndexedIndirect {
+		// Maybe it's AM_IndexedIndirect?
+		opCode, found = opCodes[mos6502.AM_IndexedIndirect]
+		if found {
+			// Yes, it is, but the address is too large
+			param.mode = mos6502.AM_IndexedIndirect
+			a.AddError(t.Pos, "parameter too big for 1 byte")
 		}
 	} else if !found && param.mode == mos6502.AM_AbsoluteIndexedX {
 		// Maybe it's AM_ZeroPageIndexedX?
@@ -999,6 +1514,7 @@ func handle6502Mnemonic(a *Assembler, t scanner.Token) {
 			// Yes, it is!
 			param.mode = mos6502.AM_AbsoluteIndexedX
 			param.val.ForceSize(2)
+			a.warnZeroPageFallback(t, param.val)
 		}
 	} else if !found && param.mode == mos6502.AM_ZeroPageIndexedY {
 		// Maybe it's AM_AbsoluteIndexedY?
@@ -1007,32 +1523,81 @@ func handle6502Mnemonic(a *Assembler, t scanner.Token) {
 			// Yes, it is!
 			param.mode = mos6502.AM_AbsoluteIndexedY
 			param.val.ForceSize(2)
+			a.warnZeroPageFallback(t, param.val)
 		}
 	}
 	if !found {
 		a.AddError(t.Pos, "Invalid parameter.")
 	}
+	if param.mode.OperandSize() == 2 {
+		// Forward references and small constants might be smaller, but the addressing mode needs 2 bytes
+		param.val.ForceSize(2)
+	}
 
-	// TODO(asigner): Add warning for JMP ($xxFF)
 	a.emit(expr.NewConst(t.Pos, int(opCode), 1))
 	if param.val != nil {
 		a.emit(param.val)
 	}
+	if found {
+		a.add6502Cycles(op, param.mode, param.val)
+		a.add6502PageChecks(op, param.mode, param.val)
+	}
 }
 
-func (a *Assembler) recordMacro(t scanner.Token, labelPos text.Pos, label string) {
-	switch t.Type {
-	case scanner.Macro:
-		a.AddError(t.Pos, "Nested macros are not allowed")
-	case scanner.Endm:
-		// End of macro
-		a.nextToken() // Read over ".endm"
+// handleBitBranch handles the 65C02's BBR and BBS instructions that test a bit in zero page and branch
+// if it's reset or set.
+func (a *Assembler) handleBitBranch(t scanner.Token, opCode byte) {
+	zp := a.expr(1, false)
+	a.match(scanner.Comma)
+	target := a.expr(2, false)
+	target.MarkRelative()
+	a.emit(expr.NewConst(t.Pos, int(opCode), 1), zp, target)
+}
+
+// longBranchOffset returns the offset of a 16-bit branch to target. The offset is relative to the
+// instruction's last byte.
+func (a *Assembler) longBranchOffset(target expr.Node) expr.Node {
+	pos := target.Pos()
+	target.ForceSize(2)
+	offset := expr.NewBinaryOp(target, a.pcNode(pos, 2), expr.Sub)
+	return expr.NewBinaryOp(offset, expr.NewConst(pos, 0xffff, 2), expr.And)
+}
+
+// startRecording starts recording the lines of a macro or loop body until the end directive is found.
+func (a *Assembler) startRecording(body *macro, end scanner.TokenType, l *loop) {
+	a.state = stateRecordBlock
+	a.macro = body
+	a.recordEnd = end
+	a.loop = l
+	a.blockNesting = 0
+}
+
+func (a *Assembler) recordBlock(t scanner.Token, labelPos text.Pos, label string) (addToListing bool) {
+	addToListing = true
+	switch {
+	case blockEnds[t.Type] && a.blockNesting == 0:
+		// End of macro or loop
+		a.nextToken() // Read over the end directive
 		if label != "" {
-			a.AddError(labelPos, "Labels not allowed for .endm")
+			a.AddError(labelPos, "Labels not allowed for %s", t.Type)
+		}
+		if t.Type != a.recordEnd {
+			a.AddError(t.Pos, "%s expected", a.recordEnd)
 		}
 		a.state = stateAssemble
+		if l := a.loop; l != nil {
+			a.loop = nil
+			a.expandLoop(l)
+			addToListing = false // The loop's lines are already in the listing
+		}
 	default:
-		// Just another macro line, add it to the current macro
+		// Nested blocks are handled when the macro or loop is instantiated
+		if blockStarts[t.Type] {
+			a.blockNesting++
+		} else if blockEnds[t.Type] {
+			a.blockNesting--
+		}
+		// Just another line, add it to the current macro or loop
 		a.macro.text.Lines = append(a.macro.text.Lines, *a.scanner.Line())
 
 		// Scan until we're at EOL to keep processLine() happy
@@ -1040,11 +1605,15 @@ func (a *Assembler) recordMacro(t scanner.Token, labelPos text.Pos, label string
 			a.nextToken()
 		}
 	}
+	return addToListing
 }
 
 func (a *Assembler) findIncludeFile(f string) *string {
 	for _, path := range a.includePaths {
 		fullFile := filepath.Join(path, f)
+		if _, found := a.overlay[overlayKey(fullFile)]; found {
+			return &fullFile
+		}
 		if _, err := os.Stat(fullFile); err == nil {
 			return &fullFile
 		}
@@ -1052,6 +1621,47 @@ func (a *Assembler) findIncludeFile(f string) *string {
 	return nil
 }
 
+// SetOverlay sets file contents that are used instead of the files on disk, e.g. for unsaved editor buffers.
+func (a *Assembler) SetOverlay(files map[string][]byte) {
+	a.overlay = make(map[string][]byte)
+	for name, content := range files {
+		a.overlay[overlayKey(name)] = content
+	}
+}
+
+func overlayKey(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		return abs
+	}
+	return filepath.Clean(filename)
+}
+
+func (a *Assembler) readFile(filename string) ([]byte, error) {
+	if content, found := a.overlay[overlayKey(filename)]; found {
+		return content, nil
+	}
+	return os.ReadFile(filename)
+}
+
+// rawMacroParam returns the text up to the next comma that is not in parentheses, without evaluating it.
+func (a *Assembler) rawMacroParam() string {
+	startPos := a.lookahead.Pos
+	parens := 0
+	for a.lookahead.Type != scanner.Eol && a.lookahead.Type != scanner.Semicolon {
+		if a.lookahead.Type == scanner.Comma && parens == 0 {
+			break
+		}
+		if a.lookahead.Type == scanner.LParen {
+			parens++
+		} else if a.lookahead.Type == scanner.RParen {
+			parens--
+		}
+		a.nextToken()
+	}
+	endPos := a.lookahead.Pos
+	return strings.TrimSpace(a.scanner.Line().Extract(startPos, endPos))
+}
+
 func (a *Assembler) actMacroParam() string {
 	// actmacroparam := ["#" ["<"|">"]] expr .
 
@@ -1067,16 +1677,16 @@ func (a *Assembler) actMacroParam() string {
 	return strings.TrimSpace(a.scanner.Line().Extract(startPos, endPos))
 }
 
-func (a *Assembler) mos6502Param() mos6502Param {
+func (a *Assembler) mos6502Param(wordImmediate bool) mos6502Param {
 	// mos6502Param := "#" ["<"|">"] expr
 	//       | expr
 	//       | expr "," "X"
 	//       | expr "," "Y"
 	//       | "(" expr ")"
 	//       | "(" expr "," "X" ")"
-	//       | "(" expr "," "Y" ")"
-	//       | "(" expr ") ""," "X"
+	//       | "(" expr "," "SP" ")" "," "Y"
 	//       | "(" expr ")" "," "Y"
+	//       | "(" expr ")" "," "Z"
 
 	if a.lookahead.Type == scanner.Semicolon || a.lookahead.Type == scanner.Eol {
 		// No param, implied addressing mode'
@@ -1088,6 +1698,11 @@ func (a *Assembler) mos6502Param() mos6502Param {
 		am := mos6502.AM_Immediate
 		var node expr.Node
 		a.nextToken()
+		if wordImmediate {
+			node = a.expr(2, false)
+			node.ForceSize(2)
+			return mos6502Param{mode: mos6502.AM_ImmediateWord, val: node}
+		}
 		p := a.lookahead.Pos
 		switch a.lookahead.Type {
 		case scanner.Lt:
@@ -1109,21 +1724,36 @@ func (a *Assembler) mos6502Param() mos6502Param {
 		am := mos6502.AM_AbsoluteIndirect
 
 		if a.lookahead.Type == scanner.Comma {
-			// AM_IndexedIndirect  // ($aa,X)
+			// AM_IndexedIndirect          // ($aa,X)
+			// AM_AbsoluteIndexedIndirect  // ($aaaa,X)
+			// AM_StackIndirectIndexed     // ($aa,SP),Y
 			a.nextToken()
-			if node.ResultSize() > 1 {
-				// Let see if we can enforce size
-				if !node.ForceSize(1) {
-					a.AddError(a.lookahead.Pos, "Address $%x is too large, only 8 bits allowed", node.Eval())
-				}
-			}
 			reg := a.lookahead.StrVal
 			pos := a.lookahead.Pos
 			a.match(scanner.Ident)
+			if strings.ToLower(reg) == "sp" {
+				if node.ResultSize() > 1 && !node.ForceSize(1) {
+					a.AddError(pos, "Address $%x is too large, only 8 bits allowed", node.Eval())
+				}
+				a.match(scanner.RParen)
+				a.match(scanner.Comma)
+				reg = a.lookahead.StrVal
+				pos = a.lookahead.Pos
+				a.match(scanner.Ident)
+				if strings.ToLower(reg) != "y" {
+					a.AddError(pos, "Register Y expected, found %s.", reg)
+				}
+				return mos6502Param{mode: mos6502.AM_StackIndirectIndexed, val: node}
+			}
 			if strings.ToLower(reg) != "x" {
 				a.AddError(pos, "Register X expected, found %s.", reg)
 			}
 			am = mos6502.AM_IndexedIndirect
+			if node.ResultSize() > 1 && !node.ForceSize(1) {
+				// Too large for zero page, but the CPU might support ($aaaa,X)
+				am = mos6502.AM_AbsoluteIndexedIndirect
+				node.ForceSize(2)
+			}
 			a.match(scanner.RParen)
 			return mos6502Param{mode: am, val: node}
 		} else {
@@ -1141,10 +1771,15 @@ func (a *Assembler) mos6502Param() mos6502Param {
 				reg := a.lookahead.StrVal
 				pos := a.lookahead.Pos
 				a.match(scanner.Ident)
-				if strings.ToLower(reg) != "y" {
+				switch strings.ToLower(reg) {
+				case "y":
+					am = mos6502.AM_IndirectIndexed
+				case "z":
+					am = mos6502.AM_IndirectIndexedZ
+				default:
 					a.AddError(pos, "Register Y expected, found %s.", reg)
+					am = mos6502.AM_IndirectIndexed
 				}
-				am = mos6502.AM_IndirectIndexed
 			}
 			return mos6502Param{mode: am, val: node}
 		}
@@ -1193,12 +1828,16 @@ func (a *Assembler) z80Param() z80.Param {
 		return z80.Param{Pos: p, Mode: z80.AM_Immediate, Val: node}
 
 	case scanner.Ident:
-		if _, found := a.symbols.get(a.lookahead.StrVal); !found {
+		if _, _, found := a.lookupSymbol(a.lookahead.StrVal); !found {
 			// Only check for registers or conditions if it's not a symbol
 			if reg, found := z80.RegisterFromString(a.lookahead.StrVal); found {
 				a.nextToken()
 				return z80.Param{Pos: p, Mode: z80.AM_Register, R: reg}
 			}
+			if reg, found := z80.UndocumentedRegisterFromString(a.lookahead.StrVal); found && a.currentCPU == "z80ill" {
+				a.nextToken()
+				return z80.Param{Pos: p, Mode: z80.AM_Register, R: reg}
+			}
 			if cond, found := z80.CondFromString(a.lookahead.StrVal); found {
 				a.nextToken()
 				return z80.Param{Pos: p, Mode: z80.AM_Cond, Cond: cond}
@@ -1280,87 +1919,143 @@ func containsKey(m map[scanner.TokenType]expr.BinaryOp, key scanner.TokenType) b
 }
 
 func (a *Assembler) expr(size int, stringsAllowed bool) expr.Node {
-	// expr := ["-"] term { "+"|"-"|"|" term } .
-	neg := false
-	var negPos text.Pos
-	if a.lookahead.Type == scanner.Minus {
-		neg = true
-		negPos = a.lookahead.Pos
-		a.nextToken()
+	// expr := binaryExpr ["?" expr ":" expr] .
+	node := a.binaryExpr(0, size, stringsAllowed)
+	if a.lookahead.Type != scanner.Question {
+		return node
 	}
-	node := a.term(size, stringsAllowed)
-	if neg {
-		if !node.Type().IsNumeric() {
-			a.AddError(negPos, "Operation not supported on non-numeric types")
-		} else {
-			node = expr.NewUnaryOp(negPos, node, expr.Neg)
-		}
+	p := a.lookahead.Pos
+	a.nextToken()
+	then := a.expr(size, stringsAllowed)
+	a.match(scanner.Colon)
+	els := a.expr(size, stringsAllowed)
+	if node.Type() != expr.NodeType_Int {
+		a.AddError(p, "Condition must be of type integer")
+		return then
 	}
-
-	ops := map[scanner.TokenType]expr.BinaryOp{
-		scanner.Plus:  expr.Add,
-		scanner.Minus: expr.Sub,
-		scanner.Bar:   expr.Or,
+	if then.Type() != els.Type() {
+		a.AddError(els.Pos(), "types don't match")
+		return then
 	}
+	return expr.NewConditional(node, then, els)
+}
+
+// binaryOperators are the binary operators, from the lowest to the highest precedence.
+var binaryOperators = []map[scanner.TokenType]expr.BinaryOp{
+	{scanner.LogOr: expr.LogOr},
+	{scanner.LogAnd: expr.LogAnd},
+	{scanner.Eq: expr.Eq, scanner.Ne: expr.Ne, scanner.Lt: expr.Lt, scanner.Le: expr.Le, scanner.Gt: expr.Gt, scanner.Ge: expr.Ge},
+	{scanner.Plus: expr.Add, scanner.Minus: expr.Sub, scanner.Bar: expr.Or},
+	{scanner.Asterisk: expr.Mul, scanner.Slash: expr.Div, scanner.Percent: expr.Mod, scanner.Ampersand: expr.And, scanner.Caret: expr.Xor, scanner.Shl: expr.Shl, scanner.Shr: expr.Shr},
+}
 
+// binaryExpr parses the operators with at least the given precedence.
+func (a *Assembler) binaryExpr(precedence int, size int, stringsAllowed bool) expr.Node {
+	// binaryExpr := unary { binaryOp unary } .
+	if precedence == len(binaryOperators) {
+		return a.unary(size, stringsAllowed)
+	}
+	ops := binaryOperators[precedence]
+	var node expr.Node
+	if a.lookahead.Type == scanner.Minus && containsKey(ops, scanner.Minus) {
+		// A leading "-" negates the whole first term, e.g. "-1 & $ff" is "-(1 & $ff)"
+		p := a.lookahead.Pos
+		a.nextToken()
+		node = a.negate(p, a.binaryExpr(precedence+1, size, stringsAllowed))
+	} else {
+		node = a.binaryExpr(precedence+1, size, stringsAllowed)
+	}
 	for containsKey(ops, a.lookahead.Type) {
 		op := ops[a.lookahead.Type]
 		a.nextToken()
 		p := a.lookahead.Pos
-		n2 := a.term(size, stringsAllowed)
-		if !n2.Type().IsNumeric() || !node.Type().IsNumeric() {
-			a.AddError(p, "operation only supported on numeric types")
-		} else {
-			node = expr.NewBinaryOp(node, n2, op)
-		}
+		n2 := a.binaryExpr(precedence+1, size, stringsAllowed)
+		node = a.binaryOp(p, node, n2, op)
 	}
 	return node
 }
 
-func (a *Assembler) term(size int, stringsAllowed bool) expr.Node {
-	// term := factor { "*"|"/"|"%"|"&"|"^" factor } .
-	ops := map[scanner.TokenType]expr.BinaryOp{
-		scanner.Asterisk:  expr.Mul,
-		scanner.Slash:     expr.Div,
-		scanner.Percent:   expr.Mod,
-		scanner.Ampersand: expr.And,
-		scanner.Caret:     expr.Xor,
+// binaryOp checks the types of the operands, and returns the node for "left op right".
+func (a *Assembler) binaryOp(p text.Pos, left, right expr.Node, op expr.BinaryOp) expr.Node {
+	switch {
+	case op.IsComparison():
+		if left.Type() == expr.NodeType_String || right.Type() == expr.NodeType_String {
+			if left.Type() != right.Type() {
+				a.AddError(p, "types don't match")
+				return left
+			}
+			return expr.NewBinaryOp(left, right, op)
+		}
+	case op == expr.Add && (left.Type() == expr.NodeType_String || right.Type() == expr.NodeType_String):
+		// Concatenation
+		if left.Type() != right.Type() {
+			a.AddError(p, "types don't match")
+			return left
+		}
+		return expr.NewBinaryOp(left, right, op)
+	case op == expr.Add || op == expr.Sub || op == expr.Mul || op == expr.Div:
+	default:
+		if left.Type() == expr.NodeType_Float || right.Type() == expr.NodeType_Float {
+			a.AddError(p, "operation only supported on int type")
+			return left
+		}
 	}
-
-	node := a.factor(size, stringsAllowed)
-	for containsKey(ops, a.lookahead.Type) {
-		op := ops[a.lookahead.Type]
-		a.nextToken()
-		p := a.lookahead.Pos
-		n2 := a.factor(size, stringsAllowed)
-		if !n2.Type().IsNumeric() || !node.Type().IsNumeric() {
-			a.AddError(p, "operation only supported on numeric types")
-		} else {
-			node = expr.NewBinaryOp(node, n2, op)
+	if !left.Type().IsNumeric() || !right.Type().IsNumeric() {
+		a.AddError(p, "operation only supported on numeric types")
+		return left
+	}
+	if right.Type() == expr.NodeType_Int && right.IsResolved() {
+		if msg := op.CheckOperand(right.Eval()); msg != "" {
+			a.AddError(p, "%s", msg)
+			return left
 		}
 	}
-	return node
+	return expr.NewBinaryOp(left, right, op)
 }
 
-func (a *Assembler) factor(size int, stringsAllowed bool) expr.Node {
-	// factor := "~" factor | number | char-const | string | ident | "*' | "scr" "(" expr ")".
-	var node expr.Node
+func (a *Assembler) unary(size int, stringsAllowed bool) expr.Node {
+	// unary := ("-"|"~"|"!") unary | factor .
+	p := a.lookahead.Pos
 	switch a.lookahead.Type {
-	case scanner.Tilde:
-		p := a.lookahead.Pos
+	case scanner.Minus:
 		a.nextToken()
-		node = a.factor(size, stringsAllowed)
+		return a.negate(p, a.unary(size, stringsAllowed))
+	case scanner.Tilde, scanner.Bang:
+		op := expr.Not
+		if a.lookahead.Type == scanner.Bang {
+			op = expr.LogNot
+		}
+		a.nextToken()
+		node := a.unary(size, stringsAllowed)
 		if node.Type() != expr.NodeType_Int {
 			a.AddError(p, "operation only supported on int type")
-		} else {
-			node = expr.NewUnaryOp(p, node, expr.Not)
+			return node
 		}
+		return expr.NewUnaryOp(p, node, op)
+	}
+	return a.factor(size, stringsAllowed)
+}
+
+// negate returns the node for "-node".
+func (a *Assembler) negate(p text.Pos, node expr.Node) expr.Node {
+	if !node.Type().IsNumeric() {
+		a.AddError(p, "Operation not supported on non-numeric types")
+		return node
+	}
+	return expr.NewUnaryOp(p, node, expr.Neg)
+}
+
+func (a *Assembler) factor(size int, stringsAllowed bool) expr.Node {
+	// factor := number | char-const | string | ["::"] ident {"::" ident} | "*' | "(" expr ")" | ident "(" [expr {"," expr}] ")".
+	var node expr.Node
+	switch a.lookahead.Type {
 	case scanner.Integer:
 		p := a.lookahead.Pos
 		val := a.lookahead.IntVal
 		node = expr.NewConst(p, int(val), size)
-		if !checkSize(size, int(val)) {
-			a.AddError(p, "Constant $%x (decimal %d) is wider than %d bits", val, val, size*8)
+		// Byte values are checked when they're emitted, so that expressions like "$1ff-$100" are possible.
+		if maxSize := max(size, 2); !checkSize(maxSize, int(val)) {
+			a.AddError(p, "Constant $%x (decimal %d) is wider than %d bits", val, val, maxSize*8)
 		}
 		a.nextToken()
 	case scanner.Float:
@@ -1377,6 +2072,7 @@ func (a *Assembler) factor(size int, stringsAllowed bool) expr.Node {
 		p := a.lookahead.Pos
 		str := a.lookahead.StrVal
 		if stringsAllowed {
+			a.checkStringTruncation(p, str)
 			node = expr.NewUnaryOp(p, expr.NewStrConst(p, str), a.currentEncoding)
 		} else {
 			a.AddError(p, "Strings are not allowed")
@@ -1386,42 +2082,18 @@ func (a *Assembler) factor(size int, stringsAllowed bool) expr.Node {
 	case scanner.Ident:
 		p := a.lookahead.Pos
 		sym := a.lookahead.StrVal
-		node = nil
-		if strings.ToLower(sym) == "scr" {
-			// "scr" "(" expr ")"
-			a.nextToken()
-			a.match(scanner.LParen)
-			n := a.expr(size, stringsAllowed)
-			n = expr.NewUnaryOp(n.Pos(), n, expr.ScreenCode)
-			a.match(scanner.RParen)
-			return n
-		}
-		if s, found := a.symbols.get(sym); found {
-			if s.kind == symbolMacro {
-				a.AddError(p, "%q is a macro, not a constant or label", sym)
-				node = expr.NewConst(p, 0, size)
-			} else if s.val.IsResolved() {
-				switch s.val.Type() {
-				case expr.NodeType_Int:
-					node = expr.NewConst(p, s.val.Eval(), size)
-				case expr.NodeType_Float:
-					node = expr.NewFloatConst(p, s.val.EvalFloat())
-				case expr.NodeType_String:
-					if stringsAllowed {
-						node = expr.NewStrConst(p, s.val.EvalStr())
-					} else {
-						a.AddError(p, "Strings not allowed")
-						node = expr.NewConst(p, 0, size)
-					}
-				default:
-					panic(fmt.Sprintf("Unhandled type %v", s.val.Type()))
-				}
-			}
-		}
-		if node == nil {
-			node = expr.NewUnresolvedSymbol(p, sym, size)
+		a.nextToken()
+		if a.isBuiltinCall(sym) {
+			return builtins[strings.ToLower(sym)](a, p, size, stringsAllowed)
 		}
+		node = a.symbolNode(p, a.qualifiedName(sym), size, stringsAllowed)
+	case scanner.DoubleColon:
+		// "::" ident: symbol in the outermost block
+		p := a.lookahead.Pos
 		a.nextToken()
+		sym := a.lookahead.StrVal
+		a.match(scanner.Ident)
+		node = a.symbolNode(p, "::"+a.qualifiedName(sym), size, stringsAllowed)
 	case scanner.LParen:
 		a.nextToken()
 		node = a.expr(size, stringsAllowed)
@@ -1433,7 +2105,7 @@ func (a *Assembler) factor(size int, stringsAllowed bool) expr.Node {
 			node = expr.NewConst(p, 0, size)
 			break
 		}
-		node = expr.NewConst(p, a.section.PC(), size)
+		node = a.pcNode(p, 0)
 		a.nextToken()
 	default:
 		a.AddError(a.lookahead.Pos, "'~', '*', number or identifier expected, found %s", a.lookahead.Type)
@@ -1442,6 +2114,49 @@ func (a *Assembler) factor(size int, stringsAllowed bool) expr.Node {
 	return node
 }
 
+// symbolNode returns a node for a reference to a symbol.
+func (a *Assembler) symbolNode(p text.Pos, sym string, size int, stringsAllowed bool) expr.Node {
+	s, qualified, found := a.lookupSymbol(sym)
+	if !found {
+		return a.symbolRef(p, sym, size)
+	}
+	a.addReference(p, qualified)
+	if s.kind == symbolMacro {
+		a.AddError(p, "%q is a macro, not a constant or label", sym)
+		return expr.NewConst(p, 0, size)
+	}
+	if !s.val.IsResolved() {
+		return a.forwardRef(p, qualified, size)
+	}
+	switch s.val.Type() {
+	case expr.NodeType_Int:
+		return a.resolvedSymbolRef(p, qualified, s.val, size)
+	case expr.NodeType_Float:
+		return expr.NewFloatConst(p, s.val.EvalFloat())
+	case expr.NodeType_String:
+		if !stringsAllowed {
+			a.AddError(p, "Strings not allowed")
+			return expr.NewConst(p, 0, size)
+		}
+		return expr.NewStrConst(p, s.val.EvalStr())
+	}
+	panic(fmt.Sprintf("Unhandled type %v", s.val.Type()))
+}
+
+// resolvedSymbolRef returns a node for a reference to a resolved int symbol. If the symbol's value depends on the
+// module's base address, the reference stays relocatable.
+func (a *Assembler) resolvedSymbolRef(p text.Pos, sym string, val expr.Node, size int) expr.Node {
+	r, ok := val.Relocations()
+	if !ok || r < 0 || r > 1 {
+		a.AddError(p, "Value of %q can't be relocated", sym)
+		return expr.NewConst(p, val.Eval(), size)
+	}
+	if r == 1 {
+		return expr.NewRelocatableSymbolRef(p, sym, size, val.Eval())
+	}
+	return expr.NewConst(p, val.Eval(), size)
+}
+
 func checkSize(maxSize int, val int) bool {
 	uv := uint64(val)
 	uv = uv >> (maxSize * 8)
@@ -1456,7 +2171,7 @@ func (a *Assembler) emit(nodes ...expr.Node) {
 
 func (a *Assembler) checkRange(n expr.Node) {
 	n.CheckRange(a)
-	if n.IsRelative() {
+	if n.IsRelative() && !a.section.needsRelocation(n) {
 		val := n.Eval() - (a.section.PC() + 1)
 		if val < -128 || val > 127 {
 			a.AddError(n.Pos(), "Branch target too far away.")
@@ -1475,6 +2190,10 @@ func (a *Assembler) checkType(n expr.Node, t expr.NodeType) expr.Node {
 func (a *Assembler) emitNode(n expr.Node) {
 	switch n.Type() {
 	case expr.NodeType_String:
+		if !n.IsResolved() {
+			a.AddError(n.Pos(), "Can't emit unresolved string")
+			return
+		}
 		str := n.EvalStr()
 		for _, b := range str {
 			a.section.Emit(byte(b & 0xff))
@@ -1532,6 +2251,7 @@ func (a *Assembler) emitNode(n expr.Node) {
 		} else {
 			a.checkRange(n)
 			val = n.Eval()
+			a.maybeAddRelocation(a.section, a.section.PC(), n)
 		}
 		size = n.ResultSize()
 		if n.IsRelative() {
@@ -1547,25 +2267,55 @@ func (a *Assembler) emitNode(n expr.Node) {
 	}
 }
 
+// pcNode returns a node for the current PC plus offset.
+func (a *Assembler) pcNode(pos text.Pos, offset int) expr.Node {
+	if a.section.relocatable {
+		return expr.NewRelocatableSymbolRef(pos, "*", 2, a.section.PC()+offset)
+	}
+	return expr.NewConst(pos, a.section.PC()+offset, 2)
+}
+
 func (a *Assembler) registerPatch(pc int, n expr.Node) {
 	for label := range n.UnresolvedSymbols() {
 		patches := a.patchesPerLabel[label]
-		patches = append(patches, patch{pc: pc, node: n})
+		patches = append(patches, patch{section: a.section, pc: pc, node: n})
 		a.patchesPerLabel[label] = patches
 	}
 }
 
+// maybeAddRelocation records resolved nodes that depend on the module's base address, so that the linker can
+// recompute them.
+func (a *Assembler) maybeAddRelocation(section *Section, pc int, n expr.Node) {
+	if !a.objectMode() || !section.needsRelocation(n) {
+		return
+	}
+	a.relocations = append(a.relocations, patch{section: section, pc: pc, node: n})
+}
+
 func (a *Assembler) addLabel(pos text.Pos, label string) {
+	label = a.qualify(label)
 	pc := a.section.PC()
-	err := a.addSymbol(label, symbolLabel, expr.NewConst(pos, pc, 2))
+	var val expr.Node
+	if a.section.relocatable {
+		val = expr.NewRelocatableSymbolRef(pos, label, 2, pc)
+	} else {
+		val = expr.NewConst(pos, pc, 2)
+	}
+	err := a.addSymbol(label, symbolLabel, val)
 	if err != nil {
 		a.AddError(pos, err.Error())
 		return
 	}
+	a.addDefinition(pos, label, symbolLabel, val)
+	a.labelCycles = Cycles{}
+	if isLocalLabel(label) && len(a.hiddenLocals) > 0 && a.hiddenLocals[len(a.hiddenLocals)-1][strings.ToLower(label)] {
+		a.warn(WarnShadowedLocal, pos, "Local label %s hides the caller's label with the same name", label)
+	}
 
 	if !isLocalLabel(label) {
 		a.reportUnresolvedSymbols(pos, isLocalLabel)
 		a.clearLocalLabels(isLocalLabel)
+		a.openScope(pos, label)
 	}
 }
 
@@ -1611,7 +2361,7 @@ func (a *Assembler) reportUnresolvedPatches(_ text.Pos, filterFunc func(string)
 }
 
 func isLocalLabel(label string) bool {
-	return strings.HasPrefix(label, "_")
+	return strings.HasPrefix(localPart(label), "_")
 }
 
 func (a *Assembler) addSymbol(name string, kind symbolKind, val expr.Node) error {
@@ -1627,25 +2377,21 @@ func (a *Assembler) addSymbol(name string, kind symbolKind, val expr.Node) error
 
 func (a *Assembler) resolveDependencies(symbol string, val expr.Node) {
 	// Try to resolve as many patches as we can
+	// Patches that are still unresolved afterwards are also registered for their other symbols.
 	patches := a.patchesPerLabel[symbol]
-	adjustedPatches := []patch{}
+	relocatable := a.isRelocatableValue(symbol, val)
 	for _, p := range patches {
-		p.node.Resolve(symbol, val.Eval())
-		if p.node.IsResolved() {
-			for _, s := range a.sections {
-				if s.Contains(p.pc) {
-					s.ApplyPatch(p)
-				}
-			}
+		if relocatable {
+			p.node.ResolveRelocatable(symbol, val.Eval())
 		} else {
-			adjustedPatches = append(adjustedPatches, p)
+			p.node.Resolve(symbol, val.Eval())
+		}
+		if p.node.IsResolved() {
+			p.section.ApplyPatch(p)
+			a.maybeAddRelocation(p.section, p.pc, p.node)
 		}
 	}
-	if len(adjustedPatches) == 0 {
-		delete(a.patchesPerLabel, symbol)
-	} else {
-		a.patchesPerLabel[symbol] = adjustedPatches
-	}
+	delete(a.patchesPerLabel, symbol)
 
 	// Now, resolve any symbols
 	for _, sym := range a.symbols.symbols() {
@@ -1655,7 +2401,11 @@ func (a *Assembler) resolveDependencies(symbol string, val expr.Node) {
 		if sym.val.IsResolved() {
 			continue
 		}
-		sym.val.Resolve(symbol, val.Eval())
+		if relocatable {
+			sym.val.ResolveRelocatable(symbol, val.Eval())
+		} else {
+			sym.val.Resolve(symbol, val.Eval())
+		}
 		if sym.val.IsResolved() {
 			a.checkRange(sym.val)
 			a.resolveDependencies(sym.name, sym.val)
@@ -1663,8 +2413,18 @@ func (a *Assembler) resolveDependencies(symbol string, val expr.Node) {
 	}
 }
 
+// isRelocatableValue returns whether the symbol's value depends on the module's base address.
+func (a *Assembler) isRelocatableValue(symbol string, val expr.Node) bool {
+	r, ok := val.Relocations()
+	if !ok || r < 0 || r > 1 {
+		a.AddError(val.Pos(), "Value of %q can't be relocated", symbol)
+		return false
+	}
+	return r == 1
+}
+
 func (a *Assembler) AddError(pos text.Pos, message string, args ...interface{}) {
-	err := errors.Error{pos, fmt.Sprintf(message, args...)}
+	err := errors.Error{Pos: pos, Msg: fmt.Sprintf(message, args...)}
 	if a.errorModifier != nil {
 		err = a.errorModifier.Modify(err)
 	}
@@ -1675,8 +2435,13 @@ func (a *Assembler) Errors() []errors.Error {
 	return a.errors
 }
 
+// AddWarning adds a warning that doesn't belong to a category. It can only be suppressed with a
+// "; cbmasm:ignore" comment without names.
 func (a *Assembler) AddWarning(pos text.Pos, message string) {
-	a.warnings = append(a.errors, errors.Error{pos, message})
+	if a.isIgnored(pos, "") {
+		return
+	}
+	a.addWarning(pos, message, "")
 }
 
 func (a *Assembler) Warnings() []errors.Error {
@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"testing"
 
+	"github.com/asig/cbmasm/pkg/errors"
 	"github.com/asig/cbmasm/pkg/text"
 )
 
@@ -820,3 +821,235 @@ func TestAssembler_expr(t *testing.T) {
 		})
 	}
 }
+
+func TestAssembler_assemble_6510ill(t *testing.T) {
+	tests := []struct {
+		name       string
+		text       string
+		want       []byte
+		wantErrors []errors.Error
+	}{
+		{
+			name: "Read-modify-write opcodes",
+			text: `
+	slo $12
+	rla $12,x
+	sre $1234
+	rra $1234,x
+	dcp $1234,y
+	isc ($12,x)
+	slo ($12),y
+`,
+			want: []byte{0x07, 0x12, 0x37, 0x12, 0x4f, 0x34, 0x12, 0x7f, 0x34, 0x12, 0xdb, 0x34, 0x12, 0xe3, 0x12, 0x13, 0x12},
+		},
+		{
+			name: "LAX and SAX",
+			text: `
+	lax $12
+	lax $12,y
+	lax $1234,y
+	lax ($12),y
+	sax $12
+	sax $12,y
+	sax $1234
+	sax ($12,x)
+`,
+			want: []byte{0xa7, 0x12, 0xb7, 0x12, 0xbf, 0x34, 0x12, 0xb3, 0x12, 0x87, 0x12, 0x97, 0x12, 0x8f, 0x34, 0x12, 0x83, 0x12},
+		},
+		{
+			name: "Immediate opcodes",
+			text: `
+	anc #$12
+	alr #$12
+	arr #$12
+	sbx #$12
+`,
+			want: []byte{0x0b, 0x12, 0x4b, 0x12, 0x6b, 0x12, 0xcb, 0x12},
+		},
+		{
+			name: "NOP variants",
+			text: `
+	nop
+	nop #$12
+	nop $12
+	nop $12,x
+	nop $1234
+	nop $1234,x
+`,
+			want: []byte{0xea, 0x80, 0x12, 0x04, 0x12, 0x14, 0x12, 0x0c, 0x34, 0x12, 0x1c, 0x34, 0x12},
+		},
+		{
+			name: "Zero page fallback",
+			text: `
+	dcp $1234,x
+	isc $12,y
+`,
+			want: []byte{0xdf, 0x34, 0x12, 0xfb, 0x12, 0x00},
+		},
+		{
+			name: "Illegal opcodes need to be enabled",
+			text: `
+	.cpu "6502"
+	lax $12
+`,
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 4, Col: 2}, Msg: "lax is not a valid mnemonic"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assembler := New([]string{}, "6510ill", "c128", "plain", "petscii", []string{})
+			src := " .org 0\n " + test.text
+			assembler.Assemble(text.Process("", src))
+			errs := assembler.Errors()
+			if len(errs) != len(test.wantErrors) {
+				t.Fatalf("Got %+v, want %+v", errs, test.wantErrors)
+			}
+			for i := range errs {
+				if errs[i] != test.wantErrors[i] {
+					t.Errorf("Error %d: got %+v, want %+v", i+1, errs[i], test.wantErrors[i])
+				}
+			}
+			if len(test.wantErrors) > 0 {
+				return
+			}
+			got := assembler.GetBytes()
+			if bytes.Compare(got, test.want) != 0 {
+				t.Errorf("Got %s, want %s", toString(got), toString(test.want))
+			}
+		})
+	}
+}
+
+func TestAssembler_assemble_CMOS(t *testing.T) {
+	tests := []struct {
+		name       string
+		cpu        string
+		platform   string
+		text       string
+		want       []byte
+		wantErrors []errors.Error
+	}{
+		{
+			name:     "65C02",
+			cpu:      "65c02",
+			platform: "generic",
+			text: `
+l	bra l
+	phx
+	ply
+	stz $12
+	stz $1234,x
+	tsb $12
+	trb $1234
+	lda ($12)
+	jmp ($1234,x)
+	bit #$12
+	inc a
+	dec
+	rmb3 $12
+	smb7 $12
+	bbr0 $12,l
+	bbs7 $12,f
+f	wai
+`,
+			want: []byte{
+				0x80, 0xfe, // bra l
+				0xda,       // phx
+				0x7a,       // ply
+				0x64, 0x12, // stz $12
+				0x9e, 0x34, 0x12, // stz $1234,x
+				0x04, 0x12, // tsb $12
+				0x1c, 0x34, 0x12, // trb $1234
+				0xb2, 0x12, // lda ($12)
+				0x7c, 0x34, 0x12, // jmp ($1234,x)
+				0x89, 0x12, // bit #$12
+				0x1a,       // inc a
+				0x3a,       // dec
+				0x37, 0x12, // rmb3 $12
+				0xf7, 0x12, // smb7 $12
+				0x0f, 0x12, 0xe2, // bbr0 $12,l
+				0xff, 0x12, 0x00, // bbs7 $12,f
+				0xcb, // wai
+			},
+		},
+		{
+			name:     "4510",
+			cpu:      "4510",
+			platform: "mega65",
+			text: `
+l	lbne l
+	bsr f
+	lda ($12),z
+	sta ($12,sp),y
+	ldz #$12
+	phw #$1234
+	inw $12
+	jsr ($1234,x)
+	rts #2
+	taz
+f	map
+	eom
+`,
+			want: []byte{
+				0xd3, 0xfe, 0xff, // lbne l
+				0x63, 0x12, 0x00, // bsr f
+				0xb2, 0x12, // lda ($12),z
+				0x82, 0x12, // sta ($12,sp),y
+				0xa3, 0x12, // ldz #$12
+				0xf4, 0x34, 0x12, // phw #$1234
+				0xe3, 0x12, // inw $12
+				0x23, 0x34, 0x12, // jsr ($1234,x)
+				0x62, 0x02, // rts #2
+				0x4b, // taz
+				0x5c, // map
+				0xea, // eom
+			},
+		},
+		{
+			name:       "65CE02 has no (zp) without Z",
+			cpu:        "65ce02",
+			platform:   "c65",
+			text:       "lda ($12)",
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 2, Col: 2}, Msg: "Invalid parameter."}},
+		},
+		{
+			name:       "6502 has no ($aaaa,X)",
+			cpu:        "6502",
+			platform:   "c64",
+			text:       "jmp ($1234,x)",
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 2, Col: 2}, Msg: "Invalid parameter."}},
+		},
+		{
+			name:       "CPU needs to match platform",
+			cpu:        "6502",
+			platform:   "c128",
+			text:       `.cpu "4510"`,
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 2, Col: 7}, Msg: "CPU \"4510\" not supported for platform \"c128\""}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assembler := New([]string{}, test.cpu, test.platform, "plain", "petscii", []string{})
+			src := " .org 0\n " + test.text
+			assembler.Assemble(text.Process("", src))
+			errs := assembler.Errors()
+			if len(errs) != len(test.wantErrors) {
+				t.Fatalf("Got %+v, want %+v", errs, test.wantErrors)
+			}
+			for i := range errs {
+				if errs[i] != test.wantErrors[i] {
+					t.Errorf("Error %d: got %+v, want %+v", i+1, errs[i], test.wantErrors[i])
+				}
+			}
+			if len(test.wantErrors) > 0 {
+				return
+			}
+			got := assembler.GetBytes()
+			if bytes.Compare(got, test.want) != 0 {
+				t.Errorf("Got %s, want %s", toString(got), toString(test.want))
+			}
+		})
+	}
+}
@@ -43,7 +43,7 @@ func TestAssembler_RelativeBranchesAreCheckedForOverflow(t *testing.T) {
 l	.reserve 128
 	beq l
 `,
-			wantErrors:   []errors.Error{{text.Pos{Filename: "", Line: 3, Col: 6}, "Branch target too far away."}},
+			wantErrors:   []errors.Error{{Pos: text.Pos{Filename: "", Line: 3, Col: 6}, Msg: "Branch target too far away."}},
 			wantWarnings: []errors.Error{},
 		},
 		{
@@ -53,7 +53,7 @@ l	.reserve 128
 	.reserve 128
 l:
 `,
-			wantErrors:   []errors.Error{{text.Pos{Filename: "", Line: 2, Col: 6}, "Branch target too far away."}},
+			wantErrors:   []errors.Error{{Pos: text.Pos{Filename: "", Line: 2, Col: 6}, Msg: "Branch target too far away."}},
 			wantWarnings: []errors.Error{},
 		},
 	}
@@ -214,7 +214,7 @@ func TestAssembler_Incbin(t *testing.T) {
     .incbin "incbin.bin", 20
 	`,
 			wantBytes:  []byte{},
-			wantErrors: []errors.Error{{text.Pos{Filename: "", Line: 3, Col: 27}, "Skipping 20 bytes, but file only contains 10."}},
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 3, Col: 27}, Msg: "Skipping 20 bytes, but file only contains 10."}},
 		},
 		{
 			desc: "incbin with too large length",
@@ -223,7 +223,7 @@ func TestAssembler_Incbin(t *testing.T) {
 	.incbin "incbin.bin", 5, 10
 	`,
 			wantBytes:  []byte{},
-			wantErrors: []errors.Error{{text.Pos{Filename: "", Line: 3, Col: 27}, "Loading 10 bytes, but only 5 bytes available."}},
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 3, Col: 27}, Msg: "Loading 10 bytes, but only 5 bytes available."}},
 		},
 		{
 			desc: "incbin with non-existing file",
@@ -232,7 +232,7 @@ func TestAssembler_Incbin(t *testing.T) {
 	.incbin "doesnotexist.bin"
 	`,
 			wantBytes:  []byte{},
-			wantErrors: []errors.Error{{text.Pos{Filename: "", Line: 3, Col: 10}, "Can't find file \"doesnotexist.bin\" in include paths."}},
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 3, Col: 10}, Msg: "Can't find file \"doesnotexist.bin\" in include paths."}},
 		},
 	}
 
@@ -287,7 +287,7 @@ func TestAssembler_BadFloatConst(t *testing.T) {
 			text: `   .org 0
 	.float "foobar"
 `,
-			wantErrors:   []errors.Error{{text.Pos{Filename: "", Line: 2, Col: 9}, "Strings are not allowed"}},
+			wantErrors:   []errors.Error{{Pos: text.Pos{Filename: "", Line: 2, Col: 9}, Msg: "Strings are not allowed"}},
 			wantWarnings: []errors.Error{},
 		},
 	}
@@ -336,7 +336,7 @@ _l	.endm
 	if len(errs) != 1 {
 		t.Fatalf("Got %d, want 1 err", len(errs))
 	}
-	wantErr := errors.Error{text.Pos{Filename: "", Line: 4, Col: 1}, "Labels not allowed for .endm"}
+	wantErr := errors.Error{Pos: text.Pos{Filename: "", Line: 4, Col: 1}, Msg: "Labels not allowed for .endm"}
 	if errs[0] != wantErr {
 		t.Errorf("Got %+v, want %+v", errs[0], wantErr)
 	}
@@ -416,8 +416,8 @@ _l1   brk
 `,
 			want: []byte{},
 			wantErrors: []errors.Error{
-				{text.Pos{Filename: "", Line: 2, Col: 10}, "Undefined label \"l\""},
-				{text.Pos{Filename: "", Line: 3, Col: 10}, "Undefined label \"l\""},
+				{Pos: text.Pos{Filename: "", Line: 2, Col: 10}, Msg: "Undefined label \"l\""},
+				{Pos: text.Pos{Filename: "", Line: 3, Col: 10}, Msg: "Undefined label \"l\""},
 			},
 		},
 
@@ -601,6 +601,75 @@ _l0 nop
 `,
 			want: []byte{0x4c, 0x09, 0x00, 0x4c, 0x0a, 0x00, 0x4c, 0x0b, 0x00, 0xea},
 		},
+		{
+			name: "macros - conditionals are evaluated on instantiation",
+			text: ` .org 0
+m	.macro n
+	.if n > 1
+	.byte n
+	.endif
+	.endm
+	m 2
+	m 1
+`,
+			want: []byte{0x02},
+		},
+		{
+			name: "macros - recursion",
+			text: ` .org 0
+countdown	.macro n
+	.if n > 0
+	.byte n
+	countdown n-1
+	.endif
+	.endm
+	countdown 3
+`,
+			want: []byte{0x03, 0x02, 0x01},
+		},
+		{
+			name: "macros - variadic",
+			text: ` .org 0
+bytes	.macro first, ...
+	.byte first
+	.if .paramcount > 1
+	bytes ...
+	.endif
+	.endm
+words	.macro ...
+	.word ...
+	.endm
+	bytes 1, 2, 3
+	bytes 4
+	words $1234, $5678
+`,
+			want: []byte{0x01, 0x02, 0x03, 0x04, 0x34, 0x12, 0x78, 0x56},
+		},
+		{
+			name: "macros - default values",
+			text: ` .org 0
+m	.macro a, b = 2, c = a+1
+	.byte a, b, c, .paramcount
+	.endm
+	m 1
+	m 1, 5
+	m 1, 5, 9
+`,
+			want: []byte{0x01, 0x02, 0x02, 0x01, 0x01, 0x05, 0x02, 0x02, 0x01, 0x05, 0x09, 0x03},
+		},
+		{
+			name: "macros - nested definitions",
+			text: ` .org 0
+gen	.macro name, val
+name	.macro ...
+	.byte val, .paramcount, ...
+	.endm
+	.endm
+	gen foo, 7
+	foo 1, 2
+`,
+			want: []byte{0x07, 0x02, 0x01, 0x02},
+		},
 		{
 			name: "STx/LDx - use zero page addressing if possible",
 			text: ` .org 0
@@ -677,3 +746,341 @@ func toString(slice []byte) string {
 	return "[ " + strings.Join(parts, ", ") + " ]"
 
 }
+
+// assembleTest assembles src for the 6502 on a C64, and returns the generated bytes and the errors.
+func assembleTest(src string) ([]byte, []string) {
+	return assembleWith(New([]string{}, "6502", "c64", "plain", "petscii", []string{}), src)
+}
+
+// assembleWith assembles src with assembler, and returns the generated bytes and the errors, formatted as
+// "line <n>: <message>".
+func assembleWith(assembler *Assembler, src string) ([]byte, []string) {
+	assembler.Assemble(text.Process("main.asm", src))
+	var errs []string
+	for _, e := range assembler.Errors() {
+		errs = append(errs, fmt.Sprintf("line %d: %s", e.Pos.Line, e.Msg))
+	}
+	return assembler.GetBytes(), errs
+}
+
+func TestAssembler_Segments(t *testing.T) {
+	memoryMap := `
+; name  start  size
+ZP      $02    $10   bss
+CODE    $1000  $10
+DATA    $1010  $08
+SHARED  $1014  $08
+`
+	tests := []struct {
+		name       string
+		text       string
+		wantOrigin int
+		want       []byte
+		wantErrors []errors.Error
+	}{
+		{
+			name: "segments can be reopened",
+			text: `
+	.segment "CODE"
+start	lda ptr
+	.segment "ZP"
+ptr	.reserve 2
+	.segment "DATA"
+msg	.byte 1,2
+	.segment "ZP"
+tmp	.reserve 1
+	.segment "CODE"
+	ldx tmp
+	jmp msg
+`,
+			wantOrigin: 0x1000,
+			want: []byte{
+				0xa5, 0x02, // lda ptr
+				0xa6, 0x04, // ldx tmp
+				0x4c, 0x10, 0x10, // jmp msg
+				0, 0, 0, 0, 0, 0, 0, 0, 0, // gap up to DATA
+				0x01, 0x02, // msg
+			},
+		},
+		{
+			name: "unknown segment",
+			text: `
+	.segment "RODATA"
+`,
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 2, Col: 11}, Msg: "Segment \"RODATA\" is not defined in the memory map"}},
+		},
+		{
+			name: "overflow",
+			text: `
+	.segment "DATA"
+	.byte 1,2,3,4
+	.byte 5,6,7,8
+	.byte 9
+	.byte 10
+`,
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 5, Col: 1}, Msg: "Segment \"DATA\" overflows by 1 bytes"}},
+		},
+		{
+			name: "overlap",
+			text: `
+	.segment "DATA"
+	.byte 1,2,3,4,5,6
+	.segment "SHARED"
+	.byte 1
+`,
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 4, Col: 11}, Msg: "Overlap between segment \"DATA\" ($1010-$1015) and segment \"SHARED\" ($1014-$1014)"}},
+		},
+		{
+			name: "no .org in segments",
+			text: `
+	.segment "CODE"
+	.org $2000
+`,
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 3, Col: 2}, Msg: "Can't use .org in segment \"CODE\""}},
+		},
+		{
+			name: ".org after .endsegment",
+			text: `
+	.segment "DATA"
+	.byte 1
+	.endsegment
+	.org $101c
+	nop
+	.segment "DATA"
+	.byte 2
+`,
+			wantOrigin: 0x1010,
+			want: []byte{
+				0x01, 0x02, // DATA
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // gap up to $101c
+				0xea, // nop
+			},
+		},
+		{
+			name: ".endsegment without .segment",
+			text: `
+	.org $1000
+	.endsegment
+`,
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 3, Col: 2}, Msg: ".endsegment without .segment"}},
+		},
+	}
+
+	m, errs := ParseMemoryMap(text.Process("memory.map", memoryMap))
+	if len(errs) > 0 {
+		t.Fatalf("Can't parse memory map: %v", errs)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assembler := New([]string{}, "6502", "c128", "plain", "petscii", []string{})
+			assembler.SetMemoryMap(m)
+			assembler.Assemble(text.Process("", test.text))
+			errs := assembler.Errors()
+			if len(errs) != len(test.wantErrors) {
+				t.Fatalf("Got errors %v, want %v", errs, test.wantErrors)
+			}
+			for i := range errs {
+				if errs[i] != test.wantErrors[i] {
+					t.Errorf("Error %d: got %+v, want %+v", i+1, errs[i], test.wantErrors[i])
+				}
+			}
+			if len(test.wantErrors) > 0 {
+				return
+			}
+			if got := assembler.Origin(); got != test.wantOrigin {
+				t.Errorf("Got origin $%04x, want $%04x", got, test.wantOrigin)
+			}
+			if got := assembler.GetBytes(); !bytes.Equal(got, test.want) {
+				t.Errorf("Got %s, want %s", toString(got), toString(test.want))
+			}
+		})
+	}
+}
+
+func TestAssembler_MultiPass(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		want      []byte
+		wantError *errors.Error
+	}{
+		{
+			name: "forward references to zero page",
+			text: `
+	.org $1000
+	lda zp
+	sta zp+1,x
+	jmp end
+end	rts
+zp	.equ $fb
+`,
+			want: []byte{0xa5, 0xfb, 0x95, 0xfc, 0x4c, 0x07, 0x10, 0x60},
+		},
+		{
+			name: "forward references to absolute addresses",
+			text: `
+	.org $1000
+	lda data
+	jmp (vec)
+data	.equ $1234
+vec	.equ $0012
+`,
+			want: []byte{0xad, 0x34, 0x12, 0x6c, 0x12, 0x00},
+		},
+		{
+			name: "byte expressions",
+			text: `
+	.org $1000
+	lda #($1ff-$100)
+`,
+			want: []byte{0xa9, 0xff},
+		},
+		{
+			name: "unstable layout",
+			text: `
+	.org $fd
+	lda y
+l	nop
+y	.equ ($100-l)*$100
+`,
+			wantError: &errors.Error{Pos: text.Pos{Filename: "", Line: 3, Col: 6}, Msg: "Layout is not stable after 10 passes: the size of \"y\" keeps changing"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assembler := New([]string{}, "6502", "c128", "plain", "petscii", []string{})
+			assembler.Assemble(text.Process("", test.text))
+			errs := assembler.Errors()
+			if test.wantError != nil {
+				if len(errs) == 0 || errs[len(errs)-1] != *test.wantError {
+					t.Errorf("Got errors %v, want %v as last error", errs, *test.wantError)
+				}
+				return
+			}
+			if len(errs) > 0 {
+				t.Fatalf("Got errors %v, want none", errs)
+			}
+			if got := assembler.GetBytes(); !bytes.Equal(got, test.want) {
+				t.Errorf("Got %s, want %s", toString(got), toString(test.want))
+			}
+		})
+	}
+}
+
+func TestAssembler_ErrorsInNestedMacros(t *testing.T) {
+	src := `	.org $1000
+inner	.macro
+	.byte 300
+	.endm
+outer	.macro
+	inner
+	.endm
+	outer
+`
+	assembler := New([]string{}, "6502", "c128", "plain", "petscii", []string{})
+	assembler.Assemble(text.Process("main.asm", src))
+	errs := assembler.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("Got errors %v, want 1", errs)
+	}
+	want := []errors.Frame{
+		{Macro: "outer", Call: text.Pos{Filename: "main.asm", Line: 8, Col: 2}, Line: 1},
+		{Macro: "inner", Call: text.Pos{Filename: "main.asm", Line: 6, Col: 2}, Line: 1},
+	}
+	got := errs[0].Expansion.Frames()
+	for i := range got {
+		got[i].Caller = nil
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got expansions %+v, want %+v", got, want)
+	}
+	wantStr := `main.asm, line 3, col 8: Value out of range.
+  in macro inner, line 1, called from main.asm, line 6
+  in macro outer, line 1, called from main.asm, line 8`
+	if got, want := errs[0].String(), wantStr; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestAssembler_ErrorsInRecursiveMacros(t *testing.T) {
+	src := `	.org 0
+m	.macro
+	m
+	.endm
+	m
+`
+	assembler := New([]string{}, "6502", "c64", "plain", "petscii", []string{})
+	assembler.Assemble(text.Process("main.asm", src))
+	errs := assembler.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("Got errors %v, want 1", errs)
+	}
+	wantStr := fmt.Sprintf(`main.asm, line 3, col 2: Macro calls are nested more than %d levels deep
+  in macro m, line 1, called from main.asm, line 3 (%d more times)
+  in macro m, line 1, called from main.asm, line 5`, maxMacroDepth, maxMacroDepth-2)
+	if got, want := errs[0].String(), wantStr; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestAssembler_MacroErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "wrong number of arguments",
+			src: `	.org 0
+fixed	.macro a, b
+	.endm
+opt	.macro a, b = 1
+	.endm
+var	.macro a, ...
+	.endm
+	fixed 1
+	opt
+	opt 1, 2, 3
+	var
+`,
+			want: []string{
+				"line 8: Wrong number of arguments: 2 expected, 1 found",
+				"line 9: Wrong number of arguments: 1 to 2 expected, 0 found",
+				"line 10: Wrong number of arguments: 1 to 2 expected, 3 found",
+				"line 11: Wrong number of arguments: at least 1 expected, 0 found",
+			},
+		},
+		{
+			name: "invalid parameter lists",
+			src: `	.org 0
+m1	.macro ..., a
+	.endm
+m2	.macro a = 1, b
+	.endm
+`,
+			want: []string{
+				"line 2: '...' must be the last parameter",
+				"line 4: Parameter b needs a default value, because the parameters before it have one",
+			},
+		},
+		{
+			name: "endless recursion",
+			src: `	.org 0
+m	.macro
+	m
+	.endm
+	m
+`,
+			want: []string{fmt.Sprintf("line 3: Macro calls are nested more than %d levels deep", maxMacroDepth)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs := assembleTest(tt.src)
+			if !reflect.DeepEqual(errs, tt.want) {
+				t.Errorf("Got errors %q, want %q", errs, tt.want)
+			}
+		})
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"testing"
 
+	"github.com/asig/cbmasm/pkg/errors"
 	"github.com/asig/cbmasm/pkg/text"
 )
 
@@ -1080,3 +1081,109 @@ foo: NOP
 		})
 	}
 }
+
+func TestAssembler_assembleZ80Undocumented(t *testing.T) {
+	tests := []struct {
+		name       string
+		cpu        string
+		text       string
+		want       []byte
+		wantErrors []errors.Error
+	}{
+		{
+			name: "Half index registers",
+			cpu:  "z80ill",
+			text: `
+	ld ixh,b
+	ld a,iyl
+	ld ixl,$12
+	ld ixh,ixl
+	inc iyh
+	dec ixl
+	add a,ixh
+	sbc a,iyl
+	cp ixl
+	xor iyh
+`,
+			want: []byte{
+				0xdd, 0x60, // ld ixh,b
+				0xfd, 0x7d, // ld a,iyl
+				0xdd, 0x2e, 0x12, // ld ixl,$12
+				0xdd, 0x65, // ld ixh,ixl
+				0xfd, 0x24, // inc iyh
+				0xdd, 0x2d, // dec ixl
+				0xdd, 0x84, // add a,ixh
+				0xfd, 0x9d, // sbc a,iyl
+				0xdd, 0xbd, // cp ixl
+				0xfd, 0xac, // xor iyh
+			},
+		},
+		{
+			name: "SLL and results in registers",
+			cpu:  "z80ill",
+			text: `
+	sll b
+	sl1 (hl)
+	sll (ix+$12)
+	rlc (ix+$12),b
+	srl (iy-$12),a
+	res 3,(ix+$12),c
+	set 7,(iy+1),l
+`,
+			want: []byte{
+				0xcb, 0x30, // sll b
+				0xcb, 0x36, // sl1 (hl)
+				0xdd, 0xcb, 0x12, 0x36, // sll (ix+$12)
+				0xdd, 0xcb, 0x12, 0x00, // rlc (ix+$12),b
+				0xfd, 0xcb, 0xee, 0x3f, // srl (iy-$12),a
+				0xdd, 0xcb, 0x12, 0x99, // res 3,(ix+$12),c
+				0xfd, 0xcb, 0x01, 0xfd, // set 7,(iy+1),l
+			},
+		},
+		{
+			name: "IN (C) and OUT (C),0",
+			cpu:  "z80ill",
+			text: `
+	in (c)
+	out (c),0
+`,
+			want: []byte{0xed, 0x70, 0xed, 0x71},
+		},
+		{
+			name:       "OUT (C) only supports 0",
+			cpu:        "z80ill",
+			text:       "out (c),1",
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 2, Col: 10}, Msg: "Only 0 can be written with OUT (C)"}},
+		},
+		{
+			name:       "Undocumented instructions need to be enabled",
+			cpu:        "z80",
+			text:       "sll b",
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "", Line: 2, Col: 2}, Msg: "sll is not a valid mnemonic"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := " .org 0\n " + test.text
+			assembler := New([]string{}, test.cpu, "c128", "plain", "petscii", []string{})
+			assembler.Assemble(text.Process("", src))
+			errs := assembler.Errors()
+			if len(errs) != len(test.wantErrors) {
+				t.Fatalf("Got %+v, want %+v", errs, test.wantErrors)
+			}
+			for i := range errs {
+				if errs[i] != test.wantErrors[i] {
+					t.Errorf("Error %d: got %+v, want %+v", i+1, errs[i], test.wantErrors[i])
+				}
+			}
+			if len(test.wantErrors) > 0 {
+				return
+			}
+			got := assembler.GetBytes()
+			if bytes.Compare(got, test.want) != 0 {
+				t.Errorf("Got %s, want %s", toString(got), toString(test.want))
+			}
+		})
+	}
+}
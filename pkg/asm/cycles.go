@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"fmt"
+
+	"github.com/asig/cbmasm/pkg/asm/mos6502"
+	"github.com/asig/cbmasm/pkg/asm/z80"
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/scanner"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// Cycles is the range of cycles (T-states on the Z80) code can take. Max is larger than Min if the code
+// contains branches, page crossings, or repeating block instructions.
+type Cycles struct {
+	Min, Max int
+}
+
+func (c Cycles) add(o Cycles) Cycles {
+	return Cycles{Min: c.Min + o.Min, Max: c.Max + o.Max}
+}
+
+// String returns the cycles of a single instruction, with the additional cycles it takes in the worst case,
+// e.g. "2+2" for a branch.
+func (c Cycles) String() string {
+	if c.Max > c.Min {
+		return fmt.Sprintf("%d+%d", c.Min, c.Max-c.Min)
+	}
+	return fmt.Sprintf("%d", c.Min)
+}
+
+// RangeString returns the cycles as "min-max", or just the number if both are the same.
+func (c Cycles) RangeString() string {
+	if c.Max > c.Min {
+		return fmt.Sprintf("%d-%d", c.Min, c.Max)
+	}
+	return fmt.Sprintf("%d", c.Min)
+}
+
+// CycleReport contains the cycles of the code between ".cycles_begin" and ".cycles_end".
+type CycleReport struct {
+	Begin, End text.Pos
+	Cycles     Cycles
+}
+
+func (r CycleReport) String() string {
+	return fmt.Sprintf("%s, lines %d-%d: %s cycles", r.Begin.Filename, r.Begin.Line, r.End.Line, r.Cycles.RangeString())
+}
+
+type cycleBlock struct {
+	pos    text.Pos
+	cycles Cycles
+}
+
+// addCycles adds the cycles of the current line's instruction to the running totals.
+func (a *Assembler) addCycles(c Cycles) {
+	a.lineCycles = &c
+	a.labelCycles = a.labelCycles.add(c)
+	for _, b := range a.cycleBlocks {
+		b.cycles = b.cycles.add(c)
+	}
+}
+
+// add6502Cycles adds the cycles of a 6502 instruction with the operand val, which is emitted already. Timings are only
+// known for the NMOS 6502/6510.
+func (a *Assembler) add6502Cycles(mnemonic string, mode mos6502.AddressingMode, val expr.Node) {
+	if a.currentCPU != "6502" && a.currentCPU != "6510ill" {
+		return
+	}
+	t, found := mos6502.InstructionTiming(mnemonic, mode)
+	if !found {
+		return
+	}
+	c := Cycles{Min: t.Cycles, Max: t.Cycles}
+	if t.PageCross {
+		c.Max++
+	}
+	if t.Branch {
+		// A taken branch takes one more cycle, and another one if the target is on a different page than the next
+		// instruction. The page is only known if the target is.
+		c.Max++
+		if val == nil || !val.IsResolved() || a.section.relocatable || val.Eval()&0xff00 != a.section.PC()&0xff00 {
+			c.Max++
+		}
+	}
+	a.addCycles(c)
+}
+
+// addZ80Cycles adds the cycles of the Z80 instruction with the given bytes.
+func (a *Assembler) addZ80Cycles(bytes []expr.Node) {
+	var code []byte
+	for _, n := range bytes {
+		if !n.IsResolved() {
+			// Only operands can be unresolved, and they don't affect the timing
+			code = append(code, 0)
+			continue
+		}
+		code = append(code, byte(n.Eval()))
+	}
+	t, found := z80.InstructionTiming(code)
+	if !found {
+		return
+	}
+	c := Cycles{Min: t.Cycles, Max: t.Cycles}
+	if t.Taken > c.Max {
+		c.Max = t.Taken
+	}
+	a.addCycles(c)
+}
+
+func (a *Assembler) handleCyclesBegin(t scanner.Token) {
+	a.nextToken()
+	a.cycleBlocks = append(a.cycleBlocks, &cycleBlock{pos: t.Pos})
+}
+
+func (a *Assembler) handleCyclesEnd(t scanner.Token) {
+	a.nextToken()
+	if len(a.cycleBlocks) == 0 {
+		a.AddError(t.Pos, ".cycles_end without .cycles_begin")
+		return
+	}
+	b := a.cycleBlocks[len(a.cycleBlocks)-1]
+	a.cycleBlocks = a.cycleBlocks[:len(a.cycleBlocks)-1]
+	a.cycleReports = append(a.cycleReports, CycleReport{Begin: b.pos, End: t.Pos, Cycles: b.cycles})
+}
+
+// finishCycleBlocks is called after assembly and reports blocks that were not closed.
+func (a *Assembler) finishCycleBlocks() {
+	for _, b := range a.cycleBlocks {
+		a.AddError(b.pos, ".cycles_end expected")
+	}
+}
+
+// CycleReports returns the cycles of all blocks between ".cycles_begin" and ".cycles_end", in the order the
+// blocks end.
+func (a *Assembler) CycleReports() []CycleReport {
+	return a.cycleReports
+}
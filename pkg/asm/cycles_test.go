@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+func TestAssembler_Cycles(t *testing.T) {
+	tests := []struct {
+		name    string
+		cpu     string
+		src     string
+		cycles  []string // Cycles of all lines with an instruction
+		totals  []string
+		reports []CycleReport
+	}{
+		{
+			name: "6502",
+			cpu:  "6502",
+			src: `	.org $1000
+start	ldx #3
+	.cycles_begin
+loop	lda $2000,x
+	sta $d020
+	dex
+	bne loop
+	.cycles_end
+	rts
+`,
+			cycles: []string{"2", "4+1", "4", "2", "2+1", "6"},
+			totals: []string{"2", "4-5", "8-9", "10-11", "12-14", "18-20"},
+			reports: []CycleReport{
+				{
+					Begin:  text.Pos{Filename: "main.asm", Line: 3, Col: 2},
+					End:    text.Pos{Filename: "main.asm", Line: 8, Col: 2},
+					Cycles: Cycles{Min: 12, Max: 14},
+				},
+			},
+		},
+		{
+			name: "6502 branches",
+			cpu:  "6502",
+			src: `	.org $10fc
+back	beq back
+	bne next
+	nop
+next	bcc back
+	rts
+`,
+			// The branch to a forward reference might cross a page
+			cycles: []string{"2+1", "2+2", "2", "2+2", "6"},
+			totals: []string{"2-3", "4-7", "6-9", "2-4", "8-10"},
+		},
+		{
+			name: "65c02 has no timing",
+			cpu:  "65c02",
+			src: `	.org $1000
+	lda #1
+`,
+		},
+		{
+			name: "z80",
+			cpu:  "z80",
+			src: `	.org $1000
+	.cycles_begin
+	ld b, 10
+	.cycles_begin
+loop	ld (ix+fwd), a
+	djnz loop
+	.cycles_end
+	ldir
+	.cycles_end
+fwd	.equ 1
+`,
+			cycles: []string{"7", "19", "8+5", "16+5"},
+			totals: []string{"7", "19", "27-32", "43-53"},
+			reports: []CycleReport{
+				{
+					Begin:  text.Pos{Filename: "main.asm", Line: 4, Col: 2},
+					End:    text.Pos{Filename: "main.asm", Line: 7, Col: 2},
+					Cycles: Cycles{Min: 27, Max: 32},
+				},
+				{
+					Begin:  text.Pos{Filename: "main.asm", Line: 2, Col: 2},
+					End:    text.Pos{Filename: "main.asm", Line: 9, Col: 2},
+					Cycles: Cycles{Min: 50, Max: 60},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			platform := "c64"
+			if tt.cpu == "z80" {
+				platform = "c128"
+			} else if tt.cpu == "65c02" {
+				platform = "generic"
+			}
+			assembler := New([]string{}, tt.cpu, platform, "plain", "petscii", []string{})
+			assembler.Assemble(text.Process("main.asm", tt.src))
+			if errs := assembler.Errors(); len(errs) > 0 {
+				t.Fatalf("Got errors %v, want none", errs)
+			}
+			var cycles, totals []string
+			for _, l := range assembler.ListingLines {
+				if l.Cycles != nil {
+					cycles = append(cycles, l.Cycles.String())
+					totals = append(totals, l.Total.RangeString())
+				}
+			}
+			if !reflect.DeepEqual(cycles, tt.cycles) {
+				t.Errorf("Got cycles %v, want %v", cycles, tt.cycles)
+			}
+			if !reflect.DeepEqual(totals, tt.totals) {
+				t.Errorf("Got totals %v, want %v", totals, tt.totals)
+			}
+			if got := assembler.CycleReports(); !reflect.DeepEqual(got, tt.reports) {
+				t.Errorf("Got reports %v, want %v", got, tt.reports)
+			}
+		})
+	}
+}
+
+func TestAssembler_CyclesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "unclosed",
+			src:  "\t.cycles_begin\n\tnop\n",
+			want: []string{".cycles_end expected"},
+		},
+		{
+			name: "end without begin",
+			src:  "\tnop\n\t.cycles_end\n",
+			want: []string{".cycles_end without .cycles_begin"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assembler := New([]string{}, "6502", "c64", "plain", "petscii", []string{})
+			assembler.Assemble(text.Process("main.asm", tt.src))
+			var got []string
+			for _, e := range assembler.Errors() {
+				got = append(got, e.Msg)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Got errors %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
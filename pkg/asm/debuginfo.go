@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"github.com/asig/cbmasm/pkg/debuginfo"
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// scope is the range in which local labels are visible. A scope starts at a global label.
+type scope struct {
+	name       string
+	pos        text.Pos
+	start, end int // end is -1 as long as the scope is open
+}
+
+func (a *Assembler) openScope(pos text.Pos, name string) {
+	a.closeScope()
+	a.scopes = append(a.scopes, scope{name: name, pos: pos, start: a.section.PC(), end: -1})
+}
+
+func (a *Assembler) closeScope() {
+	if len(a.scopes) == 0 {
+		return
+	}
+	s := &a.scopes[len(a.scopes)-1]
+	if s.end < 0 {
+		s.end = a.section.PC()
+	}
+}
+
+// DebugInfo returns the debug information for the assembled code.
+func (a *Assembler) DebugInfo() *debuginfo.Info {
+	info := &debuginfo.Info{Version: debuginfo.Version}
+	fileIndices := make(map[string]int)
+	fileIndex := func(filename string) int {
+		if i, found := fileIndices[filename]; found {
+			return i
+		}
+		i := len(info.Files)
+		info.Files = append(info.Files, filename)
+		fileIndices[filename] = i
+		return i
+	}
+
+	for _, l := range a.ListingLines {
+		if l.Bytes == 0 {
+			continue
+		}
+		line := debuginfo.Line{Addr: l.Addr, Size: l.Bytes, File: fileIndex(l.Line.Filename), Line: l.Line.LineNumber}
+		for _, p := range l.MacroCalls {
+			line.Macro = append(line.Macro, debuginfo.Location{File: fileIndex(p.Filename), Line: p.Line})
+		}
+		info.Lines = append(info.Lines, line)
+	}
+
+	for _, s := range a.scopes {
+		info.Scopes = append(info.Scopes, debuginfo.Scope{Name: s.name, Start: s.start, End: s.end, File: fileIndex(s.pos.Filename), Line: s.pos.Line})
+	}
+
+	for _, s := range a.definitions {
+		if s.kind == symbolMacro || !s.val.IsResolved() || s.val.Type() != expr.NodeType_Int {
+			continue
+		}
+		sym := debuginfo.Symbol{Name: s.name, Kind: s.kind.String(), Value: s.val.Eval(), Scope: s.scope}
+		if s.pos.Filename != "" || s.pos.Line > 0 {
+			sym.Pos = &debuginfo.Location{File: fileIndex(s.pos.Filename), Line: s.pos.Line}
+		}
+		info.Symbols = append(info.Symbols, sym)
+	}
+	return info
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/debuginfo"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+func TestAssembler_DebugInfo(t *testing.T) {
+	src := `
+	.org $1000
+inc16	.macro addr
+	inc addr
+	.endm
+start	ldx #count
+_l	inc16 $d020
+	dex
+	bne _l
+count	.equ 3
+end	rts
+`
+	assembler := New([]string{}, "6502", "c128", "plain", "petscii", []string{})
+	assembler.Assemble(text.Process("main.asm", src))
+	if errs := assembler.Errors(); len(errs) > 0 {
+		t.Fatalf("Got errors %v, want none", errs)
+	}
+
+	want := &debuginfo.Info{
+		Version: debuginfo.Version,
+		Files:   []string{"main.asm"},
+		Lines: []debuginfo.Line{
+			{Addr: 0x1000, Size: 2, File: 0, Line: 6},
+			{Addr: 0x1002, Size: 3, File: 0, Line: 4, Macro: []debuginfo.Location{{File: 0, Line: 7}}},
+			{Addr: 0x1005, Size: 1, File: 0, Line: 8},
+			{Addr: 0x1006, Size: 2, File: 0, Line: 9},
+			{Addr: 0x1008, Size: 1, File: 0, Line: 11},
+		},
+		Scopes: []debuginfo.Scope{
+			{Name: "start", Start: 0x1000, End: 0x1008, File: 0, Line: 6},
+			{Name: "end", Start: 0x1008, End: 0x1009, File: 0, Line: 11},
+		},
+		Symbols: []debuginfo.Symbol{
+			{Name: "start", Kind: "label", Value: 0x1000, Pos: &debuginfo.Location{File: 0, Line: 6}},
+			{Name: "_l", Kind: "label", Value: 0x1002, Scope: "start", Pos: &debuginfo.Location{File: 0, Line: 7}},
+			{Name: "count", Kind: "const", Value: 3, Pos: &debuginfo.Location{File: 0, Line: 10}},
+			{Name: "end", Kind: "label", Value: 0x1008, Pos: &debuginfo.Location{File: 0, Line: 11}},
+		},
+	}
+	got := assembler.DebugInfo()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+	if addrs := got.Addrs("main.asm", 4); !reflect.DeepEqual(addrs, []int{0x1002}) {
+		t.Errorf("Got addresses %v for line 4, want [$1002]", addrs)
+	}
+}
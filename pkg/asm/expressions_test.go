@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAssembler_Expressions(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		want   []byte
+		errors []string
+	}{
+		{
+			name: "shifts",
+			src: `	.org $1000
+	.byte 1 << 4, $80 >> 3, 1 << 2 + 1, 3 + 1 << 2, (-16 >> 2) & $ff
+	.word 1 << 15
+`,
+			want: []byte{16, 16, 5, 7, 0xfc, 0x00, 0x80},
+		},
+		{
+			name: "invalid shift counts",
+			src: `	.org $1000
+	.byte 1 << -1, 1 >> 64
+	.byte 1 << later, 1 >> (later - 7)
+later	.equ 6
+`,
+			errors: []string{
+				"line 2: Shift count must be between 0 and 63",
+				"line 2: Shift count must be between 0 and 63",
+				"line 3: Shift count must be between 0 and 63",
+			},
+		},
+		{
+			name: "comparisons",
+			src: `	.org $1000
+	.byte 1 < 2, 2 <= 1, 3 = 3, 3 == 4, 3 != 4, 1 + 2 > 2, 1.5 >= 1, "a" < "b"
+	.word 2 > 1.5
+`,
+			want: []byte{1, 0, 1, 0, 1, 1, 1, 1, 1, 0},
+		},
+		{
+			name: "logical operators",
+			src: `	.org $1000
+	.byte 1 && 2, 1 && 0, 0 || 3, 0 || 0, !0, !5, !!5
+	.byte 1 < 2 && 3 < 4 || 0, 1 || 1 && 0
+`,
+			want: []byte{1, 0, 1, 0, 1, 0, 1, 1, 1},
+		},
+		{
+			name: "unary operators",
+			src: `	.org $1000
+	.byte 10 - -2, ~$0f & $ff, -2 * 3 + 10
+`,
+			want: []byte{12, 0xf0, 4},
+		},
+		{
+			name: "leading minus negates the first term",
+			src: `	.org $1000
+	.byte -1 & 3 + 10, -1 ^ 3 + 10, -5 >> 1 + 10, $ff & -1
+`,
+			want: []byte{9, 8, 8, 0xff},
+		},
+		{
+			name: "conditional",
+			src: `	.org $1000
+	.byte 1 ? 2 : 3, 0 ? 2 : 3, 0 ? 1 : 0 ? 2 : 4, (1 < 2 ? 10 : 20) + 1
+`,
+			want: []byte{2, 3, 4, 11},
+		},
+		{
+			name: "forward references",
+			src: `	.org $1000
+	.byte later << 1, later >= 4 && later < 8, later > 4 ? $10 : $20, !later
+later	.equ 5
+`,
+			want: []byte{10, 1, 0x10, 0},
+		},
+		{
+			name: "comparisons in conditions",
+			src: `	.org $1000
+	.if "abc" == "abc" && 1 << 3 == 8
+	nop
+	.endif
+	.if !("abc" = "abc")
+	brk
+	.endif
+`,
+			want: []byte{0xea},
+		},
+		{
+			name: "type errors",
+			src: `	.org $1000
+	.byte 1.5 << 1
+	.byte "a" && 1
+	.byte 1 ? "a" : 2
+	.byte !1.5
+`,
+			errors: []string{
+				"line 2: operation only supported on int type",
+				"line 3: operation only supported on numeric types",
+				"line 4: types don't match",
+				"line 5: operation only supported on int type",
+			},
+		},
+		{
+			name: "division by zero",
+			src: `	.org $1000
+	.byte 1 / 0, 5 % (2 - 2)
+	.byte 1.5 / 0
+`,
+			errors: []string{
+				"line 2: Division by zero",
+				"line 2: Division by zero",
+				"line 3: Division by zero",
+			},
+		},
+		{
+			name: "division by a forward reference to zero",
+			src: `	.org $1000
+	.byte 1 / zero, 5 % (one - 1), -(2 / zero) + 3
+	lda #quot
+quot	.equ 4 / zero
+zero	.equ 0
+one	.equ 1
+`,
+			errors: []string{
+				"line 2: Division by zero",
+				"line 2: Division by zero",
+				"line 4: Division by zero",
+				"line 2: Division by zero",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := assembleTest(tt.src)
+			if !reflect.DeepEqual(errs, tt.errors) {
+				t.Errorf("Got errors %q, want %q", errs, tt.errors)
+			}
+			if tt.errors != nil {
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Got %s, want %s", toString(got), toString(tt.want))
+			}
+		})
+	}
+}
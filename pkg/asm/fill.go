@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"math"
+
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/scanner"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// defaultFillVariable is the index variable of ".fill" and ".fillword" if none is given.
+const defaultFillVariable = "i"
+
+// handleFill assembles ".fill" and ".fillword". The expression is parsed once per index, with the index variable
+// replaced by the index, like the variable of a ".rept" loop.
+func (a *Assembler) handleFill(t scanner.Token) {
+	// fill := (".fill" | ".fillword") expr ["," ident] "," expr .
+	a.nextToken()
+	size := 1
+	if t.Type == scanner.Fillword {
+		size = 2
+	}
+	errs := len(a.errors)
+	count, ok := a.resolvedInt()
+	switch {
+	case len(a.errors) > errs:
+		// E.g. a constant that is too wide
+		ok = false
+	case ok && count < 0:
+		a.AddError(t.Pos, "Count must not be negative")
+		ok = false
+	case ok && !checkSize(2, count):
+		// Like .reserve, don't fill more than the address space
+		a.AddError(t.Pos, "Count $%x (decimal %d) is wider than 16 bits", count, count)
+		ok = false
+	}
+	a.match(scanner.Comma)
+	variable := defaultFillVariable
+	if a.lookahead.Type == scanner.Ident {
+		ident := a.lookahead
+		a.nextToken()
+		if a.lookahead.Type == scanner.Comma {
+			variable = ident.StrVal
+			a.nextToken()
+		} else {
+			a.pushToken()
+			a.lookahead = ident
+		}
+	}
+
+	line := *a.scanner.Line()
+	line.Runes = append([]rune{}, line.Runes...)
+	for i := 0; i < a.lookahead.Pos.Col-1; i++ {
+		line.Runes[i] = ' '
+	}
+	body := &macro{name: t.Type.String(), pos: t.Pos, text: &text.Text{Lines: []text.Line{line}}}
+	body.addParam(variable)
+
+	// Scan until we're at EOL, the expression is parsed below
+	for a.lookahead.Type != scanner.Eol && a.lookahead.Type != scanner.Semicolon {
+		a.nextToken()
+	}
+	if !ok {
+		return
+	}
+	for i := 0; i < count; i++ {
+		errs := len(a.errors)
+		a.emit(a.fillValue(body, i, size))
+		if len(a.errors) > errs {
+			// Don't report the same error for every index
+			return
+		}
+	}
+}
+
+// fillValue parses the expression of ".fill" or ".fillword" for an index. Floats are rounded to the nearest integer.
+func (a *Assembler) fillValue(body *macro, index int, size int) expr.Node {
+	savedScanner, savedLookahead := a.scanner, a.lookahead
+	savedTokenBuf, savedTokenBufSet := a.tokenBuf, a.tokenBufSet
+	defer func() {
+		a.scanner, a.lookahead = savedScanner, savedLookahead
+		a.tokenBuf, a.tokenBufSet = savedTokenBuf, savedTokenBufSet
+	}()
+	a.beginLine(body.replaceParams([]string{loopValue(index)})[0])
+	n := a.expr(size, false)
+	a.matchEol()
+	if n.Type() == expr.NodeType_Float {
+		if !n.IsResolved() {
+			a.AddError(n.Pos(), "Can't emit unresolved float")
+			return expr.NewConst(n.Pos(), 0, size)
+		}
+		n = expr.NewConst(n.Pos(), int(math.Round(n.EvalFloat())), size)
+	}
+	// Values can be signed or unsigned
+	n.ForceSize(size)
+	n.SetRange(-1<<(size*8-1), 1<<(size*8)-1)
+	return n
+}
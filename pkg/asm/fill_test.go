@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAssembler_Fill(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		want   []byte
+		errors []string
+	}{
+		{
+			name: "default index variable",
+			src: `	.org $1000
+	.fill 4, i * 3
+	.fill 2, $ea
+`,
+			want: []byte{0, 3, 6, 9, 0xea, 0xea},
+		},
+		{
+			name: "named index variable",
+			src: `	.org $1000
+	.fill 3, row, row * 40 + 1 ; comment
+`,
+			want: []byte{1, 41, 81},
+		},
+		{
+			name: "words",
+			src: `	.org $1000
+	.fillword 3, row, $0400 + row * 40
+`,
+			want: []byte{0x00, 0x04, 0x28, 0x04, 0x50, 0x04},
+		},
+		{
+			name: "floats are rounded",
+			src: `	.org $1000
+	.fill 4, 127.5 + 127.5 * sin(i * 3.14159265 / 2)
+	.fill 3, i * 0.5
+	.fill 2, -1.6 + i
+`,
+			want: []byte{128, 255, 128, 0, 0, 1, 1, 0xfe, 0xff},
+		},
+		{
+			name: "forward references",
+			src: `	.org $1000
+	.fill 3, lo(table) + i
+table	.fillword 2, hi(table) * i
+`,
+			want: []byte{0x03, 0x04, 0x05, 0x00, 0x00, 0x10, 0x00},
+		},
+		{
+			name: "count of 0",
+			src: `	.org $1000
+	.fill 0, i
+	nop
+`,
+			want: []byte{0xea},
+		},
+		{
+			name: "range errors are reported once",
+			src: `	.org $1000
+	.fill 200, i * 2
+	.fillword 2, -40000 + i
+	.fill 2, -129.0
+`,
+			errors: []string{
+				"line 2: Value out of range.",
+				"line 3: Value out of range.",
+				"line 4: Value out of range.",
+			},
+		},
+		{
+			name: "other errors",
+			src: `	.org $1000
+	.fill later, i
+	.fill -1, i
+	.fill 2, "ab"
+	.fill 2, i i
+	.fill 100000000, 0
+	.fill 1000 * 1000, 0
+later	.equ 2
+`,
+			errors: []string{
+				"line 2: Expression is not resolved",
+				"line 3: Count must not be negative",
+				"line 4: Strings are not allowed",
+				"line 5: ';' or EOL expected",
+				"line 6: Constant $5f5e100 (decimal 100000000) is wider than 16 bits",
+				"line 7: Count $f4240 (decimal 1000000) is wider than 16 bits",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := assembleTest(tt.src)
+			if !reflect.DeepEqual(errs, tt.errors) {
+				t.Errorf("Got errors %q, want %q", errs, tt.errors)
+			}
+			if tt.errors != nil {
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Got %s, want %s", toString(got), toString(tt.want))
+			}
+		})
+	}
+}
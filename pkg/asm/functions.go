@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/scanner"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// builtin parses the arguments of a call of a built-in function, and returns the node for the call. The function's
+// name is already consumed, and the lookahead is the opening parenthesis.
+type builtin func(a *Assembler, p text.Pos, size int, stringsAllowed bool) expr.Node
+
+// builtins are the functions that can be called in expressions, indexed by their lower-case name. The map is filled
+// in init() because the functions parse expressions themselves.
+var builtins map[string]builtin
+
+func init() {
+	builtins = map[string]builtin{
+		"scr":     (*Assembler).callScr,
+		"defined": (*Assembler).callDefined,
+		"sizeof":  (*Assembler).callSizeof,
+	}
+	for _, fn := range expr.Functions {
+		builtins[fn.Name] = callFunction(fn)
+	}
+}
+
+// callFunction returns the builtin for fn.
+func callFunction(fn *expr.Function) builtin {
+	return func(a *Assembler, p text.Pos, size int, stringsAllowed bool) expr.Node {
+		// fn "(" expr {"," expr} ")"
+		a.match(scanner.LParen)
+		var args []expr.Node
+		if a.lookahead.Type != scanner.RParen {
+			args = append(args, a.expr(2, true))
+			for a.lookahead.Type == scanner.Comma {
+				a.nextToken()
+				args = append(args, a.expr(2, true))
+			}
+		}
+		a.match(scanner.RParen)
+		if msg := fn.Check(args); msg != "" {
+			a.AddError(p, "%s", msg)
+			return expr.NewConst(p, 0, size)
+		}
+		node := expr.NewCall(p, fn, args)
+		if node.Type() != expr.NodeType_String {
+			if node.ResultSize() > size {
+				// Like constants, the result is not wider than the context requires
+				node.ForceSize(size)
+			}
+			return node
+		}
+		if !stringsAllowed {
+			a.AddError(p, "Strings are not allowed")
+			return expr.NewConst(p, 0, size)
+		}
+		for _, arg := range args {
+			if arg.Type() == expr.NodeType_String {
+				// The string arguments are encoded already
+				return node
+			}
+		}
+		// Text that is computed from numbers still needs to be encoded
+		return expr.NewUnaryOp(p, node, a.currentEncoding)
+	}
+}
+
+// callScr converts a character or string to screen codes.
+func (a *Assembler) callScr(p text.Pos, size int, stringsAllowed bool) expr.Node {
+	// "scr" "(" expr ")"
+	a.match(scanner.LParen)
+	n := a.expr(size, stringsAllowed)
+	n = expr.NewUnaryOp(n.Pos(), n, expr.ScreenCode)
+	a.match(scanner.RParen)
+	return n
+}
+
+// callDefined returns 1 if the symbol is defined at this point, and 0 otherwise.
+func (a *Assembler) callDefined(p text.Pos, size int, _ bool) expr.Node {
+	// "defined" "(" ["::"] ident {"::" ident} ")"
+	a.match(scanner.LParen)
+	prefix := ""
+	if a.lookahead.Type == scanner.DoubleColon {
+		prefix = "::"
+		a.nextToken()
+	}
+	sym := a.lookahead.StrVal
+	a.match(scanner.Ident)
+	name := prefix + a.qualifiedName(sym)
+	a.match(scanner.RParen)
+	_, qualified, found := a.lookupSymbol(name)
+	if !found {
+		return expr.NewConst(p, 0, size)
+	}
+	a.addReference(p, qualified)
+	return expr.NewConst(p, 1, size)
+}
+
+// callSizeof returns the size of a struct, or of a segment in the memory map.
+func (a *Assembler) callSizeof(p text.Pos, size int, _ bool) expr.Node {
+	// "sizeof" "(" (string | ["::"] ident {"::" ident}) ")"
+	a.match(scanner.LParen)
+	defer a.match(scanner.RParen)
+	switch a.lookahead.Type {
+	case scanner.String:
+		name := a.lookahead.StrVal
+		a.nextToken()
+		def, found := a.memoryMap.find(name)
+		if !found {
+			a.AddError(p, "Segment %q is not defined in the memory map", name)
+			return expr.NewConst(p, 0, size)
+		}
+		return expr.NewConst(p, def.Size, size)
+	case scanner.DoubleColon:
+		a.nextToken()
+		sym := a.lookahead.StrVal
+		a.match(scanner.Ident)
+		return a.symbolNode(p, "::"+a.qualifiedName(sym)+".size", size, false)
+	default:
+		sym := a.lookahead.StrVal
+		a.match(scanner.Ident)
+		return a.symbolNode(p, a.qualifiedName(sym)+".size", size, false)
+	}
+}
+
+// isBuiltinCall returns whether sym, followed by the lookahead, starts a call of a built-in function.
+func (a *Assembler) isBuiltinCall(sym string) bool {
+	_, found := builtins[strings.ToLower(sym)]
+	return found && a.lookahead.Type == scanner.LParen
+}
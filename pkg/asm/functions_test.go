@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+func TestAssembler_Functions(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		memoryMap string
+		want      []byte
+		errors    []string
+	}{
+		{
+			name: "lo, hi, and bank",
+			src: `	.org $1000
+	.byte lo($1234), hi($1234), bank($1234 << 8), LO(label), hi(label)
+	lda #hi(label + $100)
+label	.equ $abcd
+`,
+			want: []byte{0x34, 0x12, 0x12, 0xcd, 0xab, 0xa9, 0xac},
+		},
+		{
+			name: "min, max, and abs",
+			src: `	.org $1000
+	.byte min(3, 1, 2), max(3, 1, 2), abs(-5), abs(5), min(later, 10), max(-1, -2) & $ff
+	.word max(later, $1000)
+later	.equ 7
+`,
+			want: []byte{1, 3, 5, 5, 7, 0xff, 0x00, 0x10},
+		},
+		{
+			name: "strings",
+			src: `	.org $1000
+	.byte strlen("hello"), strlen("")
+	.byte substr("hello", 1, 3), substr("hello", 3), substr("hello", 4, 10)
+`,
+			want: []byte{5, 0, 0x45, 0x4c, 0x4c, 0x4c, 0x4f, 0x4f},
+		},
+		{
+			name: "defined",
+			src: `	.org $1000
+early	.equ 1
+	.byte defined(early), defined(late), defined(player::x)
+late	.equ 2
+	.scope player
+x	.equ 3
+	.endscope
+	.if defined(player::x) && !defined(missing)
+	nop
+	.endif
+`,
+			want: []byte{1, 0, 0, 0xea},
+		},
+		{
+			name: "sizeof",
+			src: `	.org $1000
+	.byte sizeof(point), sizeof("DATA")
+	.struct point
+x	.word
+y	.word
+	.endstruct
+`,
+			memoryMap: `DATA $2000 $80`,
+			want:      []byte{4, 0x80},
+		},
+		{
+			name: "sin and cos",
+			src: `	.org $1000
+	.byte sin(0) == 0, cos(0) == 1, sin(1) == sin(1.0), cos(3.1415926) < -0.99
+`,
+			want: []byte{1, 1, 1, 1},
+		},
+		{
+			name: "results are as wide as the context",
+			src: `	.org $1000
+	.byte max(10, $1234) & $ff, strlen(substr("abcdef", later, 2)), abs(later - 300) - 280
+	nop
+later	.equ 2
+`,
+			want: []byte{0x34, 2, 18, 0xea},
+		},
+		{
+			name: "unresolved strings",
+			src: `	.org $1000
+	.byte substr("abc", later)
+later	.equ 1
+`,
+			errors: []string{"line 2: Can't emit unresolved string"},
+		},
+		{
+			name: "symbols named like functions",
+			src: `	.org $1000
+min	.equ 2
+	.byte min, min(min, 5)
+`,
+			want: []byte{2, 2},
+		},
+		{
+			name: "errors",
+			src: `	.org $1000
+	.byte lo(1, 2)
+	.byte min()
+	.byte substr("a")
+	.byte strlen(1)
+	.byte hi("a")
+	.byte sizeof("NOPE")
+	.byte sizeof(missing)
+	.word substr("ab", 0)
+`,
+			errors: []string{
+				"line 2: lo() expects 1 argument(s), found 2",
+				"line 3: min() expects at least 1 argument(s), found 0",
+				"line 4: substr() expects 2 to 3 arguments, found 1",
+				"line 5: Argument must be of type string",
+				"line 6: Arguments must be of type integer",
+				"line 7: Segment \"NOPE\" is not defined in the memory map",
+				"line 9: Strings are not allowed",
+				"line 8: Undefined label \"missing.size\"",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assembler := New([]string{}, "6502", "c64", "plain", "petscii", []string{})
+			if tt.memoryMap != "" {
+				m, errs := ParseMemoryMap(text.Process("memory.map", tt.memoryMap))
+				if len(errs) > 0 {
+					t.Fatalf("Can't parse memory map: %v", errs)
+				}
+				assembler.SetMemoryMap(m)
+			}
+			got, errs := assembleWith(assembler, tt.src)
+			if !reflect.DeepEqual(errs, tt.errors) {
+				t.Errorf("Got errors %q, want %q", errs, tt.errors)
+			}
+			if tt.errors != nil {
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Got %s, want %s", toString(got), toString(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/errors"
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/obj"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// Linker combines object files into a single binary. Relocatable code of all modules is placed consecutively,
+// starting at the base address; absolute sections stay at their origin.
+type Linker struct {
+	errors   []errors.Error
+	sections []*Section
+	labels   map[string]int
+}
+
+type linkerSymbol struct {
+	name   string
+	module *obj.File
+	label  bool
+	val    expr.Node
+}
+
+func NewLinker() *Linker {
+	return &Linker{}
+}
+
+func (l *Linker) Link(files []*obj.File, base int) {
+	l.errors = nil
+	l.sections = nil
+	l.labels = make(map[string]int)
+
+	// Place the sections
+	moduleBase := make(map[*obj.File]int)
+	moduleSections := make(map[*obj.File][]*Section)
+	pc := base
+	for _, f := range files {
+		moduleBase[f] = pc
+		end := pc
+		for _, s := range f.Sections {
+			org := s.Org
+			if s.Relocatable {
+				org = org + pc
+				if org+len(s.Bytes) > end {
+					end = org + len(s.Bytes)
+				}
+			}
+			section := NewSection(org, l)
+			section.bytes = append([]byte{}, s.Bytes...)
+			moduleSections[f] = append(moduleSections[f], section)
+			l.sections = append(l.sections, section)
+		}
+		pc = end
+	}
+	l.checkOverlaps(files, moduleSections)
+
+	// Collect all symbols
+	symbols := make(map[string]*linkerSymbol)
+	var pending []*linkerSymbol
+	for _, f := range files {
+		for _, s := range f.Symbols {
+			key := strings.ToLower(s.Name)
+			if other, found := symbols[key]; found {
+				l.AddError(text.Pos{Filename: f.Source}, "Symbol %q is already defined in %s", s.Name, other.module.Source)
+				continue
+			}
+			sym := &linkerSymbol{name: s.Name, module: f, label: s.Label}
+			switch {
+			case s.Expr != nil:
+				n, err := expr.Unmarshal(s.Expr)
+				if err != nil {
+					l.AddError(text.Pos{Filename: f.Source}, "Bad definition of symbol %q: %s", s.Name, err)
+					continue
+				}
+				n.Relocate(moduleBase[f])
+				sym.val = n
+				pending = append(pending, sym)
+			case s.Relocatable:
+				sym.val = expr.NewConst(text.Pos{Filename: f.Source}, s.Value+moduleBase[f], 2)
+			default:
+				sym.val = expr.NewConst(text.Pos{Filename: f.Source}, s.Value, 2)
+			}
+			symbols[key] = sym
+		}
+	}
+
+	// Resolve symbols that depend on other modules
+	for progress := true; progress; {
+		progress = false
+		var stillPending []*linkerSymbol
+		for _, sym := range pending {
+			l.resolve(sym.val, symbols)
+			if sym.val.IsResolved() {
+				progress = true
+			} else {
+				stillPending = append(stillPending, sym)
+			}
+		}
+		pending = stillPending
+	}
+	for _, sym := range pending {
+		var names []string
+		for s := range sym.val.UnresolvedSymbols() {
+			names = append(names, s)
+		}
+		sort.Strings(names)
+		l.AddError(sym.val.Pos(), "Undefined symbols in definition of %s: %s", sym.name, strings.Join(names, ", "))
+	}
+	for _, sym := range symbols {
+		if sym.label && sym.val.IsResolved() {
+			l.labels[sym.name] = sym.val.Eval()
+		}
+	}
+
+	// Apply the patches
+	for _, f := range files {
+		for _, p := range f.Patches {
+			if p.Section < 0 || p.Section >= len(moduleSections[f]) {
+				l.AddError(text.Pos{Filename: f.Source}, "Patch refers to unknown section %d", p.Section)
+				continue
+			}
+			n, err := expr.Unmarshal(&p.Expr)
+			if err != nil {
+				l.AddError(text.Pos{Filename: f.Source}, "Bad patch: %s", err)
+				continue
+			}
+			n.Relocate(moduleBase[f])
+			l.resolve(n, symbols)
+			if !n.IsResolved() {
+				var names []string
+				for s := range n.UnresolvedSymbols() {
+					names = append(names, s)
+				}
+				sort.Strings(names)
+				for _, s := range names {
+					l.AddError(n.Pos(), "Undefined label %q", s)
+				}
+				continue
+			}
+			section := moduleSections[f][p.Section]
+			section.ApplyPatch(patch{section: section, pc: section.org + p.Offset, node: n})
+		}
+	}
+}
+
+func (l *Linker) resolve(n expr.Node, symbols map[string]*linkerSymbol) {
+	for s := range n.UnresolvedSymbols() {
+		if sym, found := symbols[strings.ToLower(s)]; found && sym.val.IsResolved() {
+			n.Resolve(s, sym.val.Eval())
+		}
+	}
+}
+
+func (l *Linker) checkOverlaps(files []*obj.File, moduleSections map[*obj.File][]*Section) {
+	type placed struct {
+		module  *obj.File
+		section *Section
+	}
+	var all []placed
+	for _, f := range files {
+		for _, s := range moduleSections[f] {
+			if s.Size() > 0 {
+				all = append(all, placed{f, s})
+			}
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].section.org < all[j].section.org })
+	for i := 1; i < len(all); i++ {
+		prev, cur := all[i-1], all[i]
+		if cur.section.org < prev.section.PC() {
+			l.AddError(text.Pos{Filename: cur.module.Source}, "Section at $%04x overlaps with section at $%04x-$%04x from %s", cur.section.org, prev.section.org, prev.section.PC()-1, prev.module.Source)
+		}
+	}
+}
+
+// Origin returns the lowest address of the linked code.
+func (l *Linker) Origin() int {
+	origin := -1
+	for _, s := range l.sections {
+		if s.Size() > 0 && (origin < 0 || s.org < origin) {
+			origin = s.org
+		}
+	}
+	if origin < 0 {
+		return 0
+	}
+	return origin
+}
+
+// GetBytes returns the linked code. Gaps between sections are filled with zeroes.
+func (l *Linker) GetBytes() []byte {
+	origin := l.Origin()
+	var bytes []byte
+	for _, s := range l.sections {
+		if s.Size() == 0 {
+			continue
+		}
+		start := s.org - origin
+		for len(bytes) < start+s.Size() {
+			bytes = append(bytes, 0)
+		}
+		copy(bytes[start:], s.bytes)
+	}
+	return bytes
+}
+
+func (l *Linker) Labels() map[string]int {
+	return l.labels
+}
+
+func (l *Linker) AddError(pos text.Pos, message string, args ...interface{}) {
+	l.errors = append(l.errors, errors.Error{Pos: pos, Msg: fmt.Sprintf(message, args...)})
+}
+
+func (l *Linker) Errors() []errors.Error {
+	return l.errors
+}
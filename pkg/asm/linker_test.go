@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/errors"
+	"github.com/asig/cbmasm/pkg/obj"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+func assembleObject(t *testing.T, name, src string) *obj.File {
+	assembler := New([]string{}, "6502", "c128", "obj", "petscii", []string{})
+	assembler.Assemble(text.Process(name, src))
+	if errs := assembler.Errors(); len(errs) > 0 {
+		t.Fatalf("%s: got errors %v, want none", name, errs)
+	}
+	// Make sure the object survives a round trip through the file format
+	var buf bytes.Buffer
+	if err := obj.Write(&buf, assembler.Object(name)); err != nil {
+		t.Fatalf("%s: can't write object: %s", name, err)
+	}
+	f, err := obj.Read(&buf)
+	if err != nil {
+		t.Fatalf("%s: can't read object: %s", name, err)
+	}
+	return f
+}
+
+func TestLinker_Link(t *testing.T) {
+	tests := []struct {
+		name       string
+		modules    []string
+		base       int
+		wantOrigin int
+		want       []byte
+		wantErrors []errors.Error
+	}{
+		{
+			name: "imports and relocations",
+			modules: []string{`
+start   jsr print
+        lda #<msg
+        ldx #>msg
+_l      beq _l
+        jmp start
+ptr     .equ msg+1
+        .word ptr
+`, `
+print   lda msg
+        rts
+msg     .byte "hi",0
+`},
+			base:       0x2000,
+			wantOrigin: 0x2000,
+			want: []byte{
+				0x20, 0x0e, 0x20, // jsr print
+				0xa9, 0x12, // lda #<msg
+				0xa2, 0x20, // ldx #>msg
+				0xf0, 0xfe, // beq _l
+				0x4c, 0x00, 0x20, // jmp start
+				0x13, 0x20, // .word ptr
+				0xad, 0x12, 0x20, // lda msg
+				0x60,             // rts
+				0x48, 0x49, 0x00, // "hi",0
+			},
+		},
+		{
+			name: "absolute sections stay in place",
+			modules: []string{`
+        .org $1000
+        jmp entry
+`, `
+entry   rts
+`},
+			base:       0x1003,
+			wantOrigin: 0x1000,
+			want:       []byte{0x4c, 0x03, 0x10, 0x60},
+		},
+		{
+			name: "undefined symbol",
+			modules: []string{`
+        jmp missing
+`},
+			base:       0x2000,
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "module1", Line: 2, Col: 13}, Msg: "Undefined label \"missing\""}},
+		},
+		{
+			name: "division by zero",
+			modules: []string{`
+        .byte 1 / (last - first)
+`, `
+first
+last    rts
+`},
+			base:       0x2000,
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "module1", Line: 2, Col: 20}, Msg: "Division by zero"}},
+		},
+		{
+			name: "duplicate symbol",
+			modules: []string{`
+foo     rts
+`, `
+foo     rts
+`},
+			base:       0x2000,
+			wantErrors: []errors.Error{{Pos: text.Pos{Filename: "module2"}, Msg: "Symbol \"foo\" is already defined in module1"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var files []*obj.File
+			for i, m := range test.modules {
+				files = append(files, assembleObject(t, "module"+string(rune('1'+i)), m))
+			}
+			linker := NewLinker()
+			linker.Link(files, test.base)
+			errs := linker.Errors()
+			if len(errs) != len(test.wantErrors) {
+				t.Fatalf("Got errors %v, want %v", errs, test.wantErrors)
+			}
+			for i := range errs {
+				if errs[i] != test.wantErrors[i] {
+					t.Errorf("Error %d: got %+v, want %+v", i+1, errs[i], test.wantErrors[i])
+				}
+			}
+			if len(test.wantErrors) > 0 {
+				return
+			}
+			if got := linker.Origin(); got != test.wantOrigin {
+				t.Errorf("Got origin $%04x, want $%04x", got, test.wantOrigin)
+			}
+			if got := linker.GetBytes(); !bytes.Equal(got, test.want) {
+				t.Errorf("Got %s, want %s", toString(got), toString(test.want))
+			}
+		})
+	}
+}
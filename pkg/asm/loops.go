@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"fmt"
+
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/scanner"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// maxLoopIterations is the maximum number of iterations of a loop. It stops ".while" loops whose condition never
+// becomes false.
+const maxLoopIterations = 65536
+
+// loop is a ".rept", ".for", or ".while" block. Its body is recorded like a macro, and instantiated once per
+// iteration; the loop variable, if any, is the body's only parameter.
+type loop struct {
+	pos  text.Pos
+	body *macro
+
+	// Values of the loop variable for ".rept" and ".for"
+	start, end, step int
+
+	// Condition of ".while", with everything before the expression blanked out
+	cond *text.Line
+}
+
+var loopEnds = map[scanner.TokenType]scanner.TokenType{
+	scanner.Rept:  scanner.Endr,
+	scanner.For:   scanner.Endfor,
+	scanner.While: scanner.Endwhile,
+}
+
+func (a *Assembler) handleLoop(t scanner.Token) {
+	// loop := ".rept" expr ["," ident]
+	//       | ".for" ident "=" expr "," expr ["," expr]
+	//       | ".while" cond .
+	a.nextToken()
+	l := &loop{
+		pos:  t.Pos,
+		body: &macro{name: t.Type.String(), pos: t.Pos, text: &text.Text{}},
+		step: 1,
+	}
+	errs := len(a.errors)
+	switch t.Type {
+	case scanner.Rept:
+		count, ok := a.resolvedInt()
+		if ok && count < 0 {
+			a.AddError(t.Pos, "Count must not be negative")
+		}
+		l.end = count - 1
+		if a.lookahead.Type == scanner.Comma {
+			a.nextToken()
+			a.loopVariable(l)
+		}
+	case scanner.For:
+		a.loopVariable(l)
+		a.match(scanner.Eq)
+		l.start, _ = a.resolvedInt()
+		a.match(scanner.Comma)
+		l.end, _ = a.resolvedInt()
+		if a.lookahead.Type == scanner.Comma {
+			a.nextToken()
+			p := a.lookahead.Pos
+			l.step, _ = a.resolvedInt()
+			if l.step == 0 {
+				a.AddError(p, "Step must not be 0")
+				l.step = 1
+			}
+		}
+	case scanner.While:
+		line := *a.scanner.Line()
+		line.Runes = append([]rune{}, line.Runes...)
+		for i := 0; i < a.lookahead.Pos.Col-1; i++ {
+			line.Runes[i] = ' '
+		}
+		l.cond = &line
+		a.condition()
+	}
+	if len(a.errors) > errs {
+		// Record the body anyway, but don't assemble it
+		l.start, l.end, l.step, l.cond = 0, -1, 1, nil
+	}
+	a.startRecording(l.body, loopEnds[t.Type], l)
+}
+
+func (a *Assembler) loopVariable(l *loop) {
+	name := a.lookahead.StrVal
+	a.match(scanner.Ident)
+	l.body.addParam(name)
+}
+
+// resolvedInt parses an integer expression that needs to be resolved.
+func (a *Assembler) resolvedInt() (int, bool) {
+	n := a.expr(2, false)
+	if !n.IsResolved() {
+		a.AddError(n.Pos(), "Expression is not resolved")
+		return 0, false
+	}
+	if n.Type() != expr.NodeType_Int {
+		a.AddError(n.Pos(), "Expression must be of type integer")
+		return 0, false
+	}
+	return n.Eval(), true
+}
+
+// expandLoop assembles the loop's body once per iteration. It stops at the first iteration with errors, so that
+// they are not reported over and over again.
+func (a *Assembler) expandLoop(l *loop) {
+	for i := 0; ; i++ {
+		var args []string
+		if l.cond != nil {
+			if !a.loopCondition(l) {
+				return
+			}
+		} else {
+			v := l.start + i*l.step
+			if l.step > 0 && v > l.end || l.step < 0 && v < l.end {
+				return
+			}
+			if len(l.body.params) > 0 {
+				args = []string{loopValue(v)}
+			}
+		}
+		if i == maxLoopIterations {
+			a.AddError(l.pos, "Loop didn't end after %d iterations", maxLoopIterations)
+			return
+		}
+		errs := len(a.errors)
+		a.instantiate(l.body, args, l.pos, true)
+		if len(a.errors) > errs {
+			return
+		}
+	}
+}
+
+// loopValue returns the text that replaces the loop variable.
+func loopValue(v int) string {
+	if v < 0 {
+		return fmt.Sprintf("(%d)", v)
+	}
+	return fmt.Sprintf("%d", v)
+}
+
+// loopCondition evaluates the condition of a ".while" loop again.
+func (a *Assembler) loopCondition(l *loop) bool {
+	savedScanner, savedLookahead := a.scanner, a.lookahead
+	savedTokenBuf, savedTokenBufSet := a.tokenBuf, a.tokenBufSet
+	defer func() {
+		a.scanner, a.lookahead = savedScanner, savedLookahead
+		a.tokenBuf, a.tokenBufSet = savedTokenBuf, savedTokenBufSet
+	}()
+	a.beginLine(*l.cond)
+	return a.condition()
+}
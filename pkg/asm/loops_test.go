@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/errors"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+func TestAssembler_Loops(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		want   []byte
+		errors []string
+	}{
+		{
+			name: "rept",
+			src: `	.org $1000
+	.rept 3
+	nop
+	.endr
+	.rept 3, i
+	.byte i*2
+	.endr
+	.rept 0
+	brk
+	.endr
+`,
+			want: []byte{0xea, 0xea, 0xea, 0x00, 0x02, 0x04},
+		},
+		{
+			name: "for",
+			src: `	.org $1000
+	.for i = 1, 7, 3
+	.for j = 0, 1
+	.byte i, j
+	.endfor
+	.endfor
+	.for i = 3, 1, -1
+	.byte 10-i, i
+	.endfor
+`,
+			want: []byte{1, 0, 1, 1, 4, 0, 4, 1, 7, 0, 7, 1, 7, 3, 8, 2, 9, 1},
+		},
+		{
+			name: "while",
+			src: `	.org $1000
+	nop
+	.while * & 3
+	brk
+	.endwhile
+	nop
+`,
+			want: []byte{0xea, 0x00, 0x00, 0x00, 0xea},
+		},
+		{
+			name: "local labels per iteration",
+			src: `	.org $1000
+start	ldx #0
+	.rept 2
+_l	dex
+	bne _l
+	.endr
+_l	rts
+	jmp _l
+`,
+			want: []byte{0xa2, 0x00, 0xca, 0xd0, 0xfd, 0xca, 0xd0, 0xfd, 0x60, 0x4c, 0x08, 0x10},
+		},
+		{
+			name: "loops in macros",
+			src: `	.org $1000
+table	.macro n
+	.for i = 1, n
+	.byte i*i
+	.endfor
+	.endm
+	table 4
+`,
+			want: []byte{1, 4, 9, 16},
+		},
+		{
+			name: "errors are reported once",
+			src: `	.org $1000
+	.rept 3, i
+	.byte 254+i
+	.endr
+`,
+			errors: []string{"line 3: Value out of range."},
+		},
+		{
+			name: "unresolved count",
+			src: `	.org $1000
+	.rept n
+	nop
+	.endr
+n	.equ 2
+`,
+			errors: []string{"line 2: Expression is not resolved"},
+		},
+		{
+			name: "negative count",
+			src: `	.org $1000
+	.rept -1
+	nop
+	.endr
+`,
+			errors: []string{"line 2: Count must not be negative"},
+		},
+		{
+			name: "invalid step",
+			src: `	.org $1000
+	.for i = 1, 2, 0
+	nop
+	.endfor
+`,
+			errors: []string{"line 2: Step must not be 0"},
+		},
+		{
+			name: "endless loop",
+			src: `	.org $1000
+	.while 1
+	.endwhile
+`,
+			errors: []string{fmt.Sprintf("line 2: Loop didn't end after %d iterations", maxLoopIterations)},
+		},
+		{
+			name: "mismatched end",
+			src: `	.org $1000
+	.rept 1
+	nop
+	.endfor
+	.endr
+`,
+			errors: []string{"line 4: .endr expected", "line 5: .endr without .rept"},
+		},
+		{
+			name: "missing end",
+			src: `	.org $1000
+	.for i = 1, 2
+	nop
+`,
+			errors: []string{"line 4: .endfor expected"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := assembleTest(tt.src)
+			if !reflect.DeepEqual(errs, tt.errors) {
+				t.Errorf("Got errors %q, want %q", errs, tt.errors)
+			}
+			if tt.errors != nil {
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Got %s, want %s", toString(got), toString(tt.want))
+			}
+		})
+	}
+}
+
+func TestAssembler_ErrorsInLoops(t *testing.T) {
+	src := `	.org $1000
+m	.macro
+	.byte 300
+	.endm
+	.rept 1
+	m
+	.endr
+`
+	assembler := New([]string{}, "6502", "c64", "plain", "petscii", []string{})
+	assembler.Assemble(text.Process("main.asm", src))
+	errs := assembler.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("Got errors %v, want 1", errs)
+	}
+	want := []errors.Frame{
+		{Macro: ".rept", Call: text.Pos{Filename: "main.asm", Line: 5, Col: 2}, Line: 1, Loop: true},
+		{Macro: "m", Call: text.Pos{Filename: "main.asm", Line: 6, Col: 2}, Line: 1},
+	}
+	got := errs[0].Expansion.Frames()
+	for i := range got {
+		got[i].Caller = nil
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got expansions %+v, want %+v", got, want)
+	}
+}
+
+func TestAssembler_LoopListing(t *testing.T) {
+	src := `	.org $1000
+	.rept 2
+	nop
+	.endr
+	rts
+`
+	assembler := New([]string{}, "6502", "c64", "plain", "petscii", []string{})
+	assembler.Assemble(text.Process("main.asm", src))
+	if errs := assembler.Errors(); len(errs) > 0 {
+		t.Fatalf("Got errors %v, want none", errs)
+	}
+	var got []string
+	for _, l := range assembler.ListingLines {
+		cycles := ""
+		if l.Cycles != nil {
+			cycles = l.Cycles.String()
+		}
+		got = append(got, fmt.Sprintf("%04x %d %s %s", l.Addr, l.Bytes, cycles, strings.TrimSpace(string(l.Line.Runes))))
+	}
+	want := []string{
+		"0000 0  .org $1000",
+		"1000 0  .rept 2",
+		"1000 0  nop",
+		"1000 1 2 nop",
+		"1001 1 2 nop",
+		"1002 1 6 rts",
+		"1003 0  ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got listing %q, want %q", got, want)
+	}
+}
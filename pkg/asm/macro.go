@@ -20,16 +20,40 @@ package asm
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/asig/cbmasm/pkg/scanner"
 	"github.com/asig/cbmasm/pkg/text"
 )
 
+// maxMacroDepth is the maximum nesting depth of macro calls. It stops recursive macros without an end condition.
+const maxMacroDepth = 256
+
 type macro struct {
-	pos text.Pos
+	name string
+	pos  text.Pos
 
-	params []string
-	text   *text.Text
+	params   []string
+	defaults map[string]string // Default values of optional parameters
+	variadic bool              // If true, the macro accepts any number of additional arguments
+	text     *text.Text
+}
+
+// minArgs returns the number of arguments that need to be passed to the macro.
+func (m *macro) minArgs() int {
+	res := 0
+	for _, p := range m.params {
+		if _, found := m.defaults[p]; !found {
+			res++
+		}
+	}
+	return res
+}
+
+// acceptsArgs returns true if the macro can be called with n arguments.
+func (m *macro) acceptsArgs(n int) bool {
+	return n >= m.minArgs() && (m.variadic || n <= len(m.params))
 }
 
 func (m *macro) addParam(name string) error {
@@ -49,21 +73,77 @@ func (m *macro) paramIndex(name string) int {
 	return -1
 }
 
+// bodyLine returns the line of pos in the macro's body, starting at 1, or 0 if pos is not in the body.
+func (m *macro) bodyLine(pos text.Pos) int {
+	for i, l := range m.text.Lines {
+		if l.Filename == pos.Filename && l.LineNumber == pos.Line {
+			return i + 1
+		}
+	}
+	return 0
+}
+
 func (m *macro) replaceParams(actuals []string) []text.Line {
 
 	paramMap := make(map[string]string)
 	for idx, p := range m.params {
-		paramMap[p] = actuals[idx]
+		if idx < len(actuals) {
+			paramMap[p] = actuals[idx]
+		} else {
+			// Default values can refer to the parameters before them
+			def := text.Line{Runes: []rune(m.defaults[p])}
+			paramMap[p] = string(substituteParams(def, paramMap))
+		}
+	}
+
+	// ".paramcount" and "..." refer to the innermost macro, so they are not replaced in nested macro definitions.
+	outerParamMap := make(map[string]string)
+	for p, v := range paramMap {
+		outerParamMap[p] = v
+	}
+	paramMap[".paramcount"] = strconv.Itoa(len(actuals))
+	if m.variadic {
+		var rest []string
+		if len(actuals) > len(m.params) {
+			rest = actuals[len(m.params):]
+		}
+		paramMap["..."] = strings.Join(rest, ", ")
 	}
 
 	var res []text.Line
+	nesting := 0
 	for _, line := range m.text.Lines {
-		substituted := substituteParams(line, paramMap)
-		res = append(res, text.Line{line.Filename, line.LineNumber, substituted})
+		delta := macroNesting(line)
+		if delta > 0 {
+			nesting += delta
+		}
+		params := paramMap
+		if nesting > 0 {
+			params = outerParamMap
+		}
+		substituted := substituteParams(line, params)
+		res = append(res, text.Line{Filename: line.Filename, LineNumber: line.LineNumber, Runes: substituted})
+		if delta < 0 {
+			nesting += delta
+		}
 	}
 	return res
 }
 
+// macroNesting returns 1 if the line starts a macro definition, -1 if it ends one, and 0 otherwise.
+func macroNesting(line text.Line) int {
+	s := scanner.New(line, &dummyErrorSink{})
+	for t := s.Scan(); t.Type != scanner.Eol && t.Type != scanner.Semicolon; t = s.Scan() {
+		switch t.Type {
+		case scanner.Macro:
+			return 1
+		case scanner.Endm:
+			return -1
+		}
+	}
+	return 0
+}
+
 type dummyErrorSink struct{}
 
 func (d *dummyErrorSink) AddError(_ text.Pos, _ string, _ ...interface{}) {}
@@ -82,9 +162,13 @@ func substituteParams(line text.Line, paramMap map[string]string) []rune {
 	s := scanner.New(line, &dummyErrorSink{})
 	t := s.Scan()
 	for t.Type != scanner.Eol {
-		if t.Type == scanner.Ident {
+		if t.Type == scanner.Ident || t.Type == scanner.ParamCount || t.Type == scanner.Ellipsis {
 			// Potentially a mos6502Param
-			if val, found := paramMap[t.StrVal]; found {
+			name := t.StrVal
+			if t.Type == scanner.ParamCount {
+				name = strings.ToLower(name)
+			}
+			if val, found := paramMap[name]; found {
 				// YES. Insert replacement at the beginning
 				repls = append([]replacement{{t.Pos.Col - 1, len(t.StrVal), val}}, repls...)
 			}
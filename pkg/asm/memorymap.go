@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/errors"
+	"github.com/asig/cbmasm/pkg/scanner"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// SegmentDef describes where a named segment is placed in memory.
+type SegmentDef struct {
+	Name  string
+	Start int
+	Size  int
+	BSS   bool // If true, the segment's content is not written to the output
+	Pos   text.Pos
+}
+
+type MemoryMap []SegmentDef
+
+type memoryMapParser struct {
+	errors []errors.Error
+}
+
+func (p *memoryMapParser) AddError(pos text.Pos, message string, args ...interface{}) {
+	p.errors = append(p.errors, errors.Error{Pos: pos, Msg: fmt.Sprintf(message, args...)})
+}
+
+// ParseMemoryMap parses a memory map. Every non-empty line defines a segment:
+//
+//	name start size ["bss"] [";" comment]
+func ParseMemoryMap(t text.Text) (MemoryMap, []errors.Error) {
+	p := &memoryMapParser{}
+	var m MemoryMap
+	seen := make(map[string]bool)
+	for _, line := range t.Lines {
+		s := scanner.New(line, p)
+		tok := s.Scan()
+		if tok.Type == scanner.Eol || tok.Type == scanner.Semicolon {
+			continue
+		}
+		def := SegmentDef{Pos: tok.Pos}
+		if tok.Type != scanner.Ident {
+			p.AddError(tok.Pos, "Segment name expected")
+			continue
+		}
+		def.Name = tok.StrVal
+		if seen[strings.ToUpper(def.Name)] {
+			p.AddError(tok.Pos, "Segment %q is already defined", def.Name)
+			continue
+		}
+		tok = s.Scan()
+		if tok.Type != scanner.Integer {
+			p.AddError(tok.Pos, "Start address expected")
+			continue
+		}
+		def.Start = int(tok.IntVal)
+		tok = s.Scan()
+		if tok.Type != scanner.Integer {
+			p.AddError(tok.Pos, "Size expected")
+			continue
+		}
+		def.Size = int(tok.IntVal)
+		tok = s.Scan()
+		if tok.Type == scanner.Ident && strings.ToLower(tok.StrVal) == "bss" {
+			def.BSS = true
+			tok = s.Scan()
+		}
+		if tok.Type != scanner.Eol && tok.Type != scanner.Semicolon {
+			p.AddError(tok.Pos, "';' or EOL expected")
+			continue
+		}
+		if def.Start < 0 || def.Size < 0 || def.Start+def.Size > 0x10000 {
+			p.AddError(def.Pos, "Segment %q does not fit into 64K", def.Name)
+			continue
+		}
+		seen[strings.ToUpper(def.Name)] = true
+		m = append(m, def)
+	}
+	return m, p.errors
+}
+
+func (m MemoryMap) find(name string) (SegmentDef, bool) {
+	for _, def := range m {
+		if strings.EqualFold(def.Name, name) {
+			return def, true
+		}
+	}
+	return SegmentDef{}, false
+}
+
+// segment is the state of a segment during assembly
+type segment struct {
+	def              SegmentDef
+	pos              text.Pos // Position of the first .segment directive
+	section          *Section // Current section of the segment
+	overflowReported bool
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/scanner"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// Message is the output of a ".print" directive.
+type Message struct {
+	Pos  text.Pos
+	Text string
+}
+
+func (m Message) String() string {
+	return fmt.Sprintf("%s, line %d: %s", m.Pos.Filename, m.Pos.Line, m.Text)
+}
+
+// handleMessage assembles ".print", ".warning", ".error", and ".fail".
+func (a *Assembler) handleMessage(t scanner.Token) {
+	// message := (".print" | ".warning" | ".error" | ".fail") expr {"," expr} .
+	a.nextToken()
+	msg, ok := a.messageText()
+	if !ok {
+		return
+	}
+	switch t.Type {
+	case scanner.Print:
+		a.messages = append(a.messages, Message{Pos: t.Pos, Text: msg})
+	case scanner.Warning:
+		a.AddWarning(t.Pos, msg)
+	default:
+		a.AddError(t.Pos, "%s", msg)
+	}
+}
+
+// messageText parses a comma separated list of expressions, and concatenates their values. Strings are not encoded,
+// so that they're printed as they are written.
+func (a *Assembler) messageText() (string, bool) {
+	savedEncoding := a.currentEncoding
+	a.currentEncoding = expr.NoOp
+	defer func() {
+		a.currentEncoding = savedEncoding
+	}()
+
+	var sb strings.Builder
+	ok := true
+	for {
+		n := a.expr(2, true)
+		if !n.IsResolved() {
+			a.AddError(n.Pos(), "Expression is not resolved")
+			ok = false
+		} else {
+			sb.WriteString(expr.FormatValue(n))
+		}
+		if a.lookahead.Type != scanner.Comma {
+			break
+		}
+		a.nextToken()
+	}
+	return sb.String(), ok
+}
+
+// Messages returns the output of all ".print" directives, in the order they were assembled.
+func (a *Assembler) Messages() []Message {
+	return a.messages
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestAssembler_Messages(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		want     []byte
+		messages []string
+		warnings []string
+		errors   []string
+	}{
+		{
+			name: "print",
+			src: `	.org $1000
+table	.byte 1, 2, 3
+	.print "Table size: ", * - table, " bytes"
+	.print "free: ", hex($d000 - *, 4), " = ", dec($d000 - *), " = ", bin(3, 4)
+	.print "hex(", hex(-1), ") ", 1.5 * 2, " ", 0.25, " ", 1 < 2
+`,
+			want: []byte{1, 2, 3},
+			messages: []string{
+				"main.asm, line 3: Table size: 3 bytes",
+				"main.asm, line 4: free: $bffd = 49149 = %0011",
+				"main.asm, line 5: hex(-$1) 3 0.25 1",
+			},
+		},
+		{
+			name: "print in loops",
+			src: `	.rept 2, i
+	.print "iteration ", i
+	.endr
+`,
+			messages: []string{
+				"main.asm, line 2: iteration 0",
+				"main.asm, line 2: iteration 1",
+			},
+		},
+		{
+			name: "warning",
+			src: `	.org $1000
+size	.equ 300
+	.if size > 256
+	.warning "Table is ", size - 256, " bytes too large"
+	.endif
+`,
+			warnings: []string{"line 4: Table is 44 bytes too large"},
+		},
+		{
+			name: "error and fail",
+			src: `	.org $1000
+	.error "Value: ", hex(255)
+	.fail "Fail ", "with ", "a list"
+	.fail "unresolved: ", later
+later	nop
+`,
+			errors: []string{
+				"line 2: Value: $ff",
+				"line 3: Fail with a list",
+				"line 4: Expression is not resolved",
+			},
+		},
+		{
+			name: "strings in expressions",
+			src: `	.encoding "ascii"
+	.org $1000
+	.byte "ab" + "cd", hex(171), dec(12) + bin(1, 2)
+	.if "a" + "b" == "ab" && strlen("ab" + "cd") == 4
+	nop
+	.endif
+`,
+			want: []byte{'a', 'b', 'c', 'd', '$', 'a', 'b', '1', '2', '%', '0', '1', 0xea},
+		},
+		{
+			name: "computed strings are encoded",
+			src: `	.org $1000
+	.byte hex(171), "ab" + hex(10)
+`,
+			want: []byte{'$', 0x41, 0x42, 0x41, 0x42, '$', 0x41},
+		},
+		{
+			name: "string errors",
+			src: `	.org $1000
+	.byte "a" + 1
+	.byte hex("a")
+	.word hex(1)
+	.byte bin(1, 65)
+	.byte hex(1, -1)
+`,
+			errors: []string{
+				"line 2: types don't match",
+				"line 3: Arguments must be of type integer",
+				"line 4: Strings are not allowed",
+				"line 5: Number of digits must be between 0 and 64",
+				"line 6: Number of digits must be between 0 and 64",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assembler := New([]string{}, "6502", "c64", "plain", "petscii", []string{})
+			got, errs := assembleWith(assembler, tt.src)
+			var warnings, messages []string
+			for _, w := range assembler.Warnings() {
+				warnings = append(warnings, fmt.Sprintf("line %d: %s", w.Pos.Line, w.Msg))
+			}
+			for _, m := range assembler.Messages() {
+				messages = append(messages, m.String())
+			}
+			if !reflect.DeepEqual(errs, tt.errors) {
+				t.Errorf("Got errors %q, want %q", errs, tt.errors)
+			}
+			if !reflect.DeepEqual(warnings, tt.warnings) {
+				t.Errorf("Got warnings %q, want %q", warnings, tt.warnings)
+			}
+			if !reflect.DeepEqual(messages, tt.messages) {
+				t.Errorf("Got messages %q, want %q", messages, tt.messages)
+			}
+			if tt.errors != nil {
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Got %s, want %s", toString(got), toString(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package mos6502
+
+var (
+	// Mnemonics65C02 contains the opcodes of the WDC 65C02, including the Rockwell bit instructions.
+	Mnemonics65C02 = Merge(Mnemonics, cmosMnemonics, wdc65c02Mnemonics)
+
+	// Mnemonics65CE02 contains the opcodes of the CSG 65CE02.
+	Mnemonics65CE02 = Merge(Mnemonics, cmosMnemonics, ce02Mnemonics)
+
+	// Mnemonics4510 contains the opcodes of the CSG 4510 used in the C65 and the MEGA65.
+	Mnemonics4510 = Merge(Mnemonics65CE02, m4510Mnemonics)
+)
+
+// cmosMnemonics contains the extensions that the 65C02 and the 65CE02 have in common.
+var cmosMnemonics = map[string]OpCodes{
+	"bit": {
+		AM_Immediate:        0x89,
+		AM_ZeroPageIndexedX: 0x34,
+		AM_AbsoluteIndexedX: 0x3c,
+	},
+	"inc": {
+		AM_Implied:     0x1a,
+		AM_Accumulator: 0x1a,
+	},
+	"dec": {
+		AM_Implied:     0x3a,
+		AM_Accumulator: 0x3a,
+	},
+	"jmp": {
+		AM_AbsoluteIndexedIndirect: 0x7c,
+	},
+	"bra": {
+		AM_Relative: 0x80,
+	},
+	"phx": {
+		AM_Implied: 0xda,
+	},
+	"phy": {
+		AM_Implied: 0x5a,
+	},
+	"plx": {
+		AM_Implied: 0xfa,
+	},
+	"ply": {
+		AM_Implied: 0x7a,
+	},
+	"stz": {
+		AM_ZeroPage:         0x64,
+		AM_ZeroPageIndexedX: 0x74,
+		AM_Absolute:         0x9c,
+		AM_AbsoluteIndexedX: 0x9e,
+	},
+	"trb": {
+		AM_ZeroPage: 0x14,
+		AM_Absolute: 0x1c,
+	},
+	"tsb": {
+		AM_ZeroPage: 0x04,
+		AM_Absolute: 0x0c,
+	},
+	"bbr0": {
+		AM_ZeroPageRelative: 0x0f,
+	},
+	"bbr1": {
+		AM_ZeroPageRelative: 0x1f,
+	},
+	"bbr2": {
+		AM_ZeroPageRelative: 0x2f,
+	},
+	"bbr3": {
+		AM_ZeroPageRelative: 0x3f,
+	},
+	"bbr4": {
+		AM_ZeroPageRelative: 0x4f,
+	},
+	"bbr5": {
+		AM_ZeroPageRelative: 0x5f,
+	},
+	"bbr6": {
+		AM_ZeroPageRelative: 0x6f,
+	},
+	"bbr7": {
+		AM_ZeroPageRelative: 0x7f,
+	},
+	"bbs0": {
+		AM_ZeroPageRelative: 0x8f,
+	},
+	"bbs1": {
+		AM_ZeroPageRelative: 0x9f,
+	},
+	"bbs2": {
+		AM_ZeroPageRelative: 0xaf,
+	},
+	"bbs3": {
+		AM_ZeroPageRelative: 0xbf,
+	},
+	"bbs4": {
+		AM_ZeroPageRelative: 0xcf,
+	},
+	"bbs5": {
+		AM_ZeroPageRelative: 0xdf,
+	},
+	"bbs6": {
+		AM_ZeroPageRelative: 0xef,
+	},
+	"bbs7": {
+		AM_ZeroPageRelative: 0xff,
+	},
+	"rmb0": {
+		AM_ZeroPage: 0x07,
+	},
+	"rmb1": {
+		AM_ZeroPage: 0x17,
+	},
+	"rmb2": {
+		AM_ZeroPage: 0x27,
+	},
+	"rmb3": {
+		AM_ZeroPage: 0x37,
+	},
+	"rmb4": {
+		AM_ZeroPage: 0x47,
+	},
+	"rmb5": {
+		AM_ZeroPage: 0x57,
+	},
+	"rmb6": {
+		AM_ZeroPage: 0x67,
+	},
+	"rmb7": {
+		AM_ZeroPage: 0x77,
+	},
+	"smb0": {
+		AM_ZeroPage: 0x87,
+	},
+	"smb1": {
+		AM_ZeroPage: 0x97,
+	},
+	"smb2": {
+		AM_ZeroPage: 0xa7,
+	},
+	"smb3": {
+		AM_ZeroPage: 0xb7,
+	},
+	"smb4": {
+		AM_ZeroPage: 0xc7,
+	},
+	"smb5": {
+		AM_ZeroPage: 0xd7,
+	},
+	"smb6": {
+		AM_ZeroPage: 0xe7,
+	},
+	"smb7": {
+		AM_ZeroPage: 0xf7,
+	},
+}
+
+// wdc65c02Mnemonics contains the extensions that are only available on the 65C02. On the 65CE02, the
+// opcodes for (zp) are used for (zp),Z, and the ones for WAI and STP for ASW and PHZ.
+var wdc65c02Mnemonics = map[string]OpCodes{
+	"ora": {
+		AM_ZeroPageIndirect: 0x12,
+	},
+	"and": {
+		AM_ZeroPageIndirect: 0x32,
+	},
+	"eor": {
+		AM_ZeroPageIndirect: 0x52,
+	},
+	"adc": {
+		AM_ZeroPageIndirect: 0x72,
+	},
+	"sta": {
+		AM_ZeroPageIndirect: 0x92,
+	},
+	"lda": {
+		AM_ZeroPageIndirect: 0xb2,
+	},
+	"cmp": {
+		AM_ZeroPageIndirect: 0xd2,
+	},
+	"sbc": {
+		AM_ZeroPageIndirect: 0xf2,
+	},
+	"wai": {
+		AM_Implied: 0xcb,
+	},
+	"stp": {
+		AM_Implied: 0xdb,
+	},
+}
+
+// ce02Mnemonics contains the extensions that are only available on the 65CE02.
+var ce02Mnemonics = map[string]OpCodes{
+	"ora": {
+		AM_IndirectIndexedZ: 0x12,
+	},
+	"and": {
+		AM_IndirectIndexedZ: 0x32,
+	},
+	"eor": {
+		AM_IndirectIndexedZ: 0x52,
+	},
+	"adc": {
+		AM_IndirectIndexedZ: 0x72,
+	},
+	"sta": {
+		AM_IndirectIndexedZ:     0x92,
+		AM_StackIndirectIndexed: 0x82,
+	},
+	"lda": {
+		AM_IndirectIndexedZ:     0xb2,
+		AM_StackIndirectIndexed: 0xe2,
+	},
+	"cmp": {
+		AM_IndirectIndexedZ: 0xd2,
+	},
+	"sbc": {
+		AM_IndirectIndexedZ: 0xf2,
+	},
+	"jsr": {
+		AM_AbsoluteIndirect:        0x22,
+		AM_AbsoluteIndexedIndirect: 0x23,
+	},
+	"rts": {
+		AM_Immediate: 0x62,
+	},
+	"stx": {
+		AM_AbsoluteIndexedY: 0x9b,
+	},
+	"sty": {
+		AM_AbsoluteIndexedX: 0x8b,
+	},
+	"cle": {
+		AM_Implied: 0x02,
+	},
+	"see": {
+		AM_Implied: 0x03,
+	},
+	"tsy": {
+		AM_Implied: 0x0b,
+	},
+	"inz": {
+		AM_Implied: 0x1b,
+	},
+	"tys": {
+		AM_Implied: 0x2b,
+	},
+	"dez": {
+		AM_Implied: 0x3b,
+	},
+	"taz": {
+		AM_Implied: 0x4b,
+	},
+	"tab": {
+		AM_Implied: 0x5b,
+	},
+	"tza": {
+		AM_Implied: 0x6b,
+	},
+	"tba": {
+		AM_Implied: 0x7b,
+	},
+	"phz": {
+		AM_Implied: 0xdb,
+	},
+	"plz": {
+		AM_Implied: 0xfb,
+	},
+	"neg": {
+		AM_Implied:     0x42,
+		AM_Accumulator: 0x42,
+	},
+	"asr": {
+		AM_Implied:          0x43,
+		AM_Accumulator:      0x43,
+		AM_ZeroPage:         0x44,
+		AM_ZeroPageIndexedX: 0x54,
+	},
+	"ldz": {
+		AM_Immediate:        0xa3,
+		AM_Absolute:         0xab,
+		AM_AbsoluteIndexedX: 0xbb,
+	},
+	"cpz": {
+		AM_Immediate: 0xc2,
+		AM_ZeroPage:  0xd4,
+		AM_Absolute:  0xdc,
+	},
+	"dew": {
+		AM_ZeroPage: 0xc3,
+	},
+	"inw": {
+		AM_ZeroPage: 0xe3,
+	},
+	"asw": {
+		AM_Absolute: 0xcb,
+	},
+	"row": {
+		AM_Absolute: 0xeb,
+	},
+	"phw": {
+		AM_ImmediateWord: 0xf4,
+		AM_Absolute:      0xfc,
+	},
+	"bsr": {
+		AM_RelativeLong: 0x63,
+	},
+	"lbpl": {
+		AM_RelativeLong: 0x13,
+	},
+	"lbmi": {
+		AM_RelativeLong: 0x33,
+	},
+	"lbvc": {
+		AM_RelativeLong: 0x53,
+	},
+	"lbvs": {
+		AM_RelativeLong: 0x73,
+	},
+	"lbra": {
+		AM_RelativeLong: 0x83,
+	},
+	"lbcc": {
+		AM_RelativeLong: 0x93,
+	},
+	"lbcs": {
+		AM_RelativeLong: 0xb3,
+	},
+	"lbne": {
+		AM_RelativeLong: 0xd3,
+	},
+	"lbeq": {
+		AM_RelativeLong: 0xf3,
+	},
+}
+
+var m4510Mnemonics = map[string]OpCodes{
+	"map": {
+		AM_Implied: 0x5c,
+	},
+	"eom": {
+		AM_Implied: 0xea,
+	},
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package mos6502
+
+// Mnemonics6510Ill contains the documented opcodes of the 6510 and the stable undocumented ones.
+var Mnemonics6510Ill = Merge(Mnemonics, illegalMnemonics)
+
+// illegalMnemonics contains the stable undocumented opcodes of the NMOS 6502/6510. Unstable opcodes
+// (e.g. LAX #imm, SHA, SHX, SHY, TAS, LAS) are deliberately left out.
+var illegalMnemonics = map[string]OpCodes{
+	"slo": {
+		AM_ZeroPage:         0x07,
+		AM_ZeroPageIndexedX: 0x17,
+		AM_Absolute:         0x0f,
+		AM_AbsoluteIndexedX: 0x1f,
+		AM_AbsoluteIndexedY: 0x1b,
+		AM_IndexedIndirect:  0x03,
+		AM_IndirectIndexed:  0x13,
+	},
+	"rla": {
+		AM_ZeroPage:         0x27,
+		AM_ZeroPageIndexedX: 0x37,
+		AM_Absolute:         0x2f,
+		AM_AbsoluteIndexedX: 0x3f,
+		AM_AbsoluteIndexedY: 0x3b,
+		AM_IndexedIndirect:  0x23,
+		AM_IndirectIndexed:  0x33,
+	},
+	"sre": {
+		AM_ZeroPage:         0x47,
+		AM_ZeroPageIndexedX: 0x57,
+		AM_Absolute:         0x4f,
+		AM_AbsoluteIndexedX: 0x5f,
+		AM_AbsoluteIndexedY: 0x5b,
+		AM_IndexedIndirect:  0x43,
+		AM_IndirectIndexed:  0x53,
+	},
+	"rra": {
+		AM_ZeroPage:         0x67,
+		AM_ZeroPageIndexedX: 0x77,
+		AM_Absolute:         0x6f,
+		AM_AbsoluteIndexedX: 0x7f,
+		AM_AbsoluteIndexedY: 0x7b,
+		AM_IndexedIndirect:  0x63,
+		AM_IndirectIndexed:  0x73,
+	},
+	"sax": {
+		AM_ZeroPage:         0x87,
+		AM_ZeroPageIndexedY: 0x97,
+		AM_Absolute:         0x8f,
+		AM_IndexedIndirect:  0x83,
+	},
+	"lax": {
+		AM_ZeroPage:         0xa7,
+		AM_ZeroPageIndexedY: 0xb7,
+		AM_Absolute:         0xaf,
+		AM_AbsoluteIndexedY: 0xbf,
+		AM_IndexedIndirect:  0xa3,
+		AM_IndirectIndexed:  0xb3,
+	},
+	"dcp": {
+		AM_ZeroPage:         0xc7,
+		AM_ZeroPageIndexedX: 0xd7,
+		AM_Absolute:         0xcf,
+		AM_AbsoluteIndexedX: 0xdf,
+		AM_AbsoluteIndexedY: 0xdb,
+		AM_IndexedIndirect:  0xc3,
+		AM_IndirectIndexed:  0xd3,
+	},
+	"isc": {
+		AM_ZeroPage:         0xe7,
+		AM_ZeroPageIndexedX: 0xf7,
+		AM_Absolute:         0xef,
+		AM_AbsoluteIndexedX: 0xff,
+		AM_AbsoluteIndexedY: 0xfb,
+		AM_IndexedIndirect:  0xe3,
+		AM_IndirectIndexed:  0xf3,
+	},
+	"anc": {
+		AM_Immediate: 0x0b,
+	},
+	"alr": {
+		AM_Immediate: 0x4b,
+	},
+	"arr": {
+		AM_Immediate: 0x6b,
+	},
+	"sbx": {
+		AM_Immediate: 0xcb,
+	},
+	"nop": {
+		AM_Immediate:        0x80,
+		AM_ZeroPage:         0x04,
+		AM_ZeroPageIndexedX: 0x14,
+		AM_Absolute:         0x0c,
+		AM_AbsoluteIndexedX: 0x1c,
+	},
+}
+
+// Merge returns a new mnemonic table that contains the opcodes of all given tables. If a mnemonic is
+// defined in several tables, the addressing modes are combined; later tables win.
+func Merge(tables ...map[string]OpCodes) map[string]OpCodes {
+	res := make(map[string]OpCodes)
+	for _, table := range tables {
+		for mnemonic, opCodes := range table {
+			merged, found := res[mnemonic]
+			if !found {
+				merged = make(OpCodes)
+				res[mnemonic] = merged
+			}
+			for mode, opCode := range opCodes {
+				merged[mode] = opCode
+			}
+		}
+	}
+	return res
+}
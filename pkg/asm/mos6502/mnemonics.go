@@ -34,6 +34,15 @@ const (
 	AM_IndexedIndirect  // ($aa,X)
 	AM_IndirectIndexed  // ($aa),Y
 	AM_Relative         // $aa
+
+	// Addressing modes of the 65C02, 65CE02, and 4510
+	AM_ZeroPageIndirect        // ($aa)
+	AM_AbsoluteIndexedIndirect // ($aaaa,X)
+	AM_IndirectIndexedZ        // ($aa),Z
+	AM_StackIndirectIndexed    // ($aa,SP),Y
+	AM_ZeroPageRelative        // $aa,$bb
+	AM_RelativeLong            // $aaaa
+	AM_ImmediateWord           // #$aaaa
 )
 
 func (am AddressingMode) WithIndex(register string) AddressingMode {
@@ -86,6 +95,46 @@ func (am AddressingMode) WithSize(size int) AddressingMode {
 	return am
 }
 
+var addressingModeSyntax = map[AddressingMode]string{
+	AM_Implied:                 "",
+	AM_Immediate:               "#$aa",
+	AM_Accumulator:             "A",
+	AM_ZeroPage:                "$aa",
+	AM_ZeroPageIndexedX:        "$aa,X",
+	AM_ZeroPageIndexedY:        "$aa,Y",
+	AM_Absolute:                "$aaaa",
+	AM_AbsoluteIndirect:        "($aaaa)",
+	AM_AbsoluteIndexedX:        "$aaaa,X",
+	AM_AbsoluteIndexedY:        "$aaaa,Y",
+	AM_IndexedIndirect:         "($aa,X)",
+	AM_IndirectIndexed:         "($aa),Y",
+	AM_Relative:                "$aa",
+	AM_ZeroPageIndirect:        "($aa)",
+	AM_AbsoluteIndexedIndirect: "($aaaa,X)",
+	AM_IndirectIndexedZ:        "($aa),Z",
+	AM_StackIndirectIndexed:    "($aa,SP),Y",
+	AM_ZeroPageRelative:        "$aa,$bb",
+	AM_RelativeLong:            "$aaaa",
+	AM_ImmediateWord:           "#$aaaa",
+}
+
+// Syntax returns what the operand looks like in the source, e.g. "($aa),Y".
+func (am AddressingMode) Syntax() string {
+	return addressingModeSyntax[am]
+}
+
+// OperandSize returns the number of bytes of the operand.
+func (am AddressingMode) OperandSize() int {
+	switch am {
+	case AM_Implied, AM_Accumulator:
+		return 0
+	case AM_Absolute, AM_AbsoluteIndirect, AM_AbsoluteIndexedX, AM_AbsoluteIndexedY, AM_AbsoluteIndexedIndirect,
+		AM_RelativeLong, AM_ImmediateWord:
+		return 2
+	}
+	return 1
+}
+
 type OpCodes map[AddressingMode]byte
 
 var Mnemonics = map[string]OpCodes{
@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package mos6502
+
+// Timing is the number of cycles an instruction takes on the NMOS 6502/6510.
+type Timing struct {
+	Cycles    int
+	PageCross bool // One more cycle if the indexed address is on another page than the base address
+	Branch    bool // One more cycle if the branch is taken, two if the target is on another page
+}
+
+// Classes of instructions that share their timing
+const (
+	timingRead = iota
+	timingWrite
+	timingReadModifyWrite
+)
+
+var instructionClass = map[string]int{
+	"adc": timingRead, "and": timingRead, "bit": timingRead, "cmp": timingRead, "cpx": timingRead,
+	"cpy": timingRead, "eor": timingRead, "lda": timingRead, "ldx": timingRead, "ldy": timingRead,
+	"ora": timingRead, "sbc": timingRead, "nop": timingRead, "lax": timingRead,
+	"sta": timingWrite, "stx": timingWrite, "sty": timingWrite, "sax": timingWrite,
+	"asl": timingReadModifyWrite, "lsr": timingReadModifyWrite, "rol": timingReadModifyWrite,
+	"ror": timingReadModifyWrite, "inc": timingReadModifyWrite, "dec": timingReadModifyWrite,
+	"slo": timingReadModifyWrite, "rla": timingReadModifyWrite, "sre": timingReadModifyWrite,
+	"rra": timingReadModifyWrite, "dcp": timingReadModifyWrite, "isc": timingReadModifyWrite,
+}
+
+// Timings of implied instructions that don't take 2 cycles
+var impliedCycles = map[string]int{
+	"pha": 3, "php": 3, "pla": 4, "plp": 4, "rts": 6, "rti": 6, "brk": 7,
+}
+
+var branches = map[string]bool{
+	"bcc": true, "bcs": true, "beq": true, "bne": true, "bmi": true, "bpl": true, "bvc": true, "bvs": true,
+}
+
+// InstructionTiming returns the timing of an instruction of the NMOS 6502/6510, including the stable
+// undocumented ones. The second result is false for unknown instructions.
+func InstructionTiming(mnemonic string, mode AddressingMode) (Timing, bool) {
+	switch mnemonic {
+	case "jmp":
+		switch mode {
+		case AM_Absolute:
+			return Timing{Cycles: 3}, true
+		case AM_AbsoluteIndirect:
+			return Timing{Cycles: 5}, true
+		}
+		return Timing{}, false
+	case "jsr":
+		return Timing{Cycles: 6}, mode == AM_Absolute
+	}
+	if branches[mnemonic] {
+		return Timing{Cycles: 2, Branch: true}, mode == AM_Relative
+	}
+
+	switch mode {
+	case AM_Implied, AM_Accumulator:
+		if c, found := impliedCycles[mnemonic]; found {
+			return Timing{Cycles: c}, true
+		}
+		return Timing{Cycles: 2}, true
+	case AM_Immediate:
+		return Timing{Cycles: 2}, true
+	}
+
+	class, found := instructionClass[mnemonic]
+	if !found {
+		return Timing{}, false
+	}
+	switch class {
+	case timingRead:
+		switch mode {
+		case AM_ZeroPage:
+			return Timing{Cycles: 3}, true
+		case AM_ZeroPageIndexedX, AM_ZeroPageIndexedY, AM_Absolute:
+			return Timing{Cycles: 4}, true
+		case AM_AbsoluteIndexedX, AM_AbsoluteIndexedY:
+			return Timing{Cycles: 4, PageCross: true}, true
+		case AM_IndexedIndirect:
+			return Timing{Cycles: 6}, true
+		case AM_IndirectIndexed:
+			return Timing{Cycles: 5, PageCross: true}, true
+		}
+	case timingWrite:
+		switch mode {
+		case AM_ZeroPage:
+			return Timing{Cycles: 3}, true
+		case AM_ZeroPageIndexedX, AM_ZeroPageIndexedY, AM_Absolute:
+			return Timing{Cycles: 4}, true
+		case AM_AbsoluteIndexedX, AM_AbsoluteIndexedY:
+			return Timing{Cycles: 5}, true
+		case AM_IndexedIndirect, AM_IndirectIndexed:
+			return Timing{Cycles: 6}, true
+		}
+	case timingReadModifyWrite:
+		switch mode {
+		case AM_ZeroPage:
+			return Timing{Cycles: 5}, true
+		case AM_ZeroPageIndexedX, AM_Absolute:
+			return Timing{Cycles: 6}, true
+		case AM_AbsoluteIndexedX, AM_AbsoluteIndexedY:
+			return Timing{Cycles: 7}, true
+		case AM_IndexedIndirect, AM_IndirectIndexed:
+			return Timing{Cycles: 8}, true
+		}
+	}
+	return Timing{}, false
+}
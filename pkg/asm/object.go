@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"sort"
+
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/obj"
+)
+
+// Object returns the assembled module as an object file. It must only be called if the assembler was created with
+// output "obj".
+func (a *Assembler) Object(source string) *obj.File {
+	f := &obj.File{Source: source}
+
+	sectionIndex := make(map[*Section]int)
+	for _, s := range a.sections {
+		if s.ignore && len(s.bytes) == 0 || s.segment != nil && s.segment.def.BSS {
+			continue
+		}
+		sectionIndex[s] = len(f.Sections)
+		f.Sections = append(f.Sections, obj.Section{Org: s.org, Relocatable: s.relocatable, Bytes: s.bytes})
+	}
+
+	for _, sym := range a.symbols.symbols() {
+		if sym.kind == symbolMacro || sym.kind == symbolVariable || isLocalLabel(sym.name) || sym.val.Type() != expr.NodeType_Int {
+			continue
+		}
+		s := obj.Symbol{Name: sym.name, Label: sym.kind == symbolLabel}
+		if sym.val.IsResolved() {
+			r, _ := sym.val.Relocations()
+			s.Value = sym.val.Eval()
+			s.Relocatable = r == 1
+		} else {
+			s.Expr = expr.Marshal(sym.val)
+		}
+		f.Symbols = append(f.Symbols, s)
+	}
+	sort.Slice(f.Symbols, func(i, j int) bool { return f.Symbols[i].Name < f.Symbols[j].Name })
+
+	// Pending patches are registered once per unresolved symbol, so make sure we only write them once.
+	type patchKey struct {
+		section *Section
+		pc      int
+	}
+	seen := make(map[patchKey]bool)
+	addPatch := func(p patch) {
+		k := patchKey{p.section, p.pc}
+		if seen[k] {
+			return
+		}
+		seen[k] = true
+		idx, found := sectionIndex[p.section]
+		if !found {
+			return
+		}
+		f.Patches = append(f.Patches, obj.Patch{Section: idx, Offset: p.pc - p.section.org, Expr: *expr.Marshal(p.node)})
+	}
+	var imports []string
+	addImports := func(n expr.Node) {
+		for s := range n.UnresolvedSymbols() {
+			if _, found := a.symbols.get(s); !found {
+				imports = append(imports, s)
+			}
+		}
+	}
+	for _, patches := range a.patchesPerLabel {
+		for _, p := range patches {
+			if p.node.IsResolved() {
+				// Already applied when the last symbol was resolved.
+				continue
+			}
+			addImports(p.node)
+			addPatch(p)
+		}
+	}
+	for _, sym := range a.symbols.symbols() {
+		if sym.kind != symbolMacro && !sym.val.IsResolved() {
+			addImports(sym.val)
+		}
+	}
+	for _, p := range a.relocations {
+		addPatch(p)
+	}
+	sort.Slice(f.Patches, func(i, j int) bool {
+		if f.Patches[i].Section != f.Patches[j].Section {
+			return f.Patches[i].Section < f.Patches[j].Section
+		}
+		return f.Patches[i].Offset < f.Patches[j].Offset
+	})
+
+	sort.Strings(imports)
+	for i, imp := range imports {
+		if i == 0 || imports[i-1] != imp {
+			f.Imports = append(f.Imports, imp)
+		}
+	}
+	return f
+}
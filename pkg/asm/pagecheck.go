@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"sort"
+
+	"github.com/asig/cbmasm/pkg/asm/mos6502"
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/scanner"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+type pageCheckKind int
+
+const (
+	pageCheckBranch      pageCheckKind = iota // A relative branch that takes an extra cycle if it crosses a page
+	pageCheckIndexed                          // An indexed read that takes an extra cycle if it crosses a page
+	pageCheckJmpIndirect                      // JMP ($xxff), which the NMOS 6502 gets wrong
+	pageCheckSamePage                         // ".assert_same_page"
+)
+
+// pageCheck is a check of code whose timing or behavior depends on page boundaries. As it needs the final
+// addresses, all checks are done after assembly.
+type pageCheck struct {
+	kind  pageCheckKind
+	pos   text.Pos
+	pc    int       // Address of the next instruction
+	node  expr.Node // Branch target, base address, pointer, or start of the range
+	end   expr.Node // End of the range (exclusive); nil if the range ends at the next label
+	scope string    // Scope for local labels in node and end
+}
+
+// add6502PageChecks records the page checks for a 6502 instruction that was just emitted.
+func (a *Assembler) add6502PageChecks(mnemonic string, mode mos6502.AddressingMode, val expr.Node) {
+	if val == nil || a.section.relocatable {
+		// Nothing to check, or addresses are only known after linking
+		return
+	}
+	check := pageCheck{pos: val.Pos(), pc: a.section.PC(), node: val, scope: a.localScope()}
+	switch mode {
+	case mos6502.AM_Relative:
+		check.kind = pageCheckBranch
+	case mos6502.AM_AbsoluteIndexedX, mos6502.AM_AbsoluteIndexedY:
+		if t, found := mos6502.InstructionTiming(mnemonic, mode); !found || !t.PageCross {
+			return
+		}
+		check.kind = pageCheckIndexed
+	case mos6502.AM_AbsoluteIndirect:
+		if mnemonic != "jmp" || (a.currentCPU != "6502" && a.currentCPU != "6510ill") {
+			// Later CPUs fixed the bug
+			return
+		}
+		check.kind = pageCheckJmpIndirect
+	default:
+		return
+	}
+	a.pageChecks = append(a.pageChecks, check)
+}
+
+// handleAssertSamePage parses the parameters of ".assert_same_page":
+//
+//	start [ "," end ]
+//
+// Without end, the range ends at the next label.
+func (a *Assembler) handleAssertSamePage(t scanner.Token) {
+	a.nextToken()
+	check := pageCheck{kind: pageCheckSamePage, pos: t.Pos, scope: a.localScope()}
+	check.node = a.expr(2, false)
+	if a.lookahead.Type == scanner.Comma {
+		a.nextToken()
+		check.end = a.expr(2, false)
+	}
+	a.pageChecks = append(a.pageChecks, check)
+}
+
+// labelRangeEnd returns the end (exclusive) of the range that starts at label addr: the address of the next
+// label, or the end of the section. The second result is false if no label is at addr.
+func (a *Assembler) labelRangeEnd(addr int) (int, bool) {
+	var section *Section
+	for _, s := range a.sections {
+		if s.Contains(addr) {
+			section = s
+		}
+	}
+	if section == nil {
+		return 0, false
+	}
+	isLabel := false
+	end := section.org + len(section.bytes)
+	for _, d := range a.definitions {
+		if d.kind != symbolLabel || !d.val.IsResolved() {
+			continue
+		}
+		v := d.val.Eval()
+		if v == addr {
+			isLabel = true
+		} else if v > addr && v < end {
+			end = v
+		}
+	}
+	return end, isLabel
+}
+
+// samePage returns whether addresses start to end (exclusive) are on the same page.
+func samePage(start, end int) bool {
+	return end <= start || start>>8 == (end-1)>>8
+}
+
+// checkPages is called after assembly and runs all page checks.
+func (a *Assembler) checkPages() {
+	for _, c := range a.pageChecks {
+		a.resolveLate(c.node, c.scope)
+		if c.end != nil {
+			a.resolveLate(c.end, c.scope)
+		}
+		if !c.node.IsResolved() || (c.end != nil && !c.end.IsResolved()) {
+			if c.kind == pageCheckSamePage {
+				a.reportUnresolved(c.node, c.end)
+			}
+			// Operands of instructions have already been reported as errors
+			continue
+		}
+		addr := c.node.Eval()
+		switch c.kind {
+		case pageCheckBranch:
+			if addr>>8 != c.pc>>8 {
+				a.warn(WarnPageCrossing, c.pos, "Branch crosses a page boundary and takes an extra cycle if taken")
+			}
+		case pageCheckIndexed:
+			end, isLabel := a.labelRangeEnd(addr)
+			if isLabel && !samePage(addr, end) {
+				a.warn(WarnPageCrossing, c.pos, "Table at $%04x-$%04x crosses a page boundary; indexed reads can take an extra cycle", addr, end-1)
+			}
+		case pageCheckJmpIndirect:
+			if addr&0xff == 0xff {
+				a.warn(WarnJmpIndirect, c.pos, "JMP ($%04x) reads the high byte of the target from $%04x on the NMOS 6502", addr, addr&0xff00)
+			}
+		case pageCheckSamePage:
+			end := 0
+			if c.end != nil {
+				end = c.end.Eval()
+			} else {
+				var isLabel bool
+				if end, isLabel = a.labelRangeEnd(addr); !isLabel {
+					a.AddError(c.pos, "$%04x is not the address of a label", addr)
+					continue
+				}
+			}
+			if !samePage(addr, end) {
+				a.AddError(c.pos, "Range $%04x-$%04x crosses a page boundary", addr, end-1)
+			}
+		}
+	}
+}
+
+func (a *Assembler) reportUnresolved(nodes ...expr.Node) {
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		var syms []string
+		for sym := range n.UnresolvedSymbols() {
+			syms = append(syms, sym)
+		}
+		sort.Strings(syms)
+		for _, sym := range syms {
+			a.AddError(n.Pos(), "Undefined label %q", sym)
+		}
+	}
+}
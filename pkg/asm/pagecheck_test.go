@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+func TestAssembler_PageChecks(t *testing.T) {
+	tests := []struct {
+		name     string
+		cpu      string
+		warn     bool
+		src      string
+		errors   []string
+		warnings []string
+	}{
+		{
+			name: "branch across page",
+			warn: true,
+			src: `	.org $10fc
+	bne l1
+	bne l1
+l1	rts
+`,
+			warnings: []string{"line 2: Branch crosses a page boundary and takes an extra cycle if taken [-Wpage-crossing]"},
+		},
+		{
+			name: "branch warnings are optional",
+			src: `	.org $10fc
+	bne l1
+	bne l1
+l1	rts
+`,
+		},
+		{
+			name: "indexed tables",
+			warn: true,
+			src: `	.org $10f0
+	lda tab1,x
+	sta tab1,x
+	lda tab2,y
+	lda tab1+1,x
+	rts
+tab1	.byte 1, 2, 3, 4
+tab2	.byte 1, 2, 3
+`,
+			warnings: []string{"line 2: Table at $10fd-$1100 crosses a page boundary; indexed reads can take an extra cycle [-Wpage-crossing]"},
+		},
+		{
+			name: "jmp indirect",
+			src: `	.org $1000
+	jmp (vec)
+	jmp (vec+1)
+vec	.equ $03ff
+`,
+			warnings: []string{"line 2: JMP ($03ff) reads the high byte of the target from $0300 on the NMOS 6502 [-Wjmp-indirect]"},
+		},
+		{
+			name: "jmp indirect on 65c02",
+			cpu:  "65c02",
+			src: `	.org $1000
+	jmp ($03ff)
+`,
+		},
+		{
+			name: "assert same page",
+			src: `	.org $10fc
+start	nop
+	nop
+	nop
+loop	dex
+	.assert_same_page loop
+	.assert_same_page loop, _end
+_l	bne loop
+_end	rts
+	.assert_same_page _l
+	.assert_same_page missing
+	.assert_same_page undefined
+missing	.equ $1234
+`,
+			errors: []string{
+				"line 7: Range $10ff-$1101 crosses a page boundary",
+				"line 11: $1234 is not the address of a label",
+				"line 12: Undefined label \"undefined\"",
+			},
+		},
+		{
+			name: "assert same page with local labels",
+			src: `	.org $10f0
+a	nop
+_l	nop
+	.assert_same_page _l, _e
+_e	rts
+b	.reserve 12, 0
+_l	nop
+	.assert_same_page _l, _e
+	nop
+_e	rts
+`,
+			errors: []string{"line 8: Range $10ff-$1100 crosses a page boundary"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu, platform := "6502", "c64"
+			if tt.cpu != "" {
+				cpu, platform = tt.cpu, "generic"
+			}
+			assembler := New([]string{}, cpu, platform, "plain", "petscii", []string{})
+			assembler.SetWarning(WarnPageCrossing, tt.warn)
+			assembler.Assemble(text.Process("main.asm", tt.src))
+			var errs, warnings []string
+			for _, e := range assembler.Errors() {
+				errs = append(errs, fmt.Sprintf("line %d: %s", e.Pos.Line, e.Message()))
+			}
+			for _, e := range assembler.Warnings() {
+				warnings = append(warnings, fmt.Sprintf("line %d: %s", e.Pos.Line, e.Message()))
+			}
+			if !reflect.DeepEqual(errs, tt.errors) {
+				t.Errorf("Got errors %v, want %v", errs, tt.errors)
+			}
+			if !reflect.DeepEqual(warnings, tt.warnings) {
+				t.Errorf("Got warnings %v, want %v", warnings, tt.warnings)
+			}
+		})
+	}
+}
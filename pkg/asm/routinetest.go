@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/scanner"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// Test is a test of a routine, defined with ".test". The routine is called with the registers and memory set
+// up as given, and needs to return with them in the expected state.
+type Test struct {
+	Name    string
+	Pos     text.Pos
+	Routine int
+	Given   []Assignment
+	Expect  []Assignment
+}
+
+// Assignment sets or checks a register or memory.
+type Assignment struct {
+	Pos      text.Pos
+	Register string // "a", "x", "y", "sp", or "p"; empty for memory
+	Addr     int    // Start address for memory
+	Values   []int  // The value of a register, or the bytes starting at Addr
+}
+
+// testRegisters are the registers that can be used in ".given" and ".expect".
+var testRegisters = map[string]bool{"a": true, "x": true, "y": true, "sp": true, "p": true}
+
+// pendingTest is a test whose expressions might still contain forward references.
+type pendingTest struct {
+	name    string
+	pos     text.Pos
+	routine expr.Node
+	given   []pendingAssignment
+	expect  []pendingAssignment
+	closed  bool
+}
+
+type pendingAssignment struct {
+	pos      text.Pos
+	register string
+	addr     expr.Node
+	values   []expr.Node
+}
+
+func (a *Assembler) currentTest() *pendingTest {
+	if len(a.tests) == 0 || a.tests[len(a.tests)-1].closed {
+		return nil
+	}
+	return a.tests[len(a.tests)-1]
+}
+
+func (a *Assembler) handleTest(t scanner.Token) {
+	a.nextToken()
+	if cur := a.currentTest(); cur != nil {
+		a.AddError(t.Pos, "Tests can't be nested; .endtest expected")
+		cur.closed = true
+	}
+	name := a.lookahead.StrVal
+	a.match(scanner.String)
+	a.match(scanner.Comma)
+	routine := a.expr(2, false)
+	a.tests = append(a.tests, &pendingTest{name: name, pos: t.Pos, routine: routine})
+}
+
+// handleTestAssignment parses the parameters of ".given" and ".expect":
+//
+//	register "," expr
+//	addr "," expr { "," expr }
+func (a *Assembler) handleTestAssignment(t scanner.Token) {
+	a.nextToken()
+	cur := a.currentTest()
+	if cur == nil {
+		a.AddError(t.Pos, "%s without .test", t.Type)
+	}
+	asgn := pendingAssignment{pos: a.lookahead.Pos}
+	if a.lookahead.Type == scanner.Ident && testRegisters[strings.ToLower(a.lookahead.StrVal)] {
+		asgn.register = strings.ToLower(a.lookahead.StrVal)
+		a.nextToken()
+	} else {
+		asgn.addr = a.expr(2, false)
+	}
+	a.match(scanner.Comma)
+	asgn.values = append(asgn.values, a.expr(1, false))
+	for a.lookahead.Type == scanner.Comma {
+		if asgn.register != "" {
+			a.AddError(a.lookahead.Pos, "Only one value can be assigned to a register")
+		}
+		a.nextToken()
+		asgn.values = append(asgn.values, a.expr(1, false))
+	}
+	if cur == nil {
+		return
+	}
+	if t.Type == scanner.Given {
+		cur.given = append(cur.given, asgn)
+	} else {
+		cur.expect = append(cur.expect, asgn)
+	}
+}
+
+func (a *Assembler) handleEndTest(t scanner.Token) {
+	a.nextToken()
+	cur := a.currentTest()
+	if cur == nil {
+		a.AddError(t.Pos, ".endtest without .test")
+		return
+	}
+	cur.closed = true
+}
+
+// resolveTestNode resolves the remaining symbols of n with the final symbol table.
+func (a *Assembler) resolveTestNode(n expr.Node, min, max int) int {
+	for sym := range n.UnresolvedSymbols() {
+		if s, found := a.symbols.get(sym); found && s.kind != symbolMacro && s.val.IsResolved() && s.val.Type() == expr.NodeType_Int {
+			n.Resolve(sym, s.val.Eval())
+		}
+	}
+	if !n.IsResolved() {
+		var syms []string
+		for sym := range n.UnresolvedSymbols() {
+			syms = append(syms, sym)
+		}
+		a.AddError(n.Pos(), "Unresolved symbol(s) in test: %s", strings.Join(syms, ", "))
+		return 0
+	}
+	if n.Type() != expr.NodeType_Int {
+		a.AddError(n.Pos(), "Test values need to be integers")
+		return 0
+	}
+	val := n.Eval()
+	if val < min || val > max {
+		a.AddError(n.Pos(), "Value $%x (decimal %d) is out of range", val, val)
+	}
+	return val
+}
+
+// finishTests is called after assembly; it reports unclosed tests and resolves all expressions.
+func (a *Assembler) finishTests() {
+	a.resolvedTests = nil
+	for _, pt := range a.tests {
+		if !pt.closed {
+			a.AddError(pt.pos, ".endtest expected")
+		}
+		t := Test{Name: pt.name, Pos: pt.pos, Routine: a.resolveTestNode(pt.routine, 0, 0xffff)}
+		resolve := func(pas []pendingAssignment) []Assignment {
+			var res []Assignment
+			for _, pa := range pas {
+				asgn := Assignment{Pos: pa.pos, Register: pa.register}
+				if pa.addr != nil {
+					asgn.Addr = a.resolveTestNode(pa.addr, 0, 0xffff)
+				}
+				for _, v := range pa.values {
+					asgn.Values = append(asgn.Values, a.resolveTestNode(v, -128, 255)&0xff)
+				}
+				res = append(res, asgn)
+			}
+			return res
+		}
+		t.Given = resolve(pt.given)
+		t.Expect = resolve(pt.expect)
+		a.resolvedTests = append(a.resolvedTests, t)
+	}
+}
+
+// Tests returns the tests defined with ".test".
+func (a *Assembler) Tests() []Test {
+	return a.resolvedTests
+}
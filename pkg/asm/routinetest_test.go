@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+func TestAssembler_Tests(t *testing.T) {
+	src := `	.org $1000
+	.test "forward", clear
+	.given a, -1
+	.given buf, 1, 2, 3
+	.expect buf, 0, 0, 0
+	.expect x, len
+	.endtest
+clear	ldx #len
+	rts
+buf	.equ $2000
+len	.equ 3
+`
+	assembler := New([]string{}, "6502", "c64", "plain", "petscii", []string{})
+	assembler.Assemble(text.Process("main.asm", src))
+	if errs := assembler.Errors(); len(errs) > 0 {
+		t.Fatalf("Got errors %v, want none", errs)
+	}
+	pos := func(line, col int) text.Pos {
+		return text.Pos{Filename: "main.asm", Line: line, Col: col}
+	}
+	want := []Test{
+		{
+			Name:    "forward",
+			Pos:     text.Pos{Filename: "main.asm", Line: 2, Col: 2},
+			Routine: 0x1000,
+			Given: []Assignment{
+				{Pos: pos(3, 9), Register: "a", Values: []int{0xff}},
+				{Pos: pos(4, 9), Addr: 0x2000, Values: []int{1, 2, 3}},
+			},
+			Expect: []Assignment{
+				{Pos: pos(5, 10), Addr: 0x2000, Values: []int{0, 0, 0}},
+				{Pos: pos(6, 10), Register: "x", Values: []int{3}},
+			},
+		},
+	}
+	if got := assembler.Tests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+func TestAssembler_TestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "unclosed",
+			src:  "\t.test \"t\", 0\n",
+			want: []string{".endtest expected"},
+		},
+		{
+			name: "given without test",
+			src:  "\t.given a, 1\n",
+			want: []string{".given without .test"},
+		},
+		{
+			name: "endtest without test",
+			src:  "\t.endtest\n",
+			want: []string{".endtest without .test"},
+		},
+		{
+			name: "several values for register",
+			src:  "\t.test \"t\", 0\n\t.given a, 1, 2\n\t.endtest\n",
+			want: []string{"Only one value can be assigned to a register"},
+		},
+		{
+			name: "unresolved",
+			src:  "\t.test \"t\", missing\n\t.endtest\n",
+			want: []string{"Unresolved symbol(s) in test: missing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assembler := New([]string{}, "6502", "c64", "plain", "petscii", []string{})
+			assembler.Assemble(text.Process("main.asm", tt.src))
+			var got []string
+			for _, e := range assembler.Errors() {
+				got = append(got, e.Msg)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Got errors %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
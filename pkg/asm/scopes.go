@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/scanner"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// symbolScope is a block started with ".scope" or ".proc". The names of the symbols defined in it are qualified
+// with the names of all enclosing blocks, e.g. "player::x", so that different blocks can use the same names.
+type symbolScope struct {
+	name string
+	proc bool
+	pos  text.Pos
+
+	// Forward references made in the block. If the symbol is not defined in the block, they refer to a symbol of
+	// the enclosing block.
+	refs []scopeRef
+}
+
+type scopeRef struct {
+	node *expr.SymbolRefNode
+	ref  int // Index in a.references
+}
+
+func (s *symbolScope) end() scanner.TokenType {
+	if s.proc {
+		return scanner.Endproc
+	}
+	return scanner.Endscope
+}
+
+// localPart returns the unqualified part of a symbol name, e.g. "x" for "player::x".
+func localPart(name string) string {
+	if i := strings.LastIndex(name, "::"); i >= 0 {
+		return name[i+2:]
+	}
+	return name
+}
+
+// scopePrefix returns the qualification for symbols in the outermost n open blocks, e.g. "player::".
+func (a *Assembler) scopePrefix(n int) string {
+	var sb strings.Builder
+	for _, s := range a.symbolScopes[:n] {
+		sb.WriteString(s.name)
+		sb.WriteString("::")
+	}
+	return sb.String()
+}
+
+// qualify returns the name of a symbol that is defined in the current block.
+func (a *Assembler) qualify(name string) string {
+	return a.scopePrefix(len(a.symbolScopes)) + name
+}
+
+// lookupSymbol returns the symbol that name refers to in the current block, and its qualified name. Symbols of
+// the enclosing blocks are visible unless they are hidden by a symbol with the same name, and names starting with
+// "::" refer to the outermost block. Local labels are only visible in the block they're defined in.
+func (a *Assembler) lookupSymbol(name string) (*symbol, string, bool) {
+	if strings.HasPrefix(name, "::") {
+		s, found := a.symbols.get(name[2:])
+		return s, name[2:], found
+	}
+	for n := len(a.symbolScopes); n >= 0; n-- {
+		qualified := a.scopePrefix(n) + name
+		if s, found := a.symbols.get(qualified); found {
+			return s, qualified, true
+		}
+		if isLocalLabel(name) {
+			break
+		}
+	}
+	return nil, "", false
+}
+
+// qualifiedName reads the rest of a name like "player::x" whose first part was already read.
+func (a *Assembler) qualifiedName(first string) string {
+	name := first
+	for a.lookahead.Type == scanner.DoubleColon {
+		a.nextToken()
+		name += "::" + a.lookahead.StrVal
+		a.match(scanner.Ident)
+	}
+	return name
+}
+
+// symbolRef returns a node for a reference to a symbol that is not defined yet. Until the current block ends, it
+// refers to a symbol in the current block.
+func (a *Assembler) symbolRef(p text.Pos, name string, size int) expr.Node {
+	if strings.HasPrefix(name, "::") {
+		a.addReference(p, name[2:])
+		return a.forwardRef(p, name[2:], size)
+	}
+	qualified := a.qualify(name)
+	a.addReference(p, qualified)
+	node := a.forwardRef(p, qualified, size)
+	if len(a.symbolScopes) > 0 {
+		s := a.symbolScopes[len(a.symbolScopes)-1]
+		s.refs = append(s.refs, scopeRef{node: node.(*expr.SymbolRefNode), ref: len(a.references) - 1})
+	}
+	return node
+}
+
+func (a *Assembler) handleScope(t scanner.Token) {
+	a.nextToken()
+	pos := a.lookahead.Pos
+	name := a.lookahead.StrVal
+	a.match(scanner.Ident)
+	proc := t.Type == scanner.Proc
+	if proc {
+		a.addLabel(pos, name)
+	}
+	a.symbolScopes = append(a.symbolScopes, &symbolScope{name: name, proc: proc, pos: t.Pos})
+}
+
+func (a *Assembler) handleEndScope(t scanner.Token) {
+	a.nextToken()
+	if len(a.symbolScopes) == 0 || a.symbolScopes[len(a.symbolScopes)-1].end() != t.Type {
+		start := ".scope"
+		if t.Type == scanner.Endproc {
+			start = ".proc"
+		}
+		a.AddError(t.Pos, "%s without %s", t.Type, start)
+		return
+	}
+	a.closeSymbolScope()
+}
+
+// closeSymbolScope ends the innermost block. Forward references to symbols that were not defined in the block
+// now refer to the enclosing block.
+func (a *Assembler) closeSymbolScope() {
+	s := a.symbolScopes[len(a.symbolScopes)-1]
+	a.symbolScopes = a.symbolScopes[:len(a.symbolScopes)-1]
+	outerPrefix := a.qualify("")
+	innerPrefix := outerPrefix + s.name + "::"
+
+	renamed := make(map[string]string)
+	var outer *symbolScope
+	if len(a.symbolScopes) > 0 {
+		outer = a.symbolScopes[len(a.symbolScopes)-1]
+	}
+	for _, r := range s.refs {
+		old := r.node.Symbol()
+		if r.node.IsResolved() || isLocalLabel(old) || !strings.HasPrefix(old, innerPrefix) {
+			continue
+		}
+		if _, found := a.symbols.get(old); found {
+			continue
+		}
+		name := outerPrefix + strings.TrimPrefix(old, innerPrefix)
+		r.node.Rename(name)
+		a.references[r.ref].name = name
+		renamed[old] = name
+		if outer != nil {
+			outer.refs = append(outer.refs, r)
+		}
+	}
+	for old, name := range renamed {
+		a.patchesPerLabel[name] = append(a.patchesPerLabel[name], a.patchesPerLabel[old]...)
+		delete(a.patchesPerLabel, old)
+		if sym, found := a.symbols.get(name); found && sym.kind != symbolMacro && sym.val.IsResolved() {
+			a.resolveDependencies(name, sym.val)
+		}
+	}
+}
+
+// closeSymbolScopes ends the blocks that are still open at the end of the source.
+func (a *Assembler) closeSymbolScopes(pos text.Pos) {
+	for len(a.symbolScopes) > 0 {
+		a.AddError(pos, "%s expected", a.symbolScopes[len(a.symbolScopes)-1].end())
+		a.closeSymbolScope()
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAssembler_Scopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		want   []byte
+		errors []string
+	}{
+		{
+			name: "procs share names",
+			src: `	.org $1000
+	.proc clear
+	ldx #0
+loop	dex
+	bne loop
+_done	rts
+	.endproc
+	.proc fill
+	ldx #2
+loop	dex
+	bne loop
+_done	rts
+	.endproc
+	jsr clear
+	jsr fill
+`,
+			want: []byte{
+				0xa2, 0x00, 0xca, 0xd0, 0xfd, 0x60,
+				0xa2, 0x02, 0xca, 0xd0, 0xfd, 0x60,
+				0x20, 0x00, 0x10, 0x20, 0x06, 0x10,
+			},
+		},
+		{
+			name: "qualified names",
+			src: `	.org $1000
+base	.equ $10
+	.scope player
+x	.equ base + 1
+	.scope sprite
+y	.equ x + 1
+	.endscope
+	.endscope
+	.byte player::x, player::sprite::y, ::base
+`,
+			want: []byte{0x11, 0x12, 0x10},
+		},
+		{
+			name: "inner names hide outer names",
+			src: `	.org $1000
+v	.equ 1
+	.scope s
+v	.equ 2
+	.byte v, ::v
+	.endscope
+	.byte v, s::v
+`,
+			want: []byte{2, 1, 1, 2},
+		},
+		{
+			name: "forward references",
+			src: `	.org $1000
+	jsr player::init
+	.proc player
+init	lda #val
+	jmp done
+val	.equ 5
+	.endproc
+done	rts
+`,
+			want: []byte{0x20, 0x03, 0x10, 0xa9, 0x05, 0x4c, 0x08, 0x10, 0x60},
+		},
+		{
+			name: "variables of outer blocks",
+			src: `	.org $1000
+n	:= 0
+	.scope s
+n	:= n + 1
+	.endscope
+	.byte n
+`,
+			want: []byte{1},
+		},
+		{
+			name: "macros",
+			src: `	.org $1000
+	.scope lib
+m	.macro
+	nop
+	.endm
+	m
+	.endscope
+	lib::m
+`,
+			want: []byte{0xea, 0xea},
+		},
+		{
+			name: "undefined qualified name",
+			src: `	.org $1000
+	.scope s
+	.endscope
+	.byte s::x
+`,
+			errors: []string{`line 4: Undefined label "s::x"`},
+		},
+		{
+			name: "mismatched end",
+			src: `	.org $1000
+	.scope s
+	.endproc
+	.endscope
+	.endscope
+`,
+			errors: []string{"line 3: .endproc without .proc", "line 5: .endscope without .scope"},
+		},
+		{
+			name: "missing end",
+			src: `	.org $1000
+	.proc p
+	rts
+`,
+			errors: []string{"line 4: .endproc expected"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := assembleTest(tt.src)
+			if !reflect.DeepEqual(errs, tt.errors) {
+				t.Errorf("Got errors %q, want %q", errs, tt.errors)
+			}
+			if tt.errors != nil {
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Got %s, want %s", toString(got), toString(tt.want))
+			}
+		})
+	}
+}
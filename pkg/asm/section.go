@@ -20,13 +20,17 @@ package asm
 
 import (
 	"github.com/asig/cbmasm/pkg/errors"
+	"github.com/asig/cbmasm/pkg/expr"
 )
 
 type Section struct {
-	ignore    bool
-	errorSink errors.Sink
-	org       int
-	bytes     []byte
+	ignore      bool
+	relocatable bool     // Only set for object files; org is relative to the module's base address
+	skipped     bool     // Set if the section was started with ".skip"
+	segment     *segment // Named segment the section belongs to, if any
+	errorSink   errors.Sink
+	org         int
+	bytes       []byte
 }
 
 func NewSection(org int, errorSink errors.Sink) *Section {
@@ -66,13 +70,25 @@ func (section *Section) Contains(pc int) bool {
 	return pc >= section.org && pc < section.org+len(section.bytes)
 }
 
+// needsRelocation returns whether the bytes emitted for n in this section depend on the module's base address.
+func (section *Section) needsRelocation(n expr.Node) bool {
+	r, ok := n.Relocations()
+	if !ok {
+		return true
+	}
+	if n.IsRelative() && section.relocatable {
+		// Branch and target are both relocatable, so the distance is fixed.
+		return r != 1
+	}
+	return r != 0
+}
+
 func (section *Section) ApplyPatch(p patch) {
-	// TODO(asigner): Add warning for JMP ($xxFF)
 	p.node.CheckRange(section.errorSink)
 	val := p.node.Eval()
 	if p.node.IsRelative() {
 		val = val - (p.pc + 1)
-		if val < -128 || val > 127 {
+		if !section.needsRelocation(p.node) && (val < -128 || val > 127) {
 			section.errorSink.AddError(p.node.Pos(), "Branch target too far away.")
 		}
 	}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/scanner"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// layout is a ".struct" or ".enum" block that is currently defined. Every field or member becomes a constant named
+// "name.field".
+type layout struct {
+	pos  text.Pos
+	name string // Empty for anonymous enums
+	enum bool
+
+	// Offset of the next field, or value of the next member
+	next int
+}
+
+func (l *layout) end() scanner.TokenType {
+	if l.enum {
+		return scanner.Endenum
+	}
+	return scanner.Endstruct
+}
+
+func (l *layout) symbolName(member string) string {
+	if l.name == "" {
+		return member
+	}
+	return l.name + "." + member
+}
+
+func (a *Assembler) handleLayout(t scanner.Token) {
+	a.nextToken()
+	l := &layout{pos: t.Pos, enum: t.Type == scanner.Enum}
+	if a.lookahead.Type == scanner.Ident || !l.enum {
+		l.name = a.lookahead.StrVal
+		a.match(scanner.Ident)
+	}
+	a.layout = l
+}
+
+// layoutLine handles a line in a ".struct" or ".enum" block.
+func (a *Assembler) layoutLine(t scanner.Token, labelPos text.Pos, label string) {
+	l := a.layout
+	if t.Type == l.end() {
+		a.nextToken()
+		a.layout = nil
+		if !l.enum {
+			a.addLayoutSymbol(t.Pos, l.symbolName("size"), l.next)
+		}
+		return
+	}
+	if t.Type == scanner.Eol || t.Type == scanner.Semicolon {
+		if label != "" {
+			a.layoutMember(labelPos, label)
+		}
+		return
+	}
+	if label == "" && t.Type == scanner.Ident {
+		// Member name that doesn't start at the beginning of the line
+		labelPos, label = t.Pos, t.StrVal
+		a.nextToken()
+		t = a.lookahead
+	}
+	if l.enum {
+		if label == "" {
+			a.AddError(t.Pos, "Enum member or %s expected", l.end())
+			return
+		}
+		if t.Type == scanner.Eq {
+			a.nextToken()
+			if v, ok := a.resolvedInt(); ok {
+				l.next = v
+			}
+		}
+		a.layoutMember(labelPos, label)
+		return
+	}
+
+	size := 0
+	switch t.Type {
+	case scanner.Byte, scanner.Word:
+		a.nextToken()
+		count := 1
+		if a.lookahead.Type != scanner.Eol && a.lookahead.Type != scanner.Semicolon {
+			if v, ok := a.resolvedInt(); ok {
+				count = v
+			}
+		}
+		size = count
+		if t.Type == scanner.Word {
+			size = 2 * count
+		}
+	case scanner.Reserve:
+		a.nextToken()
+		size, _ = a.resolvedInt()
+	default:
+		a.AddError(t.Pos, "Field or %s expected", l.end())
+		return
+	}
+	if size < 0 {
+		a.AddError(t.Pos, "Field size must not be negative")
+		size = 0
+	}
+	if label != "" {
+		a.layoutMember(labelPos, label)
+	}
+	l.next += size
+}
+
+// layoutMember adds a struct field at the current offset, or an enum member with the current value.
+func (a *Assembler) layoutMember(pos text.Pos, name string) {
+	l := a.layout
+	a.addLayoutSymbol(pos, l.symbolName(name), l.next)
+	if l.enum {
+		l.next++
+	}
+}
+
+func (a *Assembler) addLayoutSymbol(pos text.Pos, name string, val int) {
+	name = a.qualify(name)
+	node := expr.NewConst(pos, val, 2)
+	if err := a.addSymbol(name, symbolConst, node); err != nil {
+		a.AddError(pos, err.Error())
+		return
+	}
+	a.addDefinition(pos, name, symbolConst, node)
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAssembler_Structs(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		want   []byte
+		errors []string
+	}{
+		{
+			name: "struct",
+			src: `	.org $1000
+	.struct actor
+x	.byte
+y	.byte
+	.byte 2         ; padding
+hp:	.word
+	name .res 8
+flags	.byte
+	.endstruct
+	.byte actor.x, actor.y, actor.hp, actor.name, actor.flags, actor.size
+`,
+			want: []byte{0, 1, 4, 6, 14, 15},
+		},
+		{
+			name: "forward references",
+			src: `	.org $1000
+	ldx #actor.size
+	lda actors+actor.y,x
+	.struct actor
+x	.byte
+y	.byte
+	.endstruct
+actors	.reserve actor.size * 2
+`,
+			want: []byte{0xa2, 0x02, 0xbd, 0x06, 0x10, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			name: "enum",
+			src: `	.org $1000
+	.enum color
+black
+white
+red = 5
+	cyan
+	purple = color.red + 3
+	.endenum
+	.byte color.black, color.white, color.red, color.cyan, color.purple
+`,
+			want: []byte{0, 1, 5, 6, 8},
+		},
+		{
+			name: "anonymous enum",
+			src: `	.org $1000
+	.enum
+north
+south
+	.endenum
+	.byte north, south
+`,
+			want: []byte{0, 1},
+		},
+		{
+			name: "in scope",
+			src: `	.org $1000
+	.scope game
+	.struct point
+x	.byte
+y	.byte
+	.endstruct
+	.endscope
+	.byte game::point.y, game::point.size
+`,
+			want: []byte{1, 2},
+		},
+		{
+			name: "errors",
+			src: `	.org $1000
+	.struct s
+a	.byte
+a	.word
+	nop
+b	.res n
+	.endstruct
+	.endenum
+n	.equ 1
+`,
+			errors: []string{
+				`line 4: Symbol "s.a" already defined`,
+				"line 5: Field or .endstruct expected",
+				"line 6: Expression is not resolved",
+				"line 8: .endenum without .enum",
+			},
+		},
+		{
+			name: "missing end",
+			src: `	.org $1000
+	.enum e
+a
+`,
+			errors: []string{"line 4: .endenum expected"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := assembleTest(tt.src)
+			if !reflect.DeepEqual(errs, tt.errors) {
+				t.Errorf("Got errors %q, want %q", errs, tt.errors)
+			}
+			if tt.errors != nil {
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Got %s, want %s", toString(got), toString(tt.want))
+			}
+		})
+	}
+}
@@ -31,8 +31,23 @@ const (
 	symbolLabel symbolKind = iota
 	symbolConst
 	symbolMacro
+	symbolVariable
 )
 
+func (k symbolKind) String() string {
+	switch k {
+	case symbolLabel:
+		return "label"
+	case symbolConst:
+		return "const"
+	case symbolMacro:
+		return "macro"
+	case symbolVariable:
+		return "variable"
+	}
+	return fmt.Sprintf("symbolKind(%d)", int(k))
+}
+
 type symbolType int
 
 const (
@@ -44,7 +59,7 @@ type symbol struct {
 	name string
 	kind symbolKind
 	typ  symbolType
-	val  expr.Node // Only set for symbolKind in { symbolLabel, symbolConst }
+	val  expr.Node // Only set for symbolKind in { symbolLabel, symbolConst, symbolVariable }
 	m    *macro    // only set for symbolKind in { symbolMacro }
 }
 
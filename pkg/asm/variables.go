@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// setVariable handles ".set name, expr" and "name := expr". Unlike constants, variables can be reassigned, and
+// every reference sees the value the variable has at that point. Hence, the value must be known when it's set,
+// and variables can't be used before they're set.
+func (a *Assembler) setVariable(pos text.Pos, name string, val expr.Node) {
+	if !val.IsResolved() {
+		a.AddError(val.Pos(), "Value of variable %q must be known when it is set", name)
+		return
+	}
+	// Assign to a visible variable, or define one in the current block.
+	s, qualified, found := a.lookupSymbol(name)
+	if !found || s.kind != symbolVariable {
+		qualified = a.qualify(name)
+		s, found = a.symbols.get(qualified)
+	}
+	name = qualified
+	if found {
+		if s.kind != symbolVariable {
+			a.AddError(pos, "%q is a %s, not a variable", name, s.kind)
+			return
+		}
+		s.val = val
+		a.addDefinition(pos, name, symbolVariable, val)
+		return
+	}
+	if p, used := a.usedBeforeSet(name); used {
+		a.AddError(p, "Variable %q is used before it is set", name)
+	}
+	if err := a.addSymbol(name, symbolVariable, val); err != nil {
+		a.AddError(pos, err.Error())
+		return
+	}
+	a.addDefinition(pos, name, symbolVariable, val)
+}
+
+// usedBeforeSet returns the position of the first forward reference to name, if any.
+func (a *Assembler) usedBeforeSet(name string) (text.Pos, bool) {
+	for label, patches := range a.patchesPerLabel {
+		if strings.EqualFold(label, name) && len(patches) > 0 {
+			return patches[0].node.Pos(), true
+		}
+	}
+	for _, s := range a.symbols.symbols() {
+		if s.kind == symbolMacro || s.val.IsResolved() {
+			continue
+		}
+		for sym := range s.val.UnresolvedSymbols() {
+			if strings.EqualFold(sym, name) {
+				return s.val.Pos(), true
+			}
+		}
+	}
+	return text.Pos{}, false
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAssembler_Variables(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		want   []byte
+		errors []string
+	}{
+		{
+			name: "reassignment",
+			src: `	.org $1000
+cnt	:= 1
+	.byte cnt
+cnt	:= cnt + 1
+	.byte cnt
+	.set cnt, cnt * 10
+	.byte cnt
+	lda #cnt
+`,
+			want: []byte{1, 2, 20, 0xa9, 20},
+		},
+		{
+			name: "indented",
+			src: `	.org $1000
+	ofs := 3
+	ofs := ofs + 2
+	.byte ofs
+`,
+			want: []byte{5},
+		},
+		{
+			name: "while loop",
+			src: `	.org $1000
+i	:= 0
+	.while i < 4
+	.byte i * 3
+i	:= i + 1
+	.endwhile
+	.byte i
+`,
+			want: []byte{0, 3, 6, 9, 4},
+		},
+		{
+			name: "counter in macro",
+			src: `	.org $1000
+	.set count, 0
+bump	.macro
+	.set count, count + 1
+	.byte count
+	.endm
+	bump
+	bump
+	bump
+`,
+			want: []byte{1, 2, 3},
+		},
+		{
+			name: "const can't be reassigned",
+			src: `	.org $1000
+c	.equ 1
+c	:= 2
+`,
+			errors: []string{`line 3: "c" is a const, not a variable`},
+		},
+		{
+			name: "label can't be reassigned",
+			src: `	.org $1000
+l	nop
+	.set l, 2
+`,
+			errors: []string{`line 3: "l" is a label, not a variable`},
+		},
+		{
+			name: "variable can't be redefined as label",
+			src: `	.org $1000
+v	:= 1
+v	nop
+`,
+			errors: []string{`line 3: Symbol "v" already defined`},
+		},
+		{
+			name: "used before set",
+			src: `	.org $1000
+	lda v
+v	:= 1
+`,
+			errors: []string{`line 2: Variable "v" is used before it is set`},
+		},
+		{
+			name: "value must be known",
+			src: `	.org $1000
+v	:= later
+later	nop
+`,
+			errors: []string{`line 2: Value of variable "v" must be known when it is set`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := assembleTest(tt.src)
+			if !reflect.DeepEqual(errs, tt.errors) {
+				t.Errorf("Got errors %q, want %q", errs, tt.errors)
+			}
+			if tt.errors != nil {
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Got %s, want %s", toString(got), toString(tt.want))
+			}
+		})
+	}
+}
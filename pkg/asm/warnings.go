@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/errors"
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/scanner"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// Warning categories. They can be enabled and disabled with SetWarning, and suppressed for a single line with a
+// "; cbmasm:ignore <name>" comment.
+const (
+	WarnUnusedLabel   = "unused-label"   // A label is never referenced
+	WarnUnusedMacro   = "unused-macro"   // A macro is never called
+	WarnJmpIndirect   = "jmp-indirect"   // JMP ($xxff) on the NMOS 6502
+	WarnZeroPage      = "zp-fallback"    // A zero-page address is used with an absolute indexed addressing mode
+	WarnTruncation    = "truncation"     // A character in .byte doesn't fit into a byte
+	WarnShadowedLocal = "shadowed-local" // A local label in a macro hides the caller's local label
+	WarnPageCrossing  = "page-crossing"  // A branch or an indexed read crosses a page boundary
+)
+
+// WarningCategories contains all warning categories, and whether they are enabled by default.
+var WarningCategories = map[string]bool{
+	WarnUnusedLabel:   false,
+	WarnUnusedMacro:   false,
+	WarnJmpIndirect:   true,
+	WarnZeroPage:      false,
+	WarnTruncation:    true,
+	WarnShadowedLocal: true,
+	WarnPageCrossing:  false,
+}
+
+// WarningCategoryNames returns the names of all warning categories, sorted alphabetically.
+func WarningCategoryNames() []string {
+	var names []string
+	for name := range WarningCategories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetWarning enables or disables a warning category; "all" stands for all categories.
+func (a *Assembler) SetWarning(name string, enabled bool) error {
+	if name == "all" {
+		for category := range WarningCategories {
+			a.warningsEnabled[category] = enabled
+		}
+		return nil
+	}
+	if _, found := WarningCategories[name]; !found {
+		return fmt.Errorf("Unknown warning %q", name)
+	}
+	a.warningsEnabled[name] = enabled
+	return nil
+}
+
+// SetWarningsAsErrors turns all warnings into errors.
+func (a *Assembler) SetWarningsAsErrors(enabled bool) {
+	a.warningsAsErrors = enabled
+}
+
+var ignoreComment = regexp.MustCompile(`;\s*cbmasm:ignore\b(.*)$`)
+
+// recordIgnoredWarnings remembers which warnings are suppressed for line. Without names, all warnings are
+// suppressed.
+func (a *Assembler) recordIgnoredWarnings(line text.Line) {
+	m := ignoreComment.FindStringSubmatch(strings.TrimRight(string(line.Runes), "\r\n"))
+	if m == nil {
+		return
+	}
+	names := make(map[string]bool)
+	for _, name := range strings.FieldsFunc(m[1], func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' }) {
+		names[name] = true
+	}
+	a.ignoredWarnings[lineKey{filename: line.Filename, line: line.LineNumber}] = names
+}
+
+type lineKey struct {
+	filename string
+	line     int
+}
+
+func (a *Assembler) isIgnored(pos text.Pos, category string) bool {
+	names, found := a.ignoredWarnings[lineKey{filename: pos.Filename, line: pos.Line}]
+	if !found {
+		return false
+	}
+	return len(names) == 0 || names[category]
+}
+
+// warn adds a warning of the given category if the category is enabled.
+func (a *Assembler) warn(category string, pos text.Pos, message string, args ...interface{}) {
+	if !a.warningsEnabled[category] || a.isIgnored(pos, category) {
+		return
+	}
+	a.addWarning(pos, fmt.Sprintf(message, args...), category)
+}
+
+func (a *Assembler) addWarning(pos text.Pos, message string, category string) {
+	w := errors.Error{Pos: pos, Msg: message, Severity: errors.SeverityWarning, Category: category}
+	if a.errorModifier != nil {
+		w = a.errorModifier.Modify(w)
+	}
+	if a.warningsAsErrors {
+		w.Severity = errors.SeverityError
+		a.errors = append(a.errors, w)
+	} else {
+		a.warnings = append(a.warnings, w)
+	}
+}
+
+// reportUnused is called after assembly, and warns about labels and macros that were never used.
+func (a *Assembler) reportUnused() {
+	used := make(map[string]bool)
+	key := func(name, scope string) string {
+		return strings.ToLower(scope) + "." + strings.ToLower(name)
+	}
+	for _, r := range a.references {
+		used[key(r.name, r.scope)] = true
+	}
+	for _, d := range a.definitions {
+		if used[key(d.name, d.scope)] {
+			continue
+		}
+		switch d.kind {
+		case symbolLabel:
+			a.warn(WarnUnusedLabel, d.pos, "Label %q is never used", d.name)
+		case symbolMacro:
+			a.warn(WarnUnusedMacro, d.pos, "Macro %q is never used", d.name)
+		}
+	}
+}
+
+// checkStringTruncation warns about characters in a string literal that don't fit into a byte.
+func (a *Assembler) checkStringTruncation(pos text.Pos, str string) {
+	for _, r := range str {
+		if r > 0xff {
+			a.warn(WarnTruncation, pos, "Character %q doesn't fit into a byte and is truncated to $%02x", r, r&0xff)
+		}
+	}
+}
+
+// warnZeroPageFallback is called when an indexed zero-page operand needs to be assembled with an absolute indexed
+// addressing mode, which doesn't wrap around in the zero page.
+func (a *Assembler) warnZeroPageFallback(t scanner.Token, val expr.Node) {
+	a.warn(WarnZeroPage, val.Pos(), "%s has no indexed zero-page addressing mode for this register; using absolute addressing", strings.ToLower(t.StrVal))
+}
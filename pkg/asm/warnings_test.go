@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+func TestAssembler_Warnings(t *testing.T) {
+	tests := []struct {
+		name     string
+		enable   []string
+		disable  []string
+		werror   bool
+		src      string
+		errors   []string
+		warnings []string
+	}{
+		{
+			name:   "unused labels and macros",
+			enable: []string{WarnUnusedLabel, WarnUnusedMacro},
+			src: `	.org $1000
+start	jsr used
+	rts
+used	rts
+unused	rts
+m1	.macro
+	.endm
+m2	.macro
+	nop
+	.endm
+	m2
+`,
+			warnings: []string{
+				"line 2: Label \"start\" is never used [-Wunused-label]",
+				"line 5: Label \"unused\" is never used [-Wunused-label]",
+				"line 6: Macro \"m1\" is never used [-Wunused-macro]",
+			},
+		},
+		{
+			name: "unused labels are disabled by default",
+			src: `	.org $1000
+start	rts
+`,
+		},
+		{
+			name:   "unused local labels",
+			enable: []string{WarnUnusedLabel},
+			src: `	.org $1000
+l1	bne _l
+_l	rts
+l2	nop
+_l	rts
+_m	rts ; cbmasm:ignore unused-label
+	jmp l1
+	jmp l2
+`,
+			warnings: []string{"line 5: Label \"_l\" is never used [-Wunused-label]"},
+		},
+		{
+			name:   "zero-page fallback",
+			enable: []string{WarnZeroPage},
+			src: `	.org $1000
+	lda $12,y
+	ldx $12,y
+	sta $12,x
+`,
+			warnings: []string{"line 2: lda has no indexed zero-page addressing mode for this register; using absolute addressing [-Wzp-fallback]"},
+		},
+		{
+			name: "truncation",
+			src: `	.org $1000
+	.byte "a€b"
+`,
+			warnings: []string{"line 2: Character '€' doesn't fit into a byte and is truncated to $ac [-Wtruncation]"},
+		},
+		{
+			name: "shadowed local label",
+			src: `	.org $1000
+m	.macro
+_l	nop
+	.endm
+start	nop
+	m
+_l	nop
+	m
+`,
+			warnings: []string{"line 3: Local label _l hides the caller's label with the same name [-Wshadowed-local]\n  in macro m, line 1, called from main.asm, line 8"},
+		},
+		{
+			name: "zero-page fallback is off by default",
+			src: `	.org $1000
+	lda $12,y
+`,
+		},
+		{
+			name:    "disable all",
+			disable: []string{"all"},
+			src: `	.org $1000
+	lda $12,y
+	jmp ($12ff)
+`,
+		},
+		{
+			name:   "warnings as errors",
+			enable: []string{WarnZeroPage},
+			werror: true,
+			src: `	.org $1000
+	lda $12,y
+`,
+			errors: []string{"line 2: lda has no indexed zero-page addressing mode for this register; using absolute addressing [-Wzp-fallback]"},
+		},
+		{
+			name:   "inline suppression",
+			enable: []string{WarnZeroPage},
+			src: `	.org $1000
+	lda $12,y ; cbmasm:ignore zp-fallback
+	lda $12,y ; cbmasm:ignore truncation
+	lda $12,y ; cbmasm:ignore
+	jmp ($12ff) ; cbmasm:ignore zp-fallback, jmp-indirect
+`,
+			warnings: []string{"line 3: lda has no indexed zero-page addressing mode for this register; using absolute addressing [-Wzp-fallback]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assembler := New([]string{}, "6502", "c64", "plain", "petscii", []string{})
+			for _, w := range tt.enable {
+				if err := assembler.SetWarning(w, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, w := range tt.disable {
+				if err := assembler.SetWarning(w, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			assembler.SetWarningsAsErrors(tt.werror)
+			assembler.Assemble(text.Process("main.asm", tt.src))
+			var errs, warnings []string
+			for _, e := range assembler.Errors() {
+				errs = append(errs, fmt.Sprintf("line %d: %s", e.Pos.Line, e.Message()))
+			}
+			for _, e := range assembler.Warnings() {
+				warnings = append(warnings, fmt.Sprintf("line %d: %s", e.Pos.Line, e.Message()))
+			}
+			if !reflect.DeepEqual(errs, tt.errors) {
+				t.Errorf("Got errors %q, want %q", errs, tt.errors)
+			}
+			if !reflect.DeepEqual(warnings, tt.warnings) {
+				t.Errorf("Got warnings %q, want %q", warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestAssembler_SetWarning(t *testing.T) {
+	assembler := New([]string{}, "6502", "c64", "plain", "petscii", []string{})
+	if err := assembler.SetWarning("no-such-warning", true); err == nil {
+		t.Errorf("SetWarning(\"no-such-warning\") didn't fail")
+	}
+	for _, name := range WarningCategoryNames() {
+		if err := assembler.SetWarning(name, false); err != nil {
+			t.Errorf("SetWarning(%q) failed: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// definition records where a symbol was defined. Local labels are removed from the symbol table when their
+// scope ends, so all definitions need to be recorded separately.
+type definition struct {
+	name  string
+	kind  symbolKind
+	val   expr.Node // nil for macros
+	scope string    // Only set for local labels
+	pos   text.Pos
+}
+
+// reference records where a symbol was used.
+type reference struct {
+	name  string
+	scope string // Only set for local labels
+	pos   text.Pos
+}
+
+// Symbol is a label, constant, or macro that was defined in the source.
+type Symbol struct {
+	Name  string
+	Kind  string    // "label", "const", or "macro"
+	Scope string    // Global label a local label belongs to
+	Value expr.Node // nil for macros
+	Pos   text.Pos
+}
+
+// Reference is a use of a symbol in the source.
+type Reference struct {
+	Name  string
+	Scope string // Global label a local label belongs to
+	Pos   text.Pos
+}
+
+func (a *Assembler) currentScope(name string) string {
+	if !isLocalLabel(name) {
+		return ""
+	}
+	return a.localScope()
+}
+
+// localScope returns the global label local labels currently belong to.
+func (a *Assembler) localScope() string {
+	if len(a.scopes) == 0 {
+		return ""
+	}
+	return a.scopes[len(a.scopes)-1].name
+}
+
+func (a *Assembler) addDefinition(pos text.Pos, name string, kind symbolKind, val expr.Node) {
+	a.definitions = append(a.definitions, definition{name: name, kind: kind, val: val, scope: a.currentScope(name), pos: pos})
+}
+
+func (a *Assembler) addReference(pos text.Pos, name string) {
+	a.references = append(a.references, reference{name: name, scope: a.currentScope(name), pos: pos})
+}
+
+// Symbols returns all symbols that were defined, in the order of their definition.
+func (a *Assembler) Symbols() []Symbol {
+	var res []Symbol
+	for _, d := range a.definitions {
+		res = append(res, Symbol{Name: d.name, Kind: d.kind.String(), Scope: d.scope, Value: d.val, Pos: d.pos})
+	}
+	return res
+}
+
+// References returns all uses of symbols, in the order they appear in the source.
+func (a *Assembler) References() []Reference {
+	var res []Reference
+	for _, r := range a.references {
+		res = append(res, Reference{Name: r.name, Scope: r.scope, Pos: r.pos})
+	}
+	return res
+}
+
+// resolveLate resolves the remaining symbols of n after assembly. Local labels are removed from the symbol
+// table when their scope ends, so all symbols are looked up in the definitions, using scope for local labels.
+func (a *Assembler) resolveLate(n expr.Node, scope string) {
+	for sym := range n.UnresolvedSymbols() {
+		for _, d := range a.definitions {
+			if d.kind == symbolMacro || !strings.EqualFold(d.name, sym) || (isLocalLabel(sym) && !strings.EqualFold(d.scope, scope)) {
+				continue
+			}
+			if d.val.IsResolved() && d.val.Type() == expr.NodeType_Int {
+				n.Resolve(sym, d.val.Eval())
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package asm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+func TestAssembler_SymbolsAndReferences(t *testing.T) {
+	src := `	.org $1000
+delay	.macro
+	nop
+	.endm
+start	ldx #count
+_l	delay
+	dex
+	bne _l
+count	.equ 3
+	.ifdef start
+	.endif
+`
+	assembler := New([]string{}, "6502", "c128", "plain", "petscii", []string{})
+	assembler.Assemble(text.Process("main.asm", src))
+	if errs := assembler.Errors(); len(errs) > 0 {
+		t.Fatalf("Got errors %v, want none", errs)
+	}
+
+	type def struct {
+		name, kind, scope string
+		line, col         int
+	}
+	var gotDefs []def
+	for _, s := range assembler.Symbols() {
+		gotDefs = append(gotDefs, def{s.Name, s.Kind, s.Scope, s.Pos.Line, s.Pos.Col})
+	}
+	wantDefs := []def{
+		{"delay", "macro", "", 2, 1},
+		{"start", "label", "", 5, 1},
+		{"_l", "label", "start", 6, 1},
+		{"count", "const", "", 9, 1},
+	}
+	if !reflect.DeepEqual(gotDefs, wantDefs) {
+		t.Errorf("Got symbols %v, want %v", gotDefs, wantDefs)
+	}
+
+	gotRefs := assembler.References()
+	wantRefs := []Reference{
+		{Name: "count", Pos: text.Pos{Filename: "main.asm", Line: 5, Col: 12}},
+		{Name: "delay", Pos: text.Pos{Filename: "main.asm", Line: 6, Col: 4}},
+		{Name: "_l", Scope: "start", Pos: text.Pos{Filename: "main.asm", Line: 8, Col: 6}},
+		{Name: "start", Pos: text.Pos{Filename: "main.asm", Line: 10, Col: 9}},
+	}
+	if !reflect.DeepEqual(gotRefs, wantRefs) {
+		t.Errorf("Got references %v, want %v", gotRefs, wantRefs)
+	}
+}
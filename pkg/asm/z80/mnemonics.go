@@ -46,6 +46,12 @@ const (
 	Reg_R
 	Reg_IX
 	Reg_IY
+
+	// Undocumented half index registers
+	Reg_IXH
+	Reg_IXL
+	Reg_IYH
+	Reg_IYL
 )
 
 var (
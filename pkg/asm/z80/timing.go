@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package z80
+
+// Timing is the number of T-states an instruction takes.
+type Timing struct {
+	Cycles int // If the instruction is conditional, the T-states if the condition is not met
+	Taken  int // T-states if the condition is met or a block instruction repeats; 0 for other instructions
+}
+
+// mainTiming returns the timing of the unprefixed instruction op.
+func mainTiming(op byte) Timing {
+	x, y, z := op>>6, op>>3&7, op&7
+	p, q := y>>1, y&1
+	switch x {
+	case 0:
+		switch z {
+		case 0:
+			switch {
+			case y < 2:
+				return Timing{Cycles: 4}
+			case y == 2:
+				return Timing{Cycles: 8, Taken: 13}
+			case y == 3:
+				return Timing{Cycles: 12}
+			}
+			return Timing{Cycles: 7, Taken: 12}
+		case 1:
+			if q == 0 {
+				return Timing{Cycles: 10}
+			}
+			return Timing{Cycles: 11}
+		case 2:
+			return Timing{Cycles: []int{7, 7, 16, 13}[p]}
+		case 3:
+			return Timing{Cycles: 6}
+		case 4, 5:
+			if y == 6 {
+				return Timing{Cycles: 11}
+			}
+			return Timing{Cycles: 4}
+		case 6:
+			if y == 6 {
+				return Timing{Cycles: 10}
+			}
+			return Timing{Cycles: 7}
+		}
+		return Timing{Cycles: 4}
+	case 1, 2:
+		if usesMemoryOperand(op) {
+			return Timing{Cycles: 7}
+		}
+		return Timing{Cycles: 4}
+	}
+	switch z {
+	case 0:
+		return Timing{Cycles: 5, Taken: 11}
+	case 1:
+		if q == 0 {
+			return Timing{Cycles: 10}
+		}
+		return Timing{Cycles: []int{10, 4, 4, 6}[p]}
+	case 2:
+		return Timing{Cycles: 10}
+	case 3:
+		return Timing{Cycles: []int{10, 0, 11, 11, 19, 4, 4, 4}[y]}
+	case 4:
+		return Timing{Cycles: 10, Taken: 17}
+	case 5:
+		if q == 0 {
+			return Timing{Cycles: 11}
+		}
+		return Timing{Cycles: 17}
+	case 6:
+		return Timing{Cycles: 7}
+	}
+	return Timing{Cycles: 11}
+}
+
+// usesMemoryOperand returns whether the unprefixed instruction op accesses (HL), which becomes (IX+d) or (IY+d)
+// with a prefix.
+func usesMemoryOperand(op byte) bool {
+	x, y, z := op>>6, op>>3&7, op&7
+	switch x {
+	case 0:
+		return y == 6 && z >= 4 && z <= 6
+	case 1:
+		return (y == 6 || z == 6) && op != 0x76
+	case 2:
+		return z == 6
+	}
+	return false
+}
+
+// edTiming returns the timing of the instruction ED op.
+func edTiming(op byte) (Timing, bool) {
+	x, y, z := op>>6, op>>3&7, op&7
+	if x == 2 && z <= 3 && y >= 4 {
+		if y >= 6 {
+			return Timing{Cycles: 16, Taken: 21}, true
+		}
+		return Timing{Cycles: 16}, true
+	}
+	if x != 1 {
+		return Timing{}, false
+	}
+	switch z {
+	case 7:
+		if y >= 6 {
+			return Timing{}, false
+		}
+		if y >= 4 {
+			return Timing{Cycles: 18}, true
+		}
+		return Timing{Cycles: 9}, true
+	}
+	return Timing{Cycles: []int{12, 12, 15, 20, 8, 14, 8}[z]}, true
+}
+
+// InstructionTiming returns the timing of the instruction that starts with the given bytes. code needs to
+// contain at least the prefixes and the opcode; for DD CB d op and FD CB d op, all 4 bytes are needed. The
+// second result is false if the bytes are not a valid instruction.
+func InstructionTiming(code []byte) (Timing, bool) {
+	if len(code) == 0 {
+		return Timing{}, false
+	}
+	switch code[0] {
+	case 0xcb:
+		if len(code) < 2 {
+			return Timing{}, false
+		}
+		op := code[1]
+		switch {
+		case op&7 != 6:
+			return Timing{Cycles: 8}, true
+		case op>>6 == 1:
+			return Timing{Cycles: 12}, true
+		}
+		return Timing{Cycles: 15}, true
+	case 0xed:
+		if len(code) < 2 {
+			return Timing{}, false
+		}
+		return edTiming(code[1])
+	case 0xdd, 0xfd:
+		if len(code) < 2 {
+			return Timing{}, false
+		}
+		op := code[1]
+		switch op {
+		case 0xcb:
+			if len(code) < 4 {
+				return Timing{}, false
+			}
+			if code[3]>>6 == 1 {
+				return Timing{Cycles: 20}, true
+			}
+			return Timing{Cycles: 23}, true
+		case 0xdd, 0xed, 0xfd:
+			return Timing{}, false
+		}
+		t := mainTiming(op)
+		t.Cycles += 4
+		if t.Taken > 0 {
+			t.Taken += 4
+		}
+		if usesMemoryOperand(op) {
+			if op == 0x36 {
+				// LD (IX+d),n reads the displacement and the value in parallel
+				t.Cycles += 5
+			} else {
+				t.Cycles += 8
+			}
+		}
+		return t, true
+	}
+	return mainTiming(code[0]), true
+}
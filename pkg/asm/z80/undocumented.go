@@ -0,0 +1,263 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package z80
+
+import (
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/errors"
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+var (
+	stringToUndocumentedReg = map[string]Register{
+		"ixh": Reg_IXH,
+		"ixl": Reg_IXL,
+		"iyh": Reg_IYH,
+		"iyl": Reg_IYL,
+	}
+
+	// pVal contains the register codes for instructions with a DD or FD prefix, where H and L are
+	// replaced by the halves of the index register.
+	pVal = map[Register]int{
+		Reg_B:   0b000,
+		Reg_C:   0b001,
+		Reg_D:   0b010,
+		Reg_E:   0b011,
+		Reg_IXH: 0b100,
+		Reg_IXL: 0b101,
+		Reg_IYH: 0b100,
+		Reg_IYL: 0b101,
+		Reg_A:   0b111,
+	}
+)
+
+// UndocumentedRegisterFromString returns the undocumented register with the given name.
+func UndocumentedRegisterFromString(s string) (Register, bool) {
+	reg, found := stringToUndocumentedReg[strings.ToLower(s)]
+	return reg, found
+}
+
+// MnemonicsUndocumented contains the documented and the undocumented instructions.
+var MnemonicsUndocumented = merge(Mnemonics, undocumentedMnemonics)
+
+func merge(tables ...map[string]OpCodeEntryList) map[string]OpCodeEntryList {
+	res := make(map[string]OpCodeEntryList)
+	for _, table := range tables {
+		for mnemonic, entries := range table {
+			res[mnemonic] = append(append(OpCodeEntryList{}, res[mnemonic]...), entries...)
+		}
+	}
+	return res
+}
+
+const (
+	regsIX = Reg_B | Reg_C | Reg_D | Reg_E | Reg_IXH | Reg_IXL | Reg_A
+	regsIY = Reg_B | Reg_C | Reg_D | Reg_E | Reg_IYH | Reg_IYL | Reg_A
+)
+
+// halfIndexALU returns the entries for an ALU instruction with a half index register as operand.
+// If withA is set, the instruction needs "A" as first operand.
+func halfIndexALU(opCode int, withA bool) OpCodeEntryList {
+	var l OpCodeEntryList
+	for _, e := range []struct {
+		prefix int
+		regs   Register
+	}{{0xdd, Reg_IXH | Reg_IXL}, {0xfd, Reg_IYH | Reg_IYL}} {
+		prefix := e.prefix
+		patterns := []ParamPattern{{mode: AM_Register, regs: e.regs}}
+		if withA {
+			patterns = append([]ParamPattern{{mode: AM_Register, regs: Reg_A}}, patterns...)
+		}
+		l = append(l, OpCodeEntry{
+			patterns,
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				return []expr.Node{c(prefix), c(opCode | pVal[p[len(p)-1].R])}
+			},
+		})
+	}
+	return l
+}
+
+// indexedShift returns the undocumented forms of a shift or rotate instruction that store the result of
+// (IX+d) or (IY+d) in a register. If basicForms is set, the forms with just one operand are included, too.
+func indexedShift(opCode int, basicForms bool) OpCodeEntryList {
+	var l OpCodeEntryList
+	if basicForms {
+		l = append(l,
+			OpCodeEntry{ // op r
+				[]ParamPattern{{mode: AM_Register, regs: Reg_B | Reg_C | Reg_D | Reg_E | Reg_H | Reg_L | Reg_A}},
+				func(p []Param, errorSink errors.Sink) []expr.Node {
+					return []expr.Node{c(0xcb), c(opCode | rVal[p[0].R])}
+				},
+			},
+			OpCodeEntry{ // op (HL)
+				[]ParamPattern{{mode: AM_RegisterIndirect, regs: Reg_HL}},
+				func(p []Param, errorSink errors.Sink) []expr.Node {
+					return []expr.Node{c(0xcb), c(opCode | 0b110)}
+				},
+			},
+			OpCodeEntry{ // op (IX + d)
+				[]ParamPattern{{mode: AM_Indexed, regs: Reg_IX}},
+				func(p []Param, errorSink errors.Sink) []expr.Node {
+					return []expr.Node{c(0xdd), c(0xcb), p[0].Val, c(opCode | 0b110)}
+				},
+			},
+			OpCodeEntry{ // op (IY + d)
+				[]ParamPattern{{mode: AM_Indexed, regs: Reg_IY}},
+				func(p []Param, errorSink errors.Sink) []expr.Node {
+					return []expr.Node{c(0xfd), c(0xcb), p[0].Val, c(opCode | 0b110)}
+				},
+			},
+		)
+	}
+	l = append(l,
+		OpCodeEntry{ // op (IX + d),r
+			[]ParamPattern{{mode: AM_Indexed, regs: Reg_IX}, {mode: AM_Register, regs: Reg_B | Reg_C | Reg_D | Reg_E | Reg_H | Reg_L | Reg_A}},
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				return []expr.Node{c(0xdd), c(0xcb), p[0].Val, c(opCode | rVal[p[1].R])}
+			},
+		},
+		OpCodeEntry{ // op (IY + d),r
+			[]ParamPattern{{mode: AM_Indexed, regs: Reg_IY}, {mode: AM_Register, regs: Reg_B | Reg_C | Reg_D | Reg_E | Reg_H | Reg_L | Reg_A}},
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				return []expr.Node{c(0xfd), c(0xcb), p[0].Val, c(opCode | rVal[p[1].R])}
+			},
+		},
+	)
+	return l
+}
+
+// indexedBit returns the entries for RES and SET that store the result of (IX+d) or (IY+d) in a register.
+func indexedBit(opCode int) OpCodeEntryList {
+	var l OpCodeEntryList
+	for _, e := range []struct {
+		prefix int
+		reg    Register
+	}{{0xdd, Reg_IX}, {0xfd, Reg_IY}} {
+		prefix := e.prefix
+		l = append(l, OpCodeEntry{ // op b,(IX + d),r
+			[]ParamPattern{{mode: AM_Immediate}, {mode: AM_Indexed, regs: e.reg}, {mode: AM_Register, regs: Reg_B | Reg_C | Reg_D | Reg_E | Reg_H | Reg_L | Reg_A}},
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				p[0].Val.SetRange(0, 7)
+				bitShifted := expr.NewBinaryOp(p[0].Val, expr.NewConst(text.Pos{}, 8, 1), expr.Mul)
+				b4 := expr.NewBinaryOp(bitShifted, expr.NewConst(p[2].Pos, opCode|rVal[p[2].R], 1), expr.Or)
+				return []expr.Node{c(prefix), c(0xcb), p[1].Val, b4}
+			},
+		})
+	}
+	return l
+}
+
+var undocumentedMnemonics = map[string]OpCodeEntryList{
+	"adc": halfIndexALU(0b10001000, true),
+	"add": halfIndexALU(0b10000000, true),
+	"and": halfIndexALU(0b10100000, false),
+	"cp":  halfIndexALU(0b10111000, false),
+	"dec": {
+		OpCodeEntry{ // DEC IXH, DEC IXL
+			[]ParamPattern{{mode: AM_Register, regs: Reg_IXH | Reg_IXL}},
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				return []expr.Node{c(0xdd), c(0b00000101 | pVal[p[0].R]<<3)}
+			},
+		},
+		OpCodeEntry{ // DEC IYH, DEC IYL
+			[]ParamPattern{{mode: AM_Register, regs: Reg_IYH | Reg_IYL}},
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				return []expr.Node{c(0xfd), c(0b00000101 | pVal[p[0].R]<<3)}
+			},
+		},
+	},
+	"in": {
+		OpCodeEntry{ // IN (C)
+			[]ParamPattern{{mode: AM_RegisterIndirect, regs: Reg_C}},
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				return []expr.Node{c(0xed), c(0x70)}
+			},
+		},
+	},
+	"inc": {
+		OpCodeEntry{ // INC IXH, INC IXL
+			[]ParamPattern{{mode: AM_Register, regs: Reg_IXH | Reg_IXL}},
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				return []expr.Node{c(0xdd), c(0b00000100 | pVal[p[0].R]<<3)}
+			},
+		},
+		OpCodeEntry{ // INC IYH, INC IYL
+			[]ParamPattern{{mode: AM_Register, regs: Reg_IYH | Reg_IYL}},
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				return []expr.Node{c(0xfd), c(0b00000100 | pVal[p[0].R]<<3)}
+			},
+		},
+	},
+	"ld": {
+		OpCodeEntry{ // LD p,p'
+			[]ParamPattern{{mode: AM_Register, regs: regsIX}, {mode: AM_Register, regs: regsIX}},
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				return []expr.Node{c(0xdd), c(0b01000000 | pVal[p[0].R]<<3 | pVal[p[1].R])}
+			},
+		},
+		OpCodeEntry{ // LD q,q'
+			[]ParamPattern{{mode: AM_Register, regs: regsIY}, {mode: AM_Register, regs: regsIY}},
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				return []expr.Node{c(0xfd), c(0b01000000 | pVal[p[0].R]<<3 | pVal[p[1].R])}
+			},
+		},
+		OpCodeEntry{ // LD IXH,n, LD IXL,n
+			[]ParamPattern{{mode: AM_Register, regs: Reg_IXH | Reg_IXL}, {mode: AM_Immediate}},
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				return []expr.Node{c(0xdd), c(0b00000110 | pVal[p[0].R]<<3), p[1].Val}
+			},
+		},
+		OpCodeEntry{ // LD IYH,n, LD IYL,n
+			[]ParamPattern{{mode: AM_Register, regs: Reg_IYH | Reg_IYL}, {mode: AM_Immediate}},
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				return []expr.Node{c(0xfd), c(0b00000110 | pVal[p[0].R]<<3), p[1].Val}
+			},
+		},
+	},
+	"or": halfIndexALU(0b10110000, false),
+	"out": {
+		OpCodeEntry{ // OUT (C),0
+			[]ParamPattern{{mode: AM_RegisterIndirect, regs: Reg_C}, {mode: AM_Immediate}},
+			func(p []Param, errorSink errors.Sink) []expr.Node {
+				if !p[1].Val.IsResolved() || p[1].Val.Eval() != 0 {
+					errorSink.AddError(p[1].Pos, "Only 0 can be written with OUT (C)")
+					return []expr.Node{}
+				}
+				return []expr.Node{c(0xed), c(0x71)}
+			},
+		},
+	},
+	"res": indexedBit(0b10000000),
+	"rl":  indexedShift(0b00010000, false),
+	"rlc": indexedShift(0b00000000, false),
+	"rr":  indexedShift(0b00011000, false),
+	"rrc": indexedShift(0b00001000, false),
+	"sbc": halfIndexALU(0b10011000, true),
+	"set": indexedBit(0b11000000),
+	"sla": indexedShift(0b00100000, false),
+	"sll": indexedShift(0b00110000, true),
+	"sl1": indexedShift(0b00110000, true),
+	"sra": indexedShift(0b00101000, false),
+	"srl": indexedShift(0b00111000, false),
+	"sub": halfIndexALU(0b10010000, false),
+	"xor": halfIndexALU(0b10101000, false),
+}
@@ -0,0 +1,472 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package dap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/asig/cbmasm/pkg/asm"
+	"github.com/asig/cbmasm/pkg/debuginfo"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+const (
+	threadID = 1
+
+	varRefRegisters = 1
+	varRefLabels    = 2
+	varRefConstants = 3
+
+	defaultMonitor = "localhost:6502"
+)
+
+// Server is a debug adapter that serves one debug session.
+type Server struct {
+	in *bufio.Reader
+
+	outMu sync.Mutex
+	out   io.Writer
+	seq   int
+
+	target      Target
+	info        *debuginfo.Info
+	stopOnEntry bool
+	breakpoints map[string][]int // Breakpoint addresses per source file
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:          bufio.NewReader(in),
+		out:         out,
+		breakpoints: make(map[string][]int),
+	}
+}
+
+// Serve handles requests until the client disconnects.
+func (s *Server) Serve() error {
+	defer func() {
+		if s.target != nil {
+			s.target.Close()
+		}
+	}()
+	for {
+		var req request
+		if err := readMessage(s.in, &req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		body, err := s.handle(&req)
+		resp := &response{Type: "response", RequestSeq: req.Seq, Command: req.Command, Success: err == nil, Body: body}
+		if err != nil {
+			resp.Message = err.Error()
+		}
+		if err := s.send(resp); err != nil {
+			return err
+		}
+		switch {
+		case req.Command == "disconnect":
+			return nil
+		case err == nil && (req.Command == "launch" || req.Command == "attach"):
+			s.sendEvent("initialized", nil)
+		}
+	}
+}
+
+func (s *Server) send(msg interface{}) error {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	s.seq++
+	switch m := msg.(type) {
+	case *response:
+		m.Seq = s.seq
+	case *event:
+		m.Seq = s.seq
+	}
+	return writeMessage(s.out, msg)
+}
+
+func (s *Server) sendEvent(name string, body interface{}) {
+	s.send(&event{Type: "event", Event: name, Body: body})
+}
+
+func (s *Server) handle(req *request) (interface{}, error) {
+	switch req.Command {
+	case "initialize":
+		return map[string]bool{
+			"supportsConfigurationDoneRequest": true,
+			"supportsReadMemoryRequest":        true,
+		}, nil
+	case "launch", "attach":
+		var args launchArguments
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return nil, s.start(&args, req.Command == "launch")
+	case "disconnect":
+		return nil, nil
+	}
+
+	if s.target == nil {
+		return nil, fmt.Errorf("No program is being debugged")
+	}
+	switch req.Command {
+	case "setBreakpoints":
+		var args setBreakpointsArguments
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return s.setBreakpoints(&args)
+	case "configurationDone":
+		if s.stopOnEntry {
+			regs, err := s.target.Registers()
+			if err != nil {
+				return nil, err
+			}
+			s.stopped(Stop{Reason: "entry", PC: registerValue(regs, "PC")})
+			return nil, nil
+		}
+		return nil, s.target.Continue()
+	case "threads":
+		return map[string][]thread{"threads": {{ID: threadID, Name: "CPU"}}}, nil
+	case "stackTrace":
+		return s.stackTrace()
+	case "scopes":
+		return map[string][]scope{"scopes": {
+			{Name: "Registers", VariablesReference: varRefRegisters},
+			{Name: "Labels", VariablesReference: varRefLabels},
+			{Name: "Constants", VariablesReference: varRefConstants},
+		}}, nil
+	case "variables":
+		var args variablesArguments
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return s.variables(args.VariablesReference)
+	case "readMemory":
+		var args readMemoryArguments
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return s.readMemory(&args)
+	case "continue":
+		return map[string]bool{"allThreadsContinued": true}, s.target.Continue()
+	case "next":
+		return nil, s.target.Step(true)
+	case "stepIn":
+		return nil, s.target.Step(false)
+	case "pause":
+		return nil, s.target.Pause()
+	}
+	return nil, fmt.Errorf("Unsupported command %q", req.Command)
+}
+
+// start assembles the program and connects to the target. If load is true, the program is loaded into the
+// target, otherwise it is assumed to be there already.
+func (s *Server) start(args *launchArguments, load bool) error {
+	if s.target != nil {
+		return fmt.Errorf("A program is already being debugged")
+	}
+	a, err := assemble(args)
+	if err != nil {
+		return err
+	}
+
+	var target Target
+	switch args.Target {
+	case "", "stepper":
+		if strings.HasPrefix(args.CPU, "z80") {
+			return fmt.Errorf("The built-in stepper only supports 6502 code")
+		}
+		target = newStepper()
+	case "vice":
+		monitor := args.Monitor
+		if monitor == "" {
+			monitor = defaultMonitor
+		}
+		v, err := dialVice(monitor)
+		if err != nil {
+			return fmt.Errorf("Can't connect to VICE monitor at %s: %s", monitor, err)
+		}
+		target = v
+	default:
+		return fmt.Errorf("Unsupported target %q", args.Target)
+	}
+
+	if load {
+		start := a.Origin()
+		if args.Entry != "" {
+			addr, found := a.Labels()[args.Entry]
+			if !found {
+				target.Close()
+				return fmt.Errorf("Entry label %q is not defined", args.Entry)
+			}
+			start = addr
+		}
+		if err := target.Load(a.Origin(), a.GetBytes(), start); err != nil {
+			target.Close()
+			return err
+		}
+	}
+
+	s.target = target
+	s.info = a.DebugInfo()
+	s.stopOnEntry = args.StopOnEntry
+	go func() {
+		for stop := range target.Stops() {
+			s.stopped(stop)
+		}
+	}()
+	return nil
+}
+
+func assemble(args *launchArguments) (*asm.Assembler, error) {
+	raw, err := os.ReadFile(args.Program)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read program: %s", err)
+	}
+	includeDirs := args.IncludeDirs
+	if len(includeDirs) == 0 {
+		includeDirs = []string{"."}
+	}
+	cpu, platform := args.CPU, args.Platform
+	if cpu == "" {
+		cpu = "6502"
+	}
+	if platform == "" {
+		platform = "c64"
+	}
+	if !asm.IsSupportedCPU(cpu) || !asm.IsSupportedPlatform(platform) || !asm.IsValidPlatformCPUCombo(platform, cpu) {
+		return nil, fmt.Errorf("Unsupported combination of CPU %q and platform %q", cpu, platform)
+	}
+	a := asm.New(includeDirs, cpu, platform, "plain", "petscii", args.Defines)
+	a.Assemble(text.Process(args.Program, string(raw)))
+	if errs := a.Errors(); len(errs) > 0 {
+		var msgs []string
+		for _, e := range errs {
+			msgs = append(msgs, e.String())
+		}
+		return nil, fmt.Errorf("%d errors occurred:\n%s", len(errs), strings.Join(msgs, "\n"))
+	}
+	return a, nil
+}
+
+func (s *Server) stopped(stop Stop) {
+	ev := &stoppedEvent{Reason: stop.Reason, ThreadID: threadID, AllThreadsStopped: true}
+	if stop.Err != nil {
+		ev.Description = stop.Err.Error()
+	}
+	s.sendEvent("stopped", ev)
+}
+
+func registerValue(regs []Register, name string) int {
+	for _, r := range regs {
+		if r.Name == name {
+			return r.Value
+		}
+	}
+	return 0
+}
+
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return absA == absB
+}
+
+func (s *Server) source(file int) *source {
+	path := s.info.Files[file]
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return &source{Name: filepath.Base(path), Path: path}
+}
+
+// addrsAt returns the addresses of the code generated by a source line. For macro calls, this is the start of
+// every expansion.
+func (s *Server) addrsAt(path string, line int) []int {
+	var res []int
+	for _, l := range s.info.Lines {
+		if l.Line == line && samePath(s.info.Files[l.File], path) {
+			res = append(res, l.Addr)
+		}
+	}
+	if len(res) > 0 {
+		return res
+	}
+
+	inExpansion := false
+	for _, l := range s.info.Lines {
+		isCall := false
+		for _, m := range l.Macro {
+			if m.Line == line && samePath(s.info.Files[m.File], path) {
+				isCall = true
+				break
+			}
+		}
+		if isCall && !inExpansion {
+			res = append(res, l.Addr)
+		}
+		inExpansion = isCall
+	}
+	return res
+}
+
+func (s *Server) setBreakpoints(args *setBreakpointsArguments) (interface{}, error) {
+	var addrs []int
+	var bps []breakpoint
+	for _, sbp := range args.Breakpoints {
+		bp := breakpoint{Source: args.Source, Line: sbp.Line}
+		a := s.addrsAt(args.Source.Path, sbp.Line)
+		if len(a) > 0 {
+			bp.Verified = true
+			addrs = append(addrs, a...)
+		} else {
+			bp.Message = "No code was generated for this line"
+		}
+		bps = append(bps, bp)
+	}
+	s.breakpoints[args.Source.Path] = addrs
+
+	var all []int
+	for _, a := range s.breakpoints {
+		all = append(all, a...)
+	}
+	sort.Ints(all)
+	if err := s.target.SetBreakpoints(all); err != nil {
+		return nil, err
+	}
+	return map[string][]breakpoint{"breakpoints": bps}, nil
+}
+
+func (s *Server) scopeAt(addr int) string {
+	for _, sc := range s.info.Scopes {
+		if addr >= sc.Start && addr < sc.End {
+			return sc.Name
+		}
+	}
+	return fmt.Sprintf("$%04x", addr)
+}
+
+// stackTrace returns the location of the PC. If the code was expanded from a macro, the macro calls are
+// returned as additional frames.
+func (s *Server) stackTrace() (interface{}, error) {
+	regs, err := s.target.Registers()
+	if err != nil {
+		return nil, err
+	}
+	pc := registerValue(regs, "PC")
+	name := s.scopeAt(pc)
+	ipRef := fmt.Sprintf("0x%04x", pc)
+	var frames []stackFrame
+	lines := s.info.LinesAt(pc)
+	if len(lines) == 0 {
+		frames = append(frames, stackFrame{ID: 0, Name: name, InstructionPointerReference: ipRef})
+	} else {
+		l := lines[0]
+		frameName := name
+		if len(l.Macro) > 0 {
+			frameName = "macro"
+		}
+		frames = append(frames, stackFrame{ID: 0, Name: frameName, Source: s.source(l.File), Line: l.Line, Column: 1, InstructionPointerReference: ipRef})
+		for i := len(l.Macro) - 1; i >= 0; i-- {
+			frameName = name
+			if i > 0 {
+				frameName = "macro"
+			}
+			m := l.Macro[i]
+			frames = append(frames, stackFrame{ID: len(frames), Name: frameName, Source: s.source(m.File), Line: m.Line, Column: 1})
+		}
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+}
+
+func (s *Server) variables(ref int) (interface{}, error) {
+	vars := []variable{}
+	switch ref {
+	case varRefRegisters:
+		regs, err := s.target.Registers()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range regs {
+			vars = append(vars, variable{Name: r.Name, Value: fmt.Sprintf("$%0*x", (r.Bits+3)/4, r.Value)})
+		}
+	case varRefLabels, varRefConstants:
+		kind := "label"
+		if ref == varRefConstants {
+			kind = "const"
+		}
+		for _, sym := range s.info.Symbols {
+			if sym.Kind != kind {
+				continue
+			}
+			name := sym.Name
+			if sym.Scope != "" {
+				name = sym.Scope + "." + name
+			}
+			v := variable{Name: name, Value: fmt.Sprintf("$%04x", sym.Value)}
+			if kind == "label" {
+				v.MemoryReference = fmt.Sprintf("0x%04x", sym.Value)
+			}
+			vars = append(vars, v)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown variables reference %d", ref)
+	}
+	return map[string][]variable{"variables": vars}, nil
+}
+
+func (s *Server) readMemory(args *readMemoryArguments) (interface{}, error) {
+	addr, err := strconv.ParseInt(args.MemoryReference, 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid memory reference %q", args.MemoryReference)
+	}
+	start := int(addr) + args.Offset
+	count := args.Count
+	if start < 0 || start > 0xffff {
+		return map[string]interface{}{"address": args.MemoryReference, "unreadableBytes": count}, nil
+	}
+	if start+count > 0x10000 {
+		count = 0x10000 - start
+	}
+	data, err := s.target.ReadMemory(start, count)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"address":         fmt.Sprintf("0x%04x", start),
+		"data":            base64.StdEncoding.EncodeToString(data),
+		"unreadableBytes": args.Count - len(data),
+	}, nil
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testProgram = `	.org $1000
+store	.macro val
+	lda #val
+	sta $2000,x
+	.endm
+start	ldx #0
+	jsr sub
+	store 42
+loop	jmp loop
+sub	inx
+	rts
+`
+
+type testMessage struct {
+	Type    string          `json:"type"`
+	Command string          `json:"command"`
+	Event   string          `json:"event"`
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// testClient talks to a Server through pipes.
+type testClient struct {
+	t        *testing.T
+	w        io.Writer
+	seq      int
+	messages chan *testMessage
+	events   []*testMessage
+}
+
+func newTestClient(t *testing.T) *testClient {
+	clientIn, serverOut := io.Pipe()
+	serverIn, clientOut := io.Pipe()
+	c := &testClient{t: t, w: clientOut, messages: make(chan *testMessage, 100)}
+	go func() {
+		NewServer(serverIn, serverOut).Serve()
+		serverOut.Close()
+	}()
+	go func() {
+		r := bufio.NewReader(clientIn)
+		for {
+			var msg testMessage
+			if err := readMessage(r, &msg); err != nil {
+				close(c.messages)
+				return
+			}
+			c.messages <- &msg
+		}
+	}()
+	return c
+}
+
+func (c *testClient) next() *testMessage {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			c.t.Fatalf("Server closed the connection")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("Timeout waiting for a message")
+	}
+	return nil
+}
+
+// request sends a request and decodes the response's body into body. Events received in the meantime are queued.
+func (c *testClient) request(command string, args interface{}, body interface{}) {
+	c.t.Helper()
+	c.seq++
+	if err := writeMessage(c.w, &request{Seq: c.seq, Type: "request", Command: command, Arguments: mustMarshal(args)}); err != nil {
+		c.t.Fatalf("Can't send request: %s", err)
+	}
+	for {
+		msg := c.next()
+		if msg.Type == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		if msg.Command != command || !msg.Success {
+			c.t.Fatalf("Request %q failed: %+v", command, msg)
+		}
+		if body != nil {
+			if err := json.Unmarshal(msg.Body, body); err != nil {
+				c.t.Fatalf("Can't decode body of %q: %s", command, err)
+			}
+		}
+		return
+	}
+}
+
+// waitForEvent returns the next event, which needs to be of the given type.
+func (c *testClient) waitForEvent(name string) *testMessage {
+	c.t.Helper()
+	var msg *testMessage
+	if len(c.events) > 0 {
+		msg, c.events = c.events[0], c.events[1:]
+	} else {
+		msg = c.next()
+	}
+	if msg.Type != "event" || msg.Event != name {
+		c.t.Fatalf("Got %+v, want event %q", msg, name)
+	}
+	return msg
+}
+
+func (c *testClient) waitForStop(wantReason string) {
+	c.t.Helper()
+	var ev stoppedEvent
+	json.Unmarshal(c.waitForEvent("stopped").Body, &ev)
+	if ev.Reason != wantReason {
+		c.t.Fatalf("Got stop reason %q (%s), want %q", ev.Reason, ev.Description, wantReason)
+	}
+}
+
+func (c *testClient) checkStack(want ...int) {
+	c.t.Helper()
+	var body struct {
+		StackFrames []stackFrame `json:"stackFrames"`
+	}
+	c.request("stackTrace", map[string]int{"threadId": threadID}, &body)
+	var got []int
+	for _, f := range body.StackFrames {
+		got = append(got, f.Line)
+	}
+	if len(got) != len(want) {
+		c.t.Fatalf("Got stack %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			c.t.Fatalf("Got stack %v, want %v", got, want)
+		}
+	}
+}
+
+func (c *testClient) variables(ref int) map[string]string {
+	c.t.Helper()
+	var body struct {
+		Variables []variable `json:"variables"`
+	}
+	c.request("variables", variablesArguments{VariablesReference: ref}, &body)
+	res := make(map[string]string)
+	for _, v := range body.Variables {
+		res[v.Name] = v.Value
+	}
+	return res
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+func TestServer(t *testing.T) {
+	program := filepath.Join(t.TempDir(), "test.asm")
+	if err := os.WriteFile(program, []byte(testProgram), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	monitor, err := newFakeMonitor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer monitor.Close()
+
+	tests := []struct {
+		target  string
+		monitor string
+	}{
+		{target: "stepper"},
+		{target: "vice", monitor: monitor.Addr()},
+	}
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			c := newTestClient(t)
+			c.request("initialize", map[string]string{"adapterID": "cbmasm"}, nil)
+			c.request("launch", launchArguments{Program: program, Target: test.target, Monitor: test.monitor, Entry: "start", StopOnEntry: true}, nil)
+			c.waitForEvent("initialized")
+
+			var bps struct {
+				Breakpoints []breakpoint `json:"breakpoints"`
+			}
+			c.request("setBreakpoints", setBreakpointsArguments{
+				Source:      source{Path: program},
+				Breakpoints: []sourceBreakpoint{{Line: 8}, {Line: 10}, {Line: 5}},
+			}, &bps)
+			if len(bps.Breakpoints) != 3 || !bps.Breakpoints[0].Verified || !bps.Breakpoints[1].Verified || bps.Breakpoints[2].Verified {
+				t.Fatalf("Got breakpoints %+v, want lines 8 and 10 verified", bps.Breakpoints)
+			}
+
+			c.request("configurationDone", nil, nil)
+			c.waitForStop("entry")
+			c.checkStack(6)
+
+			c.request("continue", map[string]int{"threadId": threadID}, nil)
+			c.waitForStop("breakpoint")
+			c.checkStack(10)
+
+			c.request("stepIn", map[string]int{"threadId": threadID}, nil)
+			c.waitForStop("step")
+			c.checkStack(11)
+			if x := c.variables(varRefRegisters)["X"]; x != "$01" {
+				t.Errorf("Got X = %s, want $01", x)
+			}
+
+			c.request("next", map[string]int{"threadId": threadID}, nil)
+			c.waitForStop("step")
+			c.checkStack(3, 8)
+
+			c.request("next", map[string]int{"threadId": threadID}, nil)
+			c.waitForStop("step")
+			c.request("next", map[string]int{"threadId": threadID}, nil)
+			c.waitForStop("step")
+			c.checkStack(9)
+
+			c.request("continue", map[string]int{"threadId": threadID}, nil)
+			c.request("pause", map[string]int{"threadId": threadID}, nil)
+			c.waitForStop("pause")
+			c.checkStack(9)
+
+			labels := c.variables(varRefLabels)
+			if labels["loop"] != "$100a" || labels["sub"] != "$100d" {
+				t.Errorf("Got labels %v, want loop = $100a and sub = $100d", labels)
+			}
+
+			var mem struct {
+				Data string `json:"data"`
+			}
+			c.request("readMemory", readMemoryArguments{MemoryReference: "0x2000", Count: 2}, &mem)
+			if mem.Data != "ACo=" { // $00 $2a
+				t.Errorf("Got memory %q, want \"ACo=\"", mem.Data)
+			}
+
+			c.request("disconnect", nil, nil)
+		})
+	}
+}
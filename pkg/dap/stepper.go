@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package dap
+
+import (
+	"sync"
+
+	"github.com/asig/cbmasm/pkg/sim/mos6502"
+)
+
+const opJSR = 0x20
+
+// stepper is a target that executes the program on the built-in 6502 simulator.
+type stepper struct {
+	mu          sync.Mutex
+	cpu         *mos6502.CPU
+	breakpoints map[int]bool
+	running     bool
+	paused      bool
+	stops       chan Stop
+}
+
+func newStepper() *stepper {
+	return &stepper{
+		cpu:         mos6502.New(),
+		breakpoints: make(map[int]bool),
+		stops:       make(chan Stop, 1),
+	}
+}
+
+func (s *stepper) Load(org int, bytes []byte, start int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cpu.Load(org, bytes)
+	s.cpu.PC = uint16(start)
+	return nil
+}
+
+func (s *stepper) Registers() ([]Register, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.cpu
+	return []Register{
+		{Name: "PC", Value: int(c.PC), Bits: 16},
+		{Name: "A", Value: int(c.A), Bits: 8},
+		{Name: "X", Value: int(c.X), Bits: 8},
+		{Name: "Y", Value: int(c.Y), Bits: 8},
+		{Name: "SP", Value: int(c.SP), Bits: 8},
+		{Name: "P", Value: int(c.P), Bits: 8},
+	}, nil
+}
+
+func (s *stepper) ReadMemory(addr, size int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]byte, size)
+	for i := range res {
+		res[i] = s.cpu.Mem[uint16(addr+i)]
+	}
+	return res, nil
+}
+
+func (s *stepper) SetBreakpoints(addrs []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.breakpoints = make(map[int]bool)
+	for _, addr := range addrs {
+		s.breakpoints[addr] = true
+	}
+	return nil
+}
+
+func (s *stepper) Continue() error {
+	s.start(-1, -1, 0)
+	return nil
+}
+
+func (s *stepper) Step(over bool) error {
+	s.mu.Lock()
+	pc, sp := int(s.cpu.PC), s.cpu.SP
+	isCall := s.cpu.Mem[s.cpu.PC] == opJSR
+	s.mu.Unlock()
+	if over && isCall {
+		s.start(-1, pc+3, sp)
+	} else {
+		s.start(1, -1, 0)
+	}
+	return nil
+}
+
+func (s *stepper) Pause() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		s.paused = true
+	}
+	return nil
+}
+
+func (s *stepper) Stops() <-chan Stop {
+	return s.stops
+}
+
+func (s *stepper) Close() error {
+	return s.Pause()
+}
+
+// start runs the CPU in the background. It stops after maxSteps instructions (if maxSteps >= 0), when the PC
+// reaches until with the stack pointer back at sp (if until >= 0), at a breakpoint, or when paused.
+func (s *stepper) start(maxSteps int, until int, sp byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return
+	}
+	s.running = true
+	s.paused = false
+	go func() {
+		stop := s.run(maxSteps, until, sp)
+		s.stops <- stop
+	}()
+}
+
+func (s *stepper) run(maxSteps int, until int, sp byte) Stop {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() { s.running = false }()
+	for steps := 0; ; steps++ {
+		if s.paused {
+			return Stop{Reason: "pause", PC: int(s.cpu.PC)}
+		}
+		if err := s.cpu.Step(); err != nil {
+			return Stop{Reason: "exception", PC: int(s.cpu.PC), Err: err}
+		}
+		pc := int(s.cpu.PC)
+		if maxSteps >= 0 && steps+1 >= maxSteps || until >= 0 && pc == until && s.cpu.SP >= sp {
+			return Stop{Reason: "step", PC: pc}
+		}
+		if s.breakpoints[pc] {
+			return Stop{Reason: "breakpoint", PC: pc}
+		}
+
+		// Give Pause and friends a chance to get the lock.
+		s.mu.Unlock()
+		s.mu.Lock()
+	}
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package dap
+
+// Register is a CPU register of a target.
+type Register struct {
+	Name  string
+	Value int
+	Bits  int
+}
+
+// Stop is reported by a target whenever it stops executing.
+type Stop struct {
+	Reason string // "entry", "breakpoint", "step", "pause", or "exception"
+	PC     int
+	Err    error // Set if Reason is "exception"
+}
+
+// Target is the machine that runs the program being debugged. Continue and Step return as soon as the target
+// starts running; when it stops, this is reported on the Stops channel.
+type Target interface {
+	// Load writes the program to memory and sets the PC to start.
+	Load(org int, bytes []byte, start int) error
+	Registers() ([]Register, error)
+	ReadMemory(addr, size int) ([]byte, error)
+	// SetBreakpoints replaces all breakpoints.
+	SetBreakpoints(addrs []int) error
+	Continue() error
+	// Step executes one instruction. If over is true, subroutine calls are executed as a single instruction.
+	Step(over bool) error
+	Pause() error
+	Stops() <-chan Stop
+	Close() error
+}
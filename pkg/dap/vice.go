@@ -0,0 +1,347 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package dap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Commands and responses of VICE's binary monitor protocol, see
+// https://vice-emu.sourceforge.io/vice_13.html
+const (
+	viceSTX        = 0x02
+	viceAPIVersion = 0x02
+
+	viceCmdMemoryGet          = 0x01
+	viceCmdMemorySet          = 0x02
+	viceCmdCheckpointSet      = 0x12
+	viceCmdCheckpointDelete   = 0x13
+	viceCmdRegistersGet       = 0x31
+	viceCmdRegistersSet       = 0x32
+	viceCmdAdvanceInstruction = 0x71
+	viceCmdPing               = 0x81
+	viceCmdRegistersAvailable = 0x83
+	viceCmdExit               = 0xaa
+
+	viceRespCheckpointInfo = 0x11
+	viceRespStopped        = 0x62
+	viceRespResumed        = 0x63
+
+	viceEventID        = 0xffffffff // Request ID of responses that were not triggered by a request
+	viceMemspaceMain   = 0x00
+	viceCpuOpExec      = 0x04
+	viceRegisterPCName = "PC"
+)
+
+type viceResponse struct {
+	typ  byte
+	err  byte
+	body []byte
+}
+
+// vice is a target that controls a running VICE through its binary monitor ("-binarymonitor").
+type vice struct {
+	conn net.Conn
+
+	mu            sync.Mutex
+	nextID        uint32
+	pending       map[uint32]chan viceResponse
+	running       bool
+	stopReason    string
+	closed        bool
+	registers     []Register // Names and sizes, by register ID
+	registerIDs   map[string]byte
+	checkpoints   []uint32
+	readLoopError error
+
+	stops chan Stop
+}
+
+func dialVice(addr string) (*vice, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	v := newVice(conn)
+	if err := v.loadRegisterNames(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+func newVice(conn net.Conn) *vice {
+	v := &vice{
+		conn:        conn,
+		pending:     make(map[uint32]chan viceResponse),
+		registerIDs: make(map[string]byte),
+		stops:       make(chan Stop, 1),
+	}
+	go v.readLoop()
+	return v
+}
+
+func (v *vice) readLoop() {
+	r := bufio.NewReader(v.conn)
+	var err error
+	for {
+		var header [12]byte
+		if _, err = io.ReadFull(r, header[:]); err != nil {
+			break
+		}
+		if header[0] != viceSTX {
+			err = fmt.Errorf("Invalid response from VICE monitor")
+			break
+		}
+		resp := viceResponse{typ: header[6], err: header[7], body: make([]byte, binary.LittleEndian.Uint32(header[2:]))}
+		id := binary.LittleEndian.Uint32(header[8:])
+		if _, err = io.ReadFull(r, resp.body); err != nil {
+			break
+		}
+		if id == viceEventID {
+			v.handleEvent(resp)
+			continue
+		}
+		v.mu.Lock()
+		ch := v.pending[id]
+		delete(v.pending, id)
+		v.mu.Unlock()
+		if ch != nil {
+			ch <- resp
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.readLoopError = err
+	for id, ch := range v.pending {
+		close(ch)
+		delete(v.pending, id)
+	}
+}
+
+func (v *vice) handleEvent(resp viceResponse) {
+	v.mu.Lock()
+	switch resp.typ {
+	case viceRespCheckpointInfo:
+		if len(resp.body) > 4 && resp.body[4] != 0 {
+			v.stopReason = "breakpoint"
+		}
+	case viceRespStopped:
+		if v.running && len(resp.body) >= 2 {
+			v.running = false
+			stop := Stop{Reason: v.stopReason, PC: int(binary.LittleEndian.Uint16(resp.body))}
+			v.mu.Unlock()
+			v.stops <- stop
+			return
+		}
+	}
+	v.mu.Unlock()
+}
+
+// send sends a command and waits for its response.
+func (v *vice) send(cmd byte, body []byte) ([]byte, error) {
+	v.mu.Lock()
+	if v.readLoopError != nil || v.closed {
+		v.mu.Unlock()
+		return nil, fmt.Errorf("Connection to VICE monitor is closed")
+	}
+	id := v.nextID
+	v.nextID++
+	ch := make(chan viceResponse, 1)
+	v.pending[id] = ch
+	v.mu.Unlock()
+
+	req := make([]byte, 11, 11+len(body))
+	req[0] = viceSTX
+	req[1] = viceAPIVersion
+	binary.LittleEndian.PutUint32(req[2:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(req[6:], id)
+	req[10] = cmd
+	req = append(req, body...)
+	if _, err := v.conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	resp, ok := <-ch
+	if !ok {
+		return nil, fmt.Errorf("Connection to VICE monitor is closed")
+	}
+	if resp.err != 0 {
+		return nil, fmt.Errorf("VICE monitor returned error $%02x for command $%02x", resp.err, cmd)
+	}
+	return resp.body, nil
+}
+
+func (v *vice) loadRegisterNames() error {
+	body, err := v.send(viceCmdRegistersAvailable, []byte{viceMemspaceMain})
+	if err != nil {
+		return err
+	}
+	if len(body) < 2 {
+		return fmt.Errorf("Invalid response from VICE monitor")
+	}
+	count := int(binary.LittleEndian.Uint16(body))
+	body = body[2:]
+	for i := 0; i < count; i++ {
+		if len(body) < 4 || len(body) < int(body[0])+1 {
+			return fmt.Errorf("Invalid response from VICE monitor")
+		}
+		item := body[1 : 1+int(body[0])]
+		body = body[1+int(body[0]):]
+		id, bits, nameLen := item[0], int(item[1]), int(item[2])
+		if len(item) < 3+nameLen {
+			return fmt.Errorf("Invalid response from VICE monitor")
+		}
+		name := string(item[3 : 3+nameLen])
+		v.registers = append(v.registers, Register{Name: name, Bits: bits})
+		v.registerIDs[name] = id
+	}
+	return nil
+}
+
+func (v *vice) Load(org int, bytes []byte, start int) error {
+	if len(bytes) > 0 {
+		body := []byte{0, byte(org), byte(org >> 8), byte(org + len(bytes) - 1), byte((org + len(bytes) - 1) >> 8), viceMemspaceMain, 0, 0}
+		if _, err := v.send(viceCmdMemorySet, append(body, bytes...)); err != nil {
+			return err
+		}
+	}
+	id, found := v.registerIDs[viceRegisterPCName]
+	if !found {
+		return fmt.Errorf("VICE monitor doesn't report a PC register")
+	}
+	_, err := v.send(viceCmdRegistersSet, []byte{viceMemspaceMain, 1, 0, 3, id, byte(start), byte(start >> 8)})
+	return err
+}
+
+func (v *vice) Registers() ([]Register, error) {
+	body, err := v.send(viceCmdRegistersGet, []byte{viceMemspaceMain})
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 2 {
+		return nil, fmt.Errorf("Invalid response from VICE monitor")
+	}
+	values := make(map[byte]int)
+	count := int(binary.LittleEndian.Uint16(body))
+	body = body[2:]
+	for i := 0; i < count; i++ {
+		if len(body) < 4 {
+			return nil, fmt.Errorf("Invalid response from VICE monitor")
+		}
+		values[body[1]] = int(binary.LittleEndian.Uint16(body[2:]))
+		body = body[1+int(body[0]):]
+	}
+	var res []Register
+	for _, r := range v.registers {
+		r.Value = values[v.registerIDs[r.Name]]
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func (v *vice) ReadMemory(addr, size int) ([]byte, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+	end := addr + size - 1
+	body, err := v.send(viceCmdMemoryGet, []byte{0, byte(addr), byte(addr >> 8), byte(end), byte(end >> 8), viceMemspaceMain, 0, 0})
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 2 || len(body) < 2+int(binary.LittleEndian.Uint16(body)) {
+		return nil, fmt.Errorf("Invalid response from VICE monitor")
+	}
+	return body[2 : 2+int(binary.LittleEndian.Uint16(body))], nil
+}
+
+func (v *vice) SetBreakpoints(addrs []int) error {
+	for _, n := range v.checkpoints {
+		if _, err := v.send(viceCmdCheckpointDelete, binary.LittleEndian.AppendUint32(nil, n)); err != nil {
+			return err
+		}
+	}
+	v.checkpoints = nil
+	for _, addr := range addrs {
+		body, err := v.send(viceCmdCheckpointSet, []byte{byte(addr), byte(addr >> 8), byte(addr), byte(addr >> 8), 1, 1, viceCpuOpExec, 0})
+		if err != nil {
+			return err
+		}
+		if len(body) < 4 {
+			return fmt.Errorf("Invalid response from VICE monitor")
+		}
+		v.checkpoints = append(v.checkpoints, binary.LittleEndian.Uint32(body))
+	}
+	return nil
+}
+
+// resume marks the target as running. Stops are reported with the given reason, unless a checkpoint is hit.
+func (v *vice) resume(reason string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.running = true
+	v.stopReason = reason
+}
+
+func (v *vice) Continue() error {
+	v.resume("pause")
+	_, err := v.send(viceCmdExit, nil)
+	return err
+}
+
+func (v *vice) Step(over bool) error {
+	var stepOver byte
+	if over {
+		stepOver = 1
+	}
+	v.resume("step")
+	_, err := v.send(viceCmdAdvanceInstruction, []byte{stepOver, 1, 0})
+	return err
+}
+
+func (v *vice) Pause() error {
+	v.mu.Lock()
+	running := v.running
+	v.mu.Unlock()
+	if !running {
+		return nil
+	}
+	// Every command stops the emulator
+	_, err := v.send(viceCmdPing, nil)
+	return err
+}
+
+func (v *vice) Stops() <-chan Stop {
+	return v.stops
+}
+
+func (v *vice) Close() error {
+	v.SetBreakpoints(nil)
+	v.send(viceCmdExit, nil)
+	v.mu.Lock()
+	v.closed = true
+	v.mu.Unlock()
+	return v.conn.Close()
+}
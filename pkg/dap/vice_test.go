@@ -0,0 +1,217 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package dap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/asig/cbmasm/pkg/sim/mos6502"
+)
+
+// fakeMonitor is a test double for VICE's binary monitor. It runs the program on the built-in simulator and
+// implements the subset of the protocol that is used by the vice target.
+type fakeMonitor struct {
+	ln net.Listener
+
+	writeMu sync.Mutex
+	conn    net.Conn
+
+	mu             sync.Mutex
+	cpu            *mos6502.CPU
+	checkpoints    map[uint32]int
+	nextCheckpoint uint32
+	running        bool
+}
+
+// Register IDs as used by VICE for the C64
+var fakeMonitorRegisters = []struct {
+	id   byte
+	name string
+	bits byte
+}{
+	{0, "A", 8}, {1, "X", 8}, {2, "Y", 8}, {3, "PC", 16}, {4, "SP", 8}, {5, "FL", 8},
+}
+
+func newFakeMonitor() (*fakeMonitor, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	m := &fakeMonitor{ln: ln, cpu: mos6502.New(), checkpoints: make(map[uint32]int)}
+	go m.serve()
+	return m, nil
+}
+
+func (m *fakeMonitor) Addr() string {
+	return m.ln.Addr().String()
+}
+
+func (m *fakeMonitor) Close() {
+	m.ln.Close()
+	m.mu.Lock()
+	m.running = false
+	m.mu.Unlock()
+}
+
+func (m *fakeMonitor) serve() {
+	conn, err := m.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	m.conn = conn
+	r := bufio.NewReader(conn)
+	for {
+		var header [11]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return
+		}
+		body := make([]byte, binary.LittleEndian.Uint32(header[2:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		m.handle(binary.LittleEndian.Uint32(header[6:]), header[10], body)
+	}
+}
+
+func (m *fakeMonitor) write(typ byte, id uint32, body []byte) {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	msg := []byte{viceSTX, viceAPIVersion}
+	msg = binary.LittleEndian.AppendUint32(msg, uint32(len(body)))
+	msg = append(msg, typ, 0)
+	msg = binary.LittleEndian.AppendUint32(msg, id)
+	m.conn.Write(append(msg, body...))
+}
+
+func (m *fakeMonitor) stopped() {
+	m.write(viceRespStopped, viceEventID, binary.LittleEndian.AppendUint16(nil, m.cpu.PC))
+}
+
+func (m *fakeMonitor) handle(id uint32, cmd byte, body []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Like VICE, every command stops the emulator.
+	if m.running {
+		m.running = false
+		m.stopped()
+	}
+
+	cpu := m.cpu
+	var resp []byte
+	switch cmd {
+	case viceCmdPing:
+	case viceCmdRegistersAvailable:
+		resp = binary.LittleEndian.AppendUint16(nil, uint16(len(fakeMonitorRegisters)))
+		for _, r := range fakeMonitorRegisters {
+			resp = append(resp, byte(3+len(r.name)), r.id, r.bits, byte(len(r.name)))
+			resp = append(resp, r.name...)
+		}
+	case viceCmdRegistersGet:
+		values := []uint16{uint16(cpu.A), uint16(cpu.X), uint16(cpu.Y), cpu.PC, uint16(cpu.SP), uint16(cpu.P)}
+		resp = binary.LittleEndian.AppendUint16(nil, uint16(len(values)))
+		for i, v := range values {
+			resp = append(resp, 3, byte(i))
+			resp = binary.LittleEndian.AppendUint16(resp, v)
+		}
+	case viceCmdRegistersSet:
+		count := int(binary.LittleEndian.Uint16(body[1:]))
+		items := body[3:]
+		for i := 0; i < count; i++ {
+			v := binary.LittleEndian.Uint16(items[2:])
+			switch items[1] {
+			case 0:
+				cpu.A = byte(v)
+			case 1:
+				cpu.X = byte(v)
+			case 2:
+				cpu.Y = byte(v)
+			case 3:
+				cpu.PC = v
+			case 4:
+				cpu.SP = byte(v)
+			case 5:
+				cpu.P = byte(v)
+			}
+			items = items[1+int(items[0]):]
+		}
+	case viceCmdMemoryGet:
+		start, end := binary.LittleEndian.Uint16(body[1:]), binary.LittleEndian.Uint16(body[3:])
+		resp = binary.LittleEndian.AppendUint16(nil, end-start+1)
+		resp = append(resp, cpu.Mem[start:int(end)+1]...)
+	case viceCmdMemorySet:
+		cpu.Load(int(binary.LittleEndian.Uint16(body[1:])), body[8:])
+	case viceCmdCheckpointSet:
+		n := m.nextCheckpoint
+		m.nextCheckpoint++
+		m.checkpoints[n] = int(binary.LittleEndian.Uint16(body))
+		resp = binary.LittleEndian.AppendUint32(nil, n)
+		resp = append(resp, make([]byte, 18)...)
+		m.write(viceRespCheckpointInfo, id, resp)
+		return
+	case viceCmdCheckpointDelete:
+		delete(m.checkpoints, binary.LittleEndian.Uint32(body))
+	case viceCmdAdvanceInstruction:
+		m.write(cmd, id, nil)
+		for i := 0; i < int(binary.LittleEndian.Uint16(body[1:])); i++ {
+			if body[0] != 0 && cpu.Mem[cpu.PC] == opJSR {
+				ret, sp := cpu.PC+3, cpu.SP
+				for cpu.PC != ret || cpu.SP < sp {
+					cpu.Step()
+				}
+			} else {
+				cpu.Step()
+			}
+		}
+		m.write(viceRespResumed, viceEventID, binary.LittleEndian.AppendUint16(nil, cpu.PC))
+		m.stopped()
+		return
+	case viceCmdExit:
+		m.running = true
+		go m.run()
+	}
+	m.write(cmd, id, resp)
+}
+
+func (m *fakeMonitor) run() {
+	for {
+		m.mu.Lock()
+		if !m.running {
+			m.mu.Unlock()
+			return
+		}
+		m.cpu.Step()
+		for n, addr := range m.checkpoints {
+			if addr == int(m.cpu.PC) {
+				m.running = false
+				info := binary.LittleEndian.AppendUint32(nil, n)
+				info = append(info, 1)
+				m.write(viceRespCheckpointInfo, viceEventID, append(info, make([]byte, 17)...))
+				m.stopped()
+				break
+			}
+		}
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+// Package debuginfo defines the debug information written by "cbmasm -debug_info". It maps the generated code
+// back to the source, so that debuggers can show source lines instead of disassembly.
+//
+// Debug information files are JSON documents:
+//   - Files lists all source files. All other entries refer to files by their index in this list.
+//   - Lines maps address ranges to the source line that generated them. If the line was expanded from a macro,
+//     the call sites of the macro are listed, too, outermost first.
+//   - Scopes are the address ranges in which local labels are visible. A scope starts at a global label and
+//     ends at the next one.
+//   - Symbols are all labels and constants with an integer value. Local labels carry the name of their scope.
+package debuginfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Version is the version of the debug information format.
+const Version = 1
+
+type Info struct {
+	Version int      `json:"version"`
+	Files   []string `json:"files"`
+	Lines   []Line   `json:"lines"`
+	Scopes  []Scope  `json:"scopes"`
+	Symbols []Symbol `json:"symbols"`
+}
+
+// Location is a position in a source file.
+type Location struct {
+	File int `json:"file"` // Index into Info.Files
+	Line int `json:"line"`
+}
+
+type Line struct {
+	Addr  int        `json:"addr"`
+	Size  int        `json:"size"`
+	File  int        `json:"file"` // Index into Info.Files
+	Line  int        `json:"line"`
+	Macro []Location `json:"macro,omitempty"` // Call sites of the macros the line was expanded from
+}
+
+type Scope struct {
+	Name  string `json:"name"`
+	Start int    `json:"start"`
+	End   int    `json:"end"` // First address after the scope
+	File  int    `json:"file"`
+	Line  int    `json:"line"`
+}
+
+type Symbol struct {
+	Name  string    `json:"name"`
+	Kind  string    `json:"kind"` // "label" or "const"
+	Value int       `json:"value"`
+	Scope string    `json:"scope,omitempty"` // Only set for local labels
+	Pos   *Location `json:"pos,omitempty"`   // Not set if the position is unknown
+}
+
+func Write(w io.Writer, info *Info) error {
+	info.Version = Version
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
+func Read(r io.Reader) (*Info, error) {
+	var info Info
+	if err := json.NewDecoder(r).Decode(&info); err != nil {
+		return nil, err
+	}
+	if info.Version != Version {
+		return nil, fmt.Errorf("Unsupported debug info version %d, expected %d", info.Version, Version)
+	}
+	return &info, nil
+}
+
+// LinesAt returns the source lines that generated the code at addr.
+func (info *Info) LinesAt(addr int) []Line {
+	var res []Line
+	for _, l := range info.Lines {
+		if addr >= l.Addr && addr < l.Addr+l.Size {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// Addrs returns the start addresses of the code generated by a source line.
+func (info *Info) Addrs(file string, line int) []int {
+	var res []int
+	for _, l := range info.Lines {
+		if l.Line == line && info.Files[l.File] == file {
+			res = append(res, l.Addr)
+		}
+	}
+	return res
+}
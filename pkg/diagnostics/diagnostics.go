@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package diagnostics writes errors and warnings in machine-readable formats:
+//   - gcc: one line per diagnostic, "file:line:col: severity: message", followed by a note for every macro expansion.
+//   - json: a JSON document with a list of all diagnostics.
+//   - sarif: a SARIF 2.1.0 log, as understood by many CI systems.
+package diagnostics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/asig/cbmasm/pkg/errors"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// Formats contains all supported output formats.
+var Formats = []string{"gcc", "json", "sarif"}
+
+// IsSupportedFormat returns true if format is one of Formats.
+func IsSupportedFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes diags to w in the given format.
+func Write(w io.Writer, format string, diags []errors.Error) error {
+	switch format {
+	case "gcc":
+		return writeGCC(w, diags)
+	case "json":
+		return writeJSON(w, diags)
+	case "sarif":
+		return writeSARIF(w, diags)
+	}
+	return fmt.Errorf("Unsupported diagnostics format %q", format)
+}
+
+func writeGCC(w io.Writer, diags []errors.Error) error {
+	for _, d := range diags {
+		if _, err := fmt.Fprintf(w, "%s: %s: %s\n", gccPos(d.Pos), d.Severity, d.Summary()); err != nil {
+			return err
+		}
+		for f := d.Expansion; f != nil; f = f.Caller {
+			if _, err := fmt.Fprintf(w, "%s: note: %s\n", gccPos(f.Call), expansionNote(*f)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expansionNote describes a macro expansion at the macro's call site.
+func expansionNote(f errors.Frame) string {
+	what := fmt.Sprintf("macro %q", f.Macro)
+	if f.Loop {
+		what = f.Macro + " loop"
+	}
+	note := "in expansion of " + what
+	if f.Line > 0 {
+		note += fmt.Sprintf(", line %d", f.Line)
+	}
+	if f.Repeated > 0 {
+		note += fmt.Sprintf(" (%d more times)", f.Repeated)
+	}
+	return note
+}
+
+func gccPos(pos text.Pos) string {
+	return fmt.Sprintf("%s:%d:%d", pos.Filename, pos.Line, pos.Col)
+}
+
+// Location is a position in a source file.
+type Location struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+// Expansion is the expansion of a macro.
+type Expansion struct {
+	Macro    string   `json:"macro"`
+	Loop     bool     `json:"loop,omitempty"`     // Whether the expansion is an iteration of a loop
+	Line     int      `json:"line,omitempty"`     // Line in the macro's body, starting at 1
+	Repeated int      `json:"repeated,omitempty"` // Number of identical expansions merged into this one
+	Call     Location `json:"call"`               // Call site of the macro
+}
+
+type Diagnostic struct {
+	Location
+	Severity   string      `json:"severity"` // "error" or "warning"
+	Category   string      `json:"category,omitempty"`
+	Message    string      `json:"message"`
+	Expansions []Expansion `json:"expansions,omitempty"` // Macro expansions the diagnostic occurred in, outermost first
+}
+
+type document struct {
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+func location(pos text.Pos) Location {
+	return Location{File: pos.Filename, Line: pos.Line, Column: pos.Col}
+}
+
+func writeJSON(w io.Writer, diags []errors.Error) error {
+	doc := document{Diagnostics: []Diagnostic{}}
+	for _, d := range diags {
+		diag := Diagnostic{
+			Location: location(d.Pos),
+			Severity: d.Severity.String(),
+			Category: d.Category,
+			Message:  d.Msg,
+		}
+		for _, f := range d.Expansion.Frames() {
+			diag.Expansions = append(diag.Expansions, Expansion{Macro: f.Macro, Loop: f.Loop, Line: f.Line, Repeated: f.Repeated, Call: location(f.Call)})
+		}
+		doc.Diagnostics = append(doc.Diagnostics, diag)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package diagnostics
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/errors"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+var testDiags = []errors.Error{
+	{Pos: text.Pos{Filename: "main.asm", Line: 9, Col: 8}, Msg: "Value out of range."},
+	{
+		Pos:      text.Pos{Filename: "macros.i", Line: 3, Col: 6},
+		Msg:      "lda has no indexed zero-page addressing mode",
+		Severity: errors.SeverityWarning,
+		Category: "zp-fallback",
+		Expansion: &errors.Frame{
+			Macro:    "inner",
+			Call:     text.Pos{Filename: "macros.i", Line: 6, Col: 2},
+			Line:     1,
+			Repeated: 3,
+			Caller:   &errors.Frame{Macro: "outer", Call: text.Pos{Filename: "main.asm", Line: 8, Col: 2}, Line: 2},
+		},
+	},
+}
+
+func TestWrite_gcc(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, "gcc", testDiags); err != nil {
+		t.Fatal(err)
+	}
+	want := `main.asm:9:8: error: Value out of range.
+macros.i:3:6: warning: lda has no indexed zero-page addressing mode [-Wzp-fallback]
+macros.i:6:2: note: in expansion of macro "inner", line 1 (3 more times)
+main.asm:8:2: note: in expansion of macro "outer", line 2
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestWrite_json(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, "json", testDiags); err != nil {
+		t.Fatal(err)
+	}
+	var got document
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := document{Diagnostics: []Diagnostic{
+		{
+			Location: Location{File: "main.asm", Line: 9, Column: 8},
+			Severity: "error",
+			Message:  "Value out of range.",
+		},
+		{
+			Location: Location{File: "macros.i", Line: 3, Column: 6},
+			Severity: "warning",
+			Category: "zp-fallback",
+			Message:  "lda has no indexed zero-page addressing mode",
+			Expansions: []Expansion{
+				{Macro: "outer", Line: 2, Call: Location{File: "main.asm", Line: 8, Column: 2}},
+				{Macro: "inner", Line: 1, Repeated: 3, Call: Location{File: "macros.i", Line: 6, Column: 2}},
+			},
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+func TestWrite_sarif(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, "sarif", testDiags); err != nil {
+		t.Fatal(err)
+	}
+	var got sarifLog
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != "2.1.0" || len(got.Runs) != 1 {
+		t.Fatalf("Got version %q and %d runs, want version 2.1.0 and 1 run", got.Version, len(got.Runs))
+	}
+	run := got.Runs[0]
+	if !reflect.DeepEqual(run.Tool.Driver.Rules, []sarifRule{{ID: "zp-fallback"}}) {
+		t.Errorf("Got rules %+v, want zp-fallback", run.Tool.Driver.Rules)
+	}
+	if len(run.Results) != 2 {
+		t.Fatalf("Got %d results, want 2", len(run.Results))
+	}
+	res := run.Results[1]
+	if res.RuleID != "zp-fallback" || res.Level != "warning" {
+		t.Errorf("Got rule %q and level %q, want zp-fallback and warning", res.RuleID, res.Level)
+	}
+	if want := (sarifRegion{StartLine: 3, StartColumn: 6}); *res.Locations[0].PhysicalLocation.Region != want {
+		t.Errorf("Got region %+v, want %+v", *res.Locations[0].PhysicalLocation.Region, want)
+	}
+	if len(res.RelatedLocations) != 2 || res.RelatedLocations[0].PhysicalLocation.ArtifactLocation.URI != "main.asm" {
+		t.Errorf("Got related locations %+v, want the outermost call in main.asm first", res.RelatedLocations)
+	}
+}
+
+func TestWrite_unsupported(t *testing.T) {
+	if err := Write(&bytes.Buffer{}, "xml", testDiags); err == nil {
+		t.Errorf("Write with unsupported format didn't fail")
+	}
+}
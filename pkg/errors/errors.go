@@ -24,13 +24,106 @@ import (
 	"github.com/asig/cbmasm/pkg/text"
 )
 
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Frame is the expansion of a macro. Frames are chained from the innermost to the outermost expansion.
+type Frame struct {
+	Macro    string   // Name of the macro, or the directive of a loop, e.g. ".rept"
+	Call     text.Pos // Call site of the macro
+	Line     int      // Line in the macro's body that was assembled, starting at 1; 0 if unknown
+	Loop     bool     // Whether the expansion is an iteration of a loop instead of a macro call
+	Repeated int      // Number of identical expansions that were merged into this one, see Compact
+	Caller   *Frame   // Expansion of the enclosing macro, or nil
+}
+
+// Frames returns f and all its callers, outermost first.
+func (f *Frame) Frames() []Frame {
+	var res []Frame
+	for ; f != nil; f = f.Caller {
+		res = append([]Frame{*f}, res...)
+	}
+	return res
+}
+
+// Compact returns a copy of the chain in which runs of identical frames, as produced by recursive macros, are
+// merged into a single frame.
+func (f *Frame) Compact() *Frame {
+	if f == nil {
+		return nil
+	}
+	c := *f
+	next := f.Caller
+	for next != nil && next.Macro == f.Macro && next.Loop == f.Loop && next.Call == f.Call && next.Line == f.Line {
+		c.Repeated += 1 + next.Repeated
+		next = next.Caller
+	}
+	c.Caller = next.Compact()
+	return &c
+}
+
+func (f *Frame) String() string {
+	line := ""
+	if f.Line > 0 {
+		line = fmt.Sprintf(", line %d", f.Line)
+	}
+	repeated := ""
+	if f.Repeated > 0 {
+		repeated = fmt.Sprintf(" (%d more times)", f.Repeated)
+	}
+	if f.Loop {
+		return fmt.Sprintf("in %s loop%s, started at %s, line %d%s", f.Macro, line, f.Call.Filename, f.Call.Line, repeated)
+	}
+	return fmt.Sprintf("in macro %s%s, called from %s, line %d%s", f.Macro, line, f.Call.Filename, f.Call.Line, repeated)
+}
+
 type Error struct {
-	Pos text.Pos
-	Msg string
+	Pos       text.Pos
+	Msg       string
+	Severity  Severity
+	Category  string // Warning category, if any
+	Expansion *Frame // Innermost macro expansion the error occurred in, if any
+}
+
+// Summary returns the message together with the warning category.
+func (e Error) Summary() string {
+	if opt := e.Option(); opt != "" {
+		return fmt.Sprintf("%s [%s]", e.Msg, opt)
+	}
+	return e.Msg
+}
+
+// Message returns the summary, and one line for every macro expansion the error occurred in, innermost first.
+func (e Error) Message() string {
+	msg := e.Summary()
+	for f := e.Expansion; f != nil; f = f.Caller {
+		msg += "\n  " + f.String()
+	}
+	return msg
+}
+
+// Option returns the command line option that controls the error, e.g. "-Wunused-label", or "" if there is none.
+func (e Error) Option() string {
+	if e.Category == "" {
+		return ""
+	}
+	// Warnings that are reported as errors because of -Werror are still controlled by their category.
+	return "-W" + e.Category
 }
 
 func (e Error) String() string {
-	return fmt.Sprintf("%s, line %d, col %d: %s", e.Pos.Filename, e.Pos.Line, e.Pos.Col, e.Msg)
+	return fmt.Sprintf("%s, line %d, col %d: %s", e.Pos.Filename, e.Pos.Line, e.Pos.Col, e.Message())
 }
 
 type Sink interface {
@@ -42,13 +42,45 @@ const (
 	Le
 	Gt
 	Ge
+	Shl
+	Shr
+	LogAnd
+	LogOr
 )
 
+// IsComparison returns whether op compares its operands.
+func (op BinaryOp) IsComparison() bool {
+	return op >= Eq && op <= Ge
+}
+
+// IsLogical returns whether op is "&&" or "||".
+func (op BinaryOp) IsLogical() bool {
+	return op == LogAnd || op == LogOr
+}
+
+// maxShift is the largest number of bits a value can be shifted by.
+const maxShift = 63
+
+// CheckOperand returns an error message if the operator can't be applied to the integer right operand r, and ""
+// otherwise.
+func (op BinaryOp) CheckOperand(r int) string {
+	switch {
+	case (op == Div || op == Mod) && r == 0:
+		return "Division by zero"
+	case (op == Shl || op == Shr) && (r < 0 || r > maxShift):
+		return fmt.Sprintf("Shift count must be between 0 and %d", maxShift)
+	}
+	return ""
+}
+
 type BinaryOpNode struct {
 	baseNode
 
 	left, right Node
 	op          BinaryOp
+
+	// Size of comparisons of floats or strings, whose operands have no meaningful size
+	size int
 }
 
 func NewBinaryOp(left, right Node, op BinaryOp) Node {
@@ -56,9 +88,15 @@ func NewBinaryOp(left, right Node, op BinaryOp) Node {
 		left:  left,
 		right: right,
 		op:    op,
+		size:  1,
 	}
 }
 
+// isNonIntComparison returns whether the node compares floats or strings.
+func (n *BinaryOpNode) isNonIntComparison() bool {
+	return n.op.IsComparison() && (n.left.Type() != NodeType_Int || n.right.Type() != NodeType_Int)
+}
+
 func max(i1, i2 int) int {
 	if i1 > i2 {
 		return i1
@@ -68,10 +106,20 @@ func max(i1, i2 int) int {
 }
 
 func (n *BinaryOpNode) ResultSize() int {
+	if n.Type() == NodeType_String && n.IsResolved() {
+		return len(n.EvalStr())
+	}
+	if n.isNonIntComparison() {
+		return n.size
+	}
 	return max(n.left.ResultSize(), n.right.ResultSize())
 }
 
 func (n *BinaryOpNode) ForceSize(size int) bool {
+	if n.isNonIntComparison() {
+		n.size = size
+		return true
+	}
 	b1 := n.left.ForceSize(size)
 	b2 := n.right.ForceSize(size)
 	return b1 && b2
@@ -92,42 +140,62 @@ func (n *BinaryOpNode) Eval() int {
 		panic("Can't Eval() a string or float node")
 	}
 
-	if n.left.Type() == NodeType_Int {
-		l := n.left.Eval()
-		r := n.right.Eval()
-		switch n.op {
-		case Add:
-			return l + r
-		case Sub:
-			return l - r
-		case Mul:
-			return l * r
-		case Mod:
-			return l % r
-		case Div:
-			return l / r
-		case And:
-			return l & r
-		case Or:
-			return l | r
-		case Xor:
-			return l ^ r
-		case Eq:
-			return n.boolToInt(l == r)
-		case Ne:
-			return n.boolToInt(l != r)
-		case Lt:
-			return n.boolToInt(l < r)
-		case Le:
-			return n.boolToInt(l <= r)
-		case Gt:
-			return n.boolToInt(l > r)
-		case Ge:
-			return n.boolToInt(l >= r)
-		}
-		panic(fmt.Sprintf("Unimplemented BinaryOp %d", n.op))
-	}
-	// Must be string
+	if n.left.Type() == NodeType_String {
+		return n.evalStrComparison()
+	}
+	if n.left.Type() == NodeType_Float || n.right.Type() == NodeType_Float {
+		// Only comparisons of floats are ints
+		return n.evalFloatComparison()
+	}
+
+	l := n.left.Eval()
+	r := n.right.Eval()
+	if n.op.CheckOperand(r) != "" {
+		// Reported by CheckRange
+		return 0
+	}
+	switch n.op {
+	case Add:
+		return l + r
+	case Sub:
+		return l - r
+	case Mul:
+		return l * r
+	case Mod:
+		return l % r
+	case Div:
+		return l / r
+	case And:
+		return l & r
+	case Or:
+		return l | r
+	case Xor:
+		return l ^ r
+	case Eq:
+		return n.boolToInt(l == r)
+	case Ne:
+		return n.boolToInt(l != r)
+	case Lt:
+		return n.boolToInt(l < r)
+	case Le:
+		return n.boolToInt(l <= r)
+	case Gt:
+		return n.boolToInt(l > r)
+	case Ge:
+		return n.boolToInt(l >= r)
+	case Shl:
+		return l << r
+	case Shr:
+		return l >> r
+	case LogAnd:
+		return n.boolToInt(l != 0 && r != 0)
+	case LogOr:
+		return n.boolToInt(l != 0 || r != 0)
+	}
+	panic(fmt.Sprintf("Unimplemented BinaryOp %d", n.op))
+}
+
+func (n *BinaryOpNode) evalStrComparison() int {
 	l := n.left.EvalStr()
 	r := n.right.EvalStr()
 	switch n.op {
@@ -147,14 +215,26 @@ func (n *BinaryOpNode) Eval() int {
 	panic(fmt.Sprintf("BinaryOp %d not supported for strings", n.op))
 }
 
-func (n *BinaryOpNode) EvalFloat() float64 {
-	if !n.IsResolved() {
-		panic("Can't evaluate non-const expr node")
-	}
-	if n.Type() != NodeType_Float {
-		panic("Can't EvalFloat() a non-float node")
+func (n *BinaryOpNode) evalFloatComparison() int {
+	l, r := n.floatOperands()
+	switch n.op {
+	case Eq:
+		return n.boolToInt(l == r)
+	case Ne:
+		return n.boolToInt(l != r)
+	case Lt:
+		return n.boolToInt(l < r)
+	case Le:
+		return n.boolToInt(l <= r)
+	case Gt:
+		return n.boolToInt(l > r)
+	case Ge:
+		return n.boolToInt(l >= r)
 	}
+	panic(fmt.Sprintf("BinaryOp %d not supported for floats", n.op))
+}
 
+func (n *BinaryOpNode) floatOperands() (float64, float64) {
 	var l, r float64
 
 	switch n.left.Type() {
@@ -173,6 +253,18 @@ func (n *BinaryOpNode) EvalFloat() float64 {
 	default:
 		panic("Right side is neither int nor float")
 	}
+	return l, r
+}
+
+func (n *BinaryOpNode) EvalFloat() float64 {
+	if !n.IsResolved() {
+		panic("Can't evaluate non-const expr node")
+	}
+	if n.Type() != NodeType_Float {
+		panic("Can't EvalFloat() a non-float node")
+	}
+
+	l, r := n.floatOperands()
 	switch n.op {
 	case Add:
 		return l + r
@@ -180,13 +272,22 @@ func (n *BinaryOpNode) EvalFloat() float64 {
 		return l - r
 	case Mul:
 		return l * r
+	case Div:
+		return l / r
 	default:
 		panic(fmt.Sprintf("Unsupported operation %d", n.op))
 	}
 }
 
 func (n *BinaryOpNode) EvalStr() string {
-	panic("Can't evaluate BinaryOp node as string")
+	if !n.IsResolved() {
+		panic("Can't evaluate non-const expr node")
+	}
+	if n.Type() != NodeType_String {
+		panic("Can't EvalStr() a non-string node")
+	}
+	// Only "+" is supported for strings
+	return n.left.EvalStr() + n.right.EvalStr()
 }
 
 func (n *BinaryOpNode) IsResolved() bool {
@@ -198,6 +299,31 @@ func (n *BinaryOpNode) Resolve(label string, val int) {
 	n.right.Resolve(label, val)
 }
 
+func (n *BinaryOpNode) ResolveRelocatable(label string, val int) {
+	n.left.ResolveRelocatable(label, val)
+	n.right.ResolveRelocatable(label, val)
+}
+
+func (n *BinaryOpNode) Relocations() (int, bool) {
+	l, okl := n.left.Relocations()
+	r, okr := n.right.Relocations()
+	ok := okl && okr
+	switch {
+	case l == 0 && r == 0:
+		return 0, ok
+	case n.op == Add:
+		return l + r, ok
+	case n.op == Sub:
+		return l - r, ok
+	}
+	return l + r, false
+}
+
+func (n *BinaryOpNode) Relocate(base int) {
+	n.left.Relocate(base)
+	n.right.Relocate(base)
+}
+
 func (n *BinaryOpNode) UnresolvedSymbols() map[string]bool {
 	m := map[string]bool{}
 	for s := range n.left.UnresolvedSymbols() {
@@ -227,6 +353,12 @@ func (n *BinaryOpNode) CheckRange(sink errors.Sink) {
 }
 
 func (n *BinaryOpNode) Type() NodeType {
+	if n.op.IsComparison() || n.op.IsLogical() {
+		return NodeType_Int
+	}
+	if n.op == Add && n.left.Type() == NodeType_String {
+		return NodeType_String
+	}
 	if n.left.Type() == NodeType_Float || n.right.Type() == NodeType_Float {
 		return NodeType_Float
 	}
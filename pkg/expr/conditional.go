@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package expr
+
+import (
+	"github.com/asig/cbmasm/pkg/errors"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// ConditionalNode is "cond ? then : else". Only the branch that is selected by the condition needs to be resolved.
+type ConditionalNode struct {
+	baseNode
+
+	cond, then, els Node
+}
+
+func NewConditional(cond, then, els Node) Node {
+	return &ConditionalNode{
+		cond: cond,
+		then: then,
+		els:  els,
+	}
+}
+
+// selected returns the branch selected by the condition, which must be resolved.
+func (n *ConditionalNode) selected() Node {
+	if n.cond.Eval() != 0 {
+		return n.then
+	}
+	return n.els
+}
+
+func (n *ConditionalNode) Type() NodeType {
+	return n.then.Type()
+}
+
+func (n *ConditionalNode) ResultSize() int {
+	return max(n.then.ResultSize(), n.els.ResultSize())
+}
+
+func (n *ConditionalNode) ForceSize(size int) bool {
+	b1 := n.then.ForceSize(size)
+	b2 := n.els.ForceSize(size)
+	return b1 && b2
+}
+
+func (n *ConditionalNode) Eval() int {
+	if !n.IsResolved() {
+		panic("Can't evaluate unresolved conditional node")
+	}
+	return n.selected().Eval()
+}
+
+func (n *ConditionalNode) EvalFloat() float64 {
+	if !n.IsResolved() {
+		panic("Can't evaluate unresolved conditional node")
+	}
+	return n.selected().EvalFloat()
+}
+
+func (n *ConditionalNode) EvalStr() string {
+	if !n.IsResolved() {
+		panic("Can't evaluate unresolved conditional node")
+	}
+	return n.selected().EvalStr()
+}
+
+func (n *ConditionalNode) IsResolved() bool {
+	return n.cond.IsResolved() && n.selected().IsResolved()
+}
+
+func (n *ConditionalNode) Resolve(label string, val int) {
+	n.cond.Resolve(label, val)
+	n.then.Resolve(label, val)
+	n.els.Resolve(label, val)
+}
+
+func (n *ConditionalNode) ResolveRelocatable(label string, val int) {
+	n.cond.ResolveRelocatable(label, val)
+	n.then.ResolveRelocatable(label, val)
+	n.els.ResolveRelocatable(label, val)
+}
+
+func (n *ConditionalNode) Relocations() (int, bool) {
+	c, ok := n.cond.Relocations()
+	if c != 0 {
+		// The condition must not depend on the module's base address
+		return 0, false
+	}
+	if n.cond.IsResolved() {
+		r, okr := n.selected().Relocations()
+		return r, ok && okr
+	}
+	t, okt := n.then.Relocations()
+	e, oke := n.els.Relocations()
+	return t, ok && okt && oke && t == e
+}
+
+func (n *ConditionalNode) Relocate(base int) {
+	n.cond.Relocate(base)
+	n.then.Relocate(base)
+	n.els.Relocate(base)
+}
+
+func (n *ConditionalNode) UnresolvedSymbols() map[string]bool {
+	if n.cond.IsResolved() {
+		return n.selected().UnresolvedSymbols()
+	}
+	m := map[string]bool{}
+	for _, child := range []Node{n.cond, n.then, n.els} {
+		for s := range child.UnresolvedSymbols() {
+			m[s] = true
+		}
+	}
+	return m
+}
+
+func (n *ConditionalNode) MarkRelative() {
+	n.then.MarkRelative()
+	n.els.MarkRelative()
+}
+
+func (n *ConditionalNode) IsRelative() bool {
+	return n.then.IsRelative() || n.els.IsRelative()
+}
+
+func (n *ConditionalNode) Pos() text.Pos {
+	return n.cond.Pos()
+}
+
+func (n *ConditionalNode) CheckRange(sink errors.Sink) {
+	checkRange(n, sink)
+}
@@ -137,6 +137,16 @@ func (n *ConstNode) IsResolved() bool {
 func (n *ConstNode) Resolve(_ string, _ int) {
 }
 
+func (n *ConstNode) ResolveRelocatable(_ string, _ int) {
+}
+
+func (n *ConstNode) Relocations() (int, bool) {
+	return 0, true
+}
+
+func (n *ConstNode) Relocate(_ int) {
+}
+
 func (n *ConstNode) UnresolvedSymbols() map[string]bool {
 	return nil
 }
@@ -0,0 +1,443 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/errors"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// Function is a built-in function that can be called in expressions.
+type Function struct {
+	Name             string
+	MinArgs, MaxArgs int // MaxArgs is -1 if the number of arguments is not limited
+
+	// check returns an error message if the arguments' types are not supported.
+	check     func(args []Node) string
+	typ       func(args []Node) NodeType
+	size      func(args []Node) int
+	eval      func(args []Node) int
+	evalFloat func(args []Node) float64
+	evalStr   func(args []Node) string
+}
+
+func intArgs(args []Node) string {
+	for _, a := range args {
+		if a.Type() != NodeType_Int {
+			return "Arguments must be of type integer"
+		}
+	}
+	return ""
+}
+
+func numericArgs(args []Node) string {
+	for _, a := range args {
+		if !a.Type().IsNumeric() {
+			return "Arguments must be numeric"
+		}
+	}
+	return ""
+}
+
+func intType(_ []Node) NodeType {
+	return NodeType_Int
+}
+
+func floatType(_ []Node) NodeType {
+	return NodeType_Float
+}
+
+// numericType is float if any argument is a float, and int otherwise.
+func numericType(args []Node) NodeType {
+	for _, a := range args {
+		if a.Type() == NodeType_Float {
+			return NodeType_Float
+		}
+	}
+	return NodeType_Int
+}
+
+func byteSize(_ []Node) int {
+	return 1
+}
+
+func maxArgSize(args []Node) int {
+	size := 1
+	for _, a := range args {
+		size = max(size, a.ResultSize())
+	}
+	return size
+}
+
+func floatArg(n Node) float64 {
+	if n.Type() == NodeType_Float {
+		return n.EvalFloat()
+	}
+	return float64(n.Eval())
+}
+
+// extremum returns the index of the argument that is preferred by less over all others.
+func extremum(args []Node, less func(a, b float64) bool) int {
+	best := 0
+	for i := 1; i < len(args); i++ {
+		if less(floatArg(args[i]), floatArg(args[best])) {
+			best = i
+		}
+	}
+	return best
+}
+
+var (
+	Lo = &Function{
+		Name: "lo", MinArgs: 1, MaxArgs: 1,
+		check: intArgs, typ: intType, size: byteSize,
+		eval: func(args []Node) int { return args[0].Eval() & 0xff },
+	}
+	Hi = &Function{
+		Name: "hi", MinArgs: 1, MaxArgs: 1,
+		check: intArgs, typ: intType, size: byteSize,
+		eval: func(args []Node) int { return (args[0].Eval() >> 8) & 0xff },
+	}
+	Bank = &Function{
+		Name: "bank", MinArgs: 1, MaxArgs: 1,
+		check: intArgs, typ: intType, size: byteSize,
+		eval: func(args []Node) int { return (args[0].Eval() >> 16) & 0xff },
+	}
+	Min = &Function{
+		Name: "min", MinArgs: 1, MaxArgs: -1,
+		check: numericArgs, typ: numericType, size: maxArgSize,
+		eval: func(args []Node) int {
+			return args[extremum(args, func(a, b float64) bool { return a < b })].Eval()
+		},
+		evalFloat: func(args []Node) float64 {
+			return floatArg(args[extremum(args, func(a, b float64) bool { return a < b })])
+		},
+	}
+	Max = &Function{
+		Name: "max", MinArgs: 1, MaxArgs: -1,
+		check: numericArgs, typ: numericType, size: maxArgSize,
+		eval: func(args []Node) int {
+			return args[extremum(args, func(a, b float64) bool { return a > b })].Eval()
+		},
+		evalFloat: func(args []Node) float64 {
+			return floatArg(args[extremum(args, func(a, b float64) bool { return a > b })])
+		},
+	}
+	Abs = &Function{
+		Name: "abs", MinArgs: 1, MaxArgs: 1,
+		check: numericArgs, typ: numericType, size: maxArgSize,
+		eval: func(args []Node) int {
+			if v := args[0].Eval(); v < 0 {
+				return -v
+			} else {
+				return v
+			}
+		},
+		evalFloat: func(args []Node) float64 { return math.Abs(args[0].EvalFloat()) },
+	}
+	Strlen = &Function{
+		Name: "strlen", MinArgs: 1, MaxArgs: 1,
+		check: func(args []Node) string {
+			if args[0].Type() != NodeType_String {
+				return "Argument must be of type string"
+			}
+			return ""
+		},
+		typ: intType,
+		size: func(args []Node) int {
+			if args[0].IsResolved() && len(args[0].EvalStr()) < 256 {
+				return 1
+			}
+			return 2
+		},
+		eval: func(args []Node) int { return len(args[0].EvalStr()) },
+	}
+	Substr = &Function{
+		Name: "substr", MinArgs: 2, MaxArgs: 3,
+		check: func(args []Node) string {
+			if args[0].Type() != NodeType_String {
+				return "First argument must be of type string"
+			}
+			return intArgs(args[1:])
+		},
+		typ: stringType, size: textSize,
+		evalStr: substr,
+	}
+	Sin = &Function{
+		Name: "sin", MinArgs: 1, MaxArgs: 1,
+		check: numericArgs, typ: floatType, size: func(_ []Node) int { return 5 },
+		evalFloat: func(args []Node) float64 { return math.Sin(floatArg(args[0])) },
+	}
+	Cos = &Function{
+		Name: "cos", MinArgs: 1, MaxArgs: 1,
+		check: numericArgs, typ: floatType, size: func(_ []Node) int { return 5 },
+		evalFloat: func(args []Node) float64 { return math.Cos(floatArg(args[0])) },
+	}
+
+	Hex = &Function{
+		Name: "hex", MinArgs: 1, MaxArgs: 2,
+		check: digitsArgs, typ: stringType, size: textSize,
+		evalStr: func(args []Node) string { return formatInt(args, 16, "$") },
+	}
+	Bin = &Function{
+		Name: "bin", MinArgs: 1, MaxArgs: 2,
+		check: digitsArgs, typ: stringType, size: textSize,
+		evalStr: func(args []Node) string { return formatInt(args, 2, "%") },
+	}
+	Dec = &Function{
+		Name: "dec", MinArgs: 1, MaxArgs: 1,
+		check: numericArgs, typ: stringType, size: textSize,
+		evalStr: func(args []Node) string { return FormatValue(args[0]) },
+	}
+)
+
+func stringType(_ []Node) NodeType {
+	return NodeType_String
+}
+
+// textSize is the size of functions that convert numbers to strings. Resolved strings are as long as their text,
+// see CallNode.ResultSize.
+func textSize(_ []Node) int {
+	return 0
+}
+
+// maxDigits is the maximum number of digits that hex() and bin() pad their result to.
+const maxDigits = 64
+
+// digitsArgs checks the arguments of hex() and bin(): integers, and a number of digits of at most maxDigits.
+func digitsArgs(args []Node) string {
+	if msg := intArgs(args); msg != "" {
+		return msg
+	}
+	if len(args) > 1 && args[1].IsResolved() {
+		if d := args[1].Eval(); d < 0 || d > maxDigits {
+			return fmt.Sprintf("Number of digits must be between 0 and %d", maxDigits)
+		}
+	}
+	return ""
+}
+
+// formatInt formats args[0] in the given base with the prefix, padded with zeros to args[1] digits, if given.
+func formatInt(args []Node, base int, prefix string) string {
+	v := args[0].Eval()
+	sign := ""
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	s := strconv.FormatInt(int64(v), base)
+	if len(args) > 1 {
+		if d := min(args[1].Eval(), maxDigits); len(s) < d {
+			s = strings.Repeat("0", d-len(s)) + s
+		}
+	}
+	return sign + prefix + s
+}
+
+// FormatValue returns the value of a resolved node as text: integers in decimal, floats in their shortest
+// representation, and strings as they are.
+func FormatValue(n Node) string {
+	switch n.Type() {
+	case NodeType_Float:
+		return strconv.FormatFloat(n.EvalFloat(), 'g', -1, 64)
+	case NodeType_String:
+		return n.EvalStr()
+	}
+	return strconv.Itoa(n.Eval())
+}
+
+// substr returns the substring of args[0] that starts at index args[1], and is at most args[2] characters long.
+// If there's no args[2], the rest of the string is returned.
+func substr(args []Node) string {
+	for _, a := range args {
+		if !a.IsResolved() {
+			return ""
+		}
+	}
+	s := args[0].EvalStr()
+	start := min(max(args[1].Eval(), 0), len(s))
+	end := len(s)
+	if len(args) > 2 {
+		end = min(start+max(args[2].Eval(), 0), len(s))
+	}
+	return s[start:end]
+}
+
+// Functions are all built-in functions.
+var Functions = []*Function{Lo, Hi, Bank, Min, Max, Abs, Strlen, Substr, Sin, Cos, Hex, Bin, Dec}
+
+// Check returns an error message if args are not valid arguments of the function.
+func (f *Function) Check(args []Node) string {
+	if len(args) < f.MinArgs || f.MaxArgs >= 0 && len(args) > f.MaxArgs {
+		switch {
+		case f.MinArgs == f.MaxArgs:
+			return fmt.Sprintf("%s() expects %d argument(s), found %d", f.Name, f.MinArgs, len(args))
+		case f.MaxArgs < 0:
+			return fmt.Sprintf("%s() expects at least %d argument(s), found %d", f.Name, f.MinArgs, len(args))
+		default:
+			return fmt.Sprintf("%s() expects %d to %d arguments, found %d", f.Name, f.MinArgs, f.MaxArgs, len(args))
+		}
+	}
+	return f.check(args)
+}
+
+// CallNode is a call of a built-in function.
+type CallNode struct {
+	baseNode
+
+	pos        text.Pos
+	fn         *Function
+	args       []Node
+	size       int
+	isRelative bool
+}
+
+// NewCall returns a node that calls fn. The arguments must have been checked with fn.Check.
+func NewCall(pos text.Pos, fn *Function, args []Node) Node {
+	return &CallNode{
+		pos:  pos,
+		fn:   fn,
+		args: args,
+		size: fn.size(args),
+	}
+}
+
+func (n *CallNode) Type() NodeType {
+	return n.fn.typ(n.args)
+}
+
+func (n *CallNode) ResultSize() int {
+	if n.Type() == NodeType_String && n.IsResolved() {
+		return len(n.EvalStr())
+	}
+	return n.size
+}
+
+func (n *CallNode) ForceSize(size int) bool {
+	if n.Type() != NodeType_Int {
+		return true
+	}
+	n.size = size
+	if !n.IsResolved() {
+		return true
+	}
+	v := n.Eval()
+	return 0 <= v && v < 1<<(size*8)
+}
+
+func (n *CallNode) Eval() int {
+	if !n.IsResolved() {
+		panic("Can't evaluate unresolved function call")
+	}
+	if n.Type() != NodeType_Int {
+		panic("Can't Eval() a string or float node")
+	}
+	return n.fn.eval(n.args)
+}
+
+func (n *CallNode) EvalFloat() float64 {
+	if !n.IsResolved() {
+		panic("Can't evaluate unresolved function call")
+	}
+	if n.Type() != NodeType_Float {
+		panic("Can't EvalFloat() a non-float node")
+	}
+	return n.fn.evalFloat(n.args)
+}
+
+func (n *CallNode) EvalStr() string {
+	if !n.IsResolved() {
+		panic("Can't evaluate unresolved function call")
+	}
+	if n.Type() != NodeType_String {
+		panic("Can't EvalStr() a non-string node")
+	}
+	return n.fn.evalStr(n.args)
+}
+
+func (n *CallNode) IsResolved() bool {
+	for _, a := range n.args {
+		if !a.IsResolved() {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *CallNode) Resolve(label string, val int) {
+	for _, a := range n.args {
+		a.Resolve(label, val)
+	}
+}
+
+func (n *CallNode) ResolveRelocatable(label string, val int) {
+	for _, a := range n.args {
+		a.ResolveRelocatable(label, val)
+	}
+}
+
+func (n *CallNode) Relocations() (int, bool) {
+	ok := true
+	for _, a := range n.args {
+		r, okr := a.Relocations()
+		if r != 0 || !okr {
+			// Functions don't depend linearly on their arguments
+			ok = false
+		}
+	}
+	return 0, ok
+}
+
+func (n *CallNode) Relocate(base int) {
+	for _, a := range n.args {
+		a.Relocate(base)
+	}
+}
+
+func (n *CallNode) UnresolvedSymbols() map[string]bool {
+	m := map[string]bool{}
+	for _, a := range n.args {
+		for s := range a.UnresolvedSymbols() {
+			m[s] = true
+		}
+	}
+	return m
+}
+
+func (n *CallNode) MarkRelative() {
+	n.isRelative = true
+	n.size = 1
+}
+
+func (n *CallNode) IsRelative() bool {
+	return n.isRelative
+}
+
+func (n *CallNode) Pos() text.Pos {
+	return n.pos
+}
+
+func (n *CallNode) CheckRange(sink errors.Sink) {
+	checkRange(n, sink)
+}
@@ -26,12 +26,13 @@ import (
 type SymbolRefNode struct {
 	baseNode
 
-	pos        text.Pos
-	symbol     string
-	maxSize    int
-	val        int
-	resolved   bool
-	isRelative bool
+	pos         text.Pos
+	symbol      string
+	maxSize     int
+	val         int
+	resolved    bool
+	relocatable bool
+	isRelative  bool
 }
 
 func NewSymbolRef(pos text.Pos, symbol string, maxSize, val int) Node {
@@ -45,6 +46,19 @@ func NewSymbolRef(pos text.Pos, symbol string, maxSize, val int) Node {
 	}
 }
 
+// NewRelocatableSymbolRef creates a reference to a symbol whose value is relative to the module's base address.
+func NewRelocatableSymbolRef(pos text.Pos, symbol string, maxSize, val int) Node {
+	return &SymbolRefNode{
+		pos:         pos,
+		symbol:      symbol,
+		maxSize:     maxSize,
+		val:         val,
+		resolved:    true,
+		relocatable: true,
+		isRelative:  false,
+	}
+}
+
 func NewUnresolvedSymbol(pos text.Pos, symbol string, maxSize int) Node {
 	return &SymbolRefNode{
 		pos:        pos,
@@ -56,6 +70,17 @@ func NewUnresolvedSymbol(pos text.Pos, symbol string, maxSize int) Node {
 	}
 }
 
+// Symbol returns the name of the referenced symbol.
+func (n *SymbolRefNode) Symbol() string {
+	return n.symbol
+}
+
+// Rename changes the name of the referenced symbol. It's used when it turns out that a forward reference refers to
+// a symbol in another scope.
+func (n *SymbolRefNode) Rename(symbol string) {
+	n.symbol = symbol
+}
+
 func (n *SymbolRefNode) Type() NodeType {
 	return NodeType_Int
 }
@@ -103,6 +128,28 @@ func (n *SymbolRefNode) Resolve(symbol string, val int) {
 	}
 }
 
+func (n *SymbolRefNode) ResolveRelocatable(symbol string, val int) {
+	if symbol == n.symbol {
+		n.val = val
+		n.resolved = true
+		n.relocatable = true
+	}
+}
+
+func (n *SymbolRefNode) Relocations() (int, bool) {
+	if n.relocatable {
+		return 1, true
+	}
+	return 0, true
+}
+
+func (n *SymbolRefNode) Relocate(base int) {
+	if n.relocatable {
+		n.val = n.val + base
+		n.relocatable = false
+	}
+}
+
 func (n *SymbolRefNode) UnresolvedSymbols() map[string]bool {
 	if n.resolved {
 		return nil
@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package expr
+
+import (
+	"fmt"
+
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// Marshaled is a serializable representation of a node tree, used to store unresolved expressions in object files.
+type Marshaled struct {
+	Kind        string       `json:"kind"` // "const", "symbol", "unary", "binary", "conditional", or "call"
+	Pos         text.Pos     `json:"pos"`
+	Type        NodeType     `json:"type,omitempty"`
+	Size        int          `json:"size,omitempty"`
+	Val         int          `json:"val,omitempty"`
+	FloatVal    float64      `json:"floatVal,omitempty"`
+	StrVal      string       `json:"strVal,omitempty"`
+	Symbol      string       `json:"symbol,omitempty"`
+	Resolved    bool         `json:"resolved,omitempty"`
+	Relocatable bool         `json:"relocatable,omitempty"`
+	Relative    bool         `json:"relative,omitempty"`
+	Signed      bool         `json:"signed,omitempty"`
+	Range       *[2]int      `json:"range,omitempty"`
+	ValidValues []int        `json:"validValues,omitempty"`
+	Op          string       `json:"op,omitempty"`
+	Left        *Marshaled   `json:"left,omitempty"`
+	Right       *Marshaled   `json:"right,omitempty"`
+	Cond        *Marshaled   `json:"cond,omitempty"`
+	Args        []*Marshaled `json:"args,omitempty"`
+}
+
+var binaryOpNames = map[BinaryOp]string{
+	Add:    "add",
+	Sub:    "sub",
+	Mul:    "mul",
+	Mod:    "mod",
+	Div:    "div",
+	And:    "and",
+	Or:     "or",
+	Xor:    "xor",
+	Eq:     "eq",
+	Ne:     "ne",
+	Lt:     "lt",
+	Le:     "le",
+	Gt:     "gt",
+	Ge:     "ge",
+	Shl:    "shl",
+	Shr:    "shr",
+	LogAnd: "logAnd",
+	LogOr:  "logOr",
+}
+
+var unaryOps = []UnaryOp{HiByte, LoByte, Neg, Not, LogNot, ScreenCode, AsciiToPetscii, NoOp}
+
+func marshalBase(m *Marshaled, n *baseNode) {
+	m.Signed = n.signed
+	m.ValidValues = n.validValues
+	if n.r != nil {
+		m.Range = &[2]int{n.r.min, n.r.max}
+	}
+}
+
+func unmarshalBase(m *Marshaled, n *baseNode) {
+	n.signed = m.Signed
+	n.validValues = m.ValidValues
+	if m.Range != nil {
+		n.r = &Range{min: m.Range[0], max: m.Range[1]}
+	}
+}
+
+// Marshal converts a node tree into its serializable representation.
+func Marshal(node Node) *Marshaled {
+	var m *Marshaled
+	switch n := node.(type) {
+	case *ConstNode:
+		m = &Marshaled{Kind: "const", Pos: n.pos, Type: n.typ, Size: n.size, Val: n.val, FloatVal: n.floatval, StrVal: n.strval, Relative: n.isRelative}
+		marshalBase(m, &n.baseNode)
+	case *SymbolRefNode:
+		m = &Marshaled{Kind: "symbol", Pos: n.pos, Size: n.maxSize, Val: n.val, Symbol: n.symbol, Resolved: n.resolved, Relocatable: n.relocatable, Relative: n.isRelative}
+		marshalBase(m, &n.baseNode)
+	case *UnaryOpNode:
+		m = &Marshaled{Kind: "unary", Pos: n.pos, Op: n.op.name, Left: Marshal(n.node)}
+		marshalBase(m, &n.baseNode)
+	case *BinaryOpNode:
+		m = &Marshaled{Kind: "binary", Op: binaryOpNames[n.op], Size: n.size, Left: Marshal(n.left), Right: Marshal(n.right)}
+		marshalBase(m, &n.baseNode)
+	case *ConditionalNode:
+		m = &Marshaled{Kind: "conditional", Cond: Marshal(n.cond), Left: Marshal(n.then), Right: Marshal(n.els)}
+		marshalBase(m, &n.baseNode)
+	case *CallNode:
+		m = &Marshaled{Kind: "call", Pos: n.pos, Op: n.fn.Name, Size: n.size, Relative: n.isRelative}
+		for _, arg := range n.args {
+			m.Args = append(m.Args, Marshal(arg))
+		}
+		marshalBase(m, &n.baseNode)
+	default:
+		panic(fmt.Sprintf("Can't marshal node of type %T", node))
+	}
+	return m
+}
+
+// Unmarshal converts a serialized node tree back into nodes.
+func Unmarshal(m *Marshaled) (Node, error) {
+	switch m.Kind {
+	case "const":
+		n := &ConstNode{pos: m.Pos, typ: m.Type, size: m.Size, val: m.Val, floatval: m.FloatVal, strval: m.StrVal, isRelative: m.Relative}
+		unmarshalBase(m, &n.baseNode)
+		return n, nil
+	case "symbol":
+		n := &SymbolRefNode{pos: m.Pos, maxSize: m.Size, val: m.Val, symbol: m.Symbol, resolved: m.Resolved, relocatable: m.Relocatable, isRelative: m.Relative}
+		unmarshalBase(m, &n.baseNode)
+		return n, nil
+	case "unary":
+		if m.Left == nil {
+			return nil, fmt.Errorf("unary node without operand")
+		}
+		child, err := Unmarshal(m.Left)
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range unaryOps {
+			if op.name == m.Op {
+				n := &UnaryOpNode{pos: m.Pos, node: child, op: op}
+				unmarshalBase(m, &n.baseNode)
+				return n, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown unary operation %q", m.Op)
+	case "binary":
+		if m.Left == nil || m.Right == nil {
+			return nil, fmt.Errorf("binary node without operands")
+		}
+		left, err := Unmarshal(m.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := Unmarshal(m.Right)
+		if err != nil {
+			return nil, err
+		}
+		for op, name := range binaryOpNames {
+			if name == m.Op {
+				n := &BinaryOpNode{left: left, right: right, op: op, size: max(m.Size, 1)}
+				unmarshalBase(m, &n.baseNode)
+				return n, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown binary operation %q", m.Op)
+	case "conditional":
+		if m.Cond == nil || m.Left == nil || m.Right == nil {
+			return nil, fmt.Errorf("conditional node without operands")
+		}
+		cond, err := Unmarshal(m.Cond)
+		if err != nil {
+			return nil, err
+		}
+		then, err := Unmarshal(m.Left)
+		if err != nil {
+			return nil, err
+		}
+		els, err := Unmarshal(m.Right)
+		if err != nil {
+			return nil, err
+		}
+		n := &ConditionalNode{cond: cond, then: then, els: els}
+		unmarshalBase(m, &n.baseNode)
+		return n, nil
+	case "call":
+		var args []Node
+		for _, ma := range m.Args {
+			arg, err := Unmarshal(ma)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		for _, fn := range Functions {
+			if fn.Name == m.Op {
+				n := &CallNode{pos: m.Pos, fn: fn, args: args, size: m.Size, isRelative: m.Relative}
+				unmarshalBase(m, &n.baseNode)
+				return n, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown function %q", m.Op)
+	}
+	return nil, fmt.Errorf("unknown node kind %q", m.Kind)
+}
@@ -81,6 +81,16 @@ type Node interface {
 	// Resolve resolves symbols
 	Resolve(label string, val int)
 
+	// ResolveRelocatable resolves symbols whose value is relative to the module's base address.
+	ResolveRelocatable(label string, val int)
+
+	// Relocations returns how often the module's base address contributes to the node's value. ok is false if the
+	// base address doesn't contribute linearly, e.g. for "<label" or "label*2".
+	Relocations() (n int, ok bool)
+
+	// Relocate adds the module's base address to all relocatable symbols in the node.
+	Relocate(base int)
+
 	// IsResolved returns whether the node is resolved
 	IsResolved() bool
 
@@ -162,6 +172,10 @@ func (n *baseNode) ValidValues() ([]int, bool) {
 }
 
 func checkRange(n Node, sink errors.Sink) {
+	if operand, msg := invalidOperand(n); operand != nil {
+		sink.AddError(operand.Pos(), "%s", msg)
+		return
+	}
 	size := n.ResultSize()
 	val := n.Eval()
 
@@ -195,3 +209,35 @@ func checkRange(n Node, sink errors.Sink) {
 		sink.AddError(n.Pos(), "Value out of range.")
 	}
 }
+
+// invalidOperand returns the first operand in the resolved node n that its operator can't be applied to, like a
+// divisor of 0, together with an error message. It returns nil if there is none. The operands are often only known
+// when a patch is applied, so they can't always be checked while parsing.
+func invalidOperand(n Node) (Node, string) {
+	switch n := n.(type) {
+	case *BinaryOpNode:
+		if n.right.Type() == NodeType_Int {
+			if msg := n.op.CheckOperand(n.right.Eval()); msg != "" {
+				return n.right, msg
+			}
+		}
+		if o, msg := invalidOperand(n.left); o != nil {
+			return o, msg
+		}
+		return invalidOperand(n.right)
+	case *UnaryOpNode:
+		return invalidOperand(n.node)
+	case *ConditionalNode:
+		if o, msg := invalidOperand(n.cond); o != nil {
+			return o, msg
+		}
+		return invalidOperand(n.selected())
+	case *CallNode:
+		for _, arg := range n.args {
+			if o, msg := invalidOperand(arg); o != nil {
+				return o, msg
+			}
+		}
+	}
+	return nil, ""
+}
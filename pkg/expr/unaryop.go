@@ -24,6 +24,7 @@ import (
 )
 
 type UnaryOp struct {
+	name                string
 	transformation      func(int) int
 	transformationStr   func(string) string
 	transformationFloat func(float64) float64
@@ -32,23 +33,38 @@ type UnaryOp struct {
 
 var (
 	HiByte = UnaryOp{
+		name:           "hiByte",
 		transformation: func(v int) int { return (v >> 8) & 0xff },
 		size:           func(_ Node) int { return 1 },
 	}
 	LoByte = UnaryOp{
+		name:           "loByte",
 		transformation: func(v int) int { return v & 0xff },
 		size:           func(_ Node) int { return 1 },
 	}
 	Neg = UnaryOp{
+		name:                "neg",
 		transformation:      func(v int) int { return -v },
 		transformationFloat: func(v float64) float64 { return -v },
 		size:                func(n Node) int { return n.ResultSize() },
 	}
 	Not = UnaryOp{
+		name:           "not",
 		transformation: func(v int) int { return ^v },
 		size:           func(n Node) int { return n.ResultSize() },
 	}
+	LogNot = UnaryOp{
+		name: "logNot",
+		transformation: func(v int) int {
+			if v == 0 {
+				return 1
+			}
+			return 0
+		},
+		size: func(n Node) int { return n.ResultSize() },
+	}
 	ScreenCode = UnaryOp{
+		name:           "screenCode",
 		transformation: func(v int) int { return int(petToScreen[v&0xff]) },
 		transformationStr: func(v string) string {
 			res := ""
@@ -60,6 +76,7 @@ var (
 		size: func(n Node) int { return n.ResultSize() },
 	}
 	AsciiToPetscii = UnaryOp{
+		name:           "asciiToPetscii",
 		transformation: func(v int) int { return int(ascToPet[v&0xff]) },
 		transformationStr: func(v string) string {
 			res := ""
@@ -71,6 +88,7 @@ var (
 		size: func(n Node) int { return n.ResultSize() },
 	}
 	NoOp = UnaryOp{
+		name:              "noOp",
 		transformation:    func(v int) int { return v },
 		transformationStr: func(v string) string { return v },
 		size:              func(n Node) int { return n.ResultSize() },
@@ -156,6 +174,28 @@ func (n *UnaryOpNode) Resolve(label string, val int) {
 	n.node.Resolve(label, val)
 }
 
+func (n *UnaryOpNode) ResolveRelocatable(label string, val int) {
+	n.node.ResolveRelocatable(label, val)
+}
+
+func (n *UnaryOpNode) Relocations() (int, bool) {
+	r, ok := n.node.Relocations()
+	if r == 0 {
+		return 0, ok
+	}
+	if n.op.name == Neg.name {
+		return -r, ok
+	}
+	if n.op.name == NoOp.name {
+		return r, ok
+	}
+	return r, false
+}
+
+func (n *UnaryOpNode) Relocate(base int) {
+	n.node.Relocate(base)
+}
+
 func (n *UnaryOpNode) UnresolvedSymbols() map[string]bool {
 	return n.node.UnresolvedSymbols()
 }
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lsp
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// document is an open text buffer.
+type document struct {
+	uri     string
+	path    string
+	version int
+	text    string
+}
+
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// offset converts a position into a byte offset in text. Positions beyond the end of a line or the text are
+// clamped.
+func offset(text string, pos position) int {
+	off := 0
+	for line := 0; line < pos.Line; line++ {
+		i := strings.IndexByte(text[off:], '\n')
+		if i < 0 {
+			return len(text)
+		}
+		off += i + 1
+	}
+	units := 0
+	for i, r := range text[off:] {
+		if units >= pos.Character || r == '\n' {
+			return off + i
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return len(text)
+}
+
+// applyChange applies an incremental or full change to the document.
+func (d *document) applyChange(c contentChange) {
+	if c.Range == nil {
+		d.text = c.Text
+		return
+	}
+	start, end := offset(d.text, c.Range.Start), offset(d.text, c.Range.End)
+	if end < start {
+		end = start
+	}
+	d.text = d.text[:start] + c.Text + d.text[end:]
+}
+
+// line returns the given line (0-based) of text without the line break.
+func line(text string, n int) string {
+	lines := strings.Split(text, "\n")
+	if n < 0 || n >= len(lines) {
+		return ""
+	}
+	return strings.TrimSuffix(lines[n], "\r")
+}
+
+// utf16Len returns the length of s in UTF-16 code units.
+func utf16Len(runes []rune) int {
+	return len(utf16.Encode(runes))
+}
@@ -0,0 +1,647 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/asig/cbmasm/pkg/asm"
+	"github.com/asig/cbmasm/pkg/asm/mos6502"
+	"github.com/asig/cbmasm/pkg/asm/z80"
+	"github.com/asig/cbmasm/pkg/errors"
+	"github.com/asig/cbmasm/pkg/expr"
+	"github.com/asig/cbmasm/pkg/scanner"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// Options are the assembler settings used for all documents. Clients can override them with the
+// "initializationOptions" of the "initialize" request.
+type Options struct {
+	IncludeDirs []string
+	Defines     []string
+	CPU         string
+	Platform    string
+}
+
+var mnemonics6502 = map[string]map[string]mos6502.OpCodes{
+	"6502":    mos6502.Mnemonics,
+	"6510ill": mos6502.Mnemonics6510Ill,
+	"65c02":   mos6502.Mnemonics65C02,
+	"65ce02":  mos6502.Mnemonics65CE02,
+	"4510":    mos6502.Mnemonics4510,
+}
+
+var mnemonicsZ80 = map[string]map[string]z80.OpCodeEntryList{
+	"z80":    z80.Mnemonics,
+	"z80ill": z80.MnemonicsUndocumented,
+}
+
+// Server is a language server for one client.
+type Server struct {
+	in *bufio.Reader
+
+	outMu sync.Mutex
+	out   io.Writer
+
+	opts      Options
+	docs      map[string]*document // Open documents, by URI
+	results   map[string]*result   // Assembly results, by URI of the root document
+	published map[string]bool      // URIs that diagnostics were published for
+}
+
+// result is the outcome of assembling a root document, i.e. a document that is not included by another one.
+type result struct {
+	root        *document
+	a           *asm.Assembler
+	includeDirs []string
+	overlay     map[string][]byte
+	files       map[string]bool // Absolute paths of all files that contributed to the result
+}
+
+func NewServer(in io.Reader, out io.Writer, opts Options) *Server {
+	return &Server{
+		in:        bufio.NewReader(in),
+		out:       out,
+		opts:      opts,
+		docs:      make(map[string]*document),
+		results:   make(map[string]*result),
+		published: make(map[string]bool),
+	}
+}
+
+// Serve handles messages until the client sends "exit".
+func (s *Server) Serve() error {
+	for {
+		var msg message
+		if err := readMessage(s.in, &msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		res, rerr := s.handle(&msg)
+		if len(msg.ID) == 0 {
+			// Notification, no response
+			continue
+		}
+		resp := &response{JSONRPC: "2.0", ID: msg.ID, Error: rerr}
+		if rerr == nil {
+			buf, err := json.Marshal(res)
+			if err != nil {
+				return err
+			}
+			resp.Result = buf
+		}
+		if err := s.send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) send(msg interface{}) error {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	return writeMessage(s.out, msg)
+}
+
+func (s *Server) notify(method string, params interface{}) {
+	s.send(&notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func decodeParams(msg *message, params interface{}) *responseError {
+	if err := json.Unmarshal(msg.Params, params); err != nil {
+		return &responseError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func (s *Server) handle(msg *message) (interface{}, *responseError) {
+	switch msg.Method {
+	case "initialize":
+		var params initializeParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		s.initialize(params.InitializationOptions)
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync": map[string]interface{}{
+					"openClose": true,
+					"change":    2, // Incremental
+				},
+				"definitionProvider": true,
+				"referencesProvider": true,
+				"hoverProvider":      true,
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"."},
+				},
+			},
+			"serverInfo": map[string]string{"name": "cbmasm"},
+		}, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc := &document{uri: params.TextDocument.URI, path: uriToPath(params.TextDocument.URI), version: params.TextDocument.Version, text: params.TextDocument.Text}
+		s.docs[doc.uri] = doc
+		s.update(doc.path)
+		return nil, nil
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc := s.docs[params.TextDocument.URI]
+		if doc == nil {
+			return nil, &responseError{Code: codeInvalidParams, Message: fmt.Sprintf("Document %q is not open", params.TextDocument.URI)}
+		}
+		for _, c := range params.ContentChanges {
+			doc.applyChange(c)
+		}
+		s.update(doc.path)
+		return nil, nil
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if doc := s.docs[params.TextDocument.URI]; doc != nil {
+			delete(s.docs, doc.uri)
+			s.update(doc.path)
+		}
+		return nil, nil
+	case "textDocument/definition", "textDocument/references", "textDocument/hover", "textDocument/completion":
+		var params textDocumentPositionParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		switch msg.Method {
+		case "textDocument/definition":
+			return s.definition(&params), nil
+		case "textDocument/references":
+			return s.references(&params), nil
+		case "textDocument/hover":
+			return s.hover(&params), nil
+		default:
+			return s.completion(&params), nil
+		}
+	}
+	if len(msg.ID) == 0 {
+		// Unknown notifications are ignored
+		return nil, nil
+	}
+	return nil, &responseError{Code: codeMethodNotFound, Message: fmt.Sprintf("Unsupported method %q", msg.Method)}
+}
+
+func (s *Server) initialize(opts *initializationOptions) {
+	if opts != nil {
+		if len(opts.IncludeDirs) > 0 {
+			s.opts.IncludeDirs = opts.IncludeDirs
+		}
+		if len(opts.Defines) > 0 {
+			s.opts.Defines = opts.Defines
+		}
+		if opts.CPU != "" {
+			s.opts.CPU = opts.CPU
+		}
+		if opts.Platform != "" {
+			s.opts.Platform = opts.Platform
+		}
+	}
+	if !asm.IsSupportedCPU(s.opts.CPU) {
+		s.opts.CPU = "6502"
+	}
+	if !asm.IsSupportedPlatform(s.opts.Platform) || !asm.IsValidPlatformCPUCombo(s.opts.Platform, s.opts.CPU) {
+		s.opts.Platform = "generic"
+	}
+}
+
+// update reassembles everything that depends on the file at path, and publishes the new diagnostics.
+func (s *Server) update(path string) {
+	for uri, r := range s.results {
+		if doc := s.docs[uri]; doc != nil && r.files[path] {
+			s.assemble(doc)
+		}
+	}
+	for _, doc := range s.docs {
+		if doc.path == path && s.results[doc.uri] == nil && !s.isIncluded(path) {
+			s.assemble(doc)
+		}
+	}
+	// Drop the results of documents that were closed, or that are included by other documents now.
+	for uri, r := range s.results {
+		if s.docs[uri] == nil || s.isIncluded(r.root.path) {
+			delete(s.results, uri)
+		}
+	}
+	s.publishDiagnostics()
+}
+
+// isIncluded returns whether the file at path contributes to the result of another root document.
+func (s *Server) isIncluded(path string) bool {
+	for _, r := range s.results {
+		if r.root.path != path && r.files[path] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) assemble(doc *document) {
+	r := &result{
+		root:        doc,
+		includeDirs: append([]string{filepath.Dir(doc.path)}, s.opts.IncludeDirs...),
+		overlay:     make(map[string][]byte),
+		files:       map[string]bool{doc.path: true},
+	}
+	for _, d := range s.docs {
+		r.overlay[absPath(d.path)] = []byte(d.text)
+	}
+	r.a = asm.New(r.includeDirs, s.opts.CPU, s.opts.Platform, "plain", "petscii", s.opts.Defines)
+	r.a.SetOverlay(r.overlay)
+	assembleText(r.a, doc)
+
+	for _, l := range r.a.ListingLines {
+		r.files[r.resolve(l.Line.Filename)] = true
+	}
+	for _, sym := range r.a.Symbols() {
+		r.files[r.resolve(sym.Pos.Filename)] = true
+	}
+	s.results[doc.uri] = r
+}
+
+// assembleText assembles the document. Half-typed text can run into bugs of the assembler, which are reported as an
+// error instead of stopping the server.
+func assembleText(a *asm.Assembler, doc *document) {
+	defer func() {
+		if p := recover(); p != nil {
+			a.AddError(text.Pos{Filename: doc.path, Line: 1, Col: 1}, "Internal error: %v", p)
+		}
+	}()
+	a.Assemble(text.Process(doc.path, doc.text))
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// resolve maps a filename from a text.Pos to an absolute path. Included files are named as they appear in the
+// ".include" directive, so they're searched in the include directories just like the assembler does.
+func (r *result) resolve(filename string) string {
+	if filename == "" || filename == r.root.path {
+		return r.root.path
+	}
+	if filepath.IsAbs(filename) {
+		return filepath.Clean(filename)
+	}
+	for _, dir := range r.includeDirs {
+		full := absPath(filepath.Join(dir, filename))
+		if _, found := r.overlay[full]; found {
+			return full
+		}
+		if _, err := os.Stat(full); err == nil {
+			return full
+		}
+	}
+	return absPath(filename)
+}
+
+// resultFor returns the result the file at path contributes to.
+func (s *Server) resultFor(path string) *result {
+	for _, r := range s.results {
+		if r.files[path] {
+			return r
+		}
+	}
+	return nil
+}
+
+// lineRunes returns a line (1-based) of the file at path. Open documents take precedence over files on disk.
+func (s *Server) lineRunes(path string, n int) []rune {
+	for _, doc := range s.docs {
+		if doc.path == path {
+			return []rune(line(doc.text, n-1))
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return []rune(line(string(content), n-1))
+}
+
+// rangeAt returns the range of the word that starts at pos.
+func (s *Server) rangeAt(path string, pos text.Pos) textRange {
+	runes := s.lineRunes(path, pos.Line)
+	start := min(max(pos.Col-1, 0), len(runes))
+	end := start
+	for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune(",;()", runes[end]) {
+		end++
+	}
+	if end == start && end < len(runes) {
+		end++
+	}
+	line := max(pos.Line-1, 0)
+	return textRange{
+		Start: position{Line: line, Character: utf16Len(runes[:start])},
+		End:   position{Line: line, Character: utf16Len(runes[:end])},
+	}
+}
+
+func (s *Server) publishDiagnostics() {
+	diags := make(map[string][]diagnostic)
+	seen := make(map[string]bool)
+	add := func(r *result, errs []errors.Error, severity int) {
+		for _, e := range errs {
+			path := r.resolve(e.Pos.Filename)
+			d := diagnostic{Range: s.rangeAt(path, e.Pos), Severity: severity, Code: e.Category, Source: "cbmasm", Message: e.Summary()}
+			for f := e.Expansion; f != nil; f = f.Caller {
+				callPath := r.resolve(f.Call.Filename)
+				d.RelatedInformation = append(d.RelatedInformation, diagnosticRelatedInformation{
+					Location: location{URI: pathToURI(callPath), Range: s.rangeAt(callPath, f.Call)},
+					Message:  strings.TrimPrefix(f.String(), "in "),
+				})
+			}
+			uri := pathToURI(path)
+			key := fmt.Sprintf("%s:%v:%d:%s", uri, d.Range, severity, e.Message())
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			diags[uri] = append(diags[uri], d)
+		}
+	}
+	for _, r := range s.results {
+		diags[pathToURI(r.root.path)] = []diagnostic{}
+		add(r, r.a.Errors(), severityError)
+		add(r, r.a.Warnings(), severityWarning)
+	}
+	for uri := range s.published {
+		if _, found := diags[uri]; !found {
+			diags[uri] = []diagnostic{}
+		}
+	}
+
+	var uris []string
+	for uri := range diags {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	s.published = make(map[string]bool)
+	for _, uri := range uris {
+		if len(diags[uri]) > 0 {
+			s.published[uri] = true
+		}
+		s.notify("textDocument/publishDiagnostics", &publishDiagnosticsParams{URI: uri, Diagnostics: diags[uri]})
+	}
+}
+
+type emptyErrorSink struct{}
+
+func (emptyErrorSink) AddError(_ text.Pos, _ string, _ ...interface{}) {}
+
+// tokenAt returns the identifier at the given position.
+func (s *Server) tokenAt(path string, p position) (scanner.Token, textRange, bool) {
+	runes := s.lineRunes(path, p.Line+1)
+	sc := scanner.New(text.Line{Filename: path, LineNumber: p.Line + 1, Runes: runes}, emptyErrorSink{})
+	for {
+		tok := sc.Scan()
+		if tok.Type == scanner.Eol || tok.Type == scanner.Semicolon {
+			return scanner.Token{}, textRange{}, false
+		}
+		if tok.StrVal == "" || tok.Type == scanner.String || tok.Type == scanner.Char {
+			continue
+		}
+		start := tok.Pos.Col - 1
+		end := min(start+len([]rune(tok.StrVal)), len(runes))
+		rng := textRange{
+			Start: position{Line: p.Line, Character: utf16Len(runes[:start])},
+			End:   position{Line: p.Line, Character: utf16Len(runes[:end])},
+		}
+		if p.Character >= rng.Start.Character && p.Character < rng.End.Character {
+			return tok, rng, true
+		}
+	}
+}
+
+// symbolAt returns the name and scope of the symbol at the given position.
+func (s *Server) symbolAt(params *textDocumentPositionParams) (r *result, name string, scope string, rng textRange, ok bool) {
+	path := uriToPath(params.TextDocument.URI)
+	r = s.resultFor(path)
+	if r == nil {
+		return nil, "", "", textRange{}, false
+	}
+	tok, rng, ok := s.tokenAt(path, params.Position)
+	if !ok || tok.Type != scanner.Ident {
+		return nil, "", "", textRange{}, false
+	}
+	at := func(pos text.Pos) bool {
+		return pos.Line == tok.Pos.Line && pos.Col == tok.Pos.Col && r.resolve(pos.Filename) == path
+	}
+	for _, ref := range r.a.References() {
+		if at(ref.Pos) {
+			return r, ref.Name, ref.Scope, rng, true
+		}
+	}
+	for _, def := range r.a.Symbols() {
+		if at(def.Pos) {
+			return r, def.Name, def.Scope, rng, true
+		}
+	}
+	return r, tok.StrVal, "", rng, true
+}
+
+func (s *Server) definitions(r *result, name, scope string) []asm.Symbol {
+	var res []asm.Symbol
+	for _, def := range r.a.Symbols() {
+		if strings.EqualFold(def.Name, name) && def.Scope == scope {
+			res = append(res, def)
+		}
+	}
+	return res
+}
+
+func (s *Server) location(r *result, pos text.Pos) location {
+	path := r.resolve(pos.Filename)
+	return location{URI: pathToURI(path), Range: s.rangeAt(path, pos)}
+}
+
+func (s *Server) definition(params *textDocumentPositionParams) []location {
+	r, name, scope, _, ok := s.symbolAt(params)
+	if !ok {
+		return nil
+	}
+	var res []location
+	for _, def := range s.definitions(r, name, scope) {
+		res = append(res, s.location(r, def.Pos))
+	}
+	return res
+}
+
+func (s *Server) references(params *textDocumentPositionParams) []location {
+	r, name, scope, _, ok := s.symbolAt(params)
+	if !ok {
+		return nil
+	}
+	var res []location
+	if params.Context != nil && params.Context.IncludeDeclaration {
+		for _, def := range s.definitions(r, name, scope) {
+			res = append(res, s.location(r, def.Pos))
+		}
+	}
+	for _, ref := range r.a.References() {
+		if strings.EqualFold(ref.Name, name) && ref.Scope == scope {
+			res = append(res, s.location(r, ref.Pos))
+		}
+	}
+	return res
+}
+
+func formatValue(n expr.Node) string {
+	if n == nil || !n.IsResolved() {
+		return "unresolved"
+	}
+	switch n.Type() {
+	case expr.NodeType_Int:
+		v := n.Eval()
+		return fmt.Sprintf("`$%04x` (%d)", v, v)
+	case expr.NodeType_Float:
+		return fmt.Sprintf("`%g`", n.EvalFloat())
+	case expr.NodeType_String:
+		return fmt.Sprintf("`%q`", n.EvalStr())
+	}
+	return "unknown"
+}
+
+func (s *Server) hover(params *textDocumentPositionParams) *hover {
+	path := uriToPath(params.TextDocument.URI)
+	if r, name, scope, rng, ok := s.symbolAt(params); ok {
+		if defs := s.definitions(r, name, scope); len(defs) > 0 {
+			var lines []string
+			for _, def := range defs {
+				if def.Kind == "macro" {
+					lines = append(lines, fmt.Sprintf("**macro** `%s`", def.Name))
+				} else {
+					lines = append(lines, fmt.Sprintf("**%s** `%s` = %s", def.Kind, def.Name, formatValue(def.Value)))
+				}
+			}
+			return &hover{Contents: markupContent{Kind: "markdown", Value: strings.Join(lines, "\n\n")}, Range: &rng}
+		}
+	}
+
+	tok, rng, ok := s.tokenAt(path, params.Position)
+	if !ok || tok.Type != scanner.Ident {
+		return nil
+	}
+	mnemonic := strings.ToLower(tok.StrVal)
+	cpu := s.cpuAt(path, params.Position.Line)
+	if table, found := mnemonics6502[cpu]; found {
+		opCodes, found := table[mnemonic]
+		if !found {
+			return nil
+		}
+		type row struct {
+			operand string
+			opCode  byte
+		}
+		var rows []row
+		for mode, opCode := range opCodes {
+			operand := "`" + strings.TrimSpace(mnemonic+" "+mode.Syntax()) + "`"
+			rows = append(rows, row{operand: operand, opCode: opCode})
+		}
+		sort.Slice(rows, func(i, j int) bool { return rows[i].opCode < rows[j].opCode })
+		lines := []string{fmt.Sprintf("**%s** (%s)", mnemonic, cpu), "", "| Instruction | Opcode |", "|---|---|"}
+		for _, r := range rows {
+			lines = append(lines, fmt.Sprintf("| %s | `$%02x` |", r.operand, r.opCode))
+		}
+		return &hover{Contents: markupContent{Kind: "markdown", Value: strings.Join(lines, "\n")}, Range: &rng}
+	}
+	if table, found := mnemonicsZ80[cpu]; found {
+		if entries, found := table[mnemonic]; found {
+			return &hover{Contents: markupContent{Kind: "markdown", Value: fmt.Sprintf("**%s** (%s), %d forms", mnemonic, cpu, len(entries))}, Range: &rng}
+		}
+	}
+	return nil
+}
+
+// cpuAt returns the CPU that is selected at the given line (0-based) of the file at path.
+func (s *Server) cpuAt(path string, n int) string {
+	cpu := s.opts.CPU
+	for i := 1; i <= n+1; i++ {
+		sc := scanner.New(text.Line{Filename: path, LineNumber: i, Runes: s.lineRunes(path, i)}, emptyErrorSink{})
+		tok := sc.Scan()
+		if tok.Type == scanner.Ident {
+			// Skip label
+			tok = sc.Scan()
+		}
+		if tok.Type != scanner.Cpu {
+			continue
+		}
+		if tok = sc.Scan(); tok.Type == scanner.String && asm.IsSupportedCPU(strings.ToLower(tok.StrVal)) {
+			cpu = strings.ToLower(tok.StrVal)
+		}
+	}
+	return cpu
+}
+
+func (s *Server) completion(params *textDocumentPositionParams) []completionItem {
+	items := []completionItem{}
+	for _, d := range scanner.Directives() {
+		items = append(items, completionItem{Label: d, Kind: completionKeyword, Detail: "directive"})
+	}
+	r := s.resultFor(uriToPath(params.TextDocument.URI))
+	if r == nil {
+		return items
+	}
+	seen := make(map[string]bool)
+	for _, def := range r.a.Symbols() {
+		key := strings.ToLower(def.Name)
+		if def.Scope != "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		item := completionItem{Label: def.Name, Kind: completionVariable, Detail: def.Kind}
+		switch def.Kind {
+		case "const":
+			item.Kind = completionConstant
+		case "macro":
+			item.Kind = completionFunction
+		}
+		items = append(items, item)
+	}
+	return items
+}
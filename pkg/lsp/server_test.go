@@ -0,0 +1,270 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMacros = `border	.equ $d020
+flash	.macro
+	inc border
+	.endm
+`
+
+const testMain = `	.include "macros.i"
+	.org $1000
+start	ldx #count
+_l	flash
+	dex
+	bne _l
+	jmp undefined
+count	.equ 3
+`
+
+type testMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *responseError  `json:"error"`
+}
+
+type testClient struct {
+	t             *testing.T
+	w             io.Writer
+	id            int
+	messages      chan *testMessage
+	notifications []*testMessage
+}
+
+func newTestClient(t *testing.T) *testClient {
+	clientIn, serverOut := io.Pipe()
+	serverIn, clientOut := io.Pipe()
+	c := &testClient{t: t, w: clientOut, messages: make(chan *testMessage, 100)}
+	go func() {
+		NewServer(serverIn, serverOut, Options{CPU: "6502", Platform: "c64"}).Serve()
+		serverOut.Close()
+	}()
+	go func() {
+		r := bufio.NewReader(clientIn)
+		for {
+			var msg testMessage
+			if err := readMessage(r, &msg); err != nil {
+				close(c.messages)
+				return
+			}
+			c.messages <- &msg
+		}
+	}()
+	return c
+}
+
+func (c *testClient) next() *testMessage {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			c.t.Fatalf("Server closed the connection")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("Timeout waiting for a message")
+	}
+	return nil
+}
+
+func (c *testClient) notify(method string, params interface{}) {
+	c.t.Helper()
+	buf, _ := json.Marshal(params)
+	if err := writeMessage(c.w, &message{JSONRPC: "2.0", Method: method, Params: buf}); err != nil {
+		c.t.Fatalf("Can't send notification: %s", err)
+	}
+}
+
+// request sends a request and decodes the result into result. Notifications received in the meantime are queued.
+func (c *testClient) request(method string, params interface{}, result interface{}) {
+	c.t.Helper()
+	c.id++
+	buf, _ := json.Marshal(params)
+	id, _ := json.Marshal(c.id)
+	if err := writeMessage(c.w, &message{JSONRPC: "2.0", ID: id, Method: method, Params: buf}); err != nil {
+		c.t.Fatalf("Can't send request: %s", err)
+	}
+	for {
+		msg := c.next()
+		if len(msg.ID) == 0 {
+			c.notifications = append(c.notifications, msg)
+			continue
+		}
+		if msg.Error != nil {
+			c.t.Fatalf("Request %q failed: %+v", method, msg.Error)
+		}
+		if result != nil {
+			if err := json.Unmarshal(msg.Result, result); err != nil {
+				c.t.Fatalf("Can't decode result of %q: %s", method, err)
+			}
+		}
+		return
+	}
+}
+
+// diagnostics waits for the diagnostics of uri.
+func (c *testClient) diagnostics(uri string) []diagnostic {
+	c.t.Helper()
+	for {
+		var msg *testMessage
+		if len(c.notifications) > 0 {
+			msg, c.notifications = c.notifications[0], c.notifications[1:]
+		} else {
+			msg = c.next()
+		}
+		if msg.Method != "textDocument/publishDiagnostics" {
+			continue
+		}
+		var params publishDiagnosticsParams
+		json.Unmarshal(msg.Params, &params)
+		if params.URI == uri {
+			return params.Diagnostics
+		}
+	}
+}
+
+func pos(uri string, line, char int) *textDocumentPositionParams {
+	return &textDocumentPositionParams{TextDocument: textDocumentIdentifier{URI: uri}, Position: position{Line: line, Character: char}}
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "macros.i"), []byte(testMacros), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mainURI := pathToURI(filepath.Join(dir, "main.asm"))
+	macrosURI := pathToURI(filepath.Join(dir, "macros.i"))
+
+	c := newTestClient(t)
+	c.request("initialize", map[string]interface{}{}, nil)
+	c.notify("initialized", map[string]interface{}{})
+	c.notify("textDocument/didOpen", didOpenParams{TextDocument: textDocumentItem{URI: mainURI, Version: 1, Text: testMain}})
+
+	// Diagnostics
+	diags := c.diagnostics(mainURI)
+	wantRange := textRange{Start: position{Line: 6, Character: 5}, End: position{Line: 6, Character: 14}}
+	if len(diags) != 1 || diags[0].Range != wantRange || diags[0].Severity != severityError {
+		t.Errorf("Got diagnostics %+v, want one error at %+v", diags, wantRange)
+	}
+
+	// Go to definition
+	tests := []struct {
+		name string
+		at   *textDocumentPositionParams
+		want location
+	}{
+		{"local label", pos(mainURI, 5, 5), location{URI: mainURI, Range: textRange{Start: position{Line: 3, Character: 0}, End: position{Line: 3, Character: 2}}}},
+		{"macro", pos(mainURI, 3, 5), location{URI: macrosURI, Range: textRange{Start: position{Line: 1, Character: 0}, End: position{Line: 1, Character: 5}}}},
+		{"constant", pos(mainURI, 2, 11), location{URI: mainURI, Range: textRange{Start: position{Line: 7, Character: 0}, End: position{Line: 7, Character: 5}}}},
+		{"in included file", pos(macrosURI, 2, 7), location{URI: macrosURI, Range: textRange{Start: position{Line: 0, Character: 0}, End: position{Line: 0, Character: 6}}}},
+	}
+	for _, test := range tests {
+		var locs []location
+		c.request("textDocument/definition", test.at, &locs)
+		if len(locs) != 1 || locs[0] != test.want {
+			t.Errorf("%s: got definitions %+v, want %+v", test.name, locs, test.want)
+		}
+	}
+
+	// Find references
+	refsAt := pos(macrosURI, 0, 2)
+	refsAt.Context = &struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	}{IncludeDeclaration: true}
+	var refs []location
+	c.request("textDocument/references", refsAt, &refs)
+	if len(refs) != 2 || refs[0].Range.Start.Line != 0 || refs[1].Range.Start.Line != 2 {
+		t.Errorf("Got references %+v, want lines 0 and 2 of macros.i", refs)
+	}
+
+	// Hover
+	var h hover
+	c.request("textDocument/hover", pos(mainURI, 2, 11), &h)
+	if want := "**const** `count` = `$0003` (3)"; h.Contents.Value != want {
+		t.Errorf("Got hover %q, want %q", h.Contents.Value, want)
+	}
+	c.request("textDocument/hover", pos(mainURI, 2, 7), &h)
+	if want := "| `ldx #$aa` | `$a2` |"; !strings.Contains(h.Contents.Value, want) {
+		t.Errorf("Got hover %q, want it to contain %q", h.Contents.Value, want)
+	}
+
+	// Completion
+	var items []completionItem
+	c.request("textDocument/completion", pos(mainURI, 4, 1), &items)
+	labels := make(map[string]bool)
+	for _, item := range items {
+		labels[item.Label] = true
+	}
+	if !labels[".macro"] || !labels["start"] || !labels["flash"] || labels["_l"] {
+		t.Errorf("Got completions %v, want directives and global symbols", labels)
+	}
+
+	// Incremental change fixes the error
+	c.notify("textDocument/didChange", didChangeParams{
+		TextDocument:   textDocumentIdentifier{URI: mainURI},
+		ContentChanges: []contentChange{{Range: &wantRange, Text: "start"}},
+	})
+	if diags := c.diagnostics(mainURI); len(diags) != 0 {
+		t.Errorf("Got diagnostics %+v, want none", diags)
+	}
+
+	c.request("shutdown", nil, nil)
+	c.notify("exit", nil)
+}
+
+func TestServer_divisionByZero(t *testing.T) {
+	uri := pathToURI(filepath.Join(t.TempDir(), "main.asm"))
+
+	c := newTestClient(t)
+	c.request("initialize", map[string]interface{}{}, nil)
+	c.notify("initialized", map[string]interface{}{})
+
+	// The divisor is only known when the patch is applied
+	c.notify("textDocument/didOpen", didOpenParams{TextDocument: textDocumentItem{URI: uri, Version: 1, Text: "\t.org $1000\n\t.byte 1/zero\nzero\t.equ 0\n"}})
+	diags := c.diagnostics(uri)
+	if len(diags) != 1 || diags[0].Message != "Division by zero" || diags[0].Range.Start.Line != 1 {
+		t.Errorf("Got diagnostics %+v, want a division by zero in line 2", diags)
+	}
+
+	c.notify("textDocument/didChange", didChangeParams{
+		TextDocument:   textDocumentIdentifier{URI: uri},
+		ContentChanges: []contentChange{{Text: "\t.org $1000\n\t.byte 1/0\n"}},
+	})
+	diags = c.diagnostics(uri)
+	if len(diags) != 1 || diags[0].Message != "Division by zero" {
+		t.Errorf("Got diagnostics %+v, want a division by zero", diags)
+	}
+
+	c.request("shutdown", nil, nil)
+	c.notify("exit", nil)
+}
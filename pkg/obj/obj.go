@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package obj defines the object file format written by "cbmasm -output obj" and read by cbmlink.
+//
+// Object files are JSON documents. A module consists of sections, symbols and patches:
+//   - Relocatable sections hold addresses that are relative to the module's base address, which is chosen by the
+//     linker. Absolute sections (the ones started with ".org") are placed at their origin.
+//   - Symbols are all global labels and constants defined in the module. Their value is either a number (which
+//     is relative to the module's base address if the symbol is relocatable), or an expression that refers to
+//     symbols from other modules.
+//   - Patches are expressions that could not be finalized by the assembler because they refer to symbols from other
+//     modules or to relocatable addresses. The linker evaluates them and writes the result into the section.
+package obj
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/asig/cbmasm/pkg/expr"
+)
+
+// Version is the version of the object file format.
+const Version = 1
+
+type File struct {
+	Version  int       `json:"version"`
+	Source   string    `json:"source"`
+	Sections []Section `json:"sections"`
+	Symbols  []Symbol  `json:"symbols"`
+	Imports  []string  `json:"imports"`
+	Patches  []Patch   `json:"patches"`
+}
+
+type Section struct {
+	Org         int    `json:"org"`
+	Relocatable bool   `json:"relocatable"`
+	Bytes       []byte `json:"bytes"`
+}
+
+type Symbol struct {
+	Name        string          `json:"name"`
+	Label       bool            `json:"label"`
+	Value       int             `json:"value"`
+	Relocatable bool            `json:"relocatable,omitempty"`
+	Expr        *expr.Marshaled `json:"expr,omitempty"` // Only set if the value depends on other modules.
+}
+
+type Patch struct {
+	Section int            `json:"section"` // Index into File.Sections
+	Offset  int            `json:"offset"`  // Offset from the beginning of the section
+	Expr    expr.Marshaled `json:"expr"`
+}
+
+func Write(w io.Writer, f *File) error {
+	f.Version = Version
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(f)
+}
+
+func Read(r io.Reader) (*File, error) {
+	var f File
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+	if f.Version != Version {
+		return nil, fmt.Errorf("Unsupported object file version %d, expected %d", f.Version, Version)
+	}
+	return &f, nil
+}
@@ -19,6 +19,7 @@
 package scanner
 
 import (
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
@@ -58,6 +59,14 @@ const (
 	Hash
 	Tilde
 	Caret
+	Assign
+	DoubleColon
+	Bang
+	Shl
+	Shr
+	LogAnd
+	LogOr
+	Question
 
 	// directives
 	Cpu
@@ -68,9 +77,14 @@ const (
 	Else
 	Endif
 	Fail
+	Print
+	Warning
+	Error
 	Include
 	Incbin
 	Reserve
+	Fill
+	Fillword
 	Byte
 	Word
 	Float
@@ -83,93 +97,202 @@ const (
 	Encoding
 	Output
 	ClearLocals
+	Segment
+	Endsegment
+	Test
+	Given
+	Expect
+	EndTest
+	CyclesBegin
+	CyclesEnd
+	AssertSamePage
+	ParamCount
+	Ellipsis
+	Rept
+	Endr
+	For
+	Endfor
+	While
+	Endwhile
+	Set
+	Scope
+	Endscope
+	Proc
+	Endproc
+	Struct
+	Endstruct
+	Enum
+	Endenum
 
 	Eol
 )
 
 var identToTokenType = map[string]TokenType{
-	".cpu":          Cpu,
-	".platform":     Platform,
-	".ifdef":        Ifdef,
-	".ifndef":       Ifndef,
-	".if":           If,
-	".else":         Else,
-	".endif":        Endif,
-	".fail":         Fail,
-	".include":      Include,
-	".incbin":       Incbin,
-	".reserve":      Reserve,
-	".byte":         Byte,
-	".word":         Word,
-	".float":        Float,
-	".equ":          Equ,
-	".org":          Org,
-	".skip":         Skip,
-	".align":        Align,
-	".macro":        Macro,
-	".endm":         Endm,
-	".encoding":     Encoding,
-	".output":       Output,
-	".clear_locals": ClearLocals,
+	".cpu":              Cpu,
+	".platform":         Platform,
+	".ifdef":            Ifdef,
+	".ifndef":           Ifndef,
+	".if":               If,
+	".else":             Else,
+	".endif":            Endif,
+	".fail":             Fail,
+	".print":            Print,
+	".warning":          Warning,
+	".error":            Error,
+	".include":          Include,
+	".incbin":           Incbin,
+	".reserve":          Reserve,
+	".fill":             Fill,
+	".fillword":         Fillword,
+	".byte":             Byte,
+	".word":             Word,
+	".float":            Float,
+	".equ":              Equ,
+	".org":              Org,
+	".skip":             Skip,
+	".align":            Align,
+	".macro":            Macro,
+	".endm":             Endm,
+	".encoding":         Encoding,
+	".output":           Output,
+	".clear_locals":     ClearLocals,
+	".segment":          Segment,
+	".endsegment":       Endsegment,
+	".test":             Test,
+	".given":            Given,
+	".expect":           Expect,
+	".endtest":          EndTest,
+	".cycles_begin":     CyclesBegin,
+	".cycles_end":       CyclesEnd,
+	".assert_same_page": AssertSamePage,
+	".paramcount":       ParamCount,
+	"...":               Ellipsis,
+	".rept":             Rept,
+	".endr":             Endr,
+	".for":              For,
+	".endfor":           Endfor,
+	".while":            While,
+	".endwhile":         Endwhile,
+	".set":              Set,
+	".scope":            Scope,
+	".endscope":         Endscope,
+	".proc":             Proc,
+	".endproc":          Endproc,
+	".struct":           Struct,
+	".endstruct":        Endstruct,
+	".enum":             Enum,
+	".endenum":          Endenum,
+	".res":              Reserve,
 }
 
 var tokenTypeToString = map[TokenType]string{
-	Unknown:   "<unknown>",
-	Ident:     "identifier",
-	Integer:   "integer",
-	String:    "string",
-	Char:      "character",
-	LParen:    "'('",
-	RParen:    "')'",
-	Plus:      "'+'",
-	Minus:     "'-'",
-	Slash:     "'/'",
-	Asterisk:  "'*'",
-	Percent:   "'%'",
-	Dollar:    "'$'",
-	Ampersand: "'&'",
-	Bar:       "'|'",
-	Dot:       "'.'",
-	Colon:     "':'",
-	Semicolon: "';'",
-	Comma:     "'.'",
-	Lt:        "'<'",
-	Le:        "'<='",
-	Gt:        "'>'",
-	Ge:        "'>='",
-	Eq:        "'='",
-	Ne:        "'!='",
-	Hash:      "'#'",
-	Tilde:     "'~'",
-	Caret:     "'^'",
-	Cpu:       ".cpu",
-	Platform:  ".platform",
-	Ifdef:     ".ifdef",
-	Ifndef:    ".ifndef",
-	If:        ".if",
-	Else:      ".else",
-	Endif:     ".endif",
-	Fail:      ".fail",
-	Include:   ".include",
-	Incbin:    ".incbin'",
-	Reserve:   ".reserve",
-	Byte:      ".byte",
-	Word:      ".word",
-	Equ:       ".equ",
-	Org:       ".org",
-	Skip:      ".skip",
-	Align:     ".align",
-	Macro:     ".macro",
-	Endm:      ".endm",
-	Encoding:  ".encoding",
-	Output:    ".output",
-	Eol:       "EOL",
+	Unknown:        "<unknown>",
+	Ident:          "identifier",
+	Integer:        "integer",
+	String:         "string",
+	Char:           "character",
+	LParen:         "'('",
+	RParen:         "')'",
+	Plus:           "'+'",
+	Minus:          "'-'",
+	Slash:          "'/'",
+	Asterisk:       "'*'",
+	Percent:        "'%'",
+	Dollar:         "'$'",
+	Ampersand:      "'&'",
+	Bar:            "'|'",
+	Dot:            "'.'",
+	Colon:          "':'",
+	Semicolon:      "';'",
+	Comma:          "'.'",
+	Lt:             "'<'",
+	Le:             "'<='",
+	Gt:             "'>'",
+	Ge:             "'>='",
+	Eq:             "'='",
+	Ne:             "'!='",
+	Hash:           "'#'",
+	Tilde:          "'~'",
+	Caret:          "'^'",
+	Assign:         "':='",
+	DoubleColon:    "'::'",
+	Bang:           "'!'",
+	Shl:            "'<<'",
+	Shr:            "'>>'",
+	LogAnd:         "'&&'",
+	LogOr:          "'||'",
+	Question:       "'?'",
+	Cpu:            ".cpu",
+	Platform:       ".platform",
+	Ifdef:          ".ifdef",
+	Ifndef:         ".ifndef",
+	If:             ".if",
+	Else:           ".else",
+	Endif:          ".endif",
+	Fail:           ".fail",
+	Print:          ".print",
+	Warning:        ".warning",
+	Error:          ".error",
+	Include:        ".include",
+	Incbin:         ".incbin'",
+	Reserve:        ".reserve",
+	Fill:           ".fill",
+	Fillword:       ".fillword",
+	Byte:           ".byte",
+	Word:           ".word",
+	Equ:            ".equ",
+	Org:            ".org",
+	Skip:           ".skip",
+	Align:          ".align",
+	Macro:          ".macro",
+	Endm:           ".endm",
+	Encoding:       ".encoding",
+	Output:         ".output",
+	Segment:        ".segment",
+	Endsegment:     ".endsegment",
+	Test:           ".test",
+	Given:          ".given",
+	Expect:         ".expect",
+	EndTest:        ".endtest",
+	CyclesBegin:    ".cycles_begin",
+	CyclesEnd:      ".cycles_end",
+	AssertSamePage: ".assert_same_page",
+	ParamCount:     ".paramcount",
+	Ellipsis:       "'...'",
+	Rept:           ".rept",
+	Endr:           ".endr",
+	For:            ".for",
+	Endfor:         ".endfor",
+	While:          ".while",
+	Endwhile:       ".endwhile",
+	Set:            ".set",
+	Scope:          ".scope",
+	Endscope:       ".endscope",
+	Proc:           ".proc",
+	Endproc:        ".endproc",
+	Struct:         ".struct",
+	Endstruct:      ".endstruct",
+	Enum:           ".enum",
+	Endenum:        ".endenum",
+	Eol:            "EOL",
 }
 
 func (t TokenType) String() string {
 	return tokenTypeToString[t]
 }
 
+// Directives returns the names of all directives, sorted alphabetically.
+func Directives() []string {
+	var res []string
+	for d := range identToTokenType {
+		if d != "..." {
+			res = append(res, d)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
 type Token struct {
 	Type     TokenType
 	StrVal   string
@@ -348,6 +471,11 @@ func (scanner *Scanner) Scan() Token {
 	case ch == '&':
 		t.StrVal = "&"
 		ch = scanner.getch()
+		if ch == '&' {
+			t.StrVal = "&&"
+			t.Type = LogAnd
+			return t
+		}
 		if !isOctalDigit(ch) {
 			scanner.ungetch()
 			t.Type = Ampersand
@@ -383,6 +511,7 @@ func (scanner *Scanner) Scan() Token {
 			return t
 		}
 		scanner.ungetch()
+		t.Type = Bang
 	case ch == '(':
 		t.Type = LParen
 	case ch == ')':
@@ -400,8 +529,27 @@ func (scanner *Scanner) Scan() Token {
 	case ch == '-':
 		t.Type = Minus
 	case ch == '|':
+		ch = scanner.getch()
+		if ch == '|' {
+			t.StrVal = "||"
+			t.Type = LogOr
+			return t
+		}
+		scanner.ungetch()
 		t.Type = Bar
 	case ch == ':':
+		ch = scanner.getch()
+		if ch == '=' {
+			t.StrVal = ":="
+			t.Type = Assign
+			return t
+		}
+		if ch == ':' {
+			t.StrVal = "::"
+			t.Type = DoubleColon
+			return t
+		}
+		scanner.ungetch()
 		t.Type = Colon
 	case ch == '<':
 		ch = scanner.getch()
@@ -410,6 +558,11 @@ func (scanner *Scanner) Scan() Token {
 			t.Type = Le
 			return t
 		}
+		if ch == '<' {
+			t.StrVal = "<<"
+			t.Type = Shl
+			return t
+		}
 		scanner.ungetch()
 		t.Type = Lt
 	case ch == '>':
@@ -419,9 +572,21 @@ func (scanner *Scanner) Scan() Token {
 			t.Type = Ge
 			return t
 		}
+		if ch == '>' {
+			t.StrVal = ">>"
+			t.Type = Shr
+			return t
+		}
 		scanner.ungetch()
 		t.Type = Gt
 	case ch == '=':
+		ch = scanner.getch()
+		if ch == '=' {
+			t.StrVal = "=="
+			t.Type = Eq
+			return t
+		}
+		scanner.ungetch()
 		t.Type = Eq
 	case ch == '#':
 		t.Type = Hash
@@ -429,6 +594,8 @@ func (scanner *Scanner) Scan() Token {
 		t.Type = Tilde
 	case ch == '^':
 		t.Type = Caret
+	case ch == '?':
+		t.Type = Question
 	}
 	return t
 }
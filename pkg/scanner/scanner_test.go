@@ -30,7 +30,7 @@ type errorSink struct {
 }
 
 func (e *errorSink) AddError(pos text.Pos, message string, args ...interface{}) {
-	e.e = append(e.e, errors.Error{pos, message})
+	e.e = append(e.e, errors.Error{Pos: pos, Msg: message})
 }
 
 func TestScanner_Scan_integers(t *testing.T) {
@@ -148,3 +148,43 @@ func TestScanner_Scan_strings(t *testing.T) {
 		})
 	}
 }
+
+func TestScanner_Scan_operators(t *testing.T) {
+	tests := []struct {
+		name string
+		text text.Line
+		want []TokenType
+	}{
+		{
+			name: "Shifts",
+			text: text.Process("filename", "<< >> < > <= >=").Lines[0],
+			want: []TokenType{Shl, Shr, Lt, Gt, Le, Ge},
+		},
+		{
+			name: "Logical operators",
+			text: text.Process("filename", "&& || ! & | !=").Lines[0],
+			want: []TokenType{LogAnd, LogOr, Bang, Ampersand, Bar, Ne},
+		},
+		{
+			name: "Equality",
+			text: text.Process("filename", "= ==").Lines[0],
+			want: []TokenType{Eq, Eq},
+		},
+		{
+			name: "Conditional",
+			text: text.Process("filename", "a?1:2").Lines[0],
+			want: []TokenType{Ident, Question, Integer, Colon, Integer},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := errorSink{}
+			scanner := New(test.text, &errors)
+			for _, want := range test.want {
+				if got := scanner.Scan(); got.Type != want {
+					t.Errorf("got token type %s, expected %s", got.Type, want)
+				}
+			}
+		})
+	}
+}
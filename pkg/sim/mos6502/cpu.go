@@ -0,0 +1,420 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package mos6502 executes 6502 machine code in a flat 64K memory model.
+package mos6502
+
+import (
+	"fmt"
+
+	"github.com/asig/cbmasm/pkg/asm/mos6502"
+)
+
+// Bits of the status register
+const (
+	FlagC byte = 1 << iota
+	FlagZ
+	FlagI
+	FlagD
+	FlagB
+	FlagU // Unused, always reads as 1
+	FlagV
+	FlagN
+)
+
+type instruction struct {
+	mnemonic string
+	mode     mos6502.AddressingMode
+	timing   mos6502.Timing
+}
+
+// instructions maps opcodes to instructions. Only the documented opcodes are supported.
+var instructions [256]*instruction
+
+func init() {
+	for m, opCodes := range mos6502.Mnemonics {
+		for mode, opCode := range opCodes {
+			timing, _ := mos6502.InstructionTiming(m, mode)
+			instructions[opCode] = &instruction{mnemonic: m, mode: mode, timing: timing}
+		}
+	}
+}
+
+// Hook is called before the instruction at its address is executed. Hooks can be used to stub out routines,
+// e.g. the KERNAL's: a hook can change the registers and memory, and set the PC to skip the routine.
+type Hook func(c *CPU)
+
+type CPU struct {
+	A, X, Y, SP, P byte
+	PC             uint16
+	Mem            [0x10000]byte
+	Cycles         uint64 // Number of cycles executed so far
+
+	labels      map[string]int
+	breakpoints map[uint16]bool
+	hooks       map[uint16]Hook
+	calling     bool // Set while a routine started with Call runs
+	returnSP    byte // Stack pointer when Call was called
+}
+
+func New() *CPU {
+	return &CPU{
+		SP:          0xff,
+		P:           FlagU | FlagI,
+		breakpoints: make(map[uint16]bool),
+		hooks:       make(map[uint16]Hook),
+	}
+}
+
+// Load copies bytes into memory, starting at org.
+func (c *CPU) Load(org int, bytes []byte) {
+	for i, b := range bytes {
+		c.Mem[uint16(org+i)] = b
+	}
+}
+
+func (c *CPU) read16(addr uint16) uint16 {
+	return uint16(c.Mem[addr]) | uint16(c.Mem[addr+1])<<8
+}
+
+// read16ZeroPage reads a word from the zero page, wrapping around at $ff.
+func (c *CPU) read16ZeroPage(addr byte) uint16 {
+	return uint16(c.Mem[addr]) | uint16(c.Mem[addr+1])<<8
+}
+
+func (c *CPU) push(b byte) {
+	c.Mem[0x100|uint16(c.SP)] = b
+	c.SP--
+}
+
+func (c *CPU) pull() byte {
+	c.SP++
+	return c.Mem[0x100|uint16(c.SP)]
+}
+
+func (c *CPU) push16(w uint16) {
+	c.push(byte(w >> 8))
+	c.push(byte(w))
+}
+
+func (c *CPU) pull16() uint16 {
+	lo := c.pull()
+	return uint16(lo) | uint16(c.pull())<<8
+}
+
+func (c *CPU) setFlag(flag byte, set bool) {
+	if set {
+		c.P |= flag
+	} else {
+		c.P &^= flag
+	}
+}
+
+func (c *CPU) setNZ(v byte) {
+	c.setFlag(FlagZ, v == 0)
+	c.setFlag(FlagN, v&0x80 != 0)
+}
+
+// operandAddr returns the effective address of the instruction's operand, and whether indexing crossed a page
+// boundary. The operand starts at pc.
+func (c *CPU) operandAddr(mode mos6502.AddressingMode, pc uint16) (uint16, bool) {
+	indexed := func(base uint16, index byte) (uint16, bool) {
+		addr := base + uint16(index)
+		return addr, addr&0xff00 != base&0xff00
+	}
+	switch mode {
+	case mos6502.AM_Immediate:
+		return pc, false
+	case mos6502.AM_ZeroPage:
+		return uint16(c.Mem[pc]), false
+	case mos6502.AM_ZeroPageIndexedX:
+		return uint16(c.Mem[pc] + c.X), false
+	case mos6502.AM_ZeroPageIndexedY:
+		return uint16(c.Mem[pc] + c.Y), false
+	case mos6502.AM_Absolute:
+		return c.read16(pc), false
+	case mos6502.AM_AbsoluteIndexedX:
+		return indexed(c.read16(pc), c.X)
+	case mos6502.AM_AbsoluteIndexedY:
+		return indexed(c.read16(pc), c.Y)
+	case mos6502.AM_AbsoluteIndirect:
+		// The NMOS 6502 doesn't carry into the high byte of the pointer
+		ptr := c.read16(pc)
+		return uint16(c.Mem[ptr]) | uint16(c.Mem[ptr&0xff00|(ptr+1)&0x00ff])<<8, false
+	case mos6502.AM_IndexedIndirect:
+		return c.read16ZeroPage(c.Mem[pc] + c.X), false
+	case mos6502.AM_IndirectIndexed:
+		return indexed(c.read16ZeroPage(c.Mem[pc]), c.Y)
+	case mos6502.AM_Relative:
+		return pc + 1 + uint16(int8(c.Mem[pc])), false
+	}
+	return 0, false
+}
+
+// Step executes the instruction at PC.
+func (c *CPU) Step() error {
+	opCode := c.Mem[c.PC]
+	instr := instructions[opCode]
+	if instr == nil {
+		return fmt.Errorf("Illegal opcode $%02x at $%04x", opCode, c.PC)
+	}
+	addr, pageCrossed := c.operandAddr(instr.mode, c.PC+1)
+	c.PC += uint16(1 + instr.mode.OperandSize())
+	c.Cycles += uint64(instr.timing.Cycles)
+	if pageCrossed && instr.timing.PageCross {
+		c.Cycles++
+	}
+
+	switch instr.mnemonic {
+	case "adc":
+		c.adc(c.Mem[addr])
+	case "sbc":
+		c.sbc(c.Mem[addr])
+	case "and":
+		c.A &= c.Mem[addr]
+		c.setNZ(c.A)
+	case "ora":
+		c.A |= c.Mem[addr]
+		c.setNZ(c.A)
+	case "eor":
+		c.A ^= c.Mem[addr]
+		c.setNZ(c.A)
+	case "bit":
+		v := c.Mem[addr]
+		c.setFlag(FlagZ, c.A&v == 0)
+		c.setFlag(FlagN, v&0x80 != 0)
+		c.setFlag(FlagV, v&0x40 != 0)
+	case "cmp":
+		c.compare(c.A, c.Mem[addr])
+	case "cpx":
+		c.compare(c.X, c.Mem[addr])
+	case "cpy":
+		c.compare(c.Y, c.Mem[addr])
+
+	case "asl", "lsr", "rol", "ror":
+		if instr.mode == mos6502.AM_Accumulator {
+			c.A = c.shift(instr.mnemonic, c.A)
+		} else {
+			c.Mem[addr] = c.shift(instr.mnemonic, c.Mem[addr])
+		}
+	case "inc":
+		c.Mem[addr]++
+		c.setNZ(c.Mem[addr])
+	case "dec":
+		c.Mem[addr]--
+		c.setNZ(c.Mem[addr])
+	case "inx":
+		c.X++
+		c.setNZ(c.X)
+	case "iny":
+		c.Y++
+		c.setNZ(c.Y)
+	case "dex":
+		c.X--
+		c.setNZ(c.X)
+	case "dey":
+		c.Y--
+		c.setNZ(c.Y)
+
+	case "lda":
+		c.A = c.Mem[addr]
+		c.setNZ(c.A)
+	case "ldx":
+		c.X = c.Mem[addr]
+		c.setNZ(c.X)
+	case "ldy":
+		c.Y = c.Mem[addr]
+		c.setNZ(c.Y)
+	case "sta":
+		c.Mem[addr] = c.A
+	case "stx":
+		c.Mem[addr] = c.X
+	case "sty":
+		c.Mem[addr] = c.Y
+
+	case "tax":
+		c.X = c.A
+		c.setNZ(c.X)
+	case "tay":
+		c.Y = c.A
+		c.setNZ(c.Y)
+	case "txa":
+		c.A = c.X
+		c.setNZ(c.A)
+	case "tya":
+		c.A = c.Y
+		c.setNZ(c.A)
+	case "tsx":
+		c.X = c.SP
+		c.setNZ(c.X)
+	case "txs":
+		c.SP = c.X
+
+	case "pha":
+		c.push(c.A)
+	case "php":
+		c.push(c.P | FlagB | FlagU)
+	case "pla":
+		c.A = c.pull()
+		c.setNZ(c.A)
+	case "plp":
+		c.P = c.pull()&^FlagB | FlagU
+
+	case "bcc":
+		c.branch(c.P&FlagC == 0, addr)
+	case "bcs":
+		c.branch(c.P&FlagC != 0, addr)
+	case "bne":
+		c.branch(c.P&FlagZ == 0, addr)
+	case "beq":
+		c.branch(c.P&FlagZ != 0, addr)
+	case "bpl":
+		c.branch(c.P&FlagN == 0, addr)
+	case "bmi":
+		c.branch(c.P&FlagN != 0, addr)
+	case "bvc":
+		c.branch(c.P&FlagV == 0, addr)
+	case "bvs":
+		c.branch(c.P&FlagV != 0, addr)
+
+	case "jmp":
+		c.PC = addr
+	case "jsr":
+		c.push16(c.PC - 1)
+		c.PC = addr
+	case "rts":
+		c.PC = c.pull16() + 1
+	case "rti":
+		c.P = c.pull()&^FlagB | FlagU
+		c.PC = c.pull16()
+	case "brk":
+		c.push16(c.PC + 1)
+		c.push(c.P | FlagB | FlagU)
+		c.P |= FlagI
+		c.PC = c.read16(0xfffe)
+
+	case "clc":
+		c.P &^= FlagC
+	case "sec":
+		c.P |= FlagC
+	case "cli":
+		c.P &^= FlagI
+	case "sei":
+		c.P |= FlagI
+	case "cld":
+		c.P &^= FlagD
+	case "sed":
+		c.P |= FlagD
+	case "clv":
+		c.P &^= FlagV
+	case "nop":
+	}
+	return nil
+}
+
+func (c *CPU) branch(taken bool, target uint16) {
+	if !taken {
+		return
+	}
+	c.Cycles++
+	if target&0xff00 != c.PC&0xff00 {
+		c.Cycles++
+	}
+	c.PC = target
+}
+
+func (c *CPU) compare(reg, v byte) {
+	c.setFlag(FlagC, reg >= v)
+	c.setNZ(reg - v)
+}
+
+func (c *CPU) shift(mnemonic string, v byte) byte {
+	carry := c.P & FlagC
+	var res byte
+	switch mnemonic {
+	case "asl":
+		c.setFlag(FlagC, v&0x80 != 0)
+		res = v << 1
+	case "lsr":
+		c.setFlag(FlagC, v&0x01 != 0)
+		res = v >> 1
+	case "rol":
+		c.setFlag(FlagC, v&0x80 != 0)
+		res = v<<1 | carry
+	case "ror":
+		c.setFlag(FlagC, v&0x01 != 0)
+		res = v>>1 | carry<<7
+	}
+	c.setNZ(res)
+	return res
+}
+
+func (c *CPU) adc(v byte) {
+	carry := uint16(c.P & FlagC)
+	bin := uint16(c.A) + uint16(v) + carry
+	if c.P&FlagD == 0 {
+		c.setFlag(FlagC, bin > 0xff)
+		c.setFlag(FlagV, ^(c.A^v)&(c.A^byte(bin))&0x80 != 0)
+		c.A = byte(bin)
+		c.setNZ(c.A)
+		return
+	}
+
+	// Decimal mode. As on the NMOS 6502, Z is taken from the binary result, N and V from the intermediate result.
+	lo := uint16(c.A&0x0f) + uint16(v&0x0f) + carry
+	hi := uint16(c.A>>4) + uint16(v>>4)
+	if lo > 9 {
+		lo += 6
+	}
+	if lo > 0x0f {
+		hi++
+	}
+	c.setFlag(FlagZ, byte(bin) == 0)
+	c.setFlag(FlagN, hi&0x08 != 0)
+	c.setFlag(FlagV, ^(c.A^v)&(c.A^byte(hi<<4))&0x80 != 0)
+	if hi > 9 {
+		hi += 6
+	}
+	c.setFlag(FlagC, hi > 0x0f)
+	c.A = byte(hi<<4) | byte(lo&0x0f)
+}
+
+func (c *CPU) sbc(v byte) {
+	borrow := 1 - int(c.P&FlagC)
+	bin := int(c.A) - int(v) - borrow
+	c.setFlag(FlagC, bin >= 0)
+	c.setFlag(FlagV, (c.A^v)&(c.A^byte(bin))&0x80 != 0)
+	c.setNZ(byte(bin))
+	if c.P&FlagD == 0 {
+		c.A = byte(bin)
+		return
+	}
+
+	// Decimal mode. As on the NMOS 6502, all flags are taken from the binary result.
+	lo := int(c.A&0x0f) - int(v&0x0f) - borrow
+	hi := int(c.A>>4) - int(v>>4)
+	if lo < 0 {
+		lo -= 6
+		hi--
+	}
+	if hi < 0 {
+		hi -= 6
+	}
+	c.A = byte(hi<<4) | byte(lo&0x0f)
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package mos6502
+
+import (
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/asm"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+func run(t *testing.T, src string, maxSteps int) *CPU {
+	t.Helper()
+	a := asm.New([]string{}, "6502", "c64", "plain", "petscii", []string{})
+	a.Assemble(text.Process("", src))
+	if errs := a.Errors(); len(errs) > 0 {
+		t.Fatalf("Got errors %v", errs)
+	}
+	c := New()
+	c.Load(a.Origin(), a.GetBytes())
+	c.PC = uint16(a.Origin())
+	for i := 0; i < maxSteps && c.Mem[c.PC] != 0x00; i++ {
+		if err := c.Step(); err != nil {
+			t.Fatalf("Step failed: %s", err)
+		}
+	}
+	return c
+}
+
+func TestCPU_Step(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		a, x, y byte
+		p       byte
+		mem     map[uint16]byte
+	}{
+		{
+			name: "loop and indexed store",
+			src: `
+	.org $1000
+	ldx #3
+loop	txa
+	sta $2000,x
+	dex
+	bne loop
+	brk`,
+			a: 1, x: 0, y: 0, p: FlagU | FlagI | FlagZ,
+			mem: map[uint16]byte{0x2001: 1, 0x2002: 2, 0x2003: 3},
+		},
+		{
+			name: "subroutine and indirect indexed",
+			src: `
+	.org $1000
+	lda #$00
+	sta $fb
+	lda #$30
+	sta $fc
+	ldy #5
+	jsr store
+	brk
+store	lda #$aa
+	sta ($fb),y
+	rts`,
+			a: 0xaa, x: 0, y: 5, p: FlagU | FlagI | FlagN,
+			mem: map[uint16]byte{0x3005: 0xaa},
+		},
+		{
+			name: "16 bit addition",
+			src: `
+	.org $1000
+	clc
+	lda #$ff
+	adc #$01
+	tax
+	lda #$00
+	adc #$00
+	tay
+	brk`,
+			a: 1, x: 0, y: 1, p: FlagU | FlagI,
+		},
+		{
+			name: "decimal mode",
+			src: `
+	.org $1000
+	sed
+	sec
+	lda #$42
+	sbc #$13
+	tax
+	clc
+	lda #$58
+	adc #$46
+	brk`,
+			a: 0x04, x: 0x29, y: 0, p: FlagU | FlagI | FlagD | FlagC | FlagN | FlagV, // N and V are taken from the intermediate result
+		},
+	}
+	for _, test := range tests {
+		c := run(t, test.src, 1000)
+		if c.A != test.a || c.X != test.x || c.Y != test.y || c.P != test.p {
+			t.Errorf("%s: got A=$%02x X=$%02x Y=$%02x P=$%02x, want A=$%02x X=$%02x Y=$%02x P=$%02x",
+				test.name, c.A, c.X, c.Y, c.P, test.a, test.x, test.y, test.p)
+		}
+		for addr, want := range test.mem {
+			if got := c.Mem[addr]; got != want {
+				t.Errorf("%s: got $%02x at $%04x, want $%02x", test.name, got, addr, want)
+			}
+		}
+	}
+}
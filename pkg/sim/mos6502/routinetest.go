@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package mos6502
+
+import (
+	"fmt"
+
+	"github.com/asig/cbmasm/pkg/asm"
+)
+
+// TestResult is the outcome of a test defined with ".test".
+type TestResult struct {
+	Test     asm.Test
+	Cycles   uint64   // Cycles spent in the routine, including the final RTS
+	Failures []string // Expectations that were not met
+	Err      error    // Set if the routine didn't return
+}
+
+func (r TestResult) Passed() bool {
+	return r.Err == nil && len(r.Failures) == 0
+}
+
+// RunTest loads the assembled program into a fresh CPU, sets up registers and memory as given, calls the
+// routine, and checks the expectations once it returns.
+func RunTest(a *asm.Assembler, test asm.Test, maxCycles uint64) TestResult {
+	res := TestResult{Test: test}
+
+	c := New()
+	c.Load(a.Origin(), a.GetBytes())
+	c.SetLabels(a.Labels())
+	for _, g := range test.Given {
+		if g.Register != "" {
+			c.SetRegister(g.Register, g.Values[0])
+			continue
+		}
+		for i, v := range g.Values {
+			c.Mem[uint16(g.Addr+i)] = byte(v)
+		}
+	}
+
+	start := c.Cycles
+	reason, err := c.Call(uint16(test.Routine), maxCycles)
+	res.Cycles = c.Cycles - start
+	if err != nil {
+		res.Err = fmt.Errorf("%s at $%04x", err, c.PC)
+		return res
+	}
+	if reason != StopReturned {
+		res.Err = fmt.Errorf("Routine stopped at $%04x (%s) instead of returning", c.PC, reason)
+		return res
+	}
+
+	for _, e := range test.Expect {
+		if e.Register != "" {
+			val, _ := c.Register(e.Register)
+			if val != e.Values[0]&0xff {
+				res.Failures = append(res.Failures, fmt.Sprintf("%s, line %d: expected %s = $%02x, got $%02x", e.Pos.Filename, e.Pos.Line, e.Register, e.Values[0]&0xff, val))
+			}
+			continue
+		}
+		for i, v := range e.Values {
+			addr := uint16(e.Addr + i)
+			if got := c.Mem[addr]; got != byte(v) {
+				res.Failures = append(res.Failures, fmt.Sprintf("%s, line %d: expected $%04x = $%02x, got $%02x", e.Pos.Filename, e.Pos.Line, addr, byte(v), got))
+			}
+		}
+	}
+	return res
+}
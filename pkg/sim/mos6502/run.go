@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package mos6502
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// StopReason tells why Run stopped.
+type StopReason int
+
+const (
+	StopReturned   StopReason = iota // The routine started with Call returned
+	StopBreakpoint                   // A breakpoint was reached
+	StopBRK                          // A BRK instruction is about to be executed
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopReturned:
+		return "returned"
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopBRK:
+		return "brk"
+	}
+	return fmt.Sprintf("StopReason(%d)", int(r))
+}
+
+var ErrCycleLimit = errors.New("Cycle limit exceeded")
+
+// returnAddr is the address Call returns to. It is never executed.
+const returnAddr = 0xffff
+
+// SetLabels sets the labels that can be used for breakpoints and hooks, typically the assembler's Labels().
+func (c *CPU) SetLabels(labels map[string]int) {
+	c.labels = make(map[string]int)
+	for name, addr := range labels {
+		c.labels[strings.ToLower(name)] = addr
+	}
+}
+
+func (c *CPU) label(name string) (uint16, error) {
+	addr, found := c.labels[strings.ToLower(name)]
+	if !found {
+		return 0, fmt.Errorf("Label %q is not defined", name)
+	}
+	return uint16(addr), nil
+}
+
+// Break sets a breakpoint at addr.
+func (c *CPU) Break(addr uint16) {
+	c.breakpoints[addr] = true
+}
+
+// BreakAt sets a breakpoint at a label.
+func (c *CPU) BreakAt(label string) error {
+	addr, err := c.label(label)
+	if err != nil {
+		return err
+	}
+	c.Break(addr)
+	return nil
+}
+
+func (c *CPU) ClearBreakpoints() {
+	c.breakpoints = make(map[uint16]bool)
+}
+
+// Hook sets the hook for addr.
+func (c *CPU) Hook(addr uint16, h Hook) {
+	c.hooks[addr] = h
+}
+
+// HookAt sets the hook for a label.
+func (c *CPU) HookAt(label string, h Hook) error {
+	addr, err := c.label(label)
+	if err != nil {
+		return err
+	}
+	c.Hook(addr, h)
+	return nil
+}
+
+// Return returns from the current subroutine, just like RTS. It's meant to be used in hooks.
+func (c *CPU) Return() {
+	c.PC = c.pull16() + 1
+}
+
+// Register returns the value of a register ("a", "x", "y", "sp", "p", or "pc").
+func (c *CPU) Register(name string) (int, bool) {
+	switch strings.ToLower(name) {
+	case "a":
+		return int(c.A), true
+	case "x":
+		return int(c.X), true
+	case "y":
+		return int(c.Y), true
+	case "sp":
+		return int(c.SP), true
+	case "p":
+		return int(c.P), true
+	case "pc":
+		return int(c.PC), true
+	}
+	return 0, false
+}
+
+// SetRegister sets a register ("a", "x", "y", "sp", "p", or "pc").
+func (c *CPU) SetRegister(name string, val int) bool {
+	switch strings.ToLower(name) {
+	case "a":
+		c.A = byte(val)
+	case "x":
+		c.X = byte(val)
+	case "y":
+		c.Y = byte(val)
+	case "sp":
+		c.SP = byte(val)
+	case "p":
+		c.P = byte(val) | FlagU
+	case "pc":
+		c.PC = uint16(val)
+	default:
+		return false
+	}
+	return true
+}
+
+// Run executes instructions until a breakpoint or a BRK instruction is reached, or the routine started with
+// Call returns. A breakpoint at the current PC is ignored, so that Run can continue after a breakpoint.
+// ErrCycleLimit is returned if this doesn't happen within maxCycles.
+func (c *CPU) Run(maxCycles uint64) (StopReason, error) {
+	limit := c.Cycles + maxCycles
+	for first := true; ; first = false {
+		if h := c.hooks[c.PC]; h != nil {
+			pc := c.PC
+			h(c)
+			if c.PC != pc {
+				// The hook skipped the code
+				first = true
+				continue
+			}
+		}
+		if c.calling && c.PC == returnAddr && c.SP == c.returnSP {
+			c.calling = false
+			return StopReturned, nil
+		}
+		if !first && c.breakpoints[c.PC] {
+			return StopBreakpoint, nil
+		}
+		if c.Mem[c.PC] == 0x00 {
+			return StopBRK, nil
+		}
+		if c.Cycles >= limit {
+			return StopBreakpoint, ErrCycleLimit
+		}
+		if err := c.Step(); err != nil {
+			return StopBreakpoint, err
+		}
+	}
+}
+
+// Call calls the subroutine at addr, and runs it like Run.
+func (c *CPU) Call(addr uint16, maxCycles uint64) (StopReason, error) {
+	c.returnSP = c.SP
+	c.calling = true
+	c.push16(returnAddr - 1)
+	c.PC = addr
+	return c.Run(maxCycles)
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package mos6502
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/asm"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+func assemble(t *testing.T, src string) *asm.Assembler {
+	t.Helper()
+	a := asm.New([]string{}, "6502", "c64", "plain", "petscii", []string{})
+	a.Assemble(text.Process("test.asm", src))
+	if errs := a.Errors(); len(errs) > 0 {
+		t.Fatalf("Got errors %v", errs)
+	}
+	return a
+}
+
+func TestCPU_Cycles(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		cycles uint64
+	}{
+		{
+			name: "simple",
+			src: `
+	.org $1000
+	lda #1   ; 2
+	sta $20  ; 3
+	sta $2000; 4
+	rts      ; 6`,
+			cycles: 15,
+		},
+		{
+			name: "page crossing",
+			src: `
+	.org $1000
+	ldx #$ff     ; 2
+	lda $20ff,x  ; 4+1
+	sta $20ff,x  ; 5
+	rts          ; 6`,
+			cycles: 18,
+		},
+		{
+			name: "branches",
+			src: `
+	.org $1000
+	ldx #2   ; 2
+loop	dex      ; 2*2
+	bne loop ; 3+2
+	rts      ; 6`,
+			cycles: 17,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := assemble(t, tt.src)
+			c := New()
+			c.Load(a.Origin(), a.GetBytes())
+			reason, err := c.Call(uint16(a.Origin()), 1000)
+			if err != nil || reason != StopReturned {
+				t.Fatalf("Call returned %s, %v", reason, err)
+			}
+			if c.Cycles != tt.cycles {
+				t.Errorf("Got %d cycles, want %d", c.Cycles, tt.cycles)
+			}
+		})
+	}
+}
+
+func TestCPU_Run(t *testing.T) {
+	a := assemble(t, `
+	.org $1000
+	ldx #0
+loop	jsr chrout
+	inx
+	cpx #3
+	bne loop
+done	brk
+chrout	.equ $ffd2
+`)
+	c := New()
+	c.Load(a.Origin(), a.GetBytes())
+	c.SetLabels(a.Labels())
+	var out []int
+	c.Hook(0xffd2, func(c *CPU) {
+		out = append(out, int(c.X))
+		c.Return()
+	})
+	if err := c.BreakAt("LOOP"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BreakAt("missing"); err == nil {
+		t.Errorf("BreakAt succeeded for undefined label")
+	}
+
+	c.PC = uint16(a.Origin())
+	reason, err := c.Run(1000)
+	if err != nil || reason != StopBreakpoint || c.PC != 0x1002 {
+		t.Fatalf("Run returned %s, %v at $%04x; want breakpoint at $1002", reason, err, c.PC)
+	}
+	c.ClearBreakpoints()
+	reason, err = c.Run(1000)
+	if err != nil || reason != StopBRK || c.PC != uint16(a.Labels()["done"]) {
+		t.Fatalf("Run returned %s, %v at $%04x; want brk at done", reason, err, c.PC)
+	}
+	if len(out) != 3 || out[0] != 0 || out[2] != 2 {
+		t.Errorf("Hook saw %v, want [0 1 2]", out)
+	}
+
+	c.PC = uint16(a.Labels()["loop"])
+	c.Mem[uint16(a.Labels()["done"])] = 0x4c // Turn BRK into an endless loop
+	c.Mem[uint16(a.Labels()["done"])+1] = byte(a.Labels()["done"])
+	c.Mem[uint16(a.Labels()["done"])+2] = byte(a.Labels()["done"] >> 8)
+	if _, err := c.Run(100); err != ErrCycleLimit {
+		t.Errorf("Got %v, want %v", err, ErrCycleLimit)
+	}
+}
+
+func TestRunTest(t *testing.T) {
+	a := assemble(t, `
+	.org $1000
+; adds x to the 16 bit value at $20
+add16	txa
+	clc
+	adc $20
+	sta $20
+	bcc _done
+	inc $21
+_done	rts
+
+	.test "carry", add16
+	.given x, $10
+	.given $20, $f8, $01
+	.expect $20, $08, $02
+	.expect x, $10
+	.endtest
+
+	.test "wrong", add16
+	.given x, 1
+	.given $20, 1, 0
+	.expect $20, 3, 0
+	.expect a, 3
+	.endtest
+`)
+	tests := a.Tests()
+	if len(tests) != 2 {
+		t.Fatalf("Got %d tests, want 2", len(tests))
+	}
+
+	res := RunTest(a, tests[0], 1000)
+	if !res.Passed() {
+		t.Errorf("Test %q failed: %v %v", res.Test.Name, res.Failures, res.Err)
+	}
+	if res.Cycles != 23 {
+		t.Errorf("Got %d cycles, want 23", res.Cycles)
+	}
+
+	res = RunTest(a, tests[1], 1000)
+	if res.Passed() || len(res.Failures) != 2 {
+		t.Fatalf("Got failures %v, want 2", res.Failures)
+	}
+	if !strings.Contains(res.Failures[0], "expected $0020 = $03, got $02") {
+		t.Errorf("Unexpected failure %q", res.Failures[0])
+	}
+}
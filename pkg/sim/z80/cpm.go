@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package z80
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Memory layout of the simulated CP/M system
+const (
+	cpmWarmBoot = 0x0000 // Jumping here ends the program
+	cpmBdos     = 0x0005 // Entry point of BDOS calls
+	cpmTPA      = 0x0100 // Programs are loaded and started here
+	cpmBdosImpl = 0xfe06 // Where the jump at cpmBdos leads to; also the end of the TPA
+)
+
+var (
+	ErrCycleLimit = errors.New("Cycle limit exceeded")
+	ErrHalted     = errors.New("CPU halted")
+)
+
+// CPM runs CP/M programs with a minimal BDOS that supports console output (functions 2 and 9) and reading
+// lines from the console (function 10). Function 0 ends the program, just like jumping to $0000.
+type CPM struct {
+	CPU      *CPU
+	console  io.Writer
+	keyboard *bufio.Reader
+}
+
+// NewCPM returns a CP/M system that writes console output to console, and reads console input from keyboard,
+// which can be nil.
+func NewCPM(console io.Writer, keyboard io.Reader) *CPM {
+	c := New()
+	c.Mem[cpmBdos] = 0xc3 // JP cpmBdosImpl
+	c.write16(cpmBdos+1, cpmBdosImpl)
+	c.Mem[cpmBdosImpl] = 0xc9 // RET
+	c.SP = cpmBdosImpl &^ 0xff
+	c.push(cpmWarmBoot) // Returning from the program ends it
+	c.PC = cpmTPA
+
+	m := &CPM{CPU: c, console: console}
+	if keyboard != nil {
+		m.keyboard = bufio.NewReader(keyboard)
+	}
+	return m
+}
+
+// Load loads a program into the TPA.
+func (m *CPM) Load(program []byte) {
+	m.CPU.Load(cpmTPA, program)
+}
+
+// Run runs the program until it ends by returning, jumping to $0000, or calling BDOS function 0.
+func (m *CPM) Run(maxCycles uint64) error {
+	c := m.CPU
+	limit := c.Cycles + maxCycles
+	for {
+		if c.PC == cpmBdosImpl {
+			if err := m.bdos(); err != nil {
+				return err
+			}
+		}
+		if c.PC == cpmWarmBoot {
+			return nil
+		}
+		if c.Halted {
+			return ErrHalted
+		}
+		if c.Cycles >= limit {
+			return ErrCycleLimit
+		}
+		if err := c.Step(); err != nil {
+			return err
+		}
+	}
+}
+
+// bdos executes the BDOS function in C. The RET at cpmBdosImpl returns to the caller afterwards.
+func (m *CPM) bdos() error {
+	c := m.CPU
+	switch c.C {
+	case 0: // System reset
+		c.PC = cpmWarmBoot
+	case 2: // Console output
+		return m.write([]byte{c.E})
+	case 9: // Output string terminated by '$'
+		var s []byte
+		for addr := c.DE(); c.Mem[addr] != '$'; addr++ {
+			s = append(s, c.Mem[addr])
+			if len(s) > len(c.Mem) {
+				return fmt.Errorf("String at $%04x is not terminated by '$'", c.DE())
+			}
+		}
+		return m.write(s)
+	case 10: // Buffered console input
+		var line string
+		if m.keyboard != nil {
+			var err error
+			line, err = m.keyboard.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return err
+			}
+		}
+		line = strings.TrimRight(line, "\r\n")
+		buf := c.DE()
+		if max := int(c.Mem[buf]); len(line) > max {
+			line = line[:max]
+		}
+		c.Mem[buf+1] = byte(len(line))
+		for i := 0; i < len(line); i++ {
+			c.Mem[buf+2+uint16(i)] = line[i]
+		}
+	default:
+		return fmt.Errorf("Unsupported BDOS function %d called from $%04x", c.C, c.read16(c.SP)-3)
+	}
+	return nil
+}
+
+func (m *CPM) write(b []byte) error {
+	if m.console == nil {
+		return nil
+	}
+	_, err := m.console.Write(b)
+	return err
+}
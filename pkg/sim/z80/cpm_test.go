@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package z80
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/asm"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+func runCPM(t *testing.T, filename, src, input string) string {
+	t.Helper()
+	a := asm.New([]string{}, "z80", "c128", "plain", "ascii", []string{})
+	a.Assemble(text.Process(filename, src))
+	if errs := a.Errors(); len(errs) > 0 {
+		t.Fatalf("Got errors %v", errs)
+	}
+	if a.Origin() != 0x100 {
+		t.Fatalf("Program starts at $%04x, not at $0100", a.Origin())
+	}
+	var console bytes.Buffer
+	m := NewCPM(&console, strings.NewReader(input))
+	m.Load(a.GetBytes())
+	if err := m.Run(100000); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	return console.String()
+}
+
+func TestCPM_Hello(t *testing.T) {
+	filename := "../../../examples/cpm/hello.asm"
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := runCPM(t, filename, string(raw), ""), "Hello, world!\n\r"; got != want {
+		t.Errorf("Got output %q, want %q", got, want)
+	}
+}
+
+func TestCPM_ReadLine(t *testing.T) {
+	src := `
+	.org $100
+	ld de, buf
+	ld c, 10
+	call 5
+	ld a, (buf+1)
+	ld b, a
+	ld hl, buf+2
+loop	ld e, (hl)
+	inc hl
+	push bc
+	push hl
+	ld c, 2
+	call 5
+	pop hl
+	pop bc
+	djnz loop
+	ld c, 0
+	call 5
+buf	.byte 4, 0
+	.reserve 4, 0
+`
+	if got, want := runCPM(t, "readline.asm", src, "hello\n"), "hell"; got != want {
+		t.Errorf("Got output %q, want %q", got, want)
+	}
+}
+
+func TestCPM_UnsupportedFunction(t *testing.T) {
+	m := NewCPM(nil, nil)
+	m.Load([]byte{0x0e, 0x13, 0xcd, 0x05, 0x00, 0xc9}) // ld c,$13; call 5; ret
+	if err := m.Run(1000); err == nil || err.Error() != "Unsupported BDOS function 19 called from $0102" {
+		t.Errorf("Got error %v", err)
+	}
+}
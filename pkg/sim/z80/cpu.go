@@ -0,0 +1,1018 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+// Package z80 executes Z80 machine code in a flat 64K memory model.
+package z80
+
+import (
+	"fmt"
+)
+
+// Bits of the flag register
+const (
+	FlagC  byte = 1 << iota
+	FlagN       // Set if the last operation was a subtraction
+	FlagPV      // Parity or overflow
+	Flag3       // Undocumented, copy of bit 3 of the result
+	FlagH       // Half carry
+	Flag5       // Undocumented, copy of bit 5 of the result
+	FlagZ
+	FlagS
+)
+
+type CPU struct {
+	A, F, B, C, D, E, H, L byte
+
+	// The alternate register set, swapped in by EX AF,AF' and EXX
+	AltAF, AltBC, AltDE, AltHL uint16
+
+	IX, IY, SP, PC uint16
+	I, R           byte
+	IFF1, IFF2     bool
+	IM             byte
+	Halted         bool // Set by HALT. As interrupts are not simulated, the CPU stays halted.
+	Mem            [0x10000]byte
+	Cycles         uint64 // Number of T-states executed so far
+
+	// In and Out are called for I/O instructions. Without In, all ports read as $ff.
+	In  func(port uint16) byte
+	Out func(port uint16, val byte)
+
+	prefix byte // $dd or $fd if the current instruction uses IX or IY instead of HL, 0 otherwise
+}
+
+func New() *CPU {
+	return &CPU{
+		A:  0xff,
+		F:  0xff,
+		SP: 0xffff,
+	}
+}
+
+// Load copies bytes into memory, starting at org.
+func (c *CPU) Load(org int, bytes []byte) {
+	for i, b := range bytes {
+		c.Mem[uint16(org+i)] = b
+	}
+}
+
+func (c *CPU) AF() uint16 { return uint16(c.A)<<8 | uint16(c.F) }
+func (c *CPU) BC() uint16 { return uint16(c.B)<<8 | uint16(c.C) }
+func (c *CPU) DE() uint16 { return uint16(c.D)<<8 | uint16(c.E) }
+func (c *CPU) HL() uint16 { return uint16(c.H)<<8 | uint16(c.L) }
+
+func (c *CPU) SetAF(v uint16) { c.A, c.F = byte(v>>8), byte(v) }
+func (c *CPU) SetBC(v uint16) { c.B, c.C = byte(v>>8), byte(v) }
+func (c *CPU) SetDE(v uint16) { c.D, c.E = byte(v>>8), byte(v) }
+func (c *CPU) SetHL(v uint16) { c.H, c.L = byte(v>>8), byte(v) }
+
+func (c *CPU) read16(addr uint16) uint16 {
+	return uint16(c.Mem[addr]) | uint16(c.Mem[addr+1])<<8
+}
+
+func (c *CPU) write16(addr uint16, v uint16) {
+	c.Mem[addr] = byte(v)
+	c.Mem[addr+1] = byte(v >> 8)
+}
+
+func (c *CPU) fetch() byte {
+	b := c.Mem[c.PC]
+	c.PC++
+	return b
+}
+
+func (c *CPU) fetch16() uint16 {
+	lo := c.fetch()
+	return uint16(lo) | uint16(c.fetch())<<8
+}
+
+// fetchOpcode fetches an opcode byte, which increments the refresh register.
+func (c *CPU) fetchOpcode() byte {
+	c.R = c.R&0x80 | (c.R+1)&0x7f
+	return c.fetch()
+}
+
+func (c *CPU) push(v uint16) {
+	c.SP -= 2
+	c.write16(c.SP, v)
+}
+
+func (c *CPU) pop() uint16 {
+	v := c.read16(c.SP)
+	c.SP += 2
+	return v
+}
+
+func (c *CPU) in(port uint16) byte {
+	if c.In == nil {
+		return 0xff
+	}
+	return c.In(port)
+}
+
+func (c *CPU) out(port uint16, v byte) {
+	if c.Out != nil {
+		c.Out(port, v)
+	}
+}
+
+// hl returns HL, or the index register for instructions with a DD or FD prefix.
+func (c *CPU) hl() uint16 {
+	switch c.prefix {
+	case 0xdd:
+		return c.IX
+	case 0xfd:
+		return c.IY
+	}
+	return c.HL()
+}
+
+func (c *CPU) setHL(v uint16) {
+	switch c.prefix {
+	case 0xdd:
+		c.IX = v
+	case 0xfd:
+		c.IY = v
+	default:
+		c.SetHL(v)
+	}
+}
+
+// operand returns the memory address of register operand r if r is 6, i.e. (HL), or (IX+d) and (IY+d) for
+// instructions with a prefix. The displacement is read from the instruction stream.
+func (c *CPU) operand(r byte) uint16 {
+	if r != 6 {
+		return 0
+	}
+	if c.prefix == 0 {
+		return c.HL()
+	}
+	d := int8(c.fetch())
+	c.Cycles += 8
+	return c.hl() + uint16(d)
+}
+
+// get returns register r as encoded in opcodes. For instructions with a prefix, H and L are the halves of the
+// index register. Memory operands are read from addr.
+func (c *CPU) get(r byte, addr uint16) byte {
+	switch r {
+	case 0:
+		return c.B
+	case 1:
+		return c.C
+	case 2:
+		return c.D
+	case 3:
+		return c.E
+	case 4:
+		return byte(c.hl() >> 8)
+	case 5:
+		return byte(c.hl())
+	case 6:
+		return c.Mem[addr]
+	}
+	return c.A
+}
+
+func (c *CPU) set(r byte, addr uint16, v byte) {
+	switch r {
+	case 0:
+		c.B = v
+	case 1:
+		c.C = v
+	case 2:
+		c.D = v
+	case 3:
+		c.E = v
+	case 4:
+		c.setHL(c.hl()&0x00ff | uint16(v)<<8)
+	case 5:
+		c.setHL(c.hl()&0xff00 | uint16(v))
+	case 6:
+		c.Mem[addr] = v
+	default:
+		c.A = v
+	}
+}
+
+// rp returns register pair p as encoded in 16-bit loads and arithmetic.
+func (c *CPU) rp(p byte) uint16 {
+	switch p {
+	case 0:
+		return c.BC()
+	case 1:
+		return c.DE()
+	case 2:
+		return c.hl()
+	}
+	return c.SP
+}
+
+func (c *CPU) setRP(p byte, v uint16) {
+	switch p {
+	case 0:
+		c.SetBC(v)
+	case 1:
+		c.SetDE(v)
+	case 2:
+		c.setHL(v)
+	default:
+		c.SP = v
+	}
+}
+
+// rp2 returns register pair p as encoded in PUSH and POP.
+func (c *CPU) rp2(p byte) uint16 {
+	if p == 3 {
+		return c.AF()
+	}
+	return c.rp(p)
+}
+
+func (c *CPU) setRP2(p byte, v uint16) {
+	if p == 3 {
+		c.SetAF(v)
+		return
+	}
+	c.setRP(p, v)
+}
+
+// cond evaluates condition cc: NZ, Z, NC, C, PO, PE, P, M.
+func (c *CPU) cond(cc byte) bool {
+	var flag byte
+	switch cc >> 1 {
+	case 0:
+		flag = FlagZ
+	case 1:
+		flag = FlagC
+	case 2:
+		flag = FlagPV
+	case 3:
+		flag = FlagS
+	}
+	return (c.F&flag != 0) == (cc&1 != 0)
+}
+
+// Step executes the instruction at PC.
+func (c *CPU) Step() error {
+	if c.Halted {
+		c.fetchOpcode()
+		c.PC--
+		c.Cycles += 4
+		return nil
+	}
+	start := c.PC
+	c.prefix = 0
+	op := c.fetchOpcode()
+	switch op {
+	case 0xdd, 0xfd:
+		c.Cycles += 4
+		switch c.Mem[c.PC] {
+		case 0xdd, 0xfd, 0xed:
+			// The prefix has no effect, the next one starts a new instruction.
+			return nil
+		case 0xcb:
+			c.prefix = op
+			c.fetchOpcode()
+			return c.execIndexedCB()
+		}
+		c.prefix = op
+		op = c.fetchOpcode()
+	case 0xcb:
+		return c.execCB()
+	case 0xed:
+		return c.execED(start)
+	}
+	return c.exec(op, start)
+}
+
+func (c *CPU) exec(op byte, start uint16) error {
+	x, y, z := op>>6, op>>3&7, op&7
+	p, q := y>>1, y&1
+	switch x {
+	case 0:
+		switch z {
+		case 0:
+			switch y {
+			case 0: // NOP
+				c.Cycles += 4
+			case 1: // EX AF,AF'
+				af := c.AF()
+				c.SetAF(c.AltAF)
+				c.AltAF = af
+				c.Cycles += 4
+			case 2: // DJNZ
+				d := int8(c.fetch())
+				c.B--
+				c.jr(c.B != 0, d, 13, 8)
+			case 3: // JR
+				d := int8(c.fetch())
+				c.jr(true, d, 12, 12)
+			default: // JR cc
+				d := int8(c.fetch())
+				c.jr(c.cond(y-4), d, 12, 7)
+			}
+		case 1:
+			if q == 0 { // LD rr,nn
+				c.setRP(p, c.fetch16())
+				c.Cycles += 10
+			} else { // ADD HL,rr
+				c.addHL(c.rp(p))
+				c.Cycles += 11
+			}
+		case 2:
+			switch y {
+			case 0:
+				c.Mem[c.BC()] = c.A
+				c.Cycles += 7
+			case 1:
+				c.A = c.Mem[c.BC()]
+				c.Cycles += 7
+			case 2:
+				c.Mem[c.DE()] = c.A
+				c.Cycles += 7
+			case 3:
+				c.A = c.Mem[c.DE()]
+				c.Cycles += 7
+			case 4:
+				c.write16(c.fetch16(), c.hl())
+				c.Cycles += 16
+			case 5:
+				c.setHL(c.read16(c.fetch16()))
+				c.Cycles += 16
+			case 6:
+				c.Mem[c.fetch16()] = c.A
+				c.Cycles += 13
+			case 7:
+				c.A = c.Mem[c.fetch16()]
+				c.Cycles += 13
+			}
+		case 3:
+			if q == 0 {
+				c.setRP(p, c.rp(p)+1)
+			} else {
+				c.setRP(p, c.rp(p)-1)
+			}
+			c.Cycles += 6
+		case 4, 5:
+			addr := c.operand(y)
+			v := c.get(y, addr)
+			if z == 4 {
+				c.set(y, addr, c.inc8(v))
+			} else {
+				c.set(y, addr, c.dec8(v))
+			}
+			c.Cycles += 4
+			if y == 6 {
+				c.Cycles += 7
+			}
+		case 6: // LD r,n
+			addr := c.operand(y)
+			c.set(y, addr, c.fetch())
+			c.Cycles += 7
+			if y == 6 {
+				c.Cycles += 3
+				if c.prefix != 0 {
+					// The displacement and the value are read in parallel
+					c.Cycles -= 3
+				}
+			}
+		case 7:
+			c.accumulatorOp(y)
+			c.Cycles += 4
+		}
+	case 1:
+		if op == 0x76 { // HALT
+			c.Halted = true
+			c.Cycles += 4
+			return nil
+		}
+		// LD r,r'. If one operand is (IX+d), the other one is H or L, not a half of the index register.
+		addr := c.operand(y) | c.operand(z)
+		if y == 6 || z == 6 {
+			c.prefix = 0
+			c.Cycles += 3
+		}
+		c.set(y, addr, c.get(z, addr))
+		c.Cycles += 4
+	case 2:
+		addr := c.operand(z)
+		c.alu(y, c.get(z, addr))
+		c.Cycles += 4
+		if z == 6 {
+			c.Cycles += 3
+		}
+	case 3:
+		switch z {
+		case 0: // RET cc
+			if c.cond(y) {
+				c.PC = c.pop()
+				c.Cycles += 11
+			} else {
+				c.Cycles += 5
+			}
+		case 1:
+			if q == 0 { // POP
+				c.setRP2(p, c.pop())
+				c.Cycles += 10
+				break
+			}
+			switch p {
+			case 0: // RET
+				c.PC = c.pop()
+				c.Cycles += 10
+			case 1: // EXX
+				bc, de, hl := c.BC(), c.DE(), c.HL()
+				c.SetBC(c.AltBC)
+				c.SetDE(c.AltDE)
+				c.SetHL(c.AltHL)
+				c.AltBC, c.AltDE, c.AltHL = bc, de, hl
+				c.Cycles += 4
+			case 2: // JP (HL)
+				c.PC = c.hl()
+				c.Cycles += 4
+			case 3: // LD SP,HL
+				c.SP = c.hl()
+				c.Cycles += 6
+			}
+		case 2: // JP cc,nn
+			nn := c.fetch16()
+			if c.cond(y) {
+				c.PC = nn
+			}
+			c.Cycles += 10
+		case 3:
+			switch y {
+			case 0: // JP nn
+				c.PC = c.fetch16()
+				c.Cycles += 10
+			case 2: // OUT (n),A
+				n := c.fetch()
+				c.out(uint16(c.A)<<8|uint16(n), c.A)
+				c.Cycles += 11
+			case 3: // IN A,(n)
+				n := c.fetch()
+				c.A = c.in(uint16(c.A)<<8 | uint16(n))
+				c.Cycles += 11
+			case 4: // EX (SP),HL
+				v := c.read16(c.SP)
+				c.write16(c.SP, c.hl())
+				c.setHL(v)
+				c.Cycles += 19
+			case 5: // EX DE,HL, never affected by a prefix
+				de := c.DE()
+				c.SetDE(c.HL())
+				c.SetHL(de)
+				c.Cycles += 4
+			case 6: // DI
+				c.IFF1, c.IFF2 = false, false
+				c.Cycles += 4
+			case 7: // EI
+				c.IFF1, c.IFF2 = true, true
+				c.Cycles += 4
+			}
+		case 4: // CALL cc,nn
+			nn := c.fetch16()
+			if c.cond(y) {
+				c.push(c.PC)
+				c.PC = nn
+				c.Cycles += 17
+			} else {
+				c.Cycles += 10
+			}
+		case 5:
+			if q == 0 { // PUSH
+				c.push(c.rp2(p))
+				c.Cycles += 11
+				break
+			}
+			if p != 0 {
+				return fmt.Errorf("Illegal opcode $%02x at $%04x", op, start)
+			}
+			nn := c.fetch16() // CALL nn
+			c.push(c.PC)
+			c.PC = nn
+			c.Cycles += 17
+		case 6: // ALU A,n
+			c.alu(y, c.fetch())
+			c.Cycles += 7
+		case 7: // RST
+			c.push(c.PC)
+			c.PC = uint16(y) * 8
+			c.Cycles += 11
+		}
+	}
+	return nil
+}
+
+func (c *CPU) jr(taken bool, d int8, takenCycles, notTakenCycles uint64) {
+	if taken {
+		c.PC += uint16(d)
+		c.Cycles += takenCycles
+	} else {
+		c.Cycles += notTakenCycles
+	}
+}
+
+// execCB executes the instructions with a CB prefix: rotations, shifts, and bit operations.
+func (c *CPU) execCB() error {
+	op := c.fetchOpcode()
+	x, y, z := op>>6, op>>3&7, op&7
+	addr := c.operand(z)
+	v := c.get(z, addr)
+	c.Cycles += 8
+	if z == 6 {
+		c.Cycles += 7
+		if x == 1 {
+			c.Cycles -= 3
+		}
+	}
+	if x == 1 {
+		c.bit(y, v, v)
+		return nil
+	}
+	c.set(z, addr, c.bitOp(x, y, v))
+	return nil
+}
+
+// execIndexedCB executes DD CB d op and FD CB d op. Besides writing to memory, the undocumented forms also copy
+// the result to a register.
+func (c *CPU) execIndexedCB() error {
+	d := int8(c.fetch())
+	addr := c.hl() + uint16(d)
+	op := c.fetch()
+	x, y, z := op>>6, op>>3&7, op&7
+	v := c.Mem[addr]
+	if x == 1 {
+		c.bit(y, v, byte(addr>>8))
+		c.Cycles += 16
+		return nil
+	}
+	res := c.bitOp(x, y, v)
+	c.Mem[addr] = res
+	if z != 6 {
+		c.prefix = 0
+		c.set(z, 0, res)
+	}
+	c.Cycles += 19
+	return nil
+}
+
+// bitOp executes the rotation or shift y (x == 0), or RES y (x == 2) or SET y (x == 3).
+func (c *CPU) bitOp(x, y, v byte) byte {
+	switch x {
+	case 0:
+		return c.rotate(y, v)
+	case 2:
+		return v &^ (1 << y)
+	}
+	return v | 1<<y
+}
+
+// execED executes the instructions with an ED prefix.
+func (c *CPU) execED(start uint16) error {
+	op := c.fetchOpcode()
+	x, y, z := op>>6, op>>3&7, op&7
+	p, q := y>>1, y&1
+	if x == 2 && z <= 3 && y >= 4 {
+		c.blockOp(y, z)
+		return nil
+	}
+	if x != 1 {
+		return fmt.Errorf("Illegal opcode $ed $%02x at $%04x", op, start)
+	}
+	switch z {
+	case 0: // IN r,(C); IN (C) only sets the flags
+		v := c.in(c.BC())
+		if y != 6 {
+			c.set(y, 0, v)
+		}
+		c.F = c.F&FlagC | szp(v)
+		c.Cycles += 12
+	case 1: // OUT (C),r; OUT (C),0
+		var v byte
+		if y != 6 {
+			v = c.get(y, 0)
+		}
+		c.out(c.BC(), v)
+		c.Cycles += 12
+	case 2:
+		if q == 0 {
+			c.sbcHL(c.rp(p))
+		} else {
+			c.adcHL(c.rp(p))
+		}
+		c.Cycles += 15
+	case 3:
+		nn := c.fetch16()
+		if q == 0 {
+			c.write16(nn, c.rp(p))
+		} else {
+			c.setRP(p, c.read16(nn))
+		}
+		c.Cycles += 20
+	case 4: // NEG
+		v := c.A
+		c.A = 0
+		c.A = c.sub(v, 0)
+		c.Cycles += 8
+	case 5: // RETN, RETI
+		c.PC = c.pop()
+		c.IFF1 = c.IFF2
+		c.Cycles += 14
+	case 6:
+		c.IM = []byte{0, 0, 1, 2}[y&3]
+		c.Cycles += 8
+	case 7:
+		switch y {
+		case 0:
+			c.I = c.A
+			c.Cycles += 9
+		case 1:
+			c.R = c.A
+			c.Cycles += 9
+		case 2, 3:
+			if y == 2 {
+				c.A = c.I
+			} else {
+				c.A = c.R
+			}
+			c.F = c.F&FlagC | c.A&(FlagS|Flag5|Flag3)
+			if c.A == 0 {
+				c.F |= FlagZ
+			}
+			if c.IFF2 {
+				c.F |= FlagPV
+			}
+			c.Cycles += 9
+		case 4, 5:
+			m := c.Mem[c.HL()]
+			if y == 4 { // RRD
+				c.Mem[c.HL()] = c.A<<4 | m>>4
+				c.A = c.A&0xf0 | m&0x0f
+			} else { // RLD
+				c.Mem[c.HL()] = m<<4 | c.A&0x0f
+				c.A = c.A&0xf0 | m>>4
+			}
+			c.F = c.F&FlagC | szp(c.A)
+			c.Cycles += 18
+		default:
+			return fmt.Errorf("Illegal opcode $ed $%02x at $%04x", op, start)
+		}
+	}
+	return nil
+}
+
+// blockOp executes the block transfer, search, and I/O instructions LDI, CPI, INI, OUTI and their variants.
+func (c *CPU) blockOp(y, z byte) {
+	delta := uint16(1)
+	if y&1 != 0 {
+		delta = 0xffff
+	}
+	repeat := y >= 6
+	hl := c.HL()
+	c.SetHL(hl + delta)
+	again := false
+	switch z {
+	case 0: // LDI
+		v := c.Mem[hl]
+		c.Mem[c.DE()] = v
+		c.SetDE(c.DE() + delta)
+		c.SetBC(c.BC() - 1)
+		n := v + c.A
+		c.F = c.F&(FlagS|FlagZ|FlagC) | n&Flag3 | n<<4&Flag5
+		if c.BC() != 0 {
+			c.F |= FlagPV
+			again = repeat
+		}
+	case 1: // CPI
+		v := c.Mem[hl]
+		res := c.A - v
+		c.SetBC(c.BC() - 1)
+		f := c.F&FlagC | FlagN | res&FlagS
+		if res == 0 {
+			f |= FlagZ
+		}
+		if (c.A^v^res)&0x10 != 0 {
+			f |= FlagH
+			res--
+		}
+		f |= res&Flag3 | res<<4&Flag5
+		if c.BC() != 0 {
+			f |= FlagPV
+			again = repeat && f&FlagZ == 0
+		}
+		c.F = f
+	case 2: // INI
+		c.Mem[hl] = c.in(c.BC())
+		c.B--
+		again = repeat && c.B != 0
+		c.F = c.F&FlagC | FlagN | szp(c.B)&(FlagS|FlagZ|Flag5|Flag3)
+	case 3: // OUTI
+		c.B--
+		c.out(c.BC(), c.Mem[hl])
+		again = repeat && c.B != 0
+		c.F = c.F&FlagC | FlagN | szp(c.B)&(FlagS|FlagZ|Flag5|Flag3)
+	}
+	if again {
+		c.PC -= 2
+		c.Cycles += 21
+	} else {
+		c.Cycles += 16
+	}
+}
+
+// szp returns the sign, zero, parity, and undocumented flags for v.
+func szp(v byte) byte {
+	f := v & (FlagS | Flag5 | Flag3)
+	if v == 0 {
+		f |= FlagZ
+	}
+	parity := v ^ v>>4
+	parity ^= parity >> 2
+	parity ^= parity >> 1
+	if parity&1 == 0 {
+		f |= FlagPV
+	}
+	return f
+}
+
+// alu executes ADD, ADC, SUB, SBC, AND, XOR, OR, or CP with the accumulator.
+func (c *CPU) alu(op byte, v byte) {
+	switch op {
+	case 0:
+		c.A = c.add(v, 0)
+	case 1:
+		c.A = c.add(v, c.F&FlagC)
+	case 2:
+		c.A = c.sub(v, 0)
+	case 3:
+		c.A = c.sub(v, c.F&FlagC)
+	case 4:
+		c.A &= v
+		c.F = szp(c.A) | FlagH
+	case 5:
+		c.A ^= v
+		c.F = szp(c.A)
+	case 6:
+		c.A |= v
+		c.F = szp(c.A)
+	case 7:
+		c.sub(v, 0)
+		// CP takes the undocumented flags from the operand
+		c.F = c.F&^(Flag5|Flag3) | v&(Flag5|Flag3)
+	}
+}
+
+func (c *CPU) add(v, carry byte) byte {
+	sum := uint16(c.A) + uint16(v) + uint16(carry)
+	res := byte(sum)
+	f := res & (FlagS | Flag5 | Flag3)
+	if res == 0 {
+		f |= FlagZ
+	}
+	if (c.A^v^res)&0x10 != 0 {
+		f |= FlagH
+	}
+	if ^(c.A^v)&(c.A^res)&0x80 != 0 {
+		f |= FlagPV
+	}
+	if sum > 0xff {
+		f |= FlagC
+	}
+	c.F = f
+	return res
+}
+
+func (c *CPU) sub(v, carry byte) byte {
+	diff := int(c.A) - int(v) - int(carry)
+	res := byte(diff)
+	f := res&(FlagS|Flag5|Flag3) | FlagN
+	if res == 0 {
+		f |= FlagZ
+	}
+	if (c.A^v^res)&0x10 != 0 {
+		f |= FlagH
+	}
+	if (c.A^v)&(c.A^res)&0x80 != 0 {
+		f |= FlagPV
+	}
+	if diff < 0 {
+		f |= FlagC
+	}
+	c.F = f
+	return res
+}
+
+func (c *CPU) inc8(v byte) byte {
+	res := v + 1
+	f := c.F&FlagC | res&(FlagS|Flag5|Flag3)
+	if res == 0 {
+		f |= FlagZ
+	}
+	if v&0x0f == 0x0f {
+		f |= FlagH
+	}
+	if v == 0x7f {
+		f |= FlagPV
+	}
+	c.F = f
+	return res
+}
+
+func (c *CPU) dec8(v byte) byte {
+	res := v - 1
+	f := c.F&FlagC | FlagN | res&(FlagS|Flag5|Flag3)
+	if res == 0 {
+		f |= FlagZ
+	}
+	if v&0x0f == 0 {
+		f |= FlagH
+	}
+	if v == 0x80 {
+		f |= FlagPV
+	}
+	c.F = f
+	return res
+}
+
+func (c *CPU) addHL(v uint16) {
+	hl := c.hl()
+	sum := uint32(hl) + uint32(v)
+	res := uint16(sum)
+	f := c.F&(FlagS|FlagZ|FlagPV) | byte(res>>8)&(Flag5|Flag3)
+	if (hl^v^res)&0x1000 != 0 {
+		f |= FlagH
+	}
+	if sum > 0xffff {
+		f |= FlagC
+	}
+	c.F = f
+	c.setHL(res)
+}
+
+func (c *CPU) adcHL(v uint16) {
+	hl := c.HL()
+	sum := uint32(hl) + uint32(v) + uint32(c.F&FlagC)
+	res := uint16(sum)
+	f := byte(res>>8) & (FlagS | Flag5 | Flag3)
+	if res == 0 {
+		f |= FlagZ
+	}
+	if (hl^v^res)&0x1000 != 0 {
+		f |= FlagH
+	}
+	if ^(hl^v)&(hl^res)&0x8000 != 0 {
+		f |= FlagPV
+	}
+	if sum > 0xffff {
+		f |= FlagC
+	}
+	c.F = f
+	c.SetHL(res)
+}
+
+func (c *CPU) sbcHL(v uint16) {
+	hl := c.HL()
+	diff := int(hl) - int(v) - int(c.F&FlagC)
+	res := uint16(diff)
+	f := byte(res>>8)&(FlagS|Flag5|Flag3) | FlagN
+	if res == 0 {
+		f |= FlagZ
+	}
+	if (hl^v^res)&0x1000 != 0 {
+		f |= FlagH
+	}
+	if (hl^v)&(hl^res)&0x8000 != 0 {
+		f |= FlagPV
+	}
+	if diff < 0 {
+		f |= FlagC
+	}
+	c.F = f
+	c.SetHL(res)
+}
+
+// accumulatorOp executes RLCA, RRCA, RLA, RRA, DAA, CPL, SCF, or CCF.
+func (c *CPU) accumulatorOp(y byte) {
+	keep := c.F & (FlagS | FlagZ | FlagPV)
+	switch y {
+	case 0: // RLCA
+		carry := c.A >> 7
+		c.A = c.A<<1 | carry
+		c.F = keep | carry
+	case 1: // RRCA
+		carry := c.A & 1
+		c.A = c.A>>1 | carry<<7
+		c.F = keep | carry
+	case 2: // RLA
+		carry := c.A >> 7
+		c.A = c.A<<1 | c.F&FlagC
+		c.F = keep | carry
+	case 3: // RRA
+		carry := c.A & 1
+		c.A = c.A>>1 | (c.F&FlagC)<<7
+		c.F = keep | carry
+	case 4:
+		c.daa()
+		return
+	case 5: // CPL
+		c.A = ^c.A
+		c.F = c.F&(FlagS|FlagZ|FlagPV|FlagC) | FlagH | FlagN
+	case 6: // SCF
+		c.F = keep | FlagC
+	case 7: // CCF
+		f := keep | (c.F&FlagC)<<4 // H gets the old carry
+		if c.F&FlagC == 0 {
+			f |= FlagC
+		}
+		c.F = f
+	}
+	c.F = c.F&^(Flag5|Flag3) | c.A&(Flag5|Flag3)
+}
+
+func (c *CPU) daa() {
+	var corr byte
+	carry := c.F & FlagC
+	if c.F&FlagH != 0 || c.A&0x0f > 9 {
+		corr |= 0x06
+	}
+	if carry != 0 || c.A > 0x99 {
+		corr |= 0x60
+		carry = FlagC
+	}
+	var halfCarry bool
+	res := c.A
+	if c.F&FlagN != 0 {
+		halfCarry = c.F&FlagH != 0 && c.A&0x0f < 6
+		res -= corr
+	} else {
+		halfCarry = c.A&0x0f > 9
+		res += corr
+	}
+	f := szp(res) | c.F&FlagN | carry
+	if halfCarry {
+		f |= FlagH
+	}
+	c.A = res
+	c.F = f
+}
+
+// rotate executes RLC, RRC, RL, RR, SLA, SRA, SLL, or SRL.
+func (c *CPU) rotate(y, v byte) byte {
+	var res, carry byte
+	switch y {
+	case 0:
+		carry = v >> 7
+		res = v<<1 | carry
+	case 1:
+		carry = v & 1
+		res = v>>1 | carry<<7
+	case 2:
+		carry = v >> 7
+		res = v<<1 | c.F&FlagC
+	case 3:
+		carry = v & 1
+		res = v>>1 | (c.F&FlagC)<<7
+	case 4:
+		carry = v >> 7
+		res = v << 1
+	case 5:
+		carry = v & 1
+		res = v>>1 | v&0x80
+	case 6:
+		carry = v >> 7
+		res = v<<1 | 1
+	case 7:
+		carry = v & 1
+		res = v >> 1
+	}
+	c.F = szp(res) | carry
+	return res
+}
+
+// bit executes BIT y. The undocumented flags are taken from undoc.
+func (c *CPU) bit(y, v, undoc byte) {
+	f := c.F&FlagC | FlagH | undoc&(Flag5|Flag3)
+	if v&(1<<y) == 0 {
+		f |= FlagZ | FlagPV
+	} else if y == 7 {
+		f |= FlagS
+	}
+	c.F = f
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package z80
+
+import (
+	"testing"
+
+	"github.com/asig/cbmasm/pkg/asm"
+	"github.com/asig/cbmasm/pkg/asm/z80"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// run assembles src, and executes it from its origin until it halts.
+func run(t *testing.T, src string) *CPU {
+	t.Helper()
+	a := asm.New([]string{}, "z80ill", "c128", "plain", "ascii", []string{})
+	a.Assemble(text.Process("", src))
+	if errs := a.Errors(); len(errs) > 0 {
+		t.Fatalf("Got errors %v", errs)
+	}
+	c := New()
+	c.Load(a.Origin(), a.GetBytes())
+	c.PC = uint16(a.Origin())
+	for i := 0; i < 10000 && !c.Halted; i++ {
+		if err := c.Step(); err != nil {
+			t.Fatalf("Step failed: %s", err)
+		}
+	}
+	if !c.Halted {
+		t.Fatalf("Program didn't halt")
+	}
+	return c
+}
+
+func TestCPU_Step(t *testing.T) {
+	tests := []struct {
+		name       string
+		src        string
+		a, f, b, c byte
+		hl         uint16
+		mem        map[uint16]byte
+	}{
+		{
+			name: "loop and indirect store",
+			src: `
+	.org $1000
+	ld hl, $2000
+	ld b, 3
+loop	ld (hl), b
+	inc hl
+	djnz loop
+	xor a
+	halt`,
+			a: 0, f: FlagZ | FlagPV, b: 0, hl: 0x2003,
+			mem: map[uint16]byte{0x2000: 3, 0x2001: 2, 0x2002: 1},
+		},
+		{
+			name: "add with overflow",
+			src: `
+	.org $1000
+	ld a, $7f
+	add a, 1
+	halt`,
+			a: 0x80, f: FlagS | FlagH | FlagPV,
+		},
+		{
+			name: "compare sets borrow",
+			src: `
+	.org $1000
+	ld a, 1
+	cp 2
+	halt`,
+			a: 1, f: FlagS | FlagH | FlagN | FlagC,
+		},
+		{
+			name: "daa after add",
+			src: `
+	.org $1000
+	ld a, $19
+	add a, $28
+	daa
+	halt`,
+			a: 0x47, f: FlagPV,
+		},
+		{
+			name: "16 bit arithmetic",
+			src: `
+	.org $1000
+	ld hl, $ffff
+	ld bc, 1
+	add hl, bc
+	ld hl, $1000
+	scf
+	sbc hl, bc
+	halt`,
+			a: 0xff, b: 0, c: 1, hl: 0x0ffe, f: FlagN | FlagH | Flag3,
+		},
+		{
+			name: "call, push, and pop",
+			src: `
+	.org $1000
+	ld sp, $3000
+	ld bc, $1234
+	call swap
+	halt
+swap	push bc
+	pop hl
+	ld b, l
+	ld c, h
+	ret`,
+			a: 0xff, f: 0xff, b: 0x34, c: 0x12, hl: 0x1234,
+		},
+		{
+			name: "index registers",
+			src: `
+	.org $1000
+	ld ix, $2000
+	ld (ix+1), $42
+	ld a, (ix+1)
+	inc (ix+1)
+	ld iy, $2100
+	ld (iy-1), a
+	ld ixh, $21
+	ld h, (ix-1)
+	ld l, 0
+	halt`,
+			a: 0x42, f: 0x01, hl: 0x4200,
+			mem: map[uint16]byte{0x2001: 0x43, 0x20ff: 0x42},
+		},
+		{
+			name: "bit operations",
+			src: `
+	.org $1000
+	ld hl, $2000
+	ld (hl), $81
+	rlc (hl)
+	set 4, (hl)
+	ld a, $80
+	srl a
+	bit 6, a
+	halt`,
+			a: 0x40, f: FlagH, hl: 0x2000,
+			mem: map[uint16]byte{0x2000: 0x13},
+		},
+		{
+			name: "block copy",
+			src: `
+	.org $1000
+	ld hl, src
+	ld de, $2000
+	ld bc, 3
+	ldir
+	halt
+src	.byte 1, 2, 3`,
+			a: 0xff, f: FlagS | FlagZ | Flag5 | FlagC, b: 0, c: 0, hl: 0x100f,
+			mem: map[uint16]byte{0x2000: 1, 0x2001: 2, 0x2002: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := run(t, tt.src)
+			if c.A != tt.a || c.F != tt.f || c.B != tt.b || c.C != tt.c || c.HL() != tt.hl {
+				t.Errorf("Got A=$%02x F=$%02x B=$%02x C=$%02x HL=$%04x, want A=$%02x F=$%02x B=$%02x C=$%02x HL=$%04x",
+					c.A, c.F, c.B, c.C, c.HL(), tt.a, tt.f, tt.b, tt.c, tt.hl)
+			}
+			for addr, want := range tt.mem {
+				if got := c.Mem[addr]; got != want {
+					t.Errorf("Got $%02x at $%04x, want $%02x", got, addr, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCPU_Cycles(t *testing.T) {
+	c := run(t, `
+	.org $1000
+	ld b, 2      ; 7
+loop	djnz loop    ; 13 + 8
+	ld ix, $2000 ; 14
+	ld a, (ix+3) ; 19
+	halt         ; 4`)
+	if want := uint64(7 + 13 + 8 + 14 + 19 + 4); c.Cycles != want {
+		t.Errorf("Got %d cycles, want %d", c.Cycles, want)
+	}
+}
+
+func TestCPU_IllegalOpcode(t *testing.T) {
+	c := New()
+	c.Load(0, []byte{0xed, 0x00})
+	if err := c.Step(); err == nil || err.Error() != "Illegal opcode $ed $00 at $0000" {
+		t.Errorf("Got error %v", err)
+	}
+}
+
+func TestCPU_CyclesMatchTimingTable(t *testing.T) {
+	var codes [][]byte
+	for op := 0; op < 256; op++ {
+		b := byte(op)
+		switch b {
+		case 0xcb, 0xdd, 0xed, 0xfd:
+		default:
+			codes = append(codes, []byte{b}, []byte{0xdd, b}, []byte{0xfd, b})
+		}
+		codes = append(codes, []byte{0xcb, b}, []byte{0xed, b}, []byte{0xdd, 0xcb, 0x01, b})
+	}
+	for _, code := range codes {
+		timing, valid := z80.InstructionTiming(code)
+		c := New()
+		c.PC = 0x100
+		c.Load(0x100, append(code, 0x01, 0x01, 0x01))
+		err := c.Step()
+		if (err == nil) != valid {
+			t.Errorf("% x: Step returned %v, but InstructionTiming says valid == %t", code, err, valid)
+			continue
+		}
+		if valid && int(c.Cycles) != timing.Cycles && int(c.Cycles) != timing.Taken {
+			t.Errorf("% x: took %d T-states, timing is %+v", code, c.Cycles, timing)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/asm"
+	"github.com/asig/cbmasm/pkg/sim/mos6502"
+	"github.com/asig/cbmasm/pkg/text"
+)
+
+// runTest assembles a file and runs the routines annotated with ".test" in the 6502 simulator.
+func runTest(args []string) {
+	var includeDirs pathListFlag
+	var defines stringArrayFlag
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	fs.Var(&includeDirs, "I", "include paths; can be repeated")
+	fs.Var(&defines, "D", "defined symbols; can be repeated")
+	cpu := fs.String("cpu", "6502", "CPU to assemble code for. Supported values are: 6502, 6510ill")
+	platform := fs.String("platform", "c128", fmt.Sprintf("Target platform. Supported values are: %s", strings.Join(asm.SupportedPlatforms, ", ")))
+	maxCycles := fs.Uint64("max_cycles", 1000000, "Maximum number of cycles a routine can run.")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		errorOutput.Printf("Usage: %s test [flags] inputfile\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	if *cpu != "6502" && *cpu != "6510ill" {
+		errorOutput.Fatalf("Tests can't be run for CPU %q.", *cpu)
+	}
+	if len(includeDirs) == 0 {
+		includeDirs = pathListFlag{"."}
+	}
+
+	inputFilename := fs.Arg(0)
+	raw, err := os.ReadFile(inputFilename)
+	if err != nil {
+		errorOutput.Fatalf("Can't read input file %q.", inputFilename)
+	}
+	assembler := asm.New(includeDirs, *cpu, *platform, "plain", "petscii", defines)
+	assembler.Assemble(text.Process(inputFilename, string(raw)))
+	if errs := assembler.Errors(); len(errs) > 0 {
+		errorOutput.Printf("%d errors occurred:\n", len(errs))
+		for _, e := range errs {
+			errorOutput.Printf("%s\n", e)
+		}
+		os.Exit(1)
+	}
+
+	failed := 0
+	for _, t := range assembler.Tests() {
+		res := mos6502.RunTest(assembler, t, *maxCycles)
+		if res.Passed() {
+			statusOutput.Printf("PASS %s (%d cycles)\n", t.Name, res.Cycles)
+			continue
+		}
+		failed++
+		statusOutput.Printf("FAIL %s (%d cycles)\n", t.Name, res.Cycles)
+		if res.Err != nil {
+			statusOutput.Printf("    %s\n", res.Err)
+		}
+		for _, f := range res.Failures {
+			statusOutput.Printf("    %s\n", f)
+		}
+	}
+	statusOutput.Printf("%d tests, %d failed\n", len(assembler.Tests()), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
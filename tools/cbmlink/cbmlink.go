@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2020 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of cbmasm.
+ *
+ * cbmasm is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * cbmasm is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with cbmasm.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/asig/cbmasm/pkg/asm"
+	"github.com/asig/cbmasm/pkg/obj"
+)
+
+var (
+	errorOutput  = log.New(os.Stderr, "", 0)
+	statusOutput = log.New(os.Stdout, "", 0)
+)
+
+var (
+	flagOutput = flag.String("output", "prg", "Which output format should be generated. Supported values are: plain, prg")
+	flagOrg    = flag.Int("org", 0x1c01, "Address where the relocatable code of the first module is placed.")
+	flagLabels = flag.String("labels", "", "If set, a VICE-compatible 'labels' file is generated.")
+)
+
+func usage() {
+	errorOutput.Printf("Usage: %s [flags] outputfile objectfile [objectfile...]\n", filepath.Base(os.Args[0]))
+	errorOutput.Println("Flags:")
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func saveViceLabels(labels map[string]int, filename string) {
+	out, err := os.Create(filename)
+	if err != nil {
+		log.Printf("Can't open output file %q.", filename)
+		return
+	}
+	var symtab []string
+	for n, addr := range labels {
+		if !strings.HasPrefix(n, ".") {
+			n = "." + n
+		}
+		symtab = append(symtab, fmt.Sprintf("al C:%04x %s\n", addr, n))
+	}
+	sort.Strings(symtab)
+	for _, l := range symtab {
+		out.WriteString(l)
+	}
+	out.Close()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *flagOutput != "prg" && *flagOutput != "plain" {
+		errorOutput.Printf("Unsupported output %q. Valid outputs are: plain, prg.", *flagOutput)
+		usage()
+	}
+
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+	}
+	outputFilename := args[0]
+
+	var files []*obj.File
+	for _, filename := range args[1:] {
+		in, err := os.Open(filename)
+		if err != nil {
+			log.Fatalf("Can't open object file %q.", filename)
+		}
+		f, err := obj.Read(in)
+		in.Close()
+		if err != nil {
+			log.Fatalf("Can't read object file %q: %s", filename, err)
+		}
+		files = append(files, f)
+	}
+
+	linker := asm.NewLinker()
+	linker.Link(files, *flagOrg)
+	errs := linker.Errors()
+	if len(errs) > 0 {
+		errorOutput.Printf("%d errors occurred:\n", len(errs))
+		for _, e := range errs {
+			errorOutput.Printf("%s\n", e)
+		}
+		os.Exit(1)
+	}
+
+	outputFile, err := os.Create(outputFilename)
+	if err != nil {
+		log.Fatalf("Can't open output file %q.", outputFilename)
+	}
+	defer outputFile.Close()
+	if *flagOutput == "prg" {
+		o := linker.Origin()
+		outputFile.Write([]byte{byte(o & 0xff), byte((o >> 8) & 0xff)})
+	}
+	bytes := linker.GetBytes()
+	outputFile.Write(bytes)
+
+	if *flagLabels != "" {
+		saveViceLabels(linker.Labels(), *flagLabels)
+		statusOutput.Printf("Symbols written to %q.", *flagLabels)
+	}
+	statusOutput.Printf("%d bytes written to %q.", len(bytes), outputFilename)
+}